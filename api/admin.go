@@ -0,0 +1,172 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/st3fan/tqsd/tqs"
+)
+
+func (s *Server) requireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+//
+
+func (s *Server) getBackup(w http.ResponseWriter, r *http.Request) {
+	// A backup of a large database takes longer than the server wide
+	// write timeout
+	if err := disableWriteTimeout(w); err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	filename := "tqs-" + time.Now().UTC().Format("20060102T150405Z") + ".db"
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+
+	n, err := s.store.WriteBackup(w)
+	if err != nil {
+		if n == 0 {
+			w.Header().Del("Content-Disposition")
+			if err == tqs.ErrNotSupported {
+				http.Error(w, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
+			} else {
+				internalServerError(w, r, err)
+			}
+			return
+		}
+		// Too late to report it to the client, who will see a
+		// truncated download
+		requestLogger(r).Error("Failed to stream backup", "error", err)
+	}
+}
+
+//
+
+type compactResponse struct {
+	OriginalSize  int64
+	CompactedSize int64
+	Reclaimed     int64
+	Keys          int64
+	Duration      string
+}
+
+func (s *Server) compact(w http.ResponseWriter, r *http.Request) {
+	if err := disableWriteTimeout(w); err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	result, err := s.store.Compact(func(progress tqs.CompactionProgress) {
+		requestLogger(r).Info("Compacting", "keys", progress.Keys, "bytes", progress.Bytes)
+	})
+	if err != nil {
+		if err == tqs.ErrNotSupported {
+			http.Error(w, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
+		} else if err == tqs.ErrCompactionBusy {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			internalServerError(w, r, err)
+		}
+		return
+	}
+
+	requestLogger(r).Info("Compacted database", "original_size", result.OriginalSize, "compacted_size", result.CompactedSize, "duration", result.Duration)
+
+	response := compactResponse{
+		OriginalSize:  result.OriginalSize,
+		CompactedSize: result.CompactedSize,
+		Reclaimed:     result.Reclaimed(),
+		Keys:          result.Keys,
+		Duration:      result.Duration.String(),
+	}
+
+	encodedResponse, err := json.Marshal(&response)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(encodedResponse)
+}
+
+//
+
+type getQuarantinedMessagesResponse struct {
+	Messages []tqs.QuarantinedMessage
+}
+
+func (s *Server) getQuarantinedMessages(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	messages, err := s.store.GetQuarantinedMessages(vars["name"])
+	if err != nil {
+		if err == tqs.ErrQueueNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		} else {
+			internalServerError(w, r, err)
+		}
+		return
+	}
+
+	response := getQuarantinedMessagesResponse{
+		Messages: messages,
+	}
+
+	encodedResponse, err := json.Marshal(&response)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(encodedResponse)
+}
+
+func (s *Server) purgeQuarantine(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := s.store.PurgeQuarantine(vars["name"]); err != nil {
+		if err == tqs.ErrQueueNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		} else {
+			internalServerError(w, r, err)
+		}
+	}
+}
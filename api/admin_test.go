@@ -0,0 +1,73 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/st3fan/tqsd/tqs"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Backup(t *testing.T) {
+	store, err := tqs.NewStore(fmt.Sprintf("%s/%d.db", os.TempDir(), time.Now().UnixNano()))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	server, err := NewServer("test", store, AdminToken("secret"))
+	assert.Nil(t, err)
+
+	for _, test := range []struct {
+		authorization string
+		status        int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/admin/backup", nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		server.router.ServeHTTP(w, r)
+		assert.Equal(t, test.status, w.Code)
+		if w.Code == http.StatusOK {
+			assert.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+			assert.NotZero(t, w.Body.Len())
+		}
+	}
+}
+
+func Test_AdminDisabledWithoutToken(t *testing.T) {
+	store, err := tqs.NewStore(tqs.MemoryDatabase)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	server, err := NewServer("test", store)
+	assert.Nil(t, err)
+
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/backup", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -0,0 +1,97 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/st3fan/tqsd/tqs"
+)
+
+// forwardedHeader marks requests that were proxied to the leader, so
+// that they are not forwarded again while the cluster elects a new one.
+const forwardedHeader = "X-Tqs-Forwarded"
+
+// forwardToLeader proxies requests that a node of a cluster cannot
+// handle itself to the leader. The version, metrics, probe, status and
+// admin endpoints are about the node itself and are always handled
+// locally.
+func (s *Server) forwardToLeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/version", "/metrics", "/healthz", "/readyz", "/status":
+			next.ServeHTTP(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		address, leader := s.store.ClusterLeader()
+		if leader {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if address == "" || r.Header.Get(forwardedHeader) != "" {
+			http.Error(w, tqs.ErrNotLeader.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		// The leader sees the request coming from this node, with the
+		// certificate of this node, so a client certificate does not
+		// identify the client there
+		scheme := "http"
+		var transport http.RoundTripper // The default one
+		if s.tls != nil {
+			scheme = "https"
+			transport = s.tls.forwardTransport()
+		}
+
+		r.Header.Set(forwardedHeader, "1")
+		proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: scheme, Host: address})
+		proxy.Transport = transport
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) getClusterStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := s.store.ClusterStatus()
+	if err != nil {
+		if err == tqs.ErrNotClustered {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		} else {
+			internalServerError(w, r, err)
+		}
+		return
+	}
+
+	encodedResponse, err := json.Marshal(&status)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(encodedResponse)
+}
@@ -0,0 +1,122 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/st3fan/tqsd/tqs"
+)
+
+func (s *Server) exportQueue(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if _, err := s.store.GetQueueMeta(vars["name"]); err != nil {
+		if err == tqs.ErrQueueNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		} else {
+			internalServerError(w, r, err)
+		}
+		return
+	}
+
+	if err := disableWriteTimeout(w); err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	if _, err := s.store.ExportQueue(vars["name"], w); err != nil {
+		// Too late to report it to the client
+		requestLogger(r).Error("Failed to export queue", "error", err)
+	}
+}
+
+// importQueueResponse says how many messages were imported, also when
+// the import failed halfway, in which case Message says why.
+type importQueueResponse struct {
+	Imported int
+	Message  string `json:",omitempty"`
+}
+
+func (s *Server) importQueue(w http.ResponseWriter, r *http.Request) {
+	preserveIDs, err := getBoolParameter(r, "PreserveIDs")
+	if err != nil {
+		badRequestError(w, nil, "Invalid PreserveIDs: "+err.Error())
+		return
+	}
+
+	resetLeases, err := getBoolParameter(r, "ResetLeases")
+	if err != nil {
+		badRequestError(w, nil, "Invalid ResetLeases: "+err.Error())
+		return
+	}
+
+	// Reading a large import and writing it to the store takes longer
+	// than the server wide timeouts
+	if err := disableReadTimeout(w); err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	if err := disableWriteTimeout(w); err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	options := tqs.ImportOptions{
+		PreserveIDs: preserveIDs,
+		ResetLeases: resetLeases,
+	}
+
+	vars := mux.Vars(r)
+	imported, err := s.store.ImportQueue(vars["name"], r.Body, options)
+	if err == tqs.ErrQueueNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	response := importQueueResponse{
+		Imported: imported,
+	}
+
+	status := http.StatusOK
+	if err != nil {
+		if errors.Is(err, tqs.ErrInvalidImport) {
+			status = http.StatusBadRequest
+			response.Message = err.Error()
+		} else {
+			requestLogger(r).Error("Failed to import queue", "imported", imported, "error", err)
+			status = http.StatusInternalServerError
+			response.Message = http.StatusText(http.StatusInternalServerError)
+		}
+	}
+
+	encodedResponse, err := json.Marshal(&response)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(encodedResponse)
+}
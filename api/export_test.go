@@ -0,0 +1,105 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/st3fan/tqsd/api"
+	"github.com/st3fan/tqsd/tqs"
+	"github.com/stretchr/testify/assert"
+)
+
+type importResponse struct {
+	Imported int
+	Message  string
+}
+
+func newImportServer(t *testing.T) *httptest.Server {
+	store, err := tqs.NewStore(tqs.MemoryDatabase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	_, _, err = store.CreateQueue("jobs")
+	assert.Nil(t, err)
+
+	server, err := api.NewServer("test", store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := httptest.NewUnstartedServer(server.Handler())
+	s.Config.ReadTimeout = 250 * time.Millisecond
+	s.Config.WriteTimeout = 250 * time.Millisecond
+	s.Start()
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func postImport(t *testing.T, s *httptest.Server, body io.Reader) (int, importResponse) {
+	resp, err := http.Post(s.URL+"/queues/jobs/import", "application/x-ndjson", body)
+	if err != nil {
+		t.Fatal("Request failed: ", err)
+	}
+	defer resp.Body.Close()
+
+	var response importResponse
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&response))
+	return resp.StatusCode, response
+}
+
+func Test_ImportOutlastsServerTimeouts(t *testing.T) {
+	s := newImportServer(t)
+
+	r, w := io.Pipe()
+	go func() {
+		fmt.Fprintln(w, `{"ID":"7f0000000000000001","State":"Visible","Body":"Message1"}`)
+		time.Sleep(500 * time.Millisecond)
+		fmt.Fprintln(w, `{"ID":"7f0000000000000002","State":"Visible","Body":"Message2"}`)
+		w.Close()
+	}()
+
+	status, response := postImport(t, s, r)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 2, response.Imported)
+}
+
+func Test_ImportReportsProgressOnFailure(t *testing.T) {
+	s := newImportServer(t)
+
+	var body strings.Builder
+	for i := 1; i <= 1001; i++ {
+		fmt.Fprintf(&body, `{"ID":"7f%016x","State":"Visible","Body":"Message"}`+"\n", i)
+	}
+	body.WriteString(`{"State":"Sleeping","Body":"Message"}` + "\n")
+
+	status, response := postImport(t, s, strings.NewReader(body.String()))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, 1000, response.Imported) // The first batch
+	assert.Contains(t, response.Message, "line 1002")
+}
@@ -0,0 +1,127 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// The probes are for orchestrators: /healthz answers as long as the
+// process can serve requests, /readyz only while the store does its
+// work and the server is not shutting down. Neither needs an API key.
+
+var errShuttingDown = errors.New("shutting down")
+
+func (s *Server) getHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// ready returns why the server is not ready, or nil.
+func (s *Server) ready() error {
+	if s.shuttingDown.Load() {
+		return errShuttingDown
+	}
+	return s.store.CheckReady()
+}
+
+func (s *Server) getReadiness(w http.ResponseWriter, r *http.Request) {
+	if err := s.ready(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+//
+
+type databaseStatus struct {
+	Path string
+	Size int64
+}
+
+type taskStatus struct {
+	Name        string
+	Runs        uint64
+	Errors      uint64
+	LastRun     *time.Time `json:",omitempty"`
+	LastSuccess *time.Time `json:",omitempty"`
+	LastError   string     `json:",omitempty"`
+}
+
+type statusResponse struct {
+	Version   string
+	Started   time.Time
+	Uptime    string
+	Ready     bool
+	Reason    string `json:",omitempty"`
+	Databases []databaseStatus
+	Tasks     []taskStatus
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (s *Server) getStatus(w http.ResponseWriter, r *http.Request) {
+	response := statusResponse{
+		Version:   s.version,
+		Started:   s.started,
+		Uptime:    time.Since(s.started).Round(time.Second).String(),
+		Ready:     true,
+		Databases: []databaseStatus{},
+		Tasks:     []taskStatus{},
+	}
+
+	if err := s.ready(); err != nil {
+		response.Ready = false
+		response.Reason = err.Error()
+	}
+
+	for _, database := range s.store.DatabaseMetrics() {
+		response.Databases = append(response.Databases, databaseStatus{Path: database.Path, Size: database.Size})
+	}
+
+	for _, task := range s.store.TaskMetrics() {
+		response.Tasks = append(response.Tasks, taskStatus{
+			Name:        task.Name,
+			Runs:        task.Runs,
+			Errors:      task.Errors,
+			LastRun:     optionalTime(task.LastRun),
+			LastSuccess: optionalTime(task.LastSuccess),
+			LastError:   task.LastError,
+		})
+	}
+
+	encodedResponse, err := json.Marshal(&response)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(encodedResponse)
+}
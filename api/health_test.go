@@ -0,0 +1,195 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/st3fan/tqsd/api"
+	"github.com/st3fan/tqsd/tqs"
+	"github.com/st3fan/tqsd/tqstest"
+	"github.com/stretchr/testify/assert"
+)
+
+type statusResponse struct {
+	Version   string
+	Ready     bool
+	Reason    string
+	Databases []struct {
+		Path string
+		Size int64
+	}
+	Tasks []struct {
+		Name        string
+		Runs        uint64
+		Errors      uint64
+		LastSuccess *time.Time
+	}
+}
+
+func Test_Probes(t *testing.T) {
+	clock := tqstest.NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	server := tqstest.NewServer(t, tqstest.WithClock(clock), tqstest.WithTemporaryFile())
+
+	assert.Equal(t, http.StatusOK, request(t, server, "GET", "/healthz", "", nil))
+	assert.Equal(t, http.StatusOK, request(t, server, "GET", "/readyz", "", nil))
+
+	var status statusResponse
+	assert.Equal(t, http.StatusOK, request(t, server, "GET", "/status", "", &status))
+	assert.Equal(t, "test", status.Version)
+	assert.True(t, status.Ready)
+	if assert.Len(t, status.Databases, 1) {
+		assert.True(t, status.Databases[0].Size > 0)
+	}
+	assert.Len(t, status.Tasks, 0)
+
+	assert.Nil(t, server.Store.RunTasks())
+	clock.Advance(time.Minute)
+
+	assert.Equal(t, http.StatusOK, request(t, server, "GET", "/status", "", &status))
+	if assert.Len(t, status.Tasks, 3) {
+		assert.Equal(t, "expire_leases", status.Tasks[0].Name)
+		assert.True(t, status.Tasks[0].Runs >= 1)
+		assert.Equal(t, uint64(0), status.Tasks[0].Errors)
+		assert.NotNil(t, status.Tasks[0].LastSuccess)
+	}
+
+	// Without its background tasks the store is alive but not ready
+	server.Store.Stop()
+
+	assert.Equal(t, http.StatusOK, request(t, server, "GET", "/healthz", "", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, request(t, server, "GET", "/readyz", "", nil))
+
+	assert.Equal(t, http.StatusOK, request(t, server, "GET", "/status", "", &status))
+	assert.False(t, status.Ready)
+	assert.Contains(t, status.Reason, "not running")
+}
+
+func Test_ReadinessWhileShuttingDown(t *testing.T) {
+	store, err := tqs.NewStore(tqs.MemoryDatabase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	store.Start()
+
+	server, err := api.NewServer("test", store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Nil(t, server.Shutdown())
+
+	w = httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "shutting down")
+}
+
+func Test_ShutdownDrains(t *testing.T) {
+	store, err := tqs.NewStore(tqs.MemoryDatabase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	store.Start()
+
+	server, err := api.NewServer("test", store, api.DrainDelay(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	shutdown := make(chan error, 1)
+	started := time.Now()
+	go func() {
+		shutdown <- server.Shutdown()
+	}()
+
+	// The server keeps answering during the delay, with /readyz failing
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get(httpServer.URL + "/readyz")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusServiceUnavailable
+	}, 500*time.Millisecond, 10*time.Millisecond)
+
+	resp, err := http.Get(httpServer.URL + "/healthz")
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	assert.Nil(t, <-shutdown)
+	assert.True(t, time.Since(started) >= time.Second)
+}
+
+func Test_ShutdownEndsLongPolls(t *testing.T) {
+	store, err := tqs.NewStore(tqs.MemoryDatabase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	_, _, err = store.CreateQueue("jobs")
+	assert.Nil(t, err)
+
+	server, err := api.NewServer("test", store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	go func() {
+		time.Sleep(250 * time.Millisecond)
+		server.Shutdown()
+	}()
+
+	started := time.Now()
+	resp, err := http.Get(httpServer.URL + "/queues/jobs/messages?WaitTimeSeconds=10")
+	if !assert.Nil(t, err) {
+		return
+	}
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, time.Since(started) < 5*time.Second)
+
+	resp, err = http.Get(httpServer.URL + "/queues/jobs/messages")
+	if !assert.Nil(t, err) {
+		return
+	}
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
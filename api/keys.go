@@ -0,0 +1,461 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/st3fan/tqsd/tqs"
+)
+
+// ConfiguredAPIKey is a key that is given to the server, instead of
+// created through the /admin/keys endpoints. It has either the token
+// itself, its SHA-256 hash as a hex string, or the Subject of a client
+// certificate, as a common name or a full distinguished name like
+// "CN=worker,O=Example". Without grants it gets tqs.AdminGrant.
+type ConfiguredAPIKey struct {
+	Name    string
+	Token   string
+	SHA256  string
+	Subject string
+	Grants  []tqs.Grant
+}
+
+type apiKeysFile struct {
+	Keys []ConfiguredAPIKey
+}
+
+// ReadAPIKeys reads keys from a JSON file like:
+//
+//	{"Keys": [
+//	  {"Name": "deploy", "SHA256": "9f86d08..."},
+//	  {"Name": "orders", "Token": "...", "Grants": [{"Queues": "orders-*", "Actions": ["send"]}]}
+//	]}
+func ReadAPIKeys(path string) ([]ConfiguredAPIKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file apiKeysFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return file.Keys, nil
+}
+
+// RequireAPIKey makes every request, except those for /version and
+// the /admin endpoints, present the token of an API key as a bearer
+// token.
+func RequireAPIKey() ServerOption {
+	return func(s *Server) {
+		s.requireAPIKey = true
+	}
+}
+
+// APIKeys accepts keys in addition to the ones in the store. It
+// implies RequireAPIKey.
+func APIKeys(keys ...ConfiguredAPIKey) ServerOption {
+	return func(s *Server) {
+		s.requireAPIKey = true
+		s.apiKeys = append(s.apiKeys, keys...)
+	}
+}
+
+// configuredKeys maps the hex hashes and the subjects of the
+// configured keys to the keys.
+func configuredKeys(keys []ConfiguredAPIKey) (hashes, subjects map[string]tqs.APIKey, err error) {
+	hashes = make(map[string]tqs.APIKey)
+	subjects = make(map[string]tqs.APIKey)
+
+	for _, key := range keys {
+		if key.Name == "" {
+			return nil, nil, fmt.Errorf("api key without a name")
+		}
+
+		grants := key.Grants
+		if len(grants) == 0 {
+			grants = []tqs.Grant{tqs.AdminGrant}
+		}
+		if err := tqs.ValidateGrants(grants); err != nil {
+			return nil, nil, fmt.Errorf("api key <%s>: %w", key.Name, err)
+		}
+
+		apiKey := tqs.APIKey{Name: key.Name, Grants: grants}
+
+		set := 0
+		for _, field := range []string{key.Token, key.SHA256, key.Subject} {
+			if field != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			return nil, nil, fmt.Errorf("api key <%s> needs one of a Token, a SHA256 or a Subject", key.Name)
+		}
+
+		switch {
+		case key.Token != "":
+			hashes[hex.EncodeToString(tqs.HashAPIKey(key.Token))] = apiKey
+		case key.Subject != "":
+			subjects[key.Subject] = apiKey
+		case len(key.SHA256) != 64:
+			return nil, nil, fmt.Errorf("api key <%s> needs a SHA256 of 64 hex digits", key.Name)
+		default:
+			hashes[strings.ToLower(key.SHA256)] = apiKey
+		}
+	}
+
+	return hashes, subjects, nil
+}
+
+// SetAPIKeys replaces the configured keys, for example after the file
+// they come from changed. Keys in the store are not affected.
+func (s *Server) SetAPIKeys(keys ...ConfiguredAPIKey) error {
+	hashes, subjects, err := configuredKeys(keys)
+	if err != nil {
+		return err
+	}
+
+	s.apiKeysLock.Lock()
+	defer s.apiKeysLock.Unlock()
+
+	s.apiKeys = keys
+	s.apiKeyHashes = hashes
+	s.apiKeySubjects = subjects
+
+	return nil
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", false
+	}
+	return strings.TrimPrefix(header, "Bearer "), true
+}
+
+// errNoCredentials means that a request has no bearer token and no
+// client certificate of a configured key.
+var errNoCredentials = errors.New("no credentials")
+
+// authenticateRequest returns the key of a request, found by its bearer
+// token or else by the subject of its client certificate. The
+// certificate of a request that another node forwarded is that of the
+// node, which must not be taken for the client.
+func (s *Server) authenticateRequest(r *http.Request) (tqs.APIKey, error) {
+	if token, ok := bearerToken(r); ok {
+		return s.authenticateAPIKey(token)
+	}
+
+	if commonName, distinguishedName, ok := clientSubject(r); ok && r.Header.Get(forwardedHeader) == "" {
+		s.apiKeysLock.RLock()
+		defer s.apiKeysLock.RUnlock()
+
+		if key, ok := s.apiKeySubjects[distinguishedName]; ok {
+			return key, nil
+		}
+		if key, ok := s.apiKeySubjects[commonName]; ok {
+			return key, nil
+		}
+	}
+
+	return tqs.APIKey{}, errNoCredentials
+}
+
+// authenticateAPIKey returns the key that token belongs to, or
+// tqs.ErrAPIKeyNotFound.
+func (s *Server) authenticateAPIKey(token string) (tqs.APIKey, error) {
+	s.apiKeysLock.RLock()
+	key, ok := s.apiKeyHashes[hex.EncodeToString(tqs.HashAPIKey(token))]
+	s.apiKeysLock.RUnlock()
+
+	if ok {
+		return key, nil
+	}
+	return s.store.AuthenticateAPIKey(token)
+}
+
+// isPublicRoute tells if a route needs no API key, because it is for
+// probes or has its own authentication.
+func isPublicRoute(template string) bool {
+	switch template {
+	case "/version", "/healthz", "/readyz":
+		return true
+	}
+	return strings.HasPrefix(template, "/admin/")
+}
+
+// isProbeRoute tells if a route is for the probes of orchestrators,
+// which need no client certificate.
+func isProbeRoute(template string) bool {
+	return template == "/healthz" || template == "/readyz"
+}
+
+// authenticate turns away requests without a valid API key, when keys
+// are required, and adds the name of the key to the logger of the
+// request and to the access log. The /admin endpoints check the admin
+// token instead. With client CAs, every request but the probes needs a
+// verified client certificate, whether keys are required or not.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var template string
+		if route := mux.CurrentRoute(r); route != nil {
+			template, _ = route.GetPathTemplate()
+		}
+
+		if s.tls.requiresClientCertificate() && !isProbeRoute(template) {
+			if _, _, ok := clientSubject(r); !ok {
+				http.Error(w, "client certificate required", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		if !s.requireAPIKey || isPublicRoute(template) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, err := s.authenticateRequest(r)
+		if err != nil {
+			if err == errNoCredentials {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			} else if err == tqs.ErrAPIKeyNotFound {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			} else {
+				internalServerError(w, r, err)
+			}
+			return
+		}
+
+		if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok {
+			info.key = key.Name
+		}
+
+		ctx := context.WithValue(r.Context(), apiKeyKey, key)
+		ctx = context.WithValue(ctx, loggerKey, requestLogger(r).With("key", key.Name))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// anyAction is what it takes to look at a queue.
+var anyAction = []tqs.Action{tqs.ActionSend, tqs.ActionReceive, tqs.ActionAdmin}
+
+// authorized tells if the API key of a request allows one of actions
+// on queue. Everything is allowed when keys are not required.
+func (s *Server) authorized(r *http.Request, queue string, actions ...tqs.Action) bool {
+	if !s.requireAPIKey {
+		return true
+	}
+	key, ok := r.Context().Value(apiKeyKey).(tqs.APIKey)
+	return ok && key.Allows(queue, actions...)
+}
+
+func forbidden(w http.ResponseWriter, r *http.Request, queue string) {
+	requestLogger(r).Warn("Request not allowed by the grants of the key", "queue", queue)
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+}
+
+// allow runs handler only when the API key of the request allows one
+// of actions on the queue of the route.
+func (s *Server) allow(handler http.HandlerFunc, actions ...tqs.Action) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queue := mux.Vars(r)["name"]
+		if !s.authorized(r, queue, actions...) {
+			forbidden(w, r, queue)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// allowCreate runs handler only when the API key of the request has
+// admin rights on the queue named in the body. What it read of the body
+// is put back in front of the rest, so the handler gets all of it.
+func (s *Server) allowCreate(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireAPIKey {
+			handler(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxQueueRequestSize))
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+
+		var request createQueueRequest
+		json.Unmarshal(body, &request) // The handler reports bad requests
+
+		if !s.authorized(r, request.Name, tqs.ActionAdmin) {
+			forbidden(w, r, request.Name)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+//
+
+type createAPIKeyRequest struct {
+	Name   string
+	Grants []tqs.Grant
+}
+
+type createAPIKeyResponse struct {
+	Name    string
+	Created time.Time
+	Grants  []tqs.Grant
+	Token   string
+}
+
+func (s *Server) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var request createAPIKeyRequest
+	if err := unmarshalBody(r, &request, 1024); err != nil {
+		badRequestError(w, err, "invalid request")
+		return
+	}
+
+	key, token, err := s.store.CreateAPIKey(request.Name, request.Grants...)
+	if err != nil {
+		if err == tqs.ErrInvalidAPIKeyName {
+			badRequestError(w, nil, "invalid key name")
+		} else if errors.Is(err, tqs.ErrInvalidGrant) {
+			badRequestError(w, nil, err.Error())
+		} else if err == tqs.ErrAPIKeyExists {
+			http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		} else {
+			internalServerError(w, r, err)
+		}
+		return
+	}
+
+	requestLogger(r).Info("Created API key", "name", key.Name)
+
+	response := createAPIKeyResponse{
+		Name:    key.Name,
+		Created: key.Created,
+		Grants:  key.Grants,
+		Token:   token,
+	}
+
+	encodedResponse, err := json.Marshal(&response)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/admin/keys/"+key.Name)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(encodedResponse)
+}
+
+type getAPIKeysResponse struct {
+	Keys []tqs.APIKey
+}
+
+func (s *Server) getAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.store.GetAPIKeys()
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	response := getAPIKeysResponse{
+		Keys: keys,
+	}
+
+	encodedResponse, err := json.Marshal(&response)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(encodedResponse)
+}
+
+func (s *Server) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := s.store.RevokeAPIKey(vars["key"]); err != nil {
+		if err == tqs.ErrAPIKeyNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		} else {
+			internalServerError(w, r, err)
+		}
+		return
+	}
+
+	requestLogger(r).Info("Revoked API key", "name", vars["key"])
+}
+
+type setAPIKeyGrantsRequest struct {
+	Grants []tqs.Grant
+}
+
+func (s *Server) setAPIKeyGrants(w http.ResponseWriter, r *http.Request) {
+	var request setAPIKeyGrantsRequest
+	if err := unmarshalBody(r, &request, 64*1024); err != nil {
+		badRequestError(w, err, "invalid request")
+		return
+	}
+
+	vars := mux.Vars(r)
+	key, err := s.store.SetAPIKeyGrants(vars["key"], request.Grants)
+	if err != nil {
+		if err == tqs.ErrAPIKeyNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		} else if errors.Is(err, tqs.ErrInvalidGrant) {
+			badRequestError(w, nil, err.Error())
+		} else {
+			internalServerError(w, r, err)
+		}
+		return
+	}
+
+	requestLogger(r).Info("Changed grants of API key", "name", key.Name)
+
+	encodedResponse, err := json.Marshal(&key)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(encodedResponse)
+}
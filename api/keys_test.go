@@ -0,0 +1,206 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package api_test
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/st3fan/tqsd/api"
+	"github.com/st3fan/tqsd/tqs"
+	"github.com/st3fan/tqsd/tqstest"
+	"github.com/stretchr/testify/assert"
+)
+
+func authorizedRequest(t *testing.T, server *tqstest.Server, method, path, token, body string, response interface{}) int {
+	r, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	assert.Nil(t, err)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := server.Client.Do(r)
+	if err != nil {
+		t.Fatal("Request failed: ", err)
+	}
+	defer resp.Body.Close()
+
+	if response != nil && resp.StatusCode/100 == 2 {
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(response))
+	}
+
+	return resp.StatusCode
+}
+
+type createAPIKeyResponse struct {
+	Name  string
+	Token string
+}
+
+func Test_APIKeys(t *testing.T) {
+	var output lockedBuffer
+	logger := slog.New(slog.NewJSONHandler(&output, nil))
+
+	server := tqstest.NewServer(t,
+		tqstest.WithQueue("jobs"),
+		tqstest.WithAdminToken("secret"),
+		tqstest.WithServerOptions(api.RequireAPIKey(), api.Logger(logger)),
+	)
+
+	assert.Equal(t, http.StatusUnauthorized, authorizedRequest(t, server, "GET", "/queues", "", "", nil))
+	assert.Equal(t, http.StatusUnauthorized, authorizedRequest(t, server, "GET", "/queues", "wrong", "", nil))
+	assert.Equal(t, http.StatusUnauthorized, authorizedRequest(t, server, "GET", "/metrics", "", "", nil))
+	assert.Equal(t, http.StatusOK, authorizedRequest(t, server, "GET", "/version", "", "", nil))
+
+	// Keys are managed with the admin token
+
+	assert.Equal(t, http.StatusUnauthorized, authorizedRequest(t, server, "POST", "/admin/keys", "", `{"Name":"deploy"}`, nil))
+
+	var created createAPIKeyResponse
+	assert.Equal(t, http.StatusCreated, authorizedRequest(t, server, "POST", "/admin/keys", "secret", `{"Name":"deploy"}`, &created))
+	assert.Equal(t, "deploy", created.Name)
+	assert.True(t, strings.HasPrefix(created.Token, tqs.APIKeyPrefix))
+
+	assert.Equal(t, http.StatusConflict, authorizedRequest(t, server, "POST", "/admin/keys", "secret", `{"Name":"deploy"}`, nil))
+	assert.Equal(t, http.StatusBadRequest, authorizedRequest(t, server, "POST", "/admin/keys", "secret", `{"Name":"Not Valid"}`, nil))
+
+	var keys struct{ Keys []tqs.APIKey }
+	assert.Equal(t, http.StatusOK, authorizedRequest(t, server, "GET", "/admin/keys", "secret", "", &keys))
+	if assert.Len(t, keys.Keys, 1) {
+		assert.Equal(t, "deploy", keys.Keys[0].Name)
+	}
+
+	assert.Equal(t, http.StatusOK, authorizedRequest(t, server, "GET", "/queues", created.Token, "", nil))
+	assert.Equal(t, http.StatusUnauthorized, authorizedRequest(t, server, "GET", "/queues", "secret", "", nil))
+
+	assert.Eventually(t, func() bool {
+		return strings.Contains(output.String(), `"key":"deploy"`)
+	}, time.Second, 10*time.Millisecond)
+
+	// A revoked key is no longer accepted
+
+	assert.Equal(t, http.StatusOK, authorizedRequest(t, server, "DELETE", "/admin/keys/deploy", "secret", "", nil))
+	assert.Equal(t, http.StatusNotFound, authorizedRequest(t, server, "DELETE", "/admin/keys/deploy", "secret", "", nil))
+	assert.Equal(t, http.StatusUnauthorized, authorizedRequest(t, server, "GET", "/queues", created.Token, "", nil))
+}
+
+func Test_ConfiguredAPIKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	file := `{"Keys": [{"Name": "plain", "Token": "plain-token"}, {"Name": "hashed", "SHA256": "` + hex.EncodeToString(tqs.HashAPIKey("hashed-token")) + `"}]}`
+	assert.Nil(t, os.WriteFile(path, []byte(file), 0600))
+
+	keys, err := api.ReadAPIKeys(path)
+	assert.Nil(t, err)
+	assert.Len(t, keys, 2)
+
+	server := tqstest.NewServer(t, tqstest.WithServerOptions(api.APIKeys(keys...)))
+
+	assert.Equal(t, http.StatusUnauthorized, authorizedRequest(t, server, "GET", "/queues", "", "", nil))
+	assert.Equal(t, http.StatusOK, authorizedRequest(t, server, "GET", "/queues", "plain-token", "", nil))
+	assert.Equal(t, http.StatusOK, authorizedRequest(t, server, "GET", "/queues", "hashed-token", "", nil))
+
+	store, err := tqs.NewStore(tqs.MemoryDatabase)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	_, err = api.NewServer("test", store, api.APIKeys(api.ConfiguredAPIKey{Name: "bad", SHA256: "1234"}))
+	assert.NotNil(t, err)
+}
+
+func Test_APIKeyGrants(t *testing.T) {
+	server := tqstest.NewServer(t,
+		tqstest.WithQueue("orders"),
+		tqstest.WithQueue("invoices"),
+		tqstest.WithAdminToken("secret"),
+		tqstest.WithServerOptions(api.RequireAPIKey()),
+	)
+
+	_, sender, err := server.Store.CreateAPIKey("sender", tqs.Grant{Queues: "orders", Actions: []tqs.Action{tqs.ActionSend}})
+	assert.Nil(t, err)
+
+	_, receiver, err := server.Store.CreateAPIKey("receiver", tqs.Grant{Queues: "ord*", Actions: []tqs.Action{tqs.ActionReceive}})
+	assert.Nil(t, err)
+
+	_, admin, err := server.Store.CreateAPIKey("admin", tqs.Grant{Queues: "new-*", Actions: []tqs.Action{tqs.ActionAdmin}})
+	assert.Nil(t, err)
+
+	for _, test := range []struct {
+		method, path, token, body string
+		status                    int
+	}{
+		{"POST", "/queues/orders/messages", sender, `{"Messages":[{"Body":"Hello"}]}`, http.StatusOK},
+		{"POST", "/queues/invoices/messages", sender, `{"Messages":[{"Body":"Hello"}]}`, http.StatusForbidden},
+		{"GET", "/queues/orders/messages", sender, "", http.StatusForbidden},
+		{"DELETE", "/queues/orders", sender, "", http.StatusForbidden},
+		{"GET", "/queues/orders/statistics", sender, "", http.StatusOK},
+
+		{"GET", "/queues/orders/messages", receiver, "", http.StatusOK},
+		{"POST", "/queues/orders/messages", receiver, `{"Messages":[{"Body":"Hello"}]}`, http.StatusForbidden},
+		{"DELETE", "/queues/orders/leases/0102", receiver, "", http.StatusNotFound},
+		{"DELETE", "/queues/invoices/leases/0102", receiver, "", http.StatusForbidden},
+
+		{"POST", "/queues", admin, `{"Name":"new-queue"}`, http.StatusCreated},
+		{"POST", "/queues", admin, `{"Name":"other-queue"}`, http.StatusForbidden},
+		{"POST", "/queues/new-queue/messages", admin, `{"Messages":[{"Body":"Hello"}]}`, http.StatusOK},
+		{"DELETE", "/queues/new-queue", admin, "", http.StatusOK},
+		{"DELETE", "/queues/orders", admin, "", http.StatusForbidden},
+	} {
+		status := authorizedRequest(t, server, test.method, test.path, test.token, test.body, nil)
+		assert.Equal(t, test.status, status, "%s %s", test.method, test.path)
+	}
+
+	// Keys only see the queues they have grants on
+
+	var queues []api.QueueDetails
+	assert.Equal(t, http.StatusOK, authorizedRequest(t, server, "GET", "/queues", sender, "", &queues))
+	if assert.Len(t, queues, 1) {
+		assert.Equal(t, "orders", queues[0].Name)
+	}
+
+	// Grants are changed with the admin token
+
+	grants := `{"Grants":[{"Queues":"invoices","Actions":["send"]}]}`
+	assert.Equal(t, http.StatusOK, authorizedRequest(t, server, "PUT", "/admin/keys/sender/grants", "secret", grants, nil))
+	assert.Equal(t, http.StatusBadRequest, authorizedRequest(t, server, "PUT", "/admin/keys/sender/grants", "secret", `{"Grants":[{"Queues":"*","Actions":["fly"]}]}`, nil))
+	assert.Equal(t, http.StatusNotFound, authorizedRequest(t, server, "PUT", "/admin/keys/missing/grants", "secret", grants, nil))
+
+	assert.Equal(t, http.StatusForbidden, authorizedRequest(t, server, "POST", "/queues/orders/messages", sender, `{"Messages":[{"Body":"Hello"}]}`, nil))
+	assert.Equal(t, http.StatusOK, authorizedRequest(t, server, "POST", "/queues/invoices/messages", sender, `{"Messages":[{"Body":"Hello"}]}`, nil))
+}
+
+func Test_APIKeyCreateWithLargeBody(t *testing.T) {
+	server := tqstest.NewServer(t, tqstest.WithAdminToken("secret"), tqstest.WithServerOptions(api.RequireAPIKey()))
+
+	_, admin, err := server.Store.CreateAPIKey("admin", tqs.Grant{Queues: "new-*", Actions: []tqs.Action{tqs.ActionAdmin}})
+	assert.Nil(t, err)
+
+	// The check of the name must not cut off the body for the handler
+	body := `{"Name":"new-queue",` + strings.Repeat(" ", 2048) + `"Settings":{"DelaySeconds":30}}`
+	assert.Equal(t, http.StatusCreated, authorizedRequest(t, server, "POST", "/queues", admin, body, nil))
+
+	settings, err := server.Store.GetQueueSettings("new-queue")
+	assert.Nil(t, err)
+	assert.Equal(t, 30, settings.DelaySeconds)
+}
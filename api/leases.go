@@ -19,6 +19,7 @@ package api
 
 import (
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net/http"
 
@@ -51,7 +52,62 @@ func (s *Server) deleteLease(w http.ResponseWriter, r *http.Request) {
 		if err == tqs.ErrQueueNotFound || err == tqs.ErrLeaseNotFound {
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		} else {
-			internalServerError(w, err)
+			internalServerError(w, r, err)
+		}
+	}
+}
+
+func (s *Server) extendLease(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	leaseID, err := decodeLeaseID(vars["id"])
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	leaseDuration, err := getLeaseDuration(r)
+	if err != nil {
+		badRequestError(w, nil, "Invalid LeaseDuration: "+err.Error())
+		return
+	}
+
+	lease, err := s.store.ExtendLease(vars["name"], leaseID, leaseDuration)
+	if err != nil {
+		if err == tqs.ErrQueueNotFound || err == tqs.ErrLeaseNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		} else if err == tqs.ErrInvalidLeaseDuration {
+			badRequestError(w, nil, err.Error())
+		} else {
+			internalServerError(w, r, err)
+		}
+		return
+	}
+
+	encodedResponse, err := json.Marshal(&lease)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(encodedResponse)
+}
+
+func (s *Server) releaseLease(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	leaseID, err := decodeLeaseID(vars["id"])
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.store.ReleaseLease(vars["name"], leaseID); err != nil {
+		if err == tqs.ErrQueueNotFound || err == tqs.ErrLeaseNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		} else {
+			internalServerError(w, r, err)
 		}
 	}
 }
@@ -0,0 +1,146 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// requestIDHeader carries the ID of a request. A client or proxy can
+// set it, otherwise the server makes one up. It is returned with the
+// response and appears in every log message about the request.
+const requestIDHeader = "X-Request-Id"
+
+const maxRequestIDLength = 64
+
+type contextKey int
+
+const (
+	requestInfoKey contextKey = iota
+	loggerKey
+	apiKeyKey
+)
+
+// requestInfo is what the access log knows about a request after the
+// router has matched it and the request is authenticated.
+type requestInfo struct {
+	route string
+	queue string
+	lease string
+	key   string
+}
+
+// accessLog logs every request when it is done, with a logger that the
+// handlers use for messages about the request.
+func (s *Server) accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > maxRequestIDLength {
+			id = newRequestID()
+			r.Header.Set(requestIDHeader, id) // Also for the leader if the request is forwarded
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		info := &requestInfo{}
+		logger := s.logger.With("request_id", id)
+
+		ctx := context.WithValue(r.Context(), requestInfoKey, info)
+		ctx = context.WithValue(ctx, loggerKey, logger)
+
+		sw := &statusWriter{ResponseWriter: w}
+		started := time.Now()
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		if sw.code == 0 {
+			sw.code = http.StatusOK
+		}
+
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sw.code,
+			"bytes", sw.bytes,
+			"duration", time.Since(started),
+			"remote", r.RemoteAddr,
+		}
+		if info.route != "" {
+			attrs = append(attrs, "route", info.route)
+		}
+		if info.queue != "" {
+			attrs = append(attrs, "queue", info.queue)
+		}
+		if info.lease != "" {
+			attrs = append(attrs, "lease_id", info.lease)
+		}
+		if info.key != "" {
+			attrs = append(attrs, "key", info.key)
+		}
+
+		logger.Info("Request", attrs...)
+	})
+}
+
+// annotateRequest adds the route, queue name and lease ID of a request
+// that the router matched to its logger and to the access log.
+func (s *Server) annotateRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info, ok := r.Context().Value(requestInfoKey).(*requestInfo)
+		if !ok {
+			info = &requestInfo{}
+		}
+
+		if route := mux.CurrentRoute(r); route != nil {
+			info.route, _ = route.GetPathTemplate()
+		}
+
+		vars := mux.Vars(r)
+		info.queue = vars["name"]
+		info.lease = vars["id"] // Only the lease routes have an id
+
+		logger := requestLogger(r)
+		if info.queue != "" {
+			logger = logger.With("queue", info.queue)
+		}
+		if info.lease != "" {
+			logger = logger.With("lease_id", info.lease)
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), loggerKey, logger)))
+	})
+}
+
+// requestLogger returns the logger for messages about a request.
+func requestLogger(r *http.Request) *slog.Logger {
+	if logger, ok := r.Context().Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+func newRequestID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,96 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package api_test
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/st3fan/tqsd/api"
+	"github.com/st3fan/tqsd/tqstest"
+	"github.com/stretchr/testify/assert"
+)
+
+type lockedBuffer struct {
+	sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buffer.String()
+}
+
+func Test_AccessLog(t *testing.T) {
+	var output lockedBuffer
+	logger := slog.New(slog.NewJSONHandler(&output, nil))
+
+	server := tqstest.NewServer(t, tqstest.WithQueue("jobs"), tqstest.WithServerOptions(api.Logger(logger)))
+
+	r, err := http.NewRequest("DELETE", server.URL+"/queues/jobs/leases/0102", nil)
+	assert.Nil(t, err)
+	r.Header.Set("X-Request-Id", "test-request")
+
+	resp, err := server.Client.Do(r)
+	if !assert.Nil(t, err) {
+		return
+	}
+	resp.Body.Close()
+
+	assert.Equal(t, "test-request", resp.Header.Get("X-Request-Id"))
+
+	// The access log is written after the response
+	assert.Eventually(t, func() bool {
+		return strings.Contains(output.String(), `"msg":"Request"`)
+	}, time.Second, 10*time.Millisecond)
+
+	for _, field := range []string{
+		`"request_id":"test-request"`,
+		`"method":"DELETE"`,
+		`"status":404`,
+		`"route":"/queues/{name}/leases/{id}"`,
+		`"queue":"jobs"`,
+		`"lease_id":"0102"`,
+	} {
+		assert.Contains(t, output.String(), field)
+	}
+}
+
+func Test_RequestID(t *testing.T) {
+	server := tqstest.NewServer(t)
+
+	resp, err := server.Client.Get(server.URL + "/version")
+	if !assert.Nil(t, err) {
+		return
+	}
+	resp.Body.Close()
+
+	assert.Len(t, resp.Header.Get("X-Request-Id"), 16)
+}
@@ -0,0 +1,308 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The metrics are written in the Prometheus text format by hand, it is
+// simple enough to not need the client library.
+
+// requestDurationBuckets are the upper bounds, in seconds, of the
+// buckets of the request duration histograms.
+var requestDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type routeKey struct {
+	method string
+	route  string
+}
+
+type requestKey struct {
+	routeKey
+	code int
+}
+
+type histogram struct {
+	buckets []uint64 // Not cumulative, the last one counts what is above all bounds
+	sum     float64
+	count   uint64
+}
+
+type httpMetrics struct {
+	sync.Mutex
+	requests  map[requestKey]uint64
+	durations map[routeKey]*histogram
+}
+
+func newHTTPMetrics() *httpMetrics {
+	return &httpMetrics{
+		requests:  make(map[requestKey]uint64),
+		durations: make(map[routeKey]*histogram),
+	}
+}
+
+func (m *httpMetrics) observe(method, route string, code int, duration time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+
+	key := routeKey{method, route}
+	m.requests[requestKey{key, code}]++
+
+	h, ok := m.durations[key]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(requestDurationBuckets)+1)}
+		m.durations[key] = h
+	}
+
+	seconds := duration.Seconds()
+	i := sort.SearchFloat64s(requestDurationBuckets, seconds)
+	h.buckets[i]++
+	h.sum += seconds
+	h.count++
+}
+
+// statusWriter remembers the status code and size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// instrument counts requests and their durations by route, like
+// /queues/{name}/messages, so that queue names do not end up as labels.
+func (s *Server) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		started := time.Now()
+		next.ServeHTTP(sw, r)
+
+		if sw.code == 0 {
+			sw.code = http.StatusOK
+		}
+
+		s.httpMetrics.observe(r.Method, route, sw.code, time.Since(started))
+	})
+}
+
+//
+
+type metricsWriter struct {
+	*bufio.Writer
+}
+
+func (w metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a sample with labels given as name, value pairs.
+func (w metricsWriter) sample(name string, value float64, labels ...string) {
+	w.WriteString(name)
+	if len(labels) != 0 {
+		w.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i != 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", labels[i], escapeLabelValue(labels[i+1]))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	w.WriteByte('\n')
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func (s *Server) getMetrics(w http.ResponseWriter, r *http.Request) {
+	queues, err := s.store.QueueMetrics()
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	m := metricsWriter{bufio.NewWriter(w)}
+	defer m.Flush()
+
+	m.header("tqs_build_info", "gauge", "Version of tqsd.")
+	m.sample("tqs_build_info", 1, "version", s.version)
+
+	// Queues
+
+	m.header("tqs_queue_messages", "gauge", "Number of messages in a queue by state.")
+	for _, q := range queues {
+		m.sample("tqs_queue_messages", float64(q.Visible), "queue", q.Name, "state", "visible")
+		m.sample("tqs_queue_messages", float64(q.Leased), "queue", q.Name, "state", "leased")
+		m.sample("tqs_queue_messages", float64(q.Delayed), "queue", q.Name, "state", "delayed")
+		m.sample("tqs_queue_messages", float64(q.Quarantined), "queue", q.Name, "state", "quarantined")
+	}
+
+	for _, counter := range []struct {
+		name  string
+		help  string
+		value func(i int) uint64
+	}{
+		{"tqs_messages_sent_total", "Messages sent to a queue.", func(i int) uint64 { return queues[i].Sent }},
+		{"tqs_messages_received_total", "Messages leased by receivers of a queue.", func(i int) uint64 { return queues[i].Received }},
+		{"tqs_messages_acked_total", "Leased messages deleted by receivers of a queue.", func(i int) uint64 { return queues[i].Deleted }},
+		{"tqs_leases_expired_total", "Leases that expired, making their message visible again.", func(i int) uint64 { return queues[i].LeasesExpired }},
+		{"tqs_messages_expired_total", "Messages deleted because of the retention period.", func(i int) uint64 { return queues[i].MessagesExpired }},
+		{"tqs_messages_quarantined_total", "Undecodable messages moved to the quarantine.", func(i int) uint64 { return queues[i].Quarantines }},
+	} {
+		m.header(counter.name, "counter", counter.help)
+		for i := range queues {
+			m.sample(counter.name, float64(counter.value(i)), "queue", queues[i].Name)
+		}
+	}
+
+	// HTTP
+
+	s.httpMetrics.Lock()
+
+	requestKeys := make([]requestKey, 0, len(s.httpMetrics.requests))
+	for key := range s.httpMetrics.requests {
+		requestKeys = append(requestKeys, key)
+	}
+	sort.Slice(requestKeys, func(i, j int) bool {
+		a, b := requestKeys[i], requestKeys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+
+	m.header("tqs_http_requests_total", "counter", "HTTP requests by route, method and status code.")
+	for _, key := range requestKeys {
+		m.sample("tqs_http_requests_total", float64(s.httpMetrics.requests[key]), "method", key.method, "route", key.route, "code", strconv.Itoa(key.code))
+	}
+
+	routeKeys := make([]routeKey, 0, len(s.httpMetrics.durations))
+	for key := range s.httpMetrics.durations {
+		routeKeys = append(routeKeys, key)
+	}
+	sort.Slice(routeKeys, func(i, j int) bool {
+		a, b := routeKeys[i], routeKeys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		return a.method < b.method
+	})
+
+	m.header("tqs_http_request_duration_seconds", "histogram", "Time to handle HTTP requests by route and method.")
+	for _, key := range routeKeys {
+		h := s.httpMetrics.durations[key]
+		var cumulative uint64
+		for i, bound := range requestDurationBuckets {
+			cumulative += h.buckets[i]
+			m.sample("tqs_http_request_duration_seconds_bucket", float64(cumulative), "method", key.method, "route", key.route, "le", strconv.FormatFloat(bound, 'g', -1, 64))
+		}
+		m.sample("tqs_http_request_duration_seconds_bucket", float64(h.count), "method", key.method, "route", key.route, "le", "+Inf")
+		m.sample("tqs_http_request_duration_seconds_sum", h.sum, "method", key.method, "route", key.route)
+		m.sample("tqs_http_request_duration_seconds_count", float64(h.count), "method", key.method, "route", key.route)
+	}
+
+	s.httpMetrics.Unlock()
+
+	// Background tasks
+
+	tasks := s.store.TaskMetrics()
+
+	m.header("tqs_task_duration_seconds", "summary", "Time spent in runs of a background task.")
+	for _, t := range tasks {
+		m.sample("tqs_task_duration_seconds_sum", t.Duration.Seconds(), "task", t.Name)
+		m.sample("tqs_task_duration_seconds_count", float64(t.Runs), "task", t.Name)
+	}
+
+	m.header("tqs_task_errors_total", "counter", "Runs of a background task that failed.")
+	for _, t := range tasks {
+		m.sample("tqs_task_errors_total", float64(t.Errors), "task", t.Name)
+	}
+
+	// Bolt
+
+	databases := s.store.DatabaseMetrics()
+
+	for _, gauge := range []struct {
+		name  string
+		help  string
+		value func(i int) float64
+	}{
+		{"tqs_bolt_file_size_bytes", "Size of a bolt file.", func(i int) float64 { return float64(databases[i].Size) }},
+		{"tqs_bolt_free_pages", "Free pages in a bolt file.", func(i int) float64 { return float64(databases[i].Stats.FreePageN) }},
+		{"tqs_bolt_pending_pages", "Pages in a bolt file that are freed when read transactions finish.", func(i int) float64 { return float64(databases[i].Stats.PendingPageN) }},
+		{"tqs_bolt_free_alloc_bytes", "Bytes allocated in free pages of a bolt file.", func(i int) float64 { return float64(databases[i].Stats.FreeAlloc) }},
+		{"tqs_bolt_freelist_inuse_bytes", "Bytes used by the freelist of a bolt file.", func(i int) float64 { return float64(databases[i].Stats.FreelistInuse) }},
+		{"tqs_bolt_open_read_transactions", "Read transactions that are open on a bolt file.", func(i int) float64 { return float64(databases[i].Stats.OpenTxN) }},
+	} {
+		m.header(gauge.name, "gauge", gauge.help)
+		for i := range databases {
+			m.sample(gauge.name, gauge.value(i), "file", databases[i].Path)
+		}
+	}
+
+	m.header("tqs_bolt_read_transactions_total", "counter", "Read transactions started on a bolt file.")
+	for _, d := range databases {
+		m.sample("tqs_bolt_read_transactions_total", float64(d.Stats.TxN), "file", d.Path)
+	}
+}
@@ -0,0 +1,83 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package api_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/st3fan/tqsd/tqs"
+	"github.com/st3fan/tqsd/tqstest"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Metrics(t *testing.T) {
+	server := tqstest.NewServer(t, tqstest.WithQueue("jobs"), tqstest.WithTemporaryFile())
+
+	status := request(t, server, "POST", "/queues/jobs/messages", `{"Messages":[{"Body":"One"},{"Body":"Two"}]}`, nil)
+	assert.Equal(t, http.StatusOK, status)
+
+	var response receiveResponse
+	request(t, server, "GET", "/queues/jobs/messages?LeaseDuration=30", "", &response)
+	assert.Len(t, response.Messages, 1)
+
+	assert.Nil(t, server.Store.RunTasks())
+
+	resp, err := server.Client.Get(server.URL + "/metrics")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/plain")
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	for _, line := range []string{
+		`tqs_queue_messages{queue="jobs",state="visible"} 1`,
+		`tqs_queue_messages{queue="jobs",state="leased"} 1`,
+		`tqs_messages_sent_total{queue="jobs"} 2`,
+		`tqs_messages_received_total{queue="jobs"} 1`,
+		`tqs_messages_quarantined_total{queue="jobs"} 0`,
+		`tqs_http_requests_total{method="POST",route="/queues/{name}/messages",code="200"} 1`,
+		`tqs_http_request_duration_seconds_count{method="GET",route="/queues/{name}/messages"} 1`,
+		`tqs_task_duration_seconds_count{task="expire_leases"} 1`,
+		`# TYPE tqs_bolt_file_size_bytes gauge`,
+	} {
+		assert.Contains(t, string(body), line+"\n")
+	}
+}
+
+func Test_MetricsSkipsFailedSends(t *testing.T) {
+	server := tqstest.NewServer(t)
+	_, err := server.Store.PutMessages("nope", []tqs.Message{{Body: "One"}})
+	assert.Equal(t, tqs.ErrQueueNotFound, err)
+
+	resp, err := server.Client.Get(server.URL + "/metrics")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(body), `queue="nope"`)
+}
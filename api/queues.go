@@ -32,22 +32,26 @@ type getQueuesResponse []QueueDetails
 func (s *Server) getQueues(w http.ResponseWriter, r *http.Request) {
 	queueNames, err := s.store.GetQueueNames()
 	if err != nil {
-		internalServerError(w, err)
+		internalServerError(w, r, err)
 		return
 	}
 
 	response := make(getQueuesResponse, 0)
 
 	for _, queueName := range queueNames {
+		if !s.authorized(r, queueName, anyAction...) {
+			continue
+		}
+
 		queueSettings, err := s.store.GetQueueSettings(queueName)
 		if err != nil {
-			internalServerError(w, err)
+			internalServerError(w, r, err)
 			return
 		}
 
 		queueMeta, err := s.store.GetQueueMeta(queueName)
 		if err != nil {
-			internalServerError(w, err)
+			internalServerError(w, r, err)
 		}
 
 		queue := QueueDetails{
@@ -63,7 +67,7 @@ func (s *Server) getQueues(w http.ResponseWriter, r *http.Request) {
 
 	encodedResponse, err := json.Marshal(&response)
 	if err != nil {
-		internalServerError(w, err)
+		internalServerError(w, r, err)
 		return
 	}
 
@@ -86,7 +90,7 @@ func badRequestError(w http.ResponseWriter, err error, msg string) {
 
 	encodedResponse, err := json.Marshal(&response)
 	if err != nil {
-		internalServerError(w, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
@@ -98,10 +102,34 @@ func badRequestError(w http.ResponseWriter, err error, msg string) {
 
 //
 
+// maxQueueRequestSize is the most bytes read from the body of a request
+// that creates a queue or changes its settings.
+const maxQueueRequestSize = 64 * 1024
+
+// createQueueSettings has pointers so that a setting that is missing
+// from a request can be told apart from one that is set to zero.
 type createQueueSettings struct {
-	LeaseDuration          int
-	MessageRetentionPeriod int
-	DelaySeconds           int
+	LeaseDuration          *int
+	MessageRetentionPeriod *int
+	DelaySeconds           *int
+}
+
+func (settings createQueueSettings) queueSettings() []tqs.QueueSetting {
+	queueSettings := make([]tqs.QueueSetting, 0)
+
+	if settings.LeaseDuration != nil {
+		queueSettings = append(queueSettings, tqs.LeaseDuration(*settings.LeaseDuration))
+	}
+
+	if settings.MessageRetentionPeriod != nil {
+		queueSettings = append(queueSettings, tqs.MessageRetentionPeriod(*settings.MessageRetentionPeriod))
+	}
+
+	if settings.DelaySeconds != nil {
+		queueSettings = append(queueSettings, tqs.DelaySeconds(*settings.DelaySeconds))
+	}
+
+	return queueSettings
 }
 
 type createQueueRequest struct {
@@ -116,25 +144,12 @@ type createQueueResponse struct {
 
 func (s *Server) createQueue(w http.ResponseWriter, r *http.Request) {
 	var request createQueueRequest
-	if err := unmarshalBody(r, &request, 1024); err != nil {
-		internalServerError(w, err)
-	}
-
-	queueSettings := make([]tqs.QueueSetting, 0)
-
-	if request.Settings.LeaseDuration != 0 {
-		queueSettings = append(queueSettings, tqs.LeaseDuration(request.Settings.LeaseDuration))
-	}
-
-	if request.Settings.MessageRetentionPeriod != 0 {
-		queueSettings = append(queueSettings, tqs.MessageRetentionPeriod(request.Settings.MessageRetentionPeriod))
-	}
-
-	if request.Settings.DelaySeconds != 0 {
-		queueSettings = append(queueSettings, tqs.DelaySeconds(request.Settings.DelaySeconds))
+	if err := unmarshalBody(r, &request, maxQueueRequestSize); err != nil {
+		badRequestError(w, nil, "invalid request")
+		return
 	}
 
-	meta, settings, err := s.store.CreateQueue(request.Name, queueSettings...)
+	meta, settings, err := s.store.CreateQueue(request.Name, request.Settings.queueSettings()...)
 	if err != nil {
 		// TODO Error handling sucks .. maybe CreateQueue can return a more detailed error
 		if err == tqs.ErrInvalidQueueName {
@@ -144,7 +159,7 @@ func (s *Server) createQueue(w http.ResponseWriter, r *http.Request) {
 		} else if err == tqs.ErrQueueExists {
 			http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
 		} else {
-			internalServerError(w, err)
+			internalServerError(w, r, err)
 		}
 		return
 	}
@@ -156,7 +171,7 @@ func (s *Server) createQueue(w http.ResponseWriter, r *http.Request) {
 
 	encodedResponse, err := json.Marshal(&response)
 	if err != nil {
-		internalServerError(w, err)
+		internalServerError(w, r, err)
 		return
 	}
 
@@ -174,13 +189,21 @@ func (s *Server) getQueue(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		if err == tqs.ErrQueueNotFound {
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		} else {
+			internalServerError(w, r, err)
 		}
-		internalServerError(w, err)
+		return
+	}
+
+	meta, err := s.store.GetQueueMeta(vars["name"])
+	if err != nil {
+		internalServerError(w, r, err)
 		return
 	}
 
 	response := QueueDetails{
 		Name:                   vars["name"],
+		Created:                meta.Created,
 		LeaseDuration:          settings.LeaseDuration,
 		MessageRetentionPeriod: settings.MessageRetentionPeriod,
 		DelaySeconds:           settings.DelaySeconds,
@@ -188,7 +211,7 @@ func (s *Server) getQueue(w http.ResponseWriter, r *http.Request) {
 
 	encodedResponse, err := json.Marshal(&response)
 	if err != nil {
-		internalServerError(w, err)
+		internalServerError(w, r, err)
 		return
 	}
 
@@ -205,14 +228,14 @@ func (s *Server) getQueueMeta(w http.ResponseWriter, r *http.Request) {
 		if err == tqs.ErrQueueNotFound {
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		} else {
-			internalServerError(w, err)
+			internalServerError(w, r, err)
 		}
 		return
 	}
 
 	encodedResponse, err := json.Marshal(&meta)
 	if err != nil {
-		internalServerError(w, err)
+		internalServerError(w, r, err)
 		return
 	}
 
@@ -229,14 +252,46 @@ func (s *Server) getQueueSettings(w http.ResponseWriter, r *http.Request) {
 		if err == tqs.ErrQueueNotFound {
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		} else {
-			internalServerError(w, err)
+			internalServerError(w, r, err)
+		}
+		return
+	}
+
+	encodedResponse, err := json.Marshal(&settings)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(encodedResponse)
+}
+
+// updateQueueSettings changes the settings that are in the request and
+// leaves the ones that are missing alone.
+func (s *Server) updateQueueSettings(w http.ResponseWriter, r *http.Request) {
+	var request createQueueSettings
+	if err := unmarshalBody(r, &request, maxQueueRequestSize); err != nil {
+		badRequestError(w, nil, "invalid settings")
+		return
+	}
+
+	vars := mux.Vars(r)
+	settings, err := s.store.UpdateQueueSettings(vars["name"], request.queueSettings()...)
+	if err != nil {
+		if err == tqs.ErrQueueNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		} else if err == tqs.ErrInvalidLeaseDuration || err == tqs.ErrInvalidMessageRetentionPeriod || err == tqs.ErrInvalidDelaySeconds {
+			badRequestError(w, nil, err.Error())
+		} else {
+			internalServerError(w, r, err)
 		}
 		return
 	}
 
 	encodedResponse, err := json.Marshal(&settings)
 	if err != nil {
-		internalServerError(w, err)
+		internalServerError(w, r, err)
 		return
 	}
 
@@ -252,7 +307,31 @@ func (s *Server) deleteQueue(w http.ResponseWriter, r *http.Request) {
 		if err == tqs.ErrQueueNotFound {
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		} else {
-			internalServerError(w, err)
+			internalServerError(w, r, err)
 		}
 	}
 }
+
+//
+
+func (s *Server) getQueueStatistics(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	statistics, err := s.store.GetQueueStatistics(vars["name"])
+	if err != nil {
+		if err == tqs.ErrQueueNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		} else {
+			internalServerError(w, r, err)
+		}
+		return
+	}
+
+	encodedResponse, err := json.Marshal(&statistics)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(encodedResponse)
+}
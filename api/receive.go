@@ -20,6 +20,7 @@ package api
 import (
 	"encoding/json"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/st3fan/tqsd/tqs"
@@ -31,7 +32,7 @@ type receiveMessagesResponse struct {
 }
 
 func (s *Server) receiveMessages(w http.ResponseWriter, r *http.Request) {
-	maxNumberOfMessages, err := getMaxNumberOfMessages(r)
+	maxNumberOfMessages, err := getMaxNumberOfMessages(r, s.limits.MaxNumberOfMessages)
 	if err != nil {
 		badRequestError(w, nil, "Invalid MaxNumberOfMessages: "+err.Error())
 		return
@@ -43,14 +44,57 @@ func (s *Server) receiveMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	waitTimeSeconds, err := getWaitTimeSeconds(r, s.limits.MaxWaitTimeSeconds)
+	if err != nil {
+		badRequestError(w, nil, "Invalid WaitTimeSeconds: "+err.Error())
+		return
+	}
+
+	// No new leases while the server shuts down, the client can retry
+	// on another node or after the restart
+	if s.shuttingDown.Load() {
+		http.Error(w, errShuttingDown.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	// With WaitTimeSeconds the request waits for messages to arrive,
+	// instead of returning an empty response right away, or until the
+	// server shuts down. Waiting is for a change to the queue, after
+	// which a read transaction tells if receiving is worth a try.
 	vars := mux.Vars(r)
+	changed := s.store.MessagesChanged(vars["name"])
 	messages, leases, err := s.store.GetMessages(vars["name"], maxNumberOfMessages, leaseDuration)
+
+	deadline := time.NewTimer(time.Duration(waitTimeSeconds) * time.Second)
+	defer deadline.Stop()
+
+wait:
+	for err == nil && len(messages) == 0 && waitTimeSeconds != 0 {
+		select {
+		case <-changed:
+		case <-deadline.C:
+			break wait
+		case <-s.shutdown:
+			break wait
+		case <-r.Context().Done():
+			return
+		}
+
+		changed = s.store.MessagesChanged(vars["name"])
+
+		var visible bool
+		if visible, err = s.store.HasVisibleMessages(vars["name"]); err == nil && visible {
+			messages, leases, err = s.store.GetMessages(vars["name"], maxNumberOfMessages, leaseDuration)
+		}
+	}
+
 	if err != nil {
 		if err == tqs.ErrQueueNotFound {
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		} else {
-			internalServerError(w, err)
+			internalServerError(w, r, err)
 		}
+		return
 	}
 
 	response := receiveMessagesResponse{
@@ -62,7 +106,7 @@ func (s *Server) receiveMessages(w http.ResponseWriter, r *http.Request) {
 
 	encodedResponse, err := json.Marshal(&response)
 	if err != nil {
-		internalServerError(w, err)
+		internalServerError(w, r, err)
 		return
 	}
 
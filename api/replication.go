@@ -0,0 +1,51 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/st3fan/tqsd/tqs"
+)
+
+func (s *Server) getReplicationStatus(w http.ResponseWriter, r *http.Request) {
+	status := s.store.ReplicationStatus()
+
+	encodedResponse, err := json.Marshal(&status)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(encodedResponse)
+}
+
+func (s *Server) promote(w http.ResponseWriter, r *http.Request) {
+	if err := s.store.Promote(); err != nil {
+		if err == tqs.ErrNotFollower {
+			http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		} else {
+			internalServerError(w, r, err)
+		}
+		return
+	}
+
+	s.getReplicationStatus(w, r)
+}
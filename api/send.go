@@ -19,6 +19,7 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 
 	"github.com/gorilla/mux"
@@ -39,12 +40,17 @@ type sendMessagesResponse struct {
 
 func (s *Server) sendMessages(w http.ResponseWriter, r *http.Request) {
 	var request sendMessagesRequest
-	if err := unmarshalBody(r, &request, 32*tqs.MaxBodyLength); err != nil { // TODO Magic numbers
-		internalServerError(w, err)
+	if err := unmarshalBody(r, &request, s.limits.MaxRequestSize); err != nil {
+		internalServerError(w, r, err)
 		return
 	}
 
 	for i := range request.Messages {
+		if len(request.Messages[i].Body) > s.limits.MaxMessageSize {
+			badRequestError(w, nil, fmt.Sprintf("message body longer than %d bytes", s.limits.MaxMessageSize))
+			return
+		}
+
 		if request.Messages[i].Settings.Priority == 0 {
 			request.Messages[i].Settings.Priority = tqs.DefaultPriority
 		}
@@ -56,8 +62,9 @@ func (s *Server) sendMessages(w http.ResponseWriter, r *http.Request) {
 		if err == tqs.ErrQueueNotFound {
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		} else {
-			internalServerError(w, err)
+			internalServerError(w, r, err)
 		}
+		return
 	}
 
 	response := sendMessagesResponse{
@@ -66,7 +73,7 @@ func (s *Server) sendMessages(w http.ResponseWriter, r *http.Request) {
 
 	encodedResponse, err := json.Marshal(&response)
 	if err != nil {
-		internalServerError(w, err)
+		internalServerError(w, r, err)
 		return
 	}
 
@@ -19,11 +19,15 @@ package api
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -31,10 +35,109 @@ import (
 )
 
 type Server struct {
-	router  *mux.Router
-	server  *http.Server
-	version string
-	store   *tqs.Store
+	router      *mux.Router
+	server      *http.Server
+	version     string
+	store       *tqs.Store
+	adminToken  string
+	logger      *slog.Logger
+	httpMetrics *httpMetrics
+
+	limits   RequestLimits
+	timeouts ServerTimeouts
+
+	requireAPIKey  bool
+	apiKeys        []ConfiguredAPIKey
+	apiKeysLock    sync.RWMutex
+	apiKeyHashes   map[string]tqs.APIKey
+	apiKeySubjects map[string]tqs.APIKey
+
+	tls *tlsFiles
+
+	started      time.Time
+	drainDelay   time.Duration
+	shuttingDown atomic.Bool
+	shutdown     chan struct{} // Closed when Shutdown is called
+}
+
+// ServerOption configures optional features of a Server
+type ServerOption func(*Server)
+
+// AdminToken enables the /admin endpoints for requests that present
+// token as a bearer token. Without it they are disabled.
+func AdminToken(token string) ServerOption {
+	return func(s *Server) {
+		s.adminToken = token
+	}
+}
+
+// Logger sends the access log and errors of the server to logger
+// instead of the default slog logger.
+func Logger(logger *slog.Logger) ServerOption {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// RequestLimits bound what a single request can ask for.
+type RequestLimits struct {
+	MaxNumberOfMessages int   // Received at once
+	MaxWaitTimeSeconds  int   // Of a long poll
+	MaxMessageSize      int   // Length of a message body
+	MaxRequestSize      int64 // Bytes in the body of a send request
+}
+
+// DefaultRequestLimits are the limits of a server without Limits.
+var DefaultRequestLimits = RequestLimits{
+	MaxNumberOfMessages: tqs.MaxMaxNumberOfMessages,
+	MaxWaitTimeSeconds:  10,
+	MaxMessageSize:      tqs.MaxBodyLength,
+	MaxRequestSize:      32 * tqs.MaxBodyLength,
+}
+
+// Limits changes the limits of requests.
+func Limits(limits RequestLimits) ServerOption {
+	return func(s *Server) {
+		s.limits = limits
+	}
+}
+
+func (l RequestLimits) validate() error {
+	if l.MaxNumberOfMessages < tqs.MinMaxNumberOfMessages || l.MaxWaitTimeSeconds < 0 || l.MaxMessageSize <= 0 || l.MaxRequestSize <= 0 {
+		return fmt.Errorf("invalid request limits %+v", l)
+	}
+	return nil
+}
+
+// ServerTimeouts are the timeouts of the http.Server.
+type ServerTimeouts struct {
+	Read  time.Duration
+	Write time.Duration
+	Idle  time.Duration
+}
+
+// DefaultServerTimeouts are the timeouts of a server without Timeouts.
+var DefaultServerTimeouts = ServerTimeouts{
+	Read:  15 * time.Second,
+	Write: 15 * time.Second,
+	Idle:  60 * time.Second,
+}
+
+// Timeouts changes the timeouts of the http.Server. A long poll has to
+// finish well within the write timeout.
+func Timeouts(timeouts ServerTimeouts) ServerOption {
+	return func(s *Server) {
+		s.timeouts = timeouts
+	}
+}
+
+// DrainDelay makes Shutdown wait for delay between failing /readyz and
+// closing the listener, so that load balancers can stop sending
+// requests to the server before it goes away.
+func DrainDelay(delay time.Duration) ServerOption {
+	return func(s *Server) {
+		s.drainDelay = delay
+	}
 }
 
 type QueueDetails struct {
@@ -55,9 +158,15 @@ func unmarshalBody(r *http.Request, v interface{}, maxSize int64) error {
 	return json.Unmarshal(body, v)
 }
 
-func internalServerError(w http.ResponseWriter, err error) {
-	// TODO Log the error to Sentry or Logrus
-	log.Println("Failure: ", err)
+func internalServerError(w http.ResponseWriter, r *http.Request, err error) {
+	// Writes to a replication follower end up here from every handler
+	// that changes something. The client should retry on the leader.
+	if err == tqs.ErrNotLeader {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	requestLogger(r).Error("Request failed", "error", err)
 	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
 
@@ -72,7 +181,7 @@ func (s *Server) getVersion(w http.ResponseWriter, r *http.Request) {
 
 	encodedResponse, err := json.Marshal(&response)
 	if err != nil {
-		internalServerError(w, err)
+		internalServerError(w, r, err)
 		return
 	}
 
@@ -86,76 +195,160 @@ func (s *Server) purgeMessages(w http.ResponseWriter, r *http.Request) {
 		if err == tqs.ErrQueueNotFound {
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		} else {
-			internalServerError(w, err)
+			internalServerError(w, r, err)
 		}
 	}
 }
 
 //
 
-func (s *Server) NewServer(version string, store *tqs.Store, addr string) (*Server, error) {
+func NewServer(version string, store *tqs.Store, options ...ServerOption) (*Server, error) {
+	s := &Server{
+		version:     version,
+		store:       store,
+		logger:      slog.Default(),
+		httpMetrics: newHTTPMetrics(),
+		limits:      DefaultRequestLimits,
+		timeouts:    DefaultServerTimeouts,
+		started:     time.Now(),
+		shutdown:    make(chan struct{}),
+	}
+
+	for _, option := range options {
+		option(s)
+	}
+
+	if err := s.limits.validate(); err != nil {
+		return nil, err
+	}
+
+	if s.timeouts.Write > 0 && time.Duration(s.limits.MaxWaitTimeSeconds)*time.Second >= s.timeouts.Write {
+		return nil, fmt.Errorf("a long poll of %ds does not fit in the write timeout of %s", s.limits.MaxWaitTimeSeconds, s.timeouts.Write)
+	}
+
+	if err := s.SetAPIKeys(s.apiKeys...); err != nil {
+		return nil, err
+	}
+
+	if s.tls != nil {
+		if err := s.tls.load(); err != nil {
+			return nil, err
+		}
+	}
+
 	router := mux.NewRouter()
 	router.StrictSlash(true)
+	router.Use(s.annotateRequest, s.instrument, s.authenticate)
 
 	router.HandleFunc("/version", s.getVersion).Methods("GET")
+	router.HandleFunc("/metrics", s.getMetrics).Methods("GET")
+
+	router.HandleFunc("/healthz", s.getHealth).Methods("GET")
+	router.HandleFunc("/readyz", s.getReadiness).Methods("GET")
+	router.HandleFunc("/status", s.getStatus).Methods("GET")
+
+	// Routes for a queue check the grants of the API key of the request
 
 	router.HandleFunc("/queues", s.getQueues).Methods("GET")
-	router.HandleFunc("/queues", s.createQueue).Methods("POST")
+	router.HandleFunc("/queues", s.allowCreate(s.createQueue)).Methods("POST")
+
+	router.HandleFunc("/queues/{name}", s.allow(s.getQueue, anyAction...)).Methods("GET")
+	router.HandleFunc("/queues/{name}", s.allow(s.deleteQueue, tqs.ActionAdmin)).Methods("DELETE")
+
+	router.HandleFunc("/queues/{name}/meta", s.allow(s.getQueueMeta, anyAction...)).Methods("GET")
+	router.HandleFunc("/queues/{name}/settings", s.allow(s.getQueueSettings, anyAction...)).Methods("GET")
+	router.HandleFunc("/queues/{name}/settings", s.allow(s.updateQueueSettings, tqs.ActionAdmin)).Methods("PATCH")
+	router.HandleFunc("/queues/{name}/statistics", s.allow(s.getQueueStatistics, anyAction...)).Methods("GET")
 
-	router.HandleFunc("/queues/{name}", s.getQueue).Methods("GET")
-	router.HandleFunc("/queues/{name}", s.deleteQueue).Methods("DELETE")
+	router.HandleFunc("/queues/{name}/messages", s.allow(s.receiveMessages, tqs.ActionReceive)).Methods("GET")
+	router.HandleFunc("/queues/{name}/messages", s.allow(s.sendMessages, tqs.ActionSend)).Methods("POST")
+	router.HandleFunc("/queues/{name}/messages", s.allow(s.purgeMessages, tqs.ActionAdmin)).Methods("DELETE")
 
-	router.HandleFunc("/queues/{name}/meta", s.getQueueMeta).Methods("GET")
-	router.HandleFunc("/queues/{name}/settings", s.getQueueSettings).Methods("GET")
+	router.HandleFunc("/queues/{name}/leases/{id}", s.allow(s.deleteLease, tqs.ActionReceive)).Methods("DELETE")
+	router.HandleFunc("/queues/{name}/leases/{id}/extend", s.allow(s.extendLease, tqs.ActionReceive)).Methods("POST")
+	router.HandleFunc("/queues/{name}/leases/{id}/release", s.allow(s.releaseLease, tqs.ActionReceive)).Methods("POST")
 
-	router.HandleFunc("/queues/{name}/messages", s.receiveMessages).Methods("GET")
-	router.HandleFunc("/queues/{name}/messages", s.sendMessages).Methods("POST")
-	router.HandleFunc("/queues/{name}/messages", s.purgeMessages).Methods("DELETE")
+	router.HandleFunc("/queues/{name}/export", s.allow(s.exportQueue, tqs.ActionAdmin)).Methods("GET")
+	router.HandleFunc("/queues/{name}/import", s.allow(s.importQueue, tqs.ActionAdmin)).Methods("POST")
 
-	router.HandleFunc("/queues/{name}/leases/{id}", s.deleteLease).Methods("DELETE")
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(s.requireAdminToken)
 
-	loggedRouter := DebugHandler(router)
+	admin.HandleFunc("/backup", s.getBackup).Methods("GET")
+	admin.HandleFunc("/compact", s.compact).Methods("POST")
 
-	server := &http.Server{
-		Addr:         addr,
-		WriteTimeout: time.Second * 15,
-		ReadTimeout:  time.Second * 15,
-		IdleTimeout:  time.Second * 60,
-		Handler:      router,
+	admin.HandleFunc("/keys", s.getAPIKeys).Methods("GET")
+	admin.HandleFunc("/keys", s.createAPIKey).Methods("POST")
+	admin.HandleFunc("/keys/{key}", s.revokeAPIKey).Methods("DELETE")
+	admin.HandleFunc("/keys/{key}/grants", s.setAPIKeyGrants).Methods("PUT")
+
+	admin.HandleFunc("/cluster", s.getClusterStatus).Methods("GET")
+
+	admin.HandleFunc("/replication", s.getReplicationStatus).Methods("GET")
+	admin.HandleFunc("/replication/promote", s.promote).Methods("POST")
+
+	admin.HandleFunc("/queues/{name}/quarantine", s.getQuarantinedMessages).Methods("GET")
+	admin.HandleFunc("/queues/{name}/quarantine", s.purgeQuarantine).Methods("DELETE")
+
+	loggedRouter := s.accessLog(s.forwardToLeader(router))
+
+	s.router = router
+	s.server = &http.Server{
+		WriteTimeout: s.timeouts.Write,
+		ReadTimeout:  s.timeouts.Read,
+		IdleTimeout:  s.timeouts.Idle,
+		Handler:      loggedRouter,
 	}
 
-	return &Server{
-		router:  router,
-		server:  server,
-		version: version,
-		store:   store,
-	}, nil
-}
+	if s.tls != nil {
+		s.server.TLSConfig = &tls.Config{GetConfigForClient: s.tls.config}
+	}
 
-func (s *Server) Start() error {
-	return s.server.ListenAndServe()
+	return s, nil
 }
 
-func (s *Server) Shutdown() error {
-	ctx, _ := context.WithTimeout(context.Background(), 15*time.Second)
-	return s.server.Shutdown(ctx)
+// Run starts the server on addr and blocks until it stops
+func (s *Server) Run(addr string) error {
+	s.server.Addr = addr
+	return s.Start()
 }
 
-type debugHandler struct {
-	handler http.Handler
+// Handler returns the handler that serves the API, for running the
+// server on an http.Server or httptest.Server of your own.
+func (s *Server) Handler() http.Handler {
+	return s.server.Handler
 }
 
-func (h debugHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	t := time.Now()
-	h.handler.ServeHTTP(w, req)
-	d := time.Now().Sub(t)
-	log.Printf("%s %s (%s)\n", req.Method, req.URL.Path, d)
+// TLSConfig returns the TLS configuration of the server, or nil when it
+// serves plain HTTP.
+func (s *Server) TLSConfig() *tls.Config {
+	return s.server.TLSConfig
 }
 
-func DebugHandler(h http.Handler) http.Handler {
-	return debugHandler{handler: h}
+// Start serves until Shutdown is called and then returns nil. Any other
+// return, like for an address that is in use, is an error.
+func (s *Server) Start() error {
+	var err error
+	if s.tls != nil {
+		err = s.server.ListenAndServeTLS("", "")
+	} else {
+		err = s.server.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
 }
 
-// // Run starts the server
-// func (s *Server) Run(addr string) error {
-// }
+// Shutdown makes /readyz fail, turns away receives and ends the long
+// polls in flight, waits for the DrainDelay, and then stops the server,
+// waiting for the requests in flight.
+func (s *Server) Shutdown() error {
+	if s.shuttingDown.CompareAndSwap(false, true) {
+		close(s.shutdown)
+		time.Sleep(s.drainDelay)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
@@ -15,24 +15,215 @@
 // along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
 //
 
-package api
+package api_test
 
-import "testing"
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/st3fan/tqsd/api"
+	"github.com/st3fan/tqsd/tqs"
+	"github.com/st3fan/tqsd/tqstest"
+	"github.com/stretchr/testify/assert"
+)
+
+func request(t *testing.T, server *tqstest.Server, method, path, body string, response interface{}) int {
+	r, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	assert.Nil(t, err)
+
+	resp, err := server.Client.Do(r)
+	if err != nil {
+		t.Fatal("Request failed: ", err)
+	}
+	defer resp.Body.Close()
+
+	if response != nil && resp.StatusCode/100 == 2 {
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(response))
+	}
+
+	return resp.StatusCode
+}
+
+type receiveResponse struct {
+	Messages []tqs.Message
+	Leases   []tqs.Lease
+}
 
 func Test_CreateQueue(t *testing.T) {
+	server := tqstest.NewServer(t)
+
+	status := request(t, server, "POST", "/queues", `{"Name":"jobs","Settings":{"LeaseDuration":60}}`, nil)
+	assert.Equal(t, http.StatusCreated, status)
+
+	status = request(t, server, "POST", "/queues", `{"Name":"jobs"}`, nil)
+	assert.Equal(t, http.StatusConflict, status)
+
+	status = request(t, server, "POST", "/queues", `{"Name":"no spaces"}`, nil)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status = request(t, server, "POST", "/queues", `{"Name":"large",`+strings.Repeat(" ", 128*1024)+`}`, nil)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	settings, err := server.Store.GetQueueSettings("jobs")
+	assert.Nil(t, err)
+	assert.Equal(t, 60, settings.LeaseDuration)
+}
+
+func Test_UpdateQueueSettings(t *testing.T) {
+	server := tqstest.NewServer(t, tqstest.WithQueue("jobs"))
+
+	var settings tqs.QueueSettings
+	status := request(t, server, "PATCH", "/queues/jobs/settings", `{"DelaySeconds":30}`, &settings)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 30, settings.DelaySeconds)
+
+	// Settings that are missing are left alone, zero clears the delay
+	status = request(t, server, "PATCH", "/queues/jobs/settings", `{"LeaseDuration":60}`, &settings)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 60, settings.LeaseDuration)
+	assert.Equal(t, 30, settings.DelaySeconds)
+
+	status = request(t, server, "PATCH", "/queues/jobs/settings", `{"DelaySeconds":0}`, &settings)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 60, settings.LeaseDuration)
+	assert.Equal(t, 0, settings.DelaySeconds)
+
+	stored, err := server.Store.GetQueueSettings("jobs")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, stored.DelaySeconds)
+
+	status = request(t, server, "PATCH", "/queues/jobs/settings", `{"LeaseDuration":0}`, nil)
+	assert.Equal(t, http.StatusBadRequest, status)
 }
 
 func Test_SendMessage(t *testing.T) {
+	server := tqstest.NewServer(t, tqstest.WithQueue("jobs"))
+
+	var response struct{ MessageIDs []tqs.MessageID }
+	status := request(t, server, "POST", "/queues/jobs/messages", `{"Messages":[{"Body":"One"},{"Body":"Two"}]}`, &response)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, response.MessageIDs, 2)
 }
 
 func Test_ReceiveMessage(t *testing.T) {
+	server := tqstest.NewServer(t, tqstest.WithQueue("jobs"))
+
+	_, err := server.Store.PutMessages("jobs", []tqs.Message{{Body: "Hello"}})
+	assert.Nil(t, err)
+
+	var response receiveResponse
+	status := request(t, server, "GET", "/queues/jobs/messages?LeaseDuration=30", "", &response)
+	assert.Equal(t, http.StatusOK, status)
+	if assert.Len(t, response.Messages, 1) {
+		assert.Equal(t, "Hello", response.Messages[0].Body)
+	}
+	assert.Len(t, response.Leases, 1)
+}
+
+func Test_LeaseExpiration(t *testing.T) {
+	clock := tqstest.NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	server := tqstest.NewServer(t, tqstest.WithQueue("jobs"), tqstest.WithClock(clock))
+
+	_, err := server.Store.PutMessages("jobs", []tqs.Message{{Body: "Hello"}})
+	assert.Nil(t, err)
+
+	var response receiveResponse
+	request(t, server, "GET", "/queues/jobs/messages?LeaseDuration=30", "", &response)
+	assert.Len(t, response.Messages, 1)
+
+	clock.Advance(31 * time.Second)
+	assert.Nil(t, server.Store.RunTasks())
+
+	response = receiveResponse{}
+	request(t, server, "GET", "/queues/jobs/messages?LeaseDuration=30", "", &response)
+	assert.Len(t, response.Messages, 1)
 }
 
 func Test_DeleteMessage(t *testing.T) {
+	server := tqstest.NewServer(t, tqstest.WithQueue("jobs"))
+
+	_, err := server.Store.PutMessages("jobs", []tqs.Message{{Body: "Hello"}})
+	assert.Nil(t, err)
+
+	var response receiveResponse
+	request(t, server, "GET", "/queues/jobs/messages?LeaseDuration=30", "", &response)
+	if !assert.Len(t, response.Leases, 1) {
+		return
+	}
+
+	leaseID, err := json.Marshal(&response.Leases[0].ID)
+	assert.Nil(t, err)
+	path := "/queues/jobs/leases/" + strings.Trim(string(leaseID), `"`)
+
+	assert.Equal(t, http.StatusOK, request(t, server, "DELETE", path, "", nil))
+	assert.Equal(t, http.StatusNotFound, request(t, server, "DELETE", path, "", nil))
 }
 
 func Test_PurgeQueue(t *testing.T) {
+	server := tqstest.NewServer(t, tqstest.WithQueue("jobs"))
+
+	_, err := server.Store.PutMessages("jobs", []tqs.Message{{Body: "One"}, {Body: "Two"}})
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusOK, request(t, server, "DELETE", "/queues/jobs/messages", "", nil))
+
+	messages, _, err := server.Store.GetMessages("jobs", 10, 30)
+	assert.Nil(t, err)
+	assert.Len(t, messages, 0)
 }
 
 func Test_DeleteQueue(t *testing.T) {
+	server := tqstest.NewServer(t, tqstest.WithQueue("jobs"), tqstest.WithTemporaryFile())
+
+	assert.Equal(t, http.StatusOK, request(t, server, "DELETE", "/queues/jobs", "", nil))
+	assert.Equal(t, http.StatusNotFound, request(t, server, "GET", "/queues/jobs", "", nil))
+}
+
+func Test_Limits(t *testing.T) {
+	server := tqstest.NewServer(t, tqstest.WithQueue("jobs"), tqstest.WithServerOptions(api.Limits(api.RequestLimits{
+		MaxNumberOfMessages: 5,
+		MaxWaitTimeSeconds:  2,
+		MaxMessageSize:      8,
+		MaxRequestSize:      1024,
+	})))
+
+	assert.Equal(t, http.StatusOK, request(t, server, "POST", "/queues/jobs/messages", `{"Messages":[{"Body":"12345678"}]}`, nil))
+	assert.Equal(t, http.StatusBadRequest, request(t, server, "POST", "/queues/jobs/messages", `{"Messages":[{"Body":"123456789"}]}`, nil))
+
+	assert.Equal(t, http.StatusOK, request(t, server, "GET", "/queues/jobs/messages?MaxNumberOfMessages=5", "", nil))
+	assert.Equal(t, http.StatusBadRequest, request(t, server, "GET", "/queues/jobs/messages?MaxNumberOfMessages=6", "", nil))
+	assert.Equal(t, http.StatusBadRequest, request(t, server, "GET", "/queues/jobs/messages?WaitTimeSeconds=3", "", nil))
+
+	store, err := tqs.NewStore(tqs.MemoryDatabase)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	_, err = api.NewServer("test", store, api.Timeouts(api.ServerTimeouts{Write: 5 * time.Second}))
+	assert.NotNil(t, err)
+}
+
+func Test_LongPoll(t *testing.T) {
+	server := tqstest.NewServer(t, tqstest.WithQueue("jobs"))
+
+	go func() {
+		time.Sleep(250 * time.Millisecond)
+		_, err := server.Store.PutMessages("jobs", []tqs.Message{{Body: "Hello"}})
+		assert.Nil(t, err)
+	}()
+
+	// The receive wakes up for the send, long before its wait is over
+	started := time.Now()
+	var response receiveResponse
+	assert.Equal(t, http.StatusOK, request(t, server, "GET", "/queues/jobs/messages?WaitTimeSeconds=5", "", &response))
+	assert.Len(t, response.Messages, 1)
+	assert.True(t, time.Since(started) < 2*time.Second)
+
+	// And without a send it waits until its time is up
+	started = time.Now()
+	assert.Equal(t, http.StatusOK, request(t, server, "GET", "/queues/jobs/messages?WaitTimeSeconds=1", "", &response))
+	assert.Len(t, response.Messages, 0)
+	assert.True(t, time.Since(started) >= time.Second)
 }
@@ -0,0 +1,166 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// tlsFiles are the files that the TLS configuration of the server is
+// loaded from, at startup and again by ReloadTLS.
+type tlsFiles struct {
+	sync.RWMutex
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	transport   *http.Transport // For forwarding requests to the leader
+}
+
+// TLS makes the server use HTTPS with the certificate and key in the
+// given PEM files. With a clientCAFile, clients must present a
+// certificate signed by one of the CAs in it, and the subject of that
+// certificate can identify them as a ConfiguredAPIKey. The probes are
+// the exception, since orchestrators rarely have a certificate.
+func TLS(certFile, keyFile, clientCAFile string) ServerOption {
+	return func(s *Server) {
+		s.tls = &tlsFiles{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	}
+}
+
+func (f *tlsFiles) load() error {
+	certificate, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return err
+	}
+
+	// The other nodes of a cluster are trusted when their certificate
+	// is signed by one of the client CAs, since they have to present
+	// one signed by them too
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+
+	var clientCAs *x509.CertPool
+	if f.clientCAFile != "" {
+		pem, err := os.ReadFile(f.clientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", f.clientCAFile)
+		}
+		roots.AppendCertsFromPEM(pem)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{certificate},
+		RootCAs:      roots,
+	}
+
+	f.Lock()
+	previous := f.transport
+	f.certificate = &certificate
+	f.clientCAs = clientCAs
+	f.transport = transport
+	f.Unlock()
+
+	if previous != nil {
+		previous.CloseIdleConnections()
+	}
+
+	return nil
+}
+
+// forwardTransport returns the transport that forwards requests to the
+// leader of a cluster, which presents the certificate of this node as
+// its client certificate.
+func (f *tlsFiles) forwardTransport() *http.Transport {
+	f.RLock()
+	defer f.RUnlock()
+	return f.transport
+}
+
+// config returns the configuration for a new connection, so that
+// connections made after a reload use the new files and the ones that
+// are already open are left alone.
+func (f *tlsFiles) config(*tls.ClientHelloInfo) (*tls.Config, error) {
+	f.RLock()
+	defer f.RUnlock()
+
+	// This config replaces the one of the server for the connection,
+	// so it has to offer HTTP/2 itself
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*f.certificate},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	// The certificate is required by authenticate, for all but the
+	// probes
+	if f.clientCAs != nil {
+		config.ClientCAs = f.clientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config, nil
+}
+
+// ReloadTLS loads the certificate, key and client CAs again. When that
+// fails, the server keeps using the ones it has.
+func (s *Server) ReloadTLS() error {
+	if s.tls == nil {
+		return errors.New("TLS is not enabled")
+	}
+
+	if err := s.tls.load(); err != nil {
+		return err
+	}
+
+	s.logger.Info("Reloaded TLS certificates", "cert", s.tls.certFile, "client_ca", s.tls.clientCAFile)
+
+	return nil
+}
+
+// requiresClientCertificate tells if clients must present a
+// certificate signed by one of the client CAs.
+func (f *tlsFiles) requiresClientCertificate() bool {
+	return f != nil && f.clientCAFile != ""
+}
+
+// clientSubject returns the subject of the verified client certificate
+// of a request.
+func clientSubject(r *http.Request) (commonName, distinguishedName string, ok bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", "", false
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	return subject.CommonName, subject.String(), true
+}
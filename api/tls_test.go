@@ -0,0 +1,310 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package api_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/st3fan/tqsd/api"
+	"github.com/st3fan/tqsd/tqs"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+func newTestCertificate(t *testing.T, commonName string, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"Example"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.certificate, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.Nil(t, err)
+
+	certificate, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	return &testCertificate{certificate, key}
+}
+
+func (c *testCertificate) write(t *testing.T, certFile, keyFile string) {
+	assert.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.certificate.Raw}), 0600))
+	if keyFile != "" {
+		der, err := x509.MarshalECPrivateKey(c.key)
+		assert.Nil(t, err)
+		assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+	}
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.certificate.Raw}, PrivateKey: c.key}
+}
+
+func Test_MutualTLS(t *testing.T) {
+	directory := t.TempDir()
+	certFile := filepath.Join(directory, "cert.pem")
+	keyFile := filepath.Join(directory, "key.pem")
+	caFile := filepath.Join(directory, "ca.pem")
+
+	ca := newTestCertificate(t, "Test CA", nil)
+	ca.write(t, caFile, "")
+	newTestCertificate(t, "server-1", ca).write(t, certFile, keyFile)
+
+	store, err := tqs.NewStore(tqs.MemoryDatabase)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	_, _, err = store.CreateQueue("jobs")
+	assert.Nil(t, err)
+
+	server, err := api.NewServer("test", store,
+		api.TLS(certFile, keyFile, caFile),
+		api.APIKeys(
+			api.ConfiguredAPIKey{Name: "worker", Subject: "worker"},
+			api.ConfiguredAPIKey{Name: "reader", Subject: "CN=reader,O=Example", Grants: []tqs.Grant{{Queues: "other", Actions: []tqs.Action{tqs.ActionReceive}}}},
+		),
+	)
+	assert.Nil(t, err)
+
+	ts := httptest.NewUnstartedServer(server.Handler())
+	ts.EnableHTTP2 = true
+	ts.TLS = server.TLSConfig()
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+
+	client := func(commonName string) *http.Client {
+		config := &tls.Config{RootCAs: roots}
+		if commonName != "" {
+			config.Certificates = []tls.Certificate{newTestCertificate(t, commonName, ca).tlsCertificate()}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: config, ForceAttemptHTTP2: true}}
+	}
+
+	get := func(client *http.Client, path string) (*http.Response, error) {
+		resp, err := client.Get(ts.URL + path)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	// A client without a certificate can only use the probes
+
+	for path, status := range map[string]int{"/healthz": http.StatusOK, "/readyz": http.StatusServiceUnavailable, "/version": http.StatusUnauthorized, "/queues/jobs": http.StatusUnauthorized, "/admin/keys": http.StatusUnauthorized} {
+		resp, err := get(client(""), path)
+		if assert.Nil(t, err, path) {
+			assert.Equal(t, status, resp.StatusCode, path)
+		}
+	}
+
+	// The subject of the certificate identifies the client
+
+	worker := client("worker")
+	resp, err := get(worker, "/queues/jobs")
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "server-1", resp.TLS.PeerCertificates[0].Subject.CommonName)
+		assert.Equal(t, 2, resp.ProtoMajor)
+	}
+
+	resp, err = get(client("reader"), "/queues/jobs")
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+
+	resp, err = get(client("stranger"), "/queues/jobs")
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// New connections get the new certificate after a reload, open
+	// ones are left alone
+
+	newTestCertificate(t, "server-2", ca).write(t, certFile, keyFile)
+	assert.Nil(t, server.ReloadTLS())
+
+	resp, err = get(worker, "/queues/jobs")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "server-1", resp.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+
+	resp, err = get(client("worker"), "/queues/jobs")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "server-2", resp.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+
+	// A failed reload keeps the current certificate
+
+	assert.Nil(t, os.WriteFile(keyFile, []byte("garbage"), 0600))
+	assert.NotNil(t, server.ReloadTLS())
+
+	resp, err = get(client("worker"), "/queues/jobs")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "server-2", resp.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+}
+
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen: ", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func Test_MutualTLSForwardsToLeader(t *testing.T) {
+	directory := t.TempDir()
+	caFile := filepath.Join(directory, "ca.pem")
+
+	ca := newTestCertificate(t, "Test CA", nil)
+	ca.write(t, caFile, "")
+
+	var peers []tqs.ClusterPeer
+	var listeners []net.Listener
+	for i := 1; i <= 3; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		listeners = append(listeners, l)
+		peers = append(peers, tqs.ClusterPeer{ID: fmt.Sprintf("n%d", i), Address: freeAddress(t), APIAddress: l.Addr().String()})
+	}
+
+	stores := make(map[string]*tqs.Store)
+	urls := make(map[string]string)
+	for i, peer := range peers {
+		certFile := filepath.Join(directory, peer.ID+"-cert.pem")
+		keyFile := filepath.Join(directory, peer.ID+"-key.pem")
+		newTestCertificate(t, "server-"+peer.ID, ca).write(t, certFile, keyFile)
+
+		path := filepath.Join(directory, peer.ID+".db")
+		store, err := tqs.NewClusteredStore(path, tqs.ClusterConfig{NodeID: peer.ID, Directory: path + ".raft", Peers: peers})
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		defer store.Close()
+		stores[peer.ID] = store
+
+		// The keys of the nodes are there to see that a forwarded
+		// request is not taken to come from the node that forwarded it
+		keys := []api.ConfiguredAPIKey{{Name: "worker", Token: "worker-token"}}
+		for _, p := range peers {
+			keys = append(keys, api.ConfiguredAPIKey{Name: "node-" + p.ID, Subject: "server-" + p.ID})
+		}
+
+		server, err := api.NewServer("test", store, api.TLS(certFile, keyFile, caFile), api.APIKeys(keys...))
+		assert.Nil(t, err)
+
+		ts := httptest.NewUnstartedServer(server.Handler())
+		ts.Listener.Close()
+		ts.Listener = listeners[i]
+		ts.EnableHTTP2 = true
+		ts.TLS = server.TLSConfig()
+		ts.StartTLS()
+		defer ts.Close()
+		urls[peer.ID] = ts.URL
+	}
+
+	var leader, follower string
+	assert.Eventually(t, func() bool {
+		leader, follower = "", ""
+		for id, store := range stores {
+			address, isLeader := store.ClusterLeader()
+			if address == "" {
+				return false
+			}
+			if isLeader {
+				leader = id
+			} else {
+				follower = id
+			}
+		}
+		return leader != ""
+	}, 15*time.Second, 100*time.Millisecond)
+
+	_, _, err := stores[leader].CreateQueue("jobs")
+	assert.Nil(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{newTestCertificate(t, "worker", ca).tlsCertificate()},
+	}}}
+
+	send := func(token string) int {
+		r, err := http.NewRequest("POST", urls[follower]+"/queues/jobs/messages", strings.NewReader(`{"Messages":[{"Body":"Hello"}]}`))
+		assert.Nil(t, err)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(r)
+		if !assert.Nil(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, send("worker-token"))
+	assert.Equal(t, http.StatusUnauthorized, send(""))
+
+	messages, _, err := stores[leader].GetMessages("jobs", 10, 0)
+	assert.Nil(t, err)
+	assert.Len(t, messages, 1)
+}
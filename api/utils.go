@@ -18,9 +18,11 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/st3fan/tqsd/tqs"
 )
@@ -36,20 +38,62 @@ func getIntParameter(r *http.Request, name string, def int) (int, error) {
 	return strconv.Atoi(values[0])
 }
 
-func getMaxNumberOfMessages(r *http.Request) (int, error) {
+func getMaxNumberOfMessages(r *http.Request, max int) (int, error) {
 	if v, err := getIntParameter(r, "MaxNumberOfMessages", tqs.DefaultMaxNumberOfMessages); err == nil {
-		if v >= tqs.MinMaxNumberOfMessages && v <= tqs.MaxMaxNumberOfMessages {
+		if v >= tqs.MinMaxNumberOfMessages && v <= max {
 			return v, nil
 		}
 	}
 	return 0, fmt.Errorf("Invalid MaxNumberOfMessages parameter")
 }
 
+// getLeaseDuration returns 0 when the parameter is not present, which
+// means the lease duration of the queue.
 func getLeaseDuration(r *http.Request) (int, error) {
-	if v, err := getIntParameter(r, "LeaseDuration", 0); err == nil { // TODO 0 or -1?
-		if v >= tqs.MinLeaseDuration && v <= tqs.MaxLeaseDuration {
+	if v, err := getIntParameter(r, "LeaseDuration", 0); err == nil {
+		if v == 0 || (v >= tqs.MinLeaseDuration && v <= tqs.MaxLeaseDuration) {
 			return v, nil
 		}
 	}
 	return 0, fmt.Errorf("Invalid LeaseDuration parameter")
 }
+
+func getWaitTimeSeconds(r *http.Request, max int) (int, error) {
+	if v, err := getIntParameter(r, "WaitTimeSeconds", 0); err == nil {
+		if v >= 0 && v <= max {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid WaitTimeSeconds parameter")
+}
+
+func getBoolParameter(r *http.Request, name string) (bool, error) {
+	values, ok := r.URL.Query()[name]
+	if !ok {
+		return false, nil
+	}
+	if len(values) != 1 {
+		return false, fmt.Errorf("Expected one <%s> parameter", name)
+	}
+	return strconv.ParseBool(values[0])
+}
+
+// disableReadTimeout lifts the server wide read timeout for handlers
+// that read large request bodies.
+func disableReadTimeout(w http.ResponseWriter) error {
+	err := http.NewResponseController(w).SetReadDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// disableWriteTimeout lifts the server wide write timeout for handlers
+// that stream large responses.
+func disableWriteTimeout(w http.ResponseWriter) error {
+	err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Package client talks to a tqsd server over its HTTP API.
+//
+//	c, err := client.New("http://localhost:8080")
+//	if err != nil {
+//		return err
+//	}
+//
+//	_, err = c.SendMessages(ctx, "jobs", client.Message{Body: "hello"})
+//	...
+//	messages, err := c.ReceiveMessages(ctx, "jobs", client.ReceiveOptions{WaitTime: 10 * time.Second})
+//	for _, message := range messages {
+//		...
+//		c.DeleteLease(ctx, "jobs", message.Lease.ID)
+//	}
+//
+// Requests that fail because the server is unavailable, or because it
+// cannot be reached, are retried with exponential backoff until the
+// context is done or the retries run out. Sends are only retried when
+// the server certainly did not get them.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetries    = 3
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 5 * time.Second
+
+	maxErrorLength = 1024
+)
+
+// Client is a tqsd client. It is safe for concurrent use.
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	token      string
+	retries    int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient makes the client send its requests with httpClient
+// instead of http.DefaultClient.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithToken sends token as a bearer token with every request.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithRetries sets how many times a failed request is retried. Zero
+// disables retries.
+func WithRetries(retries int) Option {
+	return func(c *Client) {
+		c.retries = retries
+	}
+}
+
+// WithBackoff sets the time to wait before the first retry, which
+// doubles for every next retry up to max.
+func WithBackoff(min, max time.Duration) Option {
+	return func(c *Client) {
+		c.minBackoff = min
+		c.maxBackoff = max
+	}
+}
+
+// New returns a client for the server at baseURL, like
+// http://localhost:8080.
+func New(baseURL string, options ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid base url <%s>: scheme must be http or https", baseURL)
+	}
+
+	c := &Client{
+		baseURL:    u,
+		httpClient: http.DefaultClient,
+		retries:    defaultRetries,
+		minBackoff: defaultMinBackoff,
+		maxBackoff: defaultMaxBackoff,
+	}
+
+	for _, option := range options {
+		option(c)
+	}
+
+	return c, nil
+}
+
+//
+
+// request describes a call to the API. notFound is the error that a 404
+// response maps to, because it means something else for every call.
+type request struct {
+	method   string
+	path     string
+	query    url.Values
+	body     interface{}
+	notFound error
+}
+
+func (c *Client) do(ctx context.Context, r request, response interface{}) error {
+	var body []byte
+	if r.body != nil {
+		encoded, err := json.Marshal(r.body)
+		if err != nil {
+			return err
+		}
+		body = encoded
+	}
+
+	backoff := c.minBackoff
+	for attempt := 0; ; attempt++ {
+		err := c.roundTrip(ctx, r, body, response)
+		if err == nil || attempt >= c.retries || ctx.Err() != nil || !retryable(r.method, err) {
+			return err
+		}
+
+		// Full jitter, so that clients that failed together do not
+		// all come back at the same time
+		wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if backoff *= 2; backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+}
+
+func (c *Client) roundTrip(ctx context.Context, r request, body []byte, response interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	resp, err := c.stream(ctx, r, reader, "application/json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if response == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return fmt.Errorf("cannot decode response: %w", err)
+	}
+
+	return nil
+}
+
+// stream sends a request with body as it is and returns the response
+// for the caller to read, if it is a success.
+func (c *Client) stream(ctx context.Context, r request, body io.Reader, contentType string) (*http.Response, error) {
+	u := *c.baseURL
+	u.Path += r.path
+	u.RawQuery = r.query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, r.method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorLength))
+		return nil, newError(resp.StatusCode, message, r.notFound)
+	}
+
+	return resp, nil
+}
+
+// retryable tells if a request can be sent again after it failed with
+// err. A server that is unavailable or busy did not do anything, but
+// when the connection fails a POST may have been done already, and
+// sending it again could for example send a message twice. The same
+// goes for a bad gateway or a gateway timeout, which a node of a
+// cluster answers when forwarding to the leader failed, possibly after
+// the leader did the work.
+func retryable(method string, err error) bool {
+	if e, ok := err.(*Error); ok {
+		switch e.StatusCode {
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			return true
+		case http.StatusBadGateway, http.StatusGatewayTimeout:
+			return method != http.MethodPost
+		}
+		return false
+	}
+	return method != http.MethodPost
+}
@@ -0,0 +1,211 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/st3fan/tqsd/client"
+	"github.com/st3fan/tqsd/tqs"
+	"github.com/st3fan/tqsd/tqstest"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestClient(t *testing.T, options ...tqstest.ServerOption) (*client.Client, *tqstest.Server) {
+	server := tqstest.NewServer(t, options...)
+	c, err := client.New(server.URL, client.WithHTTPClient(server.Client))
+	if err != nil {
+		t.Fatal("Cannot create client: ", err)
+	}
+	return c, server
+}
+
+func Test_Queues(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+
+	queue, err := c.CreateQueue(ctx, "jobs", client.QueueSettings{LeaseDuration: 60})
+	assert.Nil(t, err)
+	assert.Equal(t, "jobs", queue.Name)
+	assert.Equal(t, 60, queue.LeaseDuration)
+	assert.False(t, queue.Created.IsZero())
+
+	_, err = c.CreateQueue(ctx, "jobs", client.QueueSettings{})
+	assert.True(t, errors.Is(err, client.ErrQueueExists))
+
+	queues, err := c.ListQueues(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, queues, 1)
+
+	queue, err = c.GetQueue(ctx, "jobs")
+	assert.Nil(t, err)
+	assert.Equal(t, 60, queue.LeaseDuration)
+
+	delay, noDelay := 30, 0
+	settings, err := c.UpdateQueue(ctx, "jobs", client.QueueSettingsUpdate{DelaySeconds: &delay})
+	assert.Nil(t, err)
+	assert.Equal(t, 60, settings.LeaseDuration)
+	assert.Equal(t, 30, settings.DelaySeconds)
+
+	settings, err = c.UpdateQueue(ctx, "jobs", client.QueueSettingsUpdate{DelaySeconds: &noDelay})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, settings.DelaySeconds)
+
+	_, err = c.GetQueueStatistics(ctx, "jobs")
+	assert.Nil(t, err)
+
+	assert.Nil(t, c.PurgeQueue(ctx, "jobs"))
+	assert.Nil(t, c.DeleteQueue(ctx, "jobs"))
+
+	_, err = c.GetQueue(ctx, "jobs")
+	assert.True(t, errors.Is(err, client.ErrQueueNotFound))
+
+	var e *client.Error
+	if assert.True(t, errors.As(err, &e)) {
+		assert.Equal(t, http.StatusNotFound, e.StatusCode)
+	}
+}
+
+func Test_Messages(t *testing.T) {
+	c, _ := newTestClient(t, tqstest.WithQueue("jobs"))
+	ctx := context.Background()
+
+	ids, err := c.SendMessages(ctx, "jobs", client.Message{Body: "One"}, client.Message{Body: "Two"})
+	assert.Nil(t, err)
+	assert.Len(t, ids, 2)
+	assert.NotEqual(t, client.MessageID{}, ids[0])
+
+	messages, err := c.ReceiveMessages(ctx, "jobs", client.ReceiveOptions{MaxNumberOfMessages: 10})
+	assert.Nil(t, err)
+	if !assert.Len(t, messages, 2) {
+		return
+	}
+	assert.Equal(t, "One", messages[0].Body)
+
+	lease, err := c.ExtendLease(ctx, "jobs", messages[0].Lease.ID, 120)
+	assert.Nil(t, err)
+	assert.Equal(t, messages[0].Lease.ID, lease.ID)
+	assert.True(t, lease.Expiration.After(messages[0].Lease.Expiration))
+
+	assert.Nil(t, c.DeleteLease(ctx, "jobs", messages[0].Lease.ID))
+	assert.True(t, errors.Is(c.DeleteLease(ctx, "jobs", messages[0].Lease.ID), client.ErrLeaseNotFound))
+
+	assert.Nil(t, c.ReleaseLease(ctx, "jobs", messages[1].Lease.ID))
+
+	messages, err = c.ReceiveMessages(ctx, "jobs", client.ReceiveOptions{})
+	assert.Nil(t, err)
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "Two", messages[0].Body)
+	}
+
+	_, err = c.SendMessages(ctx, "nope", client.Message{Body: "One"})
+	assert.True(t, errors.Is(err, client.ErrQueueNotFound))
+}
+
+func Test_LongPoll(t *testing.T) {
+	c, _ := newTestClient(t, tqstest.WithQueue("jobs"))
+	ctx := context.Background()
+
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		c.SendMessages(ctx, "jobs", client.Message{Body: "Late"})
+	}()
+
+	messages, err := c.ReceiveMessages(ctx, "jobs", client.ReceiveOptions{WaitTime: 5 * time.Second})
+	assert.Nil(t, err)
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "Late", messages[0].Body)
+	}
+}
+
+func Test_Retry(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			http.Error(w, "store is not the leader", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"Name":"jobs"}`))
+	}))
+	defer server.Close()
+
+	c, err := client.New(server.URL, client.WithBackoff(time.Millisecond, 10*time.Millisecond))
+	assert.Nil(t, err)
+
+	queue, err := c.GetQueue(context.Background(), "jobs")
+	assert.Nil(t, err)
+	assert.Equal(t, "jobs", queue.Name)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	c, err = client.New(server.URL, client.WithRetries(0))
+	assert.Nil(t, err)
+
+	atomic.StoreInt32(&requests, 0)
+	_, err = c.GetQueue(context.Background(), "jobs")
+	assert.True(t, errors.Is(err, client.ErrUnavailable))
+}
+
+func Test_NoRetryAfterBadGateway(t *testing.T) {
+	store := tqstest.NewServer(t, tqstest.WithQueue("jobs")).Store
+
+	// Like a node that forwarded to the leader, which sent the message
+	// before the connection to it failed
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Method == http.MethodPost {
+			_, err := store.PutMessages("jobs", []tqs.Message{{Body: "Hello"}})
+			assert.Nil(t, err)
+		}
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	c, err := client.New(server.URL, client.WithBackoff(time.Millisecond, 10*time.Millisecond))
+	assert.Nil(t, err)
+
+	_, err = c.SendMessages(context.Background(), "jobs", client.Message{Body: "Hello"})
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	messages, _, err := store.GetMessages("jobs", 10, 0)
+	assert.Nil(t, err)
+	assert.Len(t, messages, 1)
+
+	// Reads are retried
+	atomic.StoreInt32(&requests, 0)
+	_, err = c.GetQueue(context.Background(), "jobs")
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&requests))
+}
+
+func Test_ParseLeaseID(t *testing.T) {
+	id, err := client.ParseLeaseID("0102030405060708090a0b0c0d0e0f1011")
+	assert.Nil(t, err)
+	assert.Equal(t, client.LeaseID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17}, id)
+	assert.Equal(t, "0102030405060708090a0b0c0d0e0f1011", id.String())
+
+	_, err = client.ParseLeaseID("0102")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,79 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrQueueNotFound = errors.New("queue not found")
+	ErrQueueExists   = errors.New("queue already exists")
+	ErrLeaseNotFound = errors.New("lease not found")
+	ErrBadRequest    = errors.New("bad request")
+	ErrUnauthorized  = errors.New("unauthorized")
+	ErrForbidden     = errors.New("forbidden")
+	ErrUnavailable   = errors.New("server unavailable")
+)
+
+// Error is returned for responses that are not a success. It wraps one
+// of the errors above when the status code has a meaning in the API,
+// so callers can check for them with errors.Is.
+type Error struct {
+	StatusCode int
+	Message    string
+	err        error
+}
+
+func newError(statusCode int, body []byte, notFound error) *Error {
+	e := &Error{
+		StatusCode: statusCode,
+		Message:    strings.TrimSpace(string(body)),
+	}
+
+	switch statusCode {
+	case http.StatusBadRequest:
+		e.err = ErrBadRequest
+	case http.StatusUnauthorized:
+		e.err = ErrUnauthorized
+	case http.StatusForbidden:
+		e.err = ErrForbidden
+	case http.StatusNotFound:
+		e.err = notFound
+	case http.StatusConflict:
+		e.err = ErrQueueExists
+	case http.StatusServiceUnavailable:
+		e.err = ErrUnavailable
+	}
+
+	return e
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("tqsd: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("tqsd: %d %s", e.StatusCode, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,79 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ImportOptions controls how ImportQueue restores messages.
+type ImportOptions struct {
+	// PreserveIDs keeps the exported message and lease IDs
+	PreserveIDs bool
+	// ResetLeases makes leased messages visible instead of restoring
+	// their leases
+	ResetLeases bool
+}
+
+// ExportQueue writes all messages of a queue to w, as the JSON Lines
+// that ImportQueue reads. Exports are streamed and never retried.
+func (c *Client) ExportQueue(ctx context.Context, name string, w io.Writer) (int64, error) {
+	resp, err := c.stream(ctx, request{method: http.MethodGet, path: queuePath(name) + "/export", notFound: ErrQueueNotFound}, nil, "")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	return io.Copy(w, resp.Body)
+}
+
+// ImportQueue adds the messages in r, an export, to a queue and returns
+// how many there were. When the import fails halfway it returns how
+// many messages were imported before it stopped, with the error.
+// Imports are streamed and never retried.
+func (c *Client) ImportQueue(ctx context.Context, name string, r io.Reader, options ImportOptions) (int, error) {
+	query := url.Values{
+		"PreserveIDs": {strconv.FormatBool(options.PreserveIDs)},
+		"ResetLeases": {strconv.FormatBool(options.ResetLeases)},
+	}
+
+	var response struct{ Imported int }
+
+	resp, err := c.stream(ctx, request{method: http.MethodPost, path: queuePath(name) + "/import", query: query, notFound: ErrQueueNotFound}, r, "application/x-ndjson")
+	if err != nil {
+		var e *Error
+		if errors.As(err, &e) {
+			json.Unmarshal([]byte(e.Message), &response)
+		}
+		return response.Imported, err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return 0, fmt.Errorf("cannot decode response: %w", err)
+	}
+
+	return response.Imported, nil
+}
@@ -0,0 +1,118 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type sendMessagesRequest struct {
+	Messages []Message
+}
+
+type sendMessagesResponse struct {
+	MessageIDs []MessageID
+}
+
+// SendMessages adds messages to a queue and returns their IDs. Sends
+// are not retried when the connection fails, because the server may
+// have stored the messages already.
+func (c *Client) SendMessages(ctx context.Context, queue string, messages ...Message) ([]MessageID, error) {
+	var response sendMessagesResponse
+	err := c.do(ctx, request{method: http.MethodPost, path: queuePath(queue) + "/messages", body: sendMessagesRequest{messages}, notFound: ErrQueueNotFound}, &response)
+	return response.MessageIDs, err
+}
+
+// MaxNumberOfMessages is the most messages that the server returns
+// from one ReceiveMessages call.
+const MaxNumberOfMessages = 25
+
+// ReceiveOptions controls what ReceiveMessages asks for. Zero values
+// are left to the server.
+type ReceiveOptions struct {
+	// MaxNumberOfMessages is the most messages to return
+	MaxNumberOfMessages int
+	// LeaseDuration in seconds, the default is the setting of the queue
+	LeaseDuration int
+	// WaitTime is how long the server waits for messages when the
+	// queue is empty. It is rounded down to whole seconds.
+	WaitTime time.Duration
+}
+
+type receiveMessagesResponse struct {
+	Messages []Message
+	Leases   []Lease
+}
+
+// ReceiveMessages leases messages from a queue. Each message has to be
+// deleted with DeleteLease before its lease expires, or it will be
+// received again.
+func (c *Client) ReceiveMessages(ctx context.Context, queue string, options ReceiveOptions) ([]ReceivedMessage, error) {
+	query := url.Values{}
+	if options.MaxNumberOfMessages != 0 {
+		query.Set("MaxNumberOfMessages", strconv.Itoa(options.MaxNumberOfMessages))
+	}
+	if options.LeaseDuration != 0 {
+		query.Set("LeaseDuration", strconv.Itoa(options.LeaseDuration))
+	}
+	if options.WaitTime != 0 {
+		query.Set("WaitTimeSeconds", strconv.Itoa(int(options.WaitTime/time.Second)))
+	}
+
+	var response receiveMessagesResponse
+	err := c.do(ctx, request{method: http.MethodGet, path: queuePath(queue) + "/messages", query: query, notFound: ErrQueueNotFound}, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]ReceivedMessage, 0, len(response.Messages))
+	for i := range response.Messages {
+		if i < len(response.Leases) {
+			messages = append(messages, ReceivedMessage{Message: response.Messages[i], Lease: response.Leases[i]})
+		}
+	}
+
+	return messages, nil
+}
+
+// DeleteLease deletes a received message from the queue.
+func (c *Client) DeleteLease(ctx context.Context, queue string, leaseID LeaseID) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: leasePath(queue, leaseID), notFound: ErrLeaseNotFound}, nil)
+}
+
+// ExtendLease gives the receiver leaseDuration more seconds, counted
+// from now, to process a message.
+func (c *Client) ExtendLease(ctx context.Context, queue string, leaseID LeaseID, leaseDuration int) (Lease, error) {
+	query := url.Values{"LeaseDuration": {strconv.Itoa(leaseDuration)}}
+	var lease Lease
+	return lease, c.do(ctx, request{method: http.MethodPost, path: leasePath(queue, leaseID) + "/extend", query: query, notFound: ErrLeaseNotFound}, &lease)
+}
+
+// ReleaseLease makes a received message visible again right away, for
+// receivers that cannot process it.
+func (c *Client) ReleaseLease(ctx context.Context, queue string, leaseID LeaseID) error {
+	return c.do(ctx, request{method: http.MethodPost, path: leasePath(queue, leaseID) + "/release", notFound: ErrLeaseNotFound}, nil)
+}
+
+func leasePath(queue string, leaseID LeaseID) string {
+	return queuePath(queue) + "/leases/" + leaseID.String()
+}
@@ -0,0 +1,94 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type createQueueRequest struct {
+	Name     string
+	Settings QueueSettings
+}
+
+type createQueueResponse struct {
+	Meta struct {
+		Name    string
+		Created time.Time
+	}
+	Settings QueueSettings
+}
+
+// CreateQueue creates a queue. It returns ErrQueueExists if there
+// already is a queue with that name.
+func (c *Client) CreateQueue(ctx context.Context, name string, settings QueueSettings) (Queue, error) {
+	var response createQueueResponse
+	err := c.do(ctx, request{method: http.MethodPost, path: "/queues", body: createQueueRequest{name, settings}}, &response)
+	if err != nil {
+		return Queue{}, err
+	}
+	return Queue{
+		Name:                   response.Meta.Name,
+		Created:                response.Meta.Created,
+		LeaseDuration:          response.Settings.LeaseDuration,
+		MessageRetentionPeriod: response.Settings.MessageRetentionPeriod,
+		DelaySeconds:           response.Settings.DelaySeconds,
+	}, nil
+}
+
+// ListQueues returns all queues.
+func (c *Client) ListQueues(ctx context.Context) ([]Queue, error) {
+	var queues []Queue
+	return queues, c.do(ctx, request{method: http.MethodGet, path: "/queues"}, &queues)
+}
+
+// GetQueue returns the settings of a queue.
+func (c *Client) GetQueue(ctx context.Context, name string) (Queue, error) {
+	var queue Queue
+	return queue, c.do(ctx, request{method: http.MethodGet, path: queuePath(name), notFound: ErrQueueNotFound}, &queue)
+}
+
+// UpdateQueue changes the settings of a queue that are set in settings
+// and returns all its settings.
+func (c *Client) UpdateQueue(ctx context.Context, name string, settings QueueSettingsUpdate) (QueueSettings, error) {
+	var updated QueueSettings
+	return updated, c.do(ctx, request{method: http.MethodPatch, path: queuePath(name) + "/settings", body: settings, notFound: ErrQueueNotFound}, &updated)
+}
+
+// DeleteQueue deletes a queue and all its messages.
+func (c *Client) DeleteQueue(ctx context.Context, name string) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: queuePath(name), notFound: ErrQueueNotFound}, nil)
+}
+
+// PurgeQueue deletes all messages in a queue.
+func (c *Client) PurgeQueue(ctx context.Context, name string) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: queuePath(name) + "/messages", notFound: ErrQueueNotFound}, nil)
+}
+
+// GetQueueStatistics returns the statistics of a queue.
+func (c *Client) GetQueueStatistics(ctx context.Context, name string) (QueueStatistics, error) {
+	var statistics QueueStatistics
+	return statistics, c.do(ctx, request{method: http.MethodGet, path: queuePath(name) + "/statistics", notFound: ErrQueueNotFound}, &statistics)
+}
+
+func queuePath(name string) string {
+	return "/queues/" + url.PathEscape(name)
+}
@@ -0,0 +1,143 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package client
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// MessageID identifies a message. The API encodes it as a hex string.
+type MessageID [9]byte
+
+func (id MessageID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id MessageID) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + id.String() + `"`), nil
+}
+
+func (id *MessageID) UnmarshalJSON(data []byte) error {
+	return unmarshalHexID(data, id[:])
+}
+
+// LeaseID identifies the lease on a received message. The API encodes
+// it as a hex string.
+type LeaseID [17]byte
+
+func (id LeaseID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id LeaseID) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + id.String() + `"`), nil
+}
+
+func (id *LeaseID) UnmarshalJSON(data []byte) error {
+	return unmarshalHexID(data, id[:])
+}
+
+// MessageID returns the ID of the message that the lease is for.
+func (id LeaseID) MessageID() MessageID {
+	var messageID MessageID
+	copy(messageID[:], id[:len(messageID)])
+	return messageID
+}
+
+// ParseLeaseID decodes a lease ID from its hex form.
+func ParseLeaseID(s string) (LeaseID, error) {
+	var id LeaseID
+	return id, unmarshalHexID([]byte(`"`+s+`"`), id[:])
+}
+
+func unmarshalHexID(data []byte, id []byte) error {
+	if len(data) != hex.EncodedLen(len(id))+2 || data[0] != '"' || data[len(data)-1] != '"' {
+		return fmt.Errorf("invalid id <%s>", data)
+	}
+	if _, err := hex.Decode(id, data[1:len(data)-1]); err != nil {
+		return fmt.Errorf("invalid id <%s>: %w", data, err)
+	}
+	return nil
+}
+
+//
+
+// QueueSettings are the settings of a queue. Zero values are left to
+// the server default when creating a queue.
+type QueueSettings struct {
+	LeaseDuration          int `json:",omitempty"`
+	MessageRetentionPeriod int `json:",omitempty"`
+	DelaySeconds           int `json:",omitempty"`
+}
+
+// QueueSettingsUpdate has the settings that UpdateQueue changes.
+// Settings that are nil are left alone, so that a setting can also be
+// changed to zero.
+type QueueSettingsUpdate struct {
+	LeaseDuration          *int `json:",omitempty"`
+	MessageRetentionPeriod *int `json:",omitempty"`
+	DelaySeconds           *int `json:",omitempty"`
+}
+
+// Queue describes a queue.
+type Queue struct {
+	Name                   string
+	Created                time.Time
+	LeaseDuration          int
+	MessageRetentionPeriod int
+	DelaySeconds           int
+}
+
+// QueueStatistics counts what happened to the messages of a queue.
+type QueueStatistics struct {
+	Sends          uint64
+	Receives       uint64
+	Deletes        uint64
+	LeaseExpires   uint64
+	MessageExpires uint64
+	Quarantined    uint64
+}
+
+// MessageSettings override the settings of the queue for one message.
+type MessageSettings struct {
+	Priority               int
+	LeaseDuration          int
+	MessageRetentionPeriod int
+	DelaySeconds           int
+}
+
+// Message is a message to send.
+type Message struct {
+	Body     string
+	Settings MessageSettings
+}
+
+// Lease gives the receiver of a message the time until Expiration to
+// delete it, before it is handed out again.
+type Lease struct {
+	ID         LeaseID
+	Expiration time.Time
+}
+
+// ReceivedMessage is a message together with its lease.
+type ReceivedMessage struct {
+	Message
+	Lease Lease
+}
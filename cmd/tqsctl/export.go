@@ -0,0 +1,90 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/st3fan/tqsd/client"
+)
+
+func exportCommand(cli *cli, args []string) int {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	path := flags.String("file", "", "file to write the export to (default: stdout)")
+	name, _, ok := queueArgument(flags, args)
+	if !ok {
+		return 2
+	}
+
+	var w io.Writer = os.Stdout
+	if *path != "" {
+		file, err := os.Create(*path)
+		if err != nil {
+			return fail("Cannot create export", err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	if _, err := cli.client.ExportQueue(cli.ctx, name, w); err != nil {
+		return fail("Cannot export queue", err)
+	}
+
+	return 0
+}
+
+func importCommand(cli *cli, args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	path := flags.String("file", "", "file to read the export from (default: stdin)")
+	preserveIDs := flags.Bool("preserve-ids", false, "keep the exported message and lease ids")
+	resetLeases := flags.Bool("reset-leases", false, "make leased messages visible again")
+	name, _, ok := queueArgument(flags, args)
+	if !ok {
+		return 2
+	}
+
+	var r io.Reader = os.Stdin
+	if *path != "" {
+		file, err := os.Open(*path)
+		if err != nil {
+			return fail("Cannot open export", err)
+		}
+		defer file.Close()
+		r = file
+	}
+
+	imported, err := cli.client.ImportQueue(cli.ctx, name, r, client.ImportOptions{
+		PreserveIDs: *preserveIDs,
+		ResetLeases: *resetLeases,
+	})
+	if err != nil {
+		if imported != 0 {
+			fmt.Fprintf(os.Stderr, "Imported %d messages before the import stopped\n", imported)
+		}
+		return fail("Cannot import queue", err)
+	}
+
+	cli.print(struct{ Imported int }{imported}, func(w io.Writer) {
+		fmt.Fprintf(w, "Imported %d messages\n", imported)
+	})
+
+	return 0
+}
@@ -0,0 +1,200 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Command tqsctl administers a tqsd server through its API.
+//
+//	tqsctl [-server url] [-token token] [-output table|json] command [arguments]
+//
+// The server is taken from the -server flag, the TQSCTL_SERVER
+// environment variable or the config file, in that order. The config
+// file is JSON, like {"Server": "http://tqsd:8080", "Token": "secret"},
+// and lives in tqsctl/config.json under the user config directory
+// unless -config says otherwise.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/st3fan/tqsd/client"
+)
+
+const defaultServer = "http://localhost:8080"
+
+type command struct {
+	run   func(cli *cli, args []string) int
+	usage string
+}
+
+var commands = map[string]command{
+	"list":    {listCommand, "list queues"},
+	"create":  {createCommand, "create a queue"},
+	"inspect": {inspectCommand, "show the settings and statistics of a queue"},
+	"update":  {updateCommand, "change the settings of a queue"},
+	"delete":  {deleteCommand, "delete a queue and its messages"},
+	"purge":   {purgeCommand, "delete all messages in a queue"},
+	"stats":   {statsCommand, "show the statistics of a queue"},
+	"send":    {sendCommand, "send messages from stdin or files"},
+	"receive": {receiveCommand, "receive messages"},
+	"ack":     {ackCommand, "delete received messages by lease id"},
+	"tail":    {tailCommand, "print messages as they arrive"},
+	"export":  {exportCommand, "export the messages of a queue"},
+	"import":  {importCommand, "import messages into a queue"},
+}
+
+type config struct {
+	Server string
+	Token  string
+}
+
+// cli is what every command needs.
+type cli struct {
+	ctx    context.Context
+	client *client.Client
+	output string
+}
+
+func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	flag.Usage = usage
+
+	server := flag.String("server", "", "URL of the tqsd server (default "+defaultServer+")")
+	token := flag.String("token", "", "bearer token to send to the server")
+	output := flag.String("output", "table", "output format, table or json")
+	configPath := flag.String("config", "", "path to the config file")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		return 2
+	}
+
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command <%s>\n", flag.Arg(0))
+		usage()
+		return 2
+	}
+
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "Unknown output format <%s>\n", *output)
+		return 2
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot load config:", err)
+		return 1
+	}
+
+	cfg.Server = firstOf(*server, os.Getenv("TQSCTL_SERVER"), cfg.Server, defaultServer)
+	cfg.Token = firstOf(*token, os.Getenv("TQSCTL_TOKEN"), cfg.Token)
+
+	c, err := client.New(cfg.Server, client.WithToken(cfg.Token))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot create client:", err)
+		return 1
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	return command.run(&cli{ctx: ctx, client: c, output: *output}, flag.Args()[1:])
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: tqsctl [flags] command [arguments]\n\nCommands:\n")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s  %s\n", name, commands[name].usage)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// loadConfig reads the config file at path, or at the default location
+// if path is empty. Only a config file that was asked for has to exist.
+func loadConfig(path string) (config, error) {
+	var cfg config
+
+	explicit := path != ""
+	if !explicit {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return cfg, nil
+		}
+		path = filepath.Join(dir, "tqsctl", "config.json")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return cfg, nil
+		}
+		return cfg, err
+	}
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+func firstOf(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// fail reports an error of a command and returns the exit code for it.
+func fail(message string, err error) int {
+	fmt.Fprintln(os.Stderr, message+":", err)
+	return 1
+}
+
+// queueArgument parses the flags of a command that takes a queue name
+// as its first argument, and returns the name and the other arguments.
+func queueArgument(flags *flag.FlagSet, args []string) (string, []string, bool) {
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: tqsctl %s [flags] queue\n", flags.Name())
+		flags.PrintDefaults()
+		return "", nil, false
+	}
+	return flags.Arg(0), flags.Args()[1:], true
+}
@@ -0,0 +1,195 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/st3fan/tqsd/client"
+)
+
+const sendBatchSize = 32
+
+// sendCommand sends every file as one message, or every line of stdin
+// when there are no files.
+func sendCommand(cli *cli, args []string) int {
+	flags := flag.NewFlagSet("send", flag.ExitOnError)
+	priority := flags.Int("priority", 0, "priority of the messages")
+	name, files, ok := queueArgument(flags, args)
+	if !ok {
+		return 2
+	}
+
+	var bodies []string
+	if len(files) == 0 {
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "" {
+				bodies = append(bodies, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fail("Cannot read stdin", err)
+		}
+	} else {
+		for _, file := range files {
+			body, err := os.ReadFile(file)
+			if err != nil {
+				return fail("Cannot read message", err)
+			}
+			bodies = append(bodies, string(body))
+		}
+	}
+
+	var ids []client.MessageID
+	for len(bodies) > 0 {
+		n := len(bodies)
+		if n > sendBatchSize {
+			n = sendBatchSize
+		}
+
+		messages := make([]client.Message, n)
+		for i := range messages {
+			messages[i] = client.Message{Body: bodies[i], Settings: client.MessageSettings{Priority: *priority}}
+		}
+
+		sent, err := cli.client.SendMessages(cli.ctx, name, messages...)
+		if err != nil {
+			return fail("Cannot send messages", err)
+		}
+
+		ids = append(ids, sent...)
+		bodies = bodies[n:]
+	}
+
+	cli.print(ids, func(w io.Writer) {
+		for _, id := range ids {
+			fmt.Fprintln(w, id)
+		}
+	})
+
+	return 0
+}
+
+func receiveCommand(cli *cli, args []string) int {
+	flags := flag.NewFlagSet("receive", flag.ExitOnError)
+	count := flags.Int("n", 1, "maximum number of messages to receive")
+	leaseDuration := flags.Int("lease-duration", 0, "lease duration in seconds (default: the setting of the queue)")
+	wait := flags.Duration("wait", 0, "time to wait for messages when the queue is empty")
+	ack := flags.Bool("ack", false, "delete the messages after printing them")
+	name, _, ok := queueArgument(flags, args)
+	if !ok {
+		return 2
+	}
+
+	messages, err := cli.client.ReceiveMessages(cli.ctx, name, client.ReceiveOptions{
+		MaxNumberOfMessages: *count,
+		LeaseDuration:       *leaseDuration,
+		WaitTime:            *wait,
+	})
+	if err != nil {
+		return fail("Cannot receive messages", err)
+	}
+
+	cli.print(messages, func(w io.Writer) {
+		fmt.Fprintln(w, "LEASE\tEXPIRATION\tBODY")
+		for _, message := range messages {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", message.Lease.ID, formatTime(message.Lease.Expiration), message.Body)
+		}
+	})
+
+	if *ack {
+		for _, message := range messages {
+			if err := cli.client.DeleteLease(cli.ctx, name, message.Lease.ID); err != nil {
+				return fail("Cannot delete message", err)
+			}
+		}
+	}
+
+	return 0
+}
+
+func ackCommand(cli *cli, args []string) int {
+	flags := flag.NewFlagSet("ack", flag.ExitOnError)
+	name, leases, ok := queueArgument(flags, args)
+	if !ok {
+		return 2
+	}
+
+	for _, lease := range leases {
+		leaseID, err := client.ParseLeaseID(lease)
+		if err != nil {
+			return fail("Invalid lease id", err)
+		}
+		if err := cli.client.DeleteLease(cli.ctx, name, leaseID); err != nil {
+			return fail("Cannot delete message", err)
+		}
+	}
+
+	return 0
+}
+
+// tailCommand prints messages as they arrive until it is interrupted.
+// It consumes them, unless -keep leaves their leases to expire so that
+// they are received again later.
+func tailCommand(cli *cli, args []string) int {
+	flags := flag.NewFlagSet("tail", flag.ExitOnError)
+	keep := flags.Bool("keep", false, "do not delete the messages")
+	name, _, ok := queueArgument(flags, args)
+	if !ok {
+		return 2
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+
+	for cli.ctx.Err() == nil {
+		messages, err := cli.client.ReceiveMessages(cli.ctx, name, client.ReceiveOptions{
+			MaxNumberOfMessages: sendBatchSize,
+			WaitTime:            10 * time.Second,
+		})
+		if err != nil {
+			if cli.ctx.Err() != nil {
+				break
+			}
+			return fail("Cannot receive messages", err)
+		}
+
+		for _, message := range messages {
+			if cli.output == "json" {
+				encoder.Encode(message)
+			} else {
+				fmt.Println(message.Body)
+			}
+
+			if !*keep {
+				if err := cli.client.DeleteLease(cli.ctx, name, message.Lease.ID); err != nil && cli.ctx.Err() == nil {
+					return fail("Cannot delete message", err)
+				}
+			}
+		}
+	}
+
+	return 0
+}
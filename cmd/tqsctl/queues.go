@@ -0,0 +1,203 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/st3fan/tqsd/client"
+)
+
+func listCommand(cli *cli, args []string) int {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	flags.Parse(args)
+
+	queues, err := cli.client.ListQueues(cli.ctx)
+	if err != nil {
+		return fail("Cannot list queues", err)
+	}
+
+	cli.print(queues, func(w io.Writer) {
+		fmt.Fprintln(w, "QUEUE\tCREATED\tLEASE\tRETENTION\tDELAY")
+		for _, q := range queues {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\n", q.Name, formatTime(q.Created), q.LeaseDuration, q.MessageRetentionPeriod, q.DelaySeconds)
+		}
+	})
+
+	return 0
+}
+
+func settingsFlags(flags *flag.FlagSet) *client.QueueSettings {
+	var settings client.QueueSettings
+	flags.IntVar(&settings.LeaseDuration, "lease-duration", 0, "lease duration in seconds")
+	flags.IntVar(&settings.MessageRetentionPeriod, "retention", 0, "message retention period in seconds")
+	flags.IntVar(&settings.DelaySeconds, "delay", 0, "delay of new messages in seconds")
+	return &settings
+}
+
+func createCommand(cli *cli, args []string) int {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	settings := settingsFlags(flags)
+	name, _, ok := queueArgument(flags, args)
+	if !ok {
+		return 2
+	}
+
+	queue, err := cli.client.CreateQueue(cli.ctx, name, *settings)
+	if err != nil {
+		return fail("Cannot create queue", err)
+	}
+
+	cli.print(queue, func(w io.Writer) {
+		fmt.Fprintf(w, "Created queue <%s>\n", queue.Name)
+	})
+
+	return 0
+}
+
+func updateCommand(cli *cli, args []string) int {
+	flags := flag.NewFlagSet("update", flag.ExitOnError)
+	settings := settingsFlags(flags)
+	name, _, ok := queueArgument(flags, args)
+	if !ok {
+		return 2
+	}
+
+	// Only the flags that were given are changed, so -delay 0 clears it
+	var update client.QueueSettingsUpdate
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "lease-duration":
+			update.LeaseDuration = &settings.LeaseDuration
+		case "retention":
+			update.MessageRetentionPeriod = &settings.MessageRetentionPeriod
+		case "delay":
+			update.DelaySeconds = &settings.DelaySeconds
+		}
+	})
+
+	updated, err := cli.client.UpdateQueue(cli.ctx, name, update)
+	if err != nil {
+		return fail("Cannot update queue", err)
+	}
+
+	cli.print(updated, func(w io.Writer) {
+		printSettings(w, updated)
+	})
+
+	return 0
+}
+
+type queueDetails struct {
+	client.Queue
+	Statistics client.QueueStatistics
+}
+
+func inspectCommand(cli *cli, args []string) int {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	name, _, ok := queueArgument(flags, args)
+	if !ok {
+		return 2
+	}
+
+	queue, err := cli.client.GetQueue(cli.ctx, name)
+	if err != nil {
+		return fail("Cannot get queue", err)
+	}
+
+	statistics, err := cli.client.GetQueueStatistics(cli.ctx, name)
+	if err != nil {
+		return fail("Cannot get queue statistics", err)
+	}
+
+	cli.print(queueDetails{queue, statistics}, func(w io.Writer) {
+		fmt.Fprintf(w, "Name\t%s\n", queue.Name)
+		printSettings(w, client.QueueSettings{
+			LeaseDuration:          queue.LeaseDuration,
+			MessageRetentionPeriod: queue.MessageRetentionPeriod,
+			DelaySeconds:           queue.DelaySeconds,
+		})
+		printStatistics(w, statistics)
+	})
+
+	return 0
+}
+
+func printSettings(w io.Writer, settings client.QueueSettings) {
+	fmt.Fprintf(w, "LeaseDuration\t%d\n", settings.LeaseDuration)
+	fmt.Fprintf(w, "MessageRetentionPeriod\t%d\n", settings.MessageRetentionPeriod)
+	fmt.Fprintf(w, "DelaySeconds\t%d\n", settings.DelaySeconds)
+}
+
+func printStatistics(w io.Writer, statistics client.QueueStatistics) {
+	fmt.Fprintf(w, "Sends\t%d\n", statistics.Sends)
+	fmt.Fprintf(w, "Receives\t%d\n", statistics.Receives)
+	fmt.Fprintf(w, "Deletes\t%d\n", statistics.Deletes)
+	fmt.Fprintf(w, "LeaseExpires\t%d\n", statistics.LeaseExpires)
+	fmt.Fprintf(w, "MessageExpires\t%d\n", statistics.MessageExpires)
+	fmt.Fprintf(w, "Quarantined\t%d\n", statistics.Quarantined)
+}
+
+func statsCommand(cli *cli, args []string) int {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	name, _, ok := queueArgument(flags, args)
+	if !ok {
+		return 2
+	}
+
+	statistics, err := cli.client.GetQueueStatistics(cli.ctx, name)
+	if err != nil {
+		return fail("Cannot get queue statistics", err)
+	}
+
+	cli.print(statistics, func(w io.Writer) {
+		printStatistics(w, statistics)
+	})
+
+	return 0
+}
+
+func deleteCommand(cli *cli, args []string) int {
+	flags := flag.NewFlagSet("delete", flag.ExitOnError)
+	name, _, ok := queueArgument(flags, args)
+	if !ok {
+		return 2
+	}
+
+	if err := cli.client.DeleteQueue(cli.ctx, name); err != nil {
+		return fail("Cannot delete queue", err)
+	}
+
+	return 0
+}
+
+func purgeCommand(cli *cli, args []string) int {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	name, _, ok := queueArgument(flags, args)
+	if !ok {
+		return 2
+	}
+
+	if err := cli.client.PurgeQueue(cli.ctx, name); err != nil {
+		return fail("Cannot purge queue", err)
+	}
+
+	return 0
+}
@@ -0,0 +1,593 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/st3fan/tqsd/api"
+	"github.com/st3fan/tqsd/tqs"
+	"gopkg.in/yaml.v3"
+)
+
+// The configuration comes from, in order of precedence, the command
+// line flags, TQSD_ environment variables, the YAML file given with
+// -config or TQSD_CONFIG, and the defaults below. The environment
+// variable of a setting is named after its path in the file, so that
+// queues.lease_duration is TQSD_QUEUES_LEASE_DURATION. A file looks like:
+//
+//	listen:
+//	  port: 8443
+//	  tls:
+//	    cert: /etc/tqsd/cert.pem
+//	    key: /etc/tqsd/key.pem
+//	storage:
+//	  database: /var/lib/tqs.db
+//	queues:
+//	  lease_duration: 60
+//	auth:
+//	  require_api_key: true
+//	  api_keys_file: /etc/tqsd/keys.json
+//	provisioning:
+//	  queues:
+//	    - name: orders
+//	      lease_duration: 120
+//	    - name: emails
+//
+// On SIGHUP the file is read again. The log level, the API keys file,
+// the default queue settings and the TLS certificates are applied
+// right away, other changes need a restart.
+
+type config struct {
+	Listen      listenConfig      `yaml:"listen"`
+	Storage     storageConfig     `yaml:"storage"`
+	Replication replicationConfig `yaml:"replication"`
+	Cluster     clusterConfig     `yaml:"cluster"`
+	Tasks       tasksConfig       `yaml:"tasks"`
+	Limits      limitsConfig      `yaml:"limits"`
+	Queues      queuesConfig      `yaml:"queues"`
+	Log         logConfig         `yaml:"log"`
+	Auth        authConfig        `yaml:"auth"`
+
+	Provisioning provisioningConfig `yaml:"provisioning"`
+}
+
+type listenConfig struct {
+	Address      string        `yaml:"address"`
+	Port         int           `yaml:"port"`
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	DrainDelay   time.Duration `yaml:"drain_delay"`
+	TLS          tlsConfig     `yaml:"tls"`
+}
+
+type tlsConfig struct {
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"client_ca"`
+}
+
+type storageConfig struct {
+	Database string       `yaml:"database"`
+	DataDir  string       `yaml:"data_dir"`
+	Shards   int          `yaml:"shards"`
+	Backup   backupConfig `yaml:"backup"`
+}
+
+type backupConfig struct {
+	Dir       string        `yaml:"dir"`
+	Interval  time.Duration `yaml:"interval"`
+	Retention int           `yaml:"retention"`
+}
+
+type replicationConfig struct {
+	Address string `yaml:"address"`
+	Follow  string `yaml:"follow"`
+}
+
+type clusterConfig struct {
+	Node  string `yaml:"node"`
+	Peers string `yaml:"peers"`
+	Dir   string `yaml:"dir"`
+}
+
+type tasksConfig struct {
+	ExpireLeases   time.Duration `yaml:"expire_leases"`
+	ExpireMessages time.Duration `yaml:"expire_messages"`
+	MoveDelayed    time.Duration `yaml:"move_delayed"`
+}
+
+type limitsConfig struct {
+	MaxNumberOfMessages int   `yaml:"max_number_of_messages"`
+	MaxWaitTimeSeconds  int   `yaml:"max_wait_time_seconds"`
+	MaxMessageSize      int   `yaml:"max_message_size"`
+	MaxRequestSize      int64 `yaml:"max_request_size"`
+}
+
+type queuesConfig struct {
+	LeaseDuration          int `yaml:"lease_duration"`
+	MessageRetentionPeriod int `yaml:"message_retention_period"`
+	DelaySeconds           int `yaml:"delay_seconds"`
+}
+
+type logConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+type authConfig struct {
+	AdminToken    string `yaml:"admin_token"`
+	RequireAPIKey bool   `yaml:"require_api_key"`
+	APIKeysFile   string `yaml:"api_keys_file"`
+}
+
+// provisioningConfig declares queues that tqsd creates, or updates the
+// settings of, at startup. Settings that a queue does not declare are
+// those of the queues section. Queues that are not declared are only
+// deleted with prune. The store has no dead-letter queues, so a
+// dead_letter key is an unknown field like any other and the file is
+// rejected instead of silently provisioning queues without one.
+type provisioningConfig struct {
+	Prune  bool                  `yaml:"prune"`
+	Queues []declaredQueueConfig `yaml:"queues"`
+}
+
+type declaredQueueConfig struct {
+	Name                   string `yaml:"name"`
+	LeaseDuration          *int   `yaml:"lease_duration"`
+	MessageRetentionPeriod *int   `yaml:"message_retention_period"`
+	DelaySeconds           *int   `yaml:"delay_seconds"`
+}
+
+func defaultConfig() config {
+	return config{
+		Listen: listenConfig{
+			Address:      "0.0.0.0",
+			Port:         8080,
+			ReadTimeout:  api.DefaultServerTimeouts.Read,
+			WriteTimeout: api.DefaultServerTimeouts.Write,
+			IdleTimeout:  api.DefaultServerTimeouts.Idle,
+		},
+		Storage: storageConfig{
+			Database: "/var/lib/tqs.db",
+			Backup: backupConfig{
+				Interval:  6 * time.Hour,
+				Retention: 7,
+			},
+		},
+		Tasks: tasksConfig{
+			ExpireLeases:   tqs.DefaultTaskIntervals.ExpireLeases,
+			ExpireMessages: tqs.DefaultTaskIntervals.ExpireMessages,
+			MoveDelayed:    tqs.DefaultTaskIntervals.MoveDelayed,
+		},
+		Limits: limitsConfig{
+			MaxNumberOfMessages: api.DefaultRequestLimits.MaxNumberOfMessages,
+			MaxWaitTimeSeconds:  api.DefaultRequestLimits.MaxWaitTimeSeconds,
+			MaxMessageSize:      api.DefaultRequestLimits.MaxMessageSize,
+			MaxRequestSize:      api.DefaultRequestLimits.MaxRequestSize,
+		},
+		Queues: queuesConfig{
+			LeaseDuration:          tqs.DefaultLeaseDuration,
+			MessageRetentionPeriod: tqs.DefaultMessageRetentionPeriod,
+			DelaySeconds:           tqs.DefaultDelaySeconds,
+		},
+		Log: logConfig{
+			Level:  "info",
+			Format: "text",
+		},
+	}
+}
+
+//
+
+// configFlag is a command line flag that overrides a setting.
+type configFlag struct {
+	name    string
+	usage   string
+	setting func(c *config) interface{} // Pointer to the setting
+}
+
+var configFlags = []configFlag{
+	{"database", "path to the database file, or :memory: for a store that is not persisted", func(c *config) interface{} { return &c.Storage.Database }},
+	{"address", "address to bind to", func(c *config) interface{} { return &c.Listen.Address }},
+	{"port", "port to bind to", func(c *config) interface{} { return &c.Listen.Port }},
+	{"admin-token", "bearer token for the /admin endpoints, which are disabled without one", func(c *config) interface{} { return &c.Auth.AdminToken }},
+	{"require-api-key", "require an API key, created with the /admin/keys endpoints, for everything but /version and /admin", func(c *config) interface{} { return &c.Auth.RequireAPIKey }},
+	{"api-keys", "JSON file with API keys to accept in addition to those in the database, implies -require-api-key", func(c *config) interface{} { return &c.Auth.APIKeysFile }},
+	{"drain-delay", "time between failing /readyz and closing the listener on shutdown", func(c *config) interface{} { return &c.Listen.DrainDelay }},
+	{"tls-cert", "PEM file with the certificate to serve HTTPS with, reloaded on SIGHUP", func(c *config) interface{} { return &c.Listen.TLS.Cert }},
+	{"tls-key", "PEM file with the private key of -tls-cert", func(c *config) interface{} { return &c.Listen.TLS.Key }},
+	{"tls-client-ca", "PEM file with the CAs that client certificates must be signed by, enables mutual TLS", func(c *config) interface{} { return &c.Listen.TLS.ClientCA }},
+	{"backup-dir", "directory to write scheduled backups to", func(c *config) interface{} { return &c.Storage.Backup.Dir }},
+	{"backup-interval", "time between scheduled backups", func(c *config) interface{} { return &c.Storage.Backup.Interval }},
+	{"backup-retention", "number of scheduled backups to keep", func(c *config) interface{} { return &c.Storage.Backup.Retention }},
+	{"replication-address", "address to accept replication followers on, for example :8081", func(c *config) interface{} { return &c.Replication.Address }},
+	{"follow", "address of a leader to replicate from; the store is read-only until promoted", func(c *config) interface{} { return &c.Replication.Follow }},
+	{"cluster-node", "ID of this node, enables clustered mode", func(c *config) interface{} { return &c.Cluster.Node }},
+	{"cluster-peers", "all nodes of the cluster, as comma separated id=raft-address=api-address", func(c *config) interface{} { return &c.Cluster.Peers }},
+	{"cluster-dir", "directory for the Raft log and snapshots (default: the database path with .raft appended)", func(c *config) interface{} { return &c.Cluster.Dir }},
+	{"data-dir", "directory for a sharded store, used instead of -database", func(c *config) interface{} { return &c.Storage.DataDir }},
+	{"shards", "number of files a sharded store spreads new queues over, 0 gives every queue its own file", func(c *config) interface{} { return &c.Storage.Shards }},
+	{"log-level", "log messages at this level and above: debug, info, warn or error", func(c *config) interface{} { return &c.Log.Level }},
+	{"log-format", "log format, text or json", func(c *config) interface{} { return &c.Log.Format }},
+	{"prune-queues", "delete the queues that the config file does not declare", func(c *config) interface{} { return &c.Provisioning.Prune }},
+}
+
+// defineConfigFlags defines the flags of configFlags on flags, with
+// values in c.
+func defineConfigFlags(flags *flag.FlagSet, c *config) {
+	for _, f := range configFlags {
+		switch p := f.setting(c).(type) {
+		case *string:
+			flags.StringVar(p, f.name, *p, f.usage)
+		case *int:
+			flags.IntVar(p, f.name, *p, f.usage)
+		case *bool:
+			flags.BoolVar(p, f.name, *p, f.usage)
+		case *time.Duration:
+			flags.DurationVar(p, f.name, *p, f.usage)
+		}
+	}
+}
+
+// applyConfigFlags copies the settings of the flags that were given on
+// the command line from flagged to c.
+func applyConfigFlags(flags *flag.FlagSet, flagged, c *config) {
+	settings := make(map[string]func(c *config) interface{})
+	for _, f := range configFlags {
+		settings[f.name] = f.setting
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		if setting, ok := settings[f.Name]; ok {
+			reflect.ValueOf(setting(c)).Elem().Set(reflect.ValueOf(setting(flagged)).Elem())
+		}
+	})
+}
+
+//
+
+// loadConfig returns the defaults overridden by the file at path, if
+// path is not empty, and by the environment.
+func loadConfig(path string, environ []string) (config, error) {
+	c := defaultConfig()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return c, err
+		}
+
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&c); err != nil && err != io.EOF {
+			return c, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	env := make(map[string]string)
+	for _, variable := range environ {
+		if name, value, ok := strings.Cut(variable, "="); ok && strings.HasPrefix(name, "TQSD_") {
+			env[name] = value
+		}
+	}
+
+	if err := applyEnvironment(reflect.ValueOf(&c).Elem(), "TQSD", env); err != nil {
+		return c, err
+	}
+
+	return c, nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// applyEnvironment sets the fields of the struct v from the variables
+// in env that are named after them.
+func applyEnvironment(v reflect.Value, prefix string, env map[string]string) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		name := prefix + "_" + strings.ToUpper(v.Type().Field(i).Tag.Get("yaml"))
+
+		if field.Kind() == reflect.Struct {
+			if err := applyEnvironment(field, name, env); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := env[name]
+		if !ok {
+			continue
+		}
+
+		var err error
+		switch {
+		case field.Type() == durationType:
+			var d time.Duration
+			if d, err = time.ParseDuration(value); err == nil {
+				field.SetInt(int64(d))
+			}
+		case field.Kind() == reflect.String:
+			field.SetString(value)
+		case field.Kind() == reflect.Int || field.Kind() == reflect.Int64:
+			var n int64
+			if n, err = strconv.ParseInt(value, 10, 64); err == nil {
+				field.SetInt(n)
+			}
+		case field.Kind() == reflect.Bool:
+			var b bool
+			if b, err = strconv.ParseBool(value); err == nil {
+				field.SetBool(b)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value <%s> for %s: %w", value, name, err)
+		}
+	}
+	return nil
+}
+
+//
+
+// validate checks what can be checked without opening the store or
+// setting up the server.
+func (c config) validate() error {
+	var problems []error
+
+	if _, err := parseLogLevel(c.Log.Level); err != nil {
+		problems = append(problems, err)
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		problems = append(problems, fmt.Errorf("invalid log format <%s>", c.Log.Format))
+	}
+
+	if c.Listen.Port <= 0 || c.Listen.Port > 65535 {
+		problems = append(problems, fmt.Errorf("invalid port %d", c.Listen.Port))
+	}
+	if c.Listen.DrainDelay < 0 {
+		problems = append(problems, fmt.Errorf("invalid drain delay %s", c.Listen.DrainDelay))
+	}
+	if (c.Listen.TLS.Cert == "") != (c.Listen.TLS.Key == "") {
+		problems = append(problems, errors.New("TLS needs both a certificate and a key"))
+	}
+	if c.Listen.TLS.ClientCA != "" && c.Listen.TLS.Cert == "" {
+		problems = append(problems, errors.New("a TLS client CA needs a certificate and a key"))
+	}
+
+	if c.Cluster.Node != "" && (c.Replication.Follow != "" || c.Replication.Address != "") {
+		problems = append(problems, errors.New("replication cannot be combined with clustered mode"))
+	}
+	if c.Cluster.Node != "" && c.Storage.DataDir != "" {
+		problems = append(problems, errors.New("a sharded store cannot be combined with clustered mode"))
+	}
+	if c.Storage.DataDir != "" && (c.Replication.Follow != "" || c.Replication.Address != "") {
+		problems = append(problems, errors.New("replication cannot be combined with a sharded store"))
+	}
+	if c.Storage.Shards < 0 {
+		problems = append(problems, fmt.Errorf("invalid number of shards %d", c.Storage.Shards))
+	}
+	if c.Storage.Backup.Dir != "" && (c.Storage.Backup.Interval <= 0 || c.Storage.Backup.Retention <= 0) {
+		problems = append(problems, errors.New("backups need a positive interval and retention"))
+	}
+
+	if c.Tasks.ExpireLeases <= 0 || c.Tasks.ExpireMessages <= 0 || c.Tasks.MoveDelayed <= 0 {
+		problems = append(problems, errors.New("task intervals must be positive"))
+	}
+
+	var settings tqs.QueueSettings
+	for _, setting := range c.queueSettings() {
+		if err := setting(&settings); err != nil {
+			problems = append(problems, fmt.Errorf("default queue settings: %w", err))
+		}
+	}
+
+	if _, err := c.declaredQueues(); err != nil {
+		problems = append(problems, err)
+	}
+	if c.Provisioning.Prune && len(c.Provisioning.Queues) == 0 {
+		problems = append(problems, errors.New("pruning without declared queues would delete every queue"))
+	}
+
+	return errors.Join(problems...)
+}
+
+// declaredQueues returns the settings of the declared queues.
+func (c config) declaredQueues() (map[string]tqs.QueueSettings, error) {
+	declared := make(map[string]tqs.QueueSettings)
+	for _, queue := range c.Provisioning.Queues {
+		if _, ok := declared[queue.Name]; ok {
+			return nil, fmt.Errorf("queue <%s> is declared twice", queue.Name)
+		}
+
+		settings := tqs.QueueSettings{
+			LeaseDuration:          c.Queues.LeaseDuration,
+			MessageRetentionPeriod: c.Queues.MessageRetentionPeriod,
+			DelaySeconds:           c.Queues.DelaySeconds,
+		}
+		if queue.LeaseDuration != nil {
+			settings.LeaseDuration = *queue.LeaseDuration
+		}
+		if queue.MessageRetentionPeriod != nil {
+			settings.MessageRetentionPeriod = *queue.MessageRetentionPeriod
+		}
+		if queue.DelaySeconds != nil {
+			settings.DelaySeconds = *queue.DelaySeconds
+		}
+
+		var validated tqs.QueueSettings
+		for _, setting := range []tqs.QueueSetting{
+			tqs.LeaseDuration(settings.LeaseDuration),
+			tqs.MessageRetentionPeriod(settings.MessageRetentionPeriod),
+			tqs.DelaySeconds(settings.DelaySeconds),
+		} {
+			if err := setting(&validated); err != nil {
+				return nil, fmt.Errorf("queue <%s>: %w", queue.Name, err)
+			}
+		}
+
+		declared[queue.Name] = settings
+	}
+	return declared, nil
+}
+
+func (c config) queueSettings() []tqs.QueueSetting {
+	return []tqs.QueueSetting{
+		tqs.LeaseDuration(c.Queues.LeaseDuration),
+		tqs.MessageRetentionPeriod(c.Queues.MessageRetentionPeriod),
+		tqs.DelaySeconds(c.Queues.DelaySeconds),
+	}
+}
+
+func (c config) storeOptions(logger *slog.Logger) []tqs.StoreOption {
+	return []tqs.StoreOption{
+		tqs.WithLogger(logger),
+		tqs.WithTaskIntervals(tqs.TaskIntervals{
+			ExpireLeases:   c.Tasks.ExpireLeases,
+			ExpireMessages: c.Tasks.ExpireMessages,
+			MoveDelayed:    c.Tasks.MoveDelayed,
+		}),
+		tqs.WithDefaultQueueSettings(c.queueSettings()...),
+	}
+}
+
+func (c config) serverOptions(logger *slog.Logger) ([]api.ServerOption, error) {
+	options := []api.ServerOption{
+		api.AdminToken(c.Auth.AdminToken),
+		api.Logger(logger),
+		api.Timeouts(api.ServerTimeouts{
+			Read:  c.Listen.ReadTimeout,
+			Write: c.Listen.WriteTimeout,
+			Idle:  c.Listen.IdleTimeout,
+		}),
+		api.DrainDelay(c.Listen.DrainDelay),
+		api.Limits(api.RequestLimits{
+			MaxNumberOfMessages: c.Limits.MaxNumberOfMessages,
+			MaxWaitTimeSeconds:  c.Limits.MaxWaitTimeSeconds,
+			MaxMessageSize:      c.Limits.MaxMessageSize,
+			MaxRequestSize:      c.Limits.MaxRequestSize,
+		}),
+	}
+
+	if c.Auth.RequireAPIKey {
+		options = append(options, api.RequireAPIKey())
+	}
+
+	if c.Auth.APIKeysFile != "" {
+		keys, err := api.ReadAPIKeys(c.Auth.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, api.APIKeys(keys...))
+	}
+
+	if c.Listen.TLS.Cert != "" {
+		options = append(options, api.TLS(c.Listen.TLS.Cert, c.Listen.TLS.Key, c.Listen.TLS.ClientCA))
+	}
+
+	return options, nil
+}
+
+// restartNeeded returns the sections of c that differ from running in
+// settings that are not applied on SIGHUP.
+func (c config) restartNeeded(running config) []string {
+	c.Log.Level = running.Log.Level
+	c.Queues = running.Queues
+	if running.Auth.RequireAPIKey || running.Auth.APIKeysFile != "" {
+		c.Auth.APIKeysFile = running.Auth.APIKeysFile
+	}
+
+	var sections []string
+	a, b := reflect.ValueOf(c), reflect.ValueOf(running)
+	for i := 0; i < a.NumField(); i++ {
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			sections = append(sections, a.Type().Field(i).Tag.Get("yaml"))
+		}
+	}
+	return sections
+}
+
+//
+
+// configCommand runs the subcommands of tqsd config.
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "Usage: tqsd config check [-config path]")
+		return 2
+	}
+
+	flags := flag.NewFlagSet("config check", flag.ExitOnError)
+	configPath := flags.String("config", os.Getenv("TQSD_CONFIG"), "YAML config file")
+	flags.Parse(args[1:])
+
+	c, err := loadConfig(*configPath, os.Environ())
+	if err == nil {
+		err = c.validate()
+	}
+	if err == nil {
+		err = c.check()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		return 1
+	}
+
+	fmt.Println("Configuration is valid")
+
+	return 0
+}
+
+// check sets up a server with the configuration in front of a store in
+// memory, which reads the API keys and TLS files and validates the
+// limits.
+func (c config) check() error {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	store, err := tqs.NewStore(tqs.MemoryDatabase, c.storeOptions(logger)...)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	options, err := c.serverOptions(logger)
+	if err != nil {
+		return err
+	}
+
+	if _, err = api.NewServer(version, store, options...); err != nil {
+		return err
+	}
+
+	declared, err := c.declaredQueues()
+	if err != nil {
+		return err
+	}
+
+	_, err = store.PlanQueues(declared, false)
+	return err
+}
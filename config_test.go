@@ -0,0 +1,357 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/st3fan/tqsd/api"
+	"github.com/st3fan/tqsd/tqs"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "tqsd.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal("Cannot write config: ", err)
+	}
+	return path
+}
+
+func Test_LoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+listen:
+  port: 8443
+  read_timeout: 10s
+storage:
+  database: /tmp/test.db
+queues:
+  lease_duration: 60
+provisioning:
+  queues:
+    - name: orders
+      lease_duration: 120
+    - name: emails
+`)
+
+	c, err := loadConfig(path, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, c.validate())
+
+	assert.Equal(t, 8443, c.Listen.Port)
+	assert.Equal(t, 10*time.Second, c.Listen.ReadTimeout)
+	assert.Equal(t, "/tmp/test.db", c.Storage.Database)
+	assert.Equal(t, 60, c.Queues.LeaseDuration)
+	assert.Len(t, c.Provisioning.Queues, 2)
+
+	// What the file does not set keeps its default
+	assert.Equal(t, "0.0.0.0", c.Listen.Address)
+	assert.Equal(t, api.DefaultServerTimeouts.Write, c.Listen.WriteTimeout)
+	assert.Equal(t, tqs.DefaultMessageRetentionPeriod, c.Queues.MessageRetentionPeriod)
+
+	// Without a file there are only the defaults
+	c, err = loadConfig("", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, defaultConfig(), c)
+}
+
+func Test_LoadConfigErrors(t *testing.T) {
+	_, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml"), nil)
+	assert.NotNil(t, err)
+
+	_, err = loadConfig(writeConfig(t, "listen:\n  prot: 8443\n"), nil)
+	assert.NotNil(t, err, "unknown fields are rejected")
+
+	_, err = loadConfig(writeConfig(t, "provisioning:\n  queues:\n    - name: orders\n      dead_letter: orders-failed\n"), nil)
+	if assert.NotNil(t, err, "dead-letter targets are not supported") {
+		assert.Contains(t, err.Error(), "dead_letter")
+	}
+
+	_, err = loadConfig(writeConfig(t, "listen: [\n"), nil)
+	assert.NotNil(t, err)
+
+	_, err = loadConfig("", []string{"TQSD_LISTEN_PORT=http"})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "TQSD_LISTEN_PORT")
+	}
+
+	_, err = loadConfig("", []string{"TQSD_LISTEN_READ_TIMEOUT=10"})
+	assert.NotNil(t, err)
+}
+
+func Test_ConfigPrecedence(t *testing.T) {
+	path := writeConfig(t, `
+listen:
+  address: 127.0.0.1
+  port: 8443
+queues:
+  lease_duration: 60
+`)
+
+	c, err := loadConfig(path, []string{
+		"TQSD_LISTEN_PORT=9000",
+		"TQSD_LISTEN_READ_TIMEOUT=1m",
+		"TQSD_QUEUES_LEASE_DURATION=90",
+		"TQSD_AUTH_REQUIRE_API_KEY=true",
+		"TQSD_STORAGE_BACKUP_DIR=/backups",
+		"HOME=/root",
+	})
+	assert.Nil(t, err)
+
+	// The environment overrides the file, which overrides the defaults
+	assert.Equal(t, "127.0.0.1", c.Listen.Address)
+	assert.Equal(t, 9000, c.Listen.Port)
+	assert.Equal(t, time.Minute, c.Listen.ReadTimeout)
+	assert.Equal(t, 90, c.Queues.LeaseDuration)
+	assert.True(t, c.Auth.RequireAPIKey)
+	assert.Equal(t, "/backups", c.Storage.Backup.Dir)
+
+	// Flags that were given override both
+	flags := flag.NewFlagSet("tqsd", flag.ContinueOnError)
+	flagged := defaultConfig()
+	defineConfigFlags(flags, &flagged)
+	assert.Nil(t, flags.Parse([]string{"-port", "9100", "-log-level", "debug"}))
+	applyConfigFlags(flags, &flagged, &c)
+
+	assert.Equal(t, 9100, c.Listen.Port)
+	assert.Equal(t, "debug", c.Log.Level)
+	assert.Equal(t, "127.0.0.1", c.Listen.Address, "flags that were not given leave the setting alone")
+	assert.Equal(t, time.Minute, c.Listen.ReadTimeout)
+}
+
+func Test_ValidateConfig(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		change func(c *config)
+	}{
+		{"log level", func(c *config) { c.Log.Level = "loud" }},
+		{"log format", func(c *config) { c.Log.Format = "xml" }},
+		{"port", func(c *config) { c.Listen.Port = 70000 }},
+		{"drain delay", func(c *config) { c.Listen.DrainDelay = -time.Second }},
+		{"tls without key", func(c *config) { c.Listen.TLS.Cert = "cert.pem" }},
+		{"client ca without tls", func(c *config) { c.Listen.TLS.ClientCA = "ca.pem" }},
+		{"cluster and replication", func(c *config) { c.Cluster.Node = "n1"; c.Replication.Follow = "leader:8081" }},
+		{"cluster and shards", func(c *config) { c.Cluster.Node = "n1"; c.Storage.DataDir = "/data" }},
+		{"shards and replication", func(c *config) { c.Storage.DataDir = "/data"; c.Replication.Address = ":8081" }},
+		{"shards", func(c *config) { c.Storage.Shards = -1 }},
+		{"backups", func(c *config) { c.Storage.Backup.Dir = "/backups"; c.Storage.Backup.Retention = 0 }},
+		{"tasks", func(c *config) { c.Tasks.MoveDelayed = 0 }},
+		{"queue settings", func(c *config) { c.Queues.LeaseDuration = 0 }},
+		{"declared twice", func(c *config) {
+			c.Provisioning.Queues = []declaredQueueConfig{{Name: "orders"}, {Name: "orders"}}
+		}},
+		{"declared settings", func(c *config) {
+			delay := -1
+			c.Provisioning.Queues = []declaredQueueConfig{{Name: "orders", DelaySeconds: &delay}}
+		}},
+		{"prune everything", func(c *config) { c.Provisioning.Prune = true }},
+	} {
+		c := defaultConfig()
+		test.change(&c)
+		assert.NotNil(t, c.validate(), test.name)
+	}
+
+	// All problems are reported at once
+	c := defaultConfig()
+	c.Log.Level = "loud"
+	c.Listen.Port = 0
+	err := c.validate()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "invalid log level")
+		assert.Contains(t, err.Error(), "invalid port")
+	}
+
+	assert.Nil(t, defaultConfig().validate())
+}
+
+func Test_RestartNeeded(t *testing.T) {
+	running := defaultConfig()
+
+	reloaded := defaultConfig()
+	reloaded.Log.Level = "debug"
+	reloaded.Queues.LeaseDuration = 120
+	assert.Empty(t, reloaded.restartNeeded(running))
+
+	reloaded.Listen.Port = 9000
+	reloaded.Storage.Database = "/tmp/other.db"
+	reloaded.Log.Format = "json"
+	assert.Equal(t, []string{"listen", "storage", "log"}, reloaded.restartNeeded(running))
+
+	// The API keys file is only reloaded when keys are in use
+	reloaded = defaultConfig()
+	reloaded.Auth.APIKeysFile = "keys.json"
+	assert.Equal(t, []string{"auth"}, reloaded.restartNeeded(running))
+
+	running.Auth.RequireAPIKey = true
+	reloaded.Auth.RequireAPIKey = true
+	assert.Empty(t, reloaded.restartNeeded(running))
+}
+
+func Test_Reload(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	running := defaultConfig()
+	running.Storage.Database = tqs.MemoryDatabase
+	running.Auth.RequireAPIKey = true
+
+	store, err := tqs.NewStore(running.Storage.Database, running.storeOptions(logger)...)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	options, err := running.serverOptions(logger)
+	assert.Nil(t, err)
+	server, err := api.NewServer(version, store, options...)
+	assert.Nil(t, err)
+
+	var logLevel slog.LevelVar
+
+	keysPath := filepath.Join(t.TempDir(), "keys.json")
+	assert.Nil(t, os.WriteFile(keysPath, []byte(`{"Keys": [{"Name": "deploy", "Token": "deploy-token"}]}`), 0600))
+
+	reloaded := running
+	reloaded.Log.Level = "debug"
+	reloaded.Queues.LeaseDuration = 120
+	reloaded.Auth.APIKeysFile = keysPath
+	reloaded.Listen.Port = 9000
+
+	cfg := reload(logger, running, reloaded, &logLevel, store, server)
+
+	assert.Equal(t, slog.LevelDebug, logLevel.Level())
+	assert.Equal(t, "debug", cfg.Log.Level)
+	assert.Equal(t, 120, cfg.Queues.LeaseDuration)
+	assert.Equal(t, keysPath, cfg.Auth.APIKeysFile)
+	assert.Equal(t, 8080, cfg.Listen.Port, "changes that need a restart are not in effect")
+
+	_, settings, err := store.CreateQueue("jobs")
+	assert.Nil(t, err)
+	assert.Equal(t, 120, settings.LeaseDuration)
+
+	r := httptest.NewRequest("GET", "/queues", nil)
+	r.Header.Set("Authorization", "Bearer deploy-token")
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Settings that are not valid leave the running ones alone
+	reloaded = cfg
+	reloaded.Queues.LeaseDuration = 0
+	reloaded.Auth.APIKeysFile = filepath.Join(t.TempDir(), "missing.json")
+
+	cfg = reload(logger, cfg, reloaded, &logLevel, store, server)
+	assert.Equal(t, 120, cfg.Queues.LeaseDuration)
+	assert.Equal(t, keysPath, cfg.Auth.APIKeysFile)
+
+	w = httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func Test_DeclaredQueues(t *testing.T) {
+	lease, delay := 120, 0
+
+	c := defaultConfig()
+	c.Queues.LeaseDuration = 60
+	c.Queues.DelaySeconds = 10
+	c.Provisioning.Queues = []declaredQueueConfig{
+		{Name: "orders", LeaseDuration: &lease, DelaySeconds: &delay},
+		{Name: "emails"},
+	}
+
+	declared, err := c.declaredQueues()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]tqs.QueueSettings{
+		"orders": {LeaseDuration: 120, MessageRetentionPeriod: tqs.DefaultMessageRetentionPeriod, DelaySeconds: 0},
+		"emails": {LeaseDuration: 60, MessageRetentionPeriod: tqs.DefaultMessageRetentionPeriod, DelaySeconds: 10},
+	}, declared)
+}
+
+func Test_ProvisionQueues(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	database := filepath.Join(t.TempDir(), "tqs.db")
+	path := writeConfig(t, `
+storage:
+  database: `+database+`
+provisioning:
+  prune: true
+  queues:
+    - name: orders
+      lease_duration: 120
+    - name: emails
+`)
+
+	c, err := loadConfig(path, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, c.validate())
+
+	store, err := tqs.NewStore(c.Storage.Database, c.storeOptions(logger)...)
+	assert.Nil(t, err)
+
+	_, _, err = store.CreateQueue("orders")
+	assert.Nil(t, err)
+	_, _, err = store.CreateQueue("old")
+	assert.Nil(t, err)
+
+	// The dry run does not wait for a store that is in use
+	var output bytes.Buffer
+	assert.Equal(t, 1, printQueueChanges(&output, c))
+	assert.Nil(t, store.Close())
+
+	// It prints the changes without making them
+	assert.Equal(t, 0, printQueueChanges(&output, c))
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	assert.ElementsMatch(t, []string{
+		"+ emails LeaseDuration=30 MessageRetentionPeriod=345600 DelaySeconds=0",
+		"~ orders LeaseDuration=30->120",
+		"- old LeaseDuration=30 MessageRetentionPeriod=345600 DelaySeconds=0",
+	}, lines)
+
+	store, err = tqs.NewStore(c.Storage.Database, c.storeOptions(logger)...)
+	assert.Nil(t, err)
+
+	names, err := store.GetQueueNames()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"orders", "old"}, names)
+
+	provisionQueues(context.Background(), logger, store, c)
+
+	names, err = store.GetQueueNames()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"orders", "emails"}, names)
+
+	settings, err := store.GetQueueSettings("orders")
+	assert.Nil(t, err)
+	assert.Equal(t, 120, settings.LeaseDuration)
+
+	assert.Nil(t, store.Close())
+
+	output.Reset()
+	assert.Equal(t, 0, printQueueChanges(&output, c))
+	assert.Equal(t, "No changes\n", output.String())
+}
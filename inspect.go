@@ -0,0 +1,127 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/st3fan/tqsd/tqs"
+)
+
+// inspectCommand lists the queues in a database file with the sizes of
+// their message buckets.
+func inspectCommand(args []string) int {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	databasePath := flags.String("database", "/var/lib/tqs.db", "path to the database file")
+	flags.Parse(args)
+
+	sizes, err := tqs.InspectDatabase(*databasePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot inspect database:", err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "QUEUE\tVISIBLE\tLEASED\tDELAYED\tQUARANTINED")
+	for _, s := range sizes {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", s.Name, s.Visible, s.Leased, s.Delayed, s.Quarantined)
+	}
+	w.Flush()
+
+	return 0
+}
+
+// fsckCommand checks the structure of a database file and, with
+// -repair, fixes what it can. It exits with 1 when problems were found
+// and left alone.
+func fsckCommand(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	databasePath := flags.String("database", "/var/lib/tqs.db", "path to the database file")
+	repair := flags.Bool("repair", false, "fix problems and quarantine undecodable messages")
+	flags.Parse(args)
+
+	problems, err := tqs.CheckDatabase(*databasePath, *repair)
+	for _, problem := range problems {
+		if *repair {
+			fmt.Printf("%s (repaired: %s)\n", problem, problem.Repair)
+		} else {
+			fmt.Printf("%s (repair would %s)\n", problem, problem.Repair)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot check database:", err)
+		return 1
+	}
+
+	if len(problems) == 0 {
+		fmt.Println("No problems found")
+	} else if !*repair {
+		return 1
+	}
+
+	return 0
+}
+
+// compactCommand rewrites a database file that is not in use without
+// its free pages.
+func compactCommand(args []string) int {
+	flags := flag.NewFlagSet("compact", flag.ExitOnError)
+	databasePath := flags.String("database", "/var/lib/tqs.db", "path to the database file")
+	flags.Parse(args)
+
+	result, err := tqs.CompactDatabase(*databasePath, func(progress tqs.CompactionProgress) {
+		fmt.Printf("Copied %d keys (%d bytes)\n", progress.Keys, progress.Bytes)
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot compact database:", err)
+		return 1
+	}
+
+	fmt.Printf("Compacted %s from %d to %d bytes, reclaimed %d bytes in %s\n",
+		*databasePath, result.OriginalSize, result.CompactedSize, result.Reclaimed(), result.Duration)
+
+	return 0
+}
+
+// shardCommand copies the queues of a database file that is not in use
+// into a sharded store.
+func shardCommand(args []string) int {
+	flags := flag.NewFlagSet("shard", flag.ExitOnError)
+	databasePath := flags.String("database", "/var/lib/tqs.db", "path to the database file")
+	dataDir := flags.String("data-dir", "", "directory of the sharded store")
+	shards := flags.Int("shards", 0, "number of files to spread the queues over, 0 gives every queue its own file")
+	flags.Parse(args)
+
+	if *dataDir == "" {
+		fmt.Fprintln(os.Stderr, "The -data-dir flag is required")
+		return 1
+	}
+
+	n, err := tqs.MigrateToShards(*databasePath, *dataDir, *shards)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot migrate database:", err)
+		return 1
+	}
+
+	fmt.Printf("Migrated %d queues from %s to %s\n", n, *databasePath, *dataDir)
+
+	return 0
+}
@@ -21,10 +21,15 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/st3fan/daemongroup"
 	"github.com/st3fan/tqsd/api"
@@ -33,61 +38,373 @@ import (
 
 var version = "untagged"
 
+var commands = map[string]func(args []string) int{
+	"inspect": inspectCommand,
+	"fsck":    fsckCommand,
+	"restore": restoreCommand,
+	"compact": compactCommand,
+	"shard":   shardCommand,
+	"config":  configCommand,
+}
+
 func main() {
-	log.Printf("This is tqsd (%s)\n", version)
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
 
-	databasePath := flag.String("database", "/var/lib/tqs.db", "path to the database file")
-	address := flag.String("address", "0.0.0.0", "address to bind to")
-	port := flag.Int("port", 8080, "port to bind to")
+	os.Exit(runDaemon())
+}
+
+// runDaemon runs tqsd until it is told to stop with SIGINT or SIGTERM,
+// or until one of its components fails, and returns the exit code.
+func runDaemon() int {
+	configPath := flag.String("config", os.Getenv("TQSD_CONFIG"), "YAML config file, overridden by TQSD_ environment variables and flags")
+	dryRun := flag.Bool("dry-run", false, "print the changes that provisioning the declared queues would make to the store and exit")
+	flagged := defaultConfig()
+	defineConfigFlags(flag.CommandLine, &flagged)
 	flag.Parse()
 
-	store, err := tqs.NewStore(*databasePath)
+	// loadRunConfig reads the configuration, at startup and on SIGHUP
+	loadRunConfig := func() (config, error) {
+		c, err := loadConfig(*configPath, os.Environ())
+		if err != nil {
+			return c, err
+		}
+		applyConfigFlags(flag.CommandLine, &flagged, &c)
+		return c, c.validate()
+	}
+
+	cfg, err := loadRunConfig()
 	if err != nil {
-		log.Println("Cannot setup store: ", err)
-		return
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		return 2
 	}
-	defer store.Close()
 
-	server, err := api.NewServer(version, store)
+	// The dry run reads the files of the store without opening it, so
+	// that it does not wait for or change a store that tqsd is using
+	if *dryRun {
+		if cfg.Cluster.Node != "" {
+			fmt.Fprintln(os.Stderr, "A dry run cannot be combined with clustered mode, it would join the cluster")
+			return 2
+		}
+		return printQueueChanges(os.Stdout, cfg)
+	}
+
+	var logLevel slog.LevelVar
+	level, _ := parseLogLevel(cfg.Log.Level)
+	logLevel.Set(level)
+
+	logger, err := newLogger(os.Stderr, &logLevel, cfg.Log.Format)
 	if err != nil {
-		log.Println("Cannot setup server: ", err)
-		return
+		fmt.Fprintln(os.Stderr, err)
+		return 2
 	}
 
-	log.Printf("Starting at http://%s:%d\n", *address, *port)
+	// Also for the packages that use the log package
+	slog.SetDefault(logger)
 
-	serverTask := func(ctx context.Context) {
-		// Start the web server in the background
-		go func() {
-			if err := server.Run(fmt.Sprintf("%s:%d", *address, *port)); err != nil {
-				log.Println("Failed to run server: ", err)
+	logger.Info("This is tqsd", "version", version)
+
+	var store *tqs.Store
+	if cfg.Cluster.Node != "" {
+		store, err = newClusteredStore(cfg.Storage.Database, cfg.Cluster.Node, cfg.Cluster.Peers, cfg.Cluster.Dir, cfg.storeOptions(logger)...)
+	} else if cfg.Storage.DataDir != "" {
+		store, err = tqs.NewShardedStore(cfg.Storage.DataDir, cfg.Storage.Shards, cfg.storeOptions(logger)...)
+	} else {
+		store, err = tqs.NewStore(cfg.Storage.Database, cfg.storeOptions(logger)...)
+	}
+	if err != nil {
+		logger.Error("Cannot setup store", "error", err)
+		return 1
+	}
+
+	// Closing the store flushes it, after everything that uses it stopped
+	defer func() {
+		if err := store.Close(); err != nil {
+			logger.Error("Failed to close store", "error", err)
+		}
+	}()
+
+	// Become a follower before the server accepts any writes
+	var followTask func(ctx context.Context)
+	if cfg.Replication.Follow != "" {
+		followTask = store.Follow(cfg.Replication.Follow)
+	}
+
+	serverOptions, err := cfg.serverOptions(logger)
+	if err != nil {
+		logger.Error("Cannot setup server", "error", err)
+		return 1
+	}
+
+	server, err := api.NewServer(version, store, serverOptions...)
+	if err != nil {
+		logger.Error("Cannot setup server", "error", err)
+		return 1
+	}
+
+	scheme := "http"
+	if cfg.Listen.TLS.Cert != "" {
+		scheme = "https"
+	}
+
+	address := fmt.Sprintf("%s:%d", cfg.Listen.Address, cfg.Listen.Port)
+	logger.Info("Starting", "url", scheme+"://"+address)
+
+	// The context is cancelled with the error of the first component
+	// that fails, or without one when tqsd is told to stop
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	store.Start()
+
+	if len(cfg.Provisioning.Queues) != 0 {
+		if followTask != nil {
+			logger.Info("Not provisioning queues on a replication follower")
+		} else if cfg.Cluster.Node != "" {
+			go provisionQueues(ctx, logger, store, cfg)
+		} else {
+			provisionQueues(ctx, logger, store, cfg)
+		}
+	}
+
+	dg := daemongroup.NewDaemonGroup(ctx)
+
+	// run starts a component in the daemon group. A component runs until
+	// the context is done, or returns an error to stop all of them.
+	var components sync.WaitGroup
+	run := func(name string, component func(ctx context.Context) error) {
+		components.Add(1)
+		dg.Go(func(ctx context.Context) {
+			defer components.Done()
+			if err := component(ctx); err != nil {
+				cancel(fmt.Errorf("%s: %w", name, err))
 			}
-			// If we end up here then the server exited, how do we signal that/
-			// to the app so that it can shut down?
+		})
+	}
+
+	run("server", func(ctx context.Context) error {
+		stopped := make(chan error, 1)
+		go func() {
+			stopped <- server.Run(address)
 		}()
 
-		// Wait for the application to be done
 		select {
+		case err := <-stopped:
+			return err
 		case <-ctx.Done():
-			if err := server.Shutdown(); err != nil {
-				log.Println("Failed to shutdown server: ", err)
+			return server.Shutdown()
+		}
+	})
+
+	if cfg.Replication.Address != "" {
+		run("replication", func(ctx context.Context) error {
+			listener, err := net.Listen("tcp", cfg.Replication.Address)
+			if err != nil {
+				return err
+			}
+			return store.ServeReplication(ctx, listener)
+		})
+	}
+
+	if followTask != nil {
+		run("follow", func(ctx context.Context) error {
+			followTask(ctx) // Returns early when the store is promoted
+			return nil
+		})
+	}
+
+	if cfg.Storage.Backup.Dir != "" {
+		run("backup", func(ctx context.Context) error {
+			store.BackupTask(cfg.Storage.Backup.Dir, cfg.Storage.Backup.Interval, cfg.Storage.Backup.Retention)(ctx)
+			return nil
+		})
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				logger.Info("Shutting down", "signal", sig.String())
+				cancel(nil)
+				continue
+			}
+
+			reloaded, err := loadRunConfig()
+			if err != nil {
+				logger.Error("Cannot reload configuration", "error", err)
+				continue
 			}
+			cfg = reload(logger, cfg, reloaded, &logLevel, store, server)
+		}
+	}
+
+	// The server finishes the requests in flight before it stops
+	components.Wait()
+
+	if err := context.Cause(ctx); err != context.Canceled {
+		logger.Error("Shutting down after a failure", "error", err)
+		return 1
+	}
+
+	logger.Info("Stopped")
+
+	return 0
+}
+
+// newClusteredStore opens the database as a node of the cluster
+// described by peers. To run a cluster on one machine, start three
+// nodes with their own database, ports and the same peers, like:
+//
+//	tqsd -database n1.db -port 8081 -cluster-node n1 \
+//	  -cluster-peers n1=127.0.0.1:7081=127.0.0.1:8081,n2=127.0.0.1:7082=127.0.0.1:8082,n3=127.0.0.1:7083=127.0.0.1:8083
+func newClusteredStore(path, node, peers, directory string, options ...tqs.StoreOption) (*tqs.Store, error) {
+	config := tqs.ClusterConfig{
+		NodeID:    node,
+		Directory: directory,
+	}
+
+	if config.Directory == "" {
+		if path == tqs.MemoryDatabase {
+			return nil, fmt.Errorf("-cluster-dir is required for a %s database", tqs.MemoryDatabase)
+		}
+		config.Directory = path + ".raft"
+	}
+
+	for _, peer := range strings.Split(peers, ",") {
+		fields := strings.Split(peer, "=")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid cluster peer <%s>, expected id=raft-address=api-address", peer)
+		}
+		config.Peers = append(config.Peers, tqs.ClusterPeer{ID: fields[0], Address: fields[1], APIAddress: fields[2]})
+	}
+
+	return tqs.NewClusteredStore(path, config, options...)
+}
+
+// printQueueChanges prints what provisioning the declared queues would
+// change in the store of cfg and returns the exit code for the dry run.
+func printQueueChanges(w io.Writer, cfg config) int {
+	declared, _ := cfg.declaredQueues() // Validated with the config
+	changes, err := tqs.PlanDatabaseQueues(cfg.Storage.Database, cfg.Storage.DataDir, declared, cfg.Provisioning.Prune)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot plan queue changes:", err)
+		return 1
+	}
+
+	for _, change := range changes {
+		fmt.Fprintln(w, change)
+	}
+	if len(changes) == 0 {
+		fmt.Fprintln(w, "No changes")
+	}
+
+	return 0
+}
+
+// provisionQueues creates and updates the declared queues, and with
+// pruning deletes the others. A node of a cluster only does that when
+// it becomes the leader soon after starting.
+func provisionQueues(ctx context.Context, logger *slog.Logger, store *tqs.Store, cfg config) {
+	for deadline := time.Now().Add(time.Minute); ; {
+		address, leader := store.ClusterLeader()
+		if leader {
+			break
+		}
+		if address != "" || time.Now().After(deadline) {
+			logger.Info("Not provisioning queues, this node is not the leader")
 			return
 		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	declared, _ := cfg.declaredQueues()
+	changes, err := store.PlanQueues(declared, cfg.Provisioning.Prune)
+	if err == nil {
+		err = store.ApplyQueueChanges(changes)
+	}
+	if err != nil {
+		logger.Error("Cannot provision queues", "error", err)
+		return
+	}
 
-	dg := daemongroup.NewDaemonGroup(ctx)
-	dg.Go(store.ExpireLeasedMessagesTask)
-	dg.Go(store.ExpireMessagesTask)
-	dg.Go(store.MoveDelayedMessagesTask)
-	dg.Go(serverTask)
+	logger.Info("Provisioned queues", "declared", len(declared), "changes", len(changes))
+}
 
-	var c = make(chan os.Signal)
-	signal.Notify(c, syscall.SIGINT)
+// reload applies the settings of reloaded that can change while tqsd
+// runs and returns the configuration that is now in effect.
+func reload(logger *slog.Logger, running, reloaded config, logLevel *slog.LevelVar, store *tqs.Store, server *api.Server) config {
+	if running.Listen.TLS.Cert != "" {
+		if err := server.ReloadTLS(); err != nil {
+			logger.Error("Cannot reload TLS certificates", "error", err)
+		}
+	}
 
-	<-c
+	if sections := reloaded.restartNeeded(running); len(sections) != 0 {
+		logger.Warn("Configuration changes need a restart", "sections", sections)
+	}
+
+	level, _ := parseLogLevel(reloaded.Log.Level)
+	logLevel.Set(level)
+	running.Log.Level = reloaded.Log.Level
 
-	cancel()
+	if err := store.SetDefaultQueueSettings(reloaded.queueSettings()...); err != nil {
+		logger.Error("Cannot change default queue settings", "error", err)
+	} else {
+		running.Queues = reloaded.Queues
+	}
+
+	if running.Auth.RequireAPIKey || running.Auth.APIKeysFile != "" {
+		var keys []api.ConfiguredAPIKey
+		var err error
+		if reloaded.Auth.APIKeysFile != "" {
+			keys, err = api.ReadAPIKeys(reloaded.Auth.APIKeysFile)
+		}
+		if err == nil {
+			err = server.SetAPIKeys(keys...)
+		}
+		if err != nil {
+			logger.Error("Cannot reload API keys", "error", err)
+		} else {
+			running.Auth.APIKeysFile = reloaded.Auth.APIKeysFile
+		}
+	}
+
+	logger.Info("Reloaded configuration")
+
+	return running
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return l, fmt.Errorf("invalid log level <%s>", level)
+	}
+	return l, nil
+}
+
+// newLogger returns a logger that writes messages at level and above to
+// w, as text or as JSON.
+func newLogger(w io.Writer, level slog.Leveler, format string) (*slog.Logger, error) {
+	options := &slog.HandlerOptions{Level: level}
+
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format <%s>", format)
+	}
 }
@@ -0,0 +1,61 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/st3fan/tqsd/tqs"
+)
+
+// restoreCommand installs a backup as the database. With -verify-only
+// it only checks the backup.
+func restoreCommand(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	databasePath := flags.String("database", "/var/lib/tqs.db", "path to the database file")
+	verifyOnly := flags.Bool("verify-only", false, "check the backup without installing it")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: tqsd restore [flags] <backup>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	if *verifyOnly {
+		if err := tqs.VerifyBackup(flags.Arg(0)); err != nil {
+			fmt.Fprintln(os.Stderr, "Backup is not valid:", err)
+			return 1
+		}
+		fmt.Println("Backup is valid")
+		return 0
+	}
+
+	if err := tqs.RestoreBackup(flags.Arg(0), *databasePath); err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot restore backup:", err)
+		return 1
+	}
+
+	fmt.Printf("Restored %s to %s\n", flags.Arg(0), *databasePath)
+	return 0
+}
@@ -0,0 +1,134 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// MemoryDatabase is the database path that selects the in-memory
+// backend instead of a bolt file.
+const MemoryDatabase = ":memory:"
+
+var (
+	errBucketNotFound = errors.New("bucket not found")
+	errBucketExists   = errors.New("bucket already exists")
+)
+
+// The backend is the storage engine underneath the Store. It is
+// modelled after bolt: a tree of named buckets holding sorted keys,
+// accessed through read-only or read-write transactions. Queue meta
+// data, settings and the Visible/Leased/Delayed message states are all
+// buckets in that tree; message and lease IDs sort by priority and
+// time, so the keys double as the index.
+
+type backend interface {
+	View(fn func(tx backendTx) error) error
+	Update(fn func(tx backendTx) error) error
+	Close() error
+}
+
+type backendTx interface {
+	Bucket(name []byte) backendBucket
+	CreateBucketIfNotExists(name []byte) (backendBucket, error)
+	DeleteBucket(name []byte) error
+	ForEach(fn func(name []byte, bucket backendBucket) error) error
+}
+
+type backendBucket interface {
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	ForEach(fn func(key, value []byte) error) error
+	Cursor() backendCursor
+	KeyN() int // The keys in the bucket and its nested buckets
+
+	Bucket(name []byte) backendBucket
+	CreateBucket(name []byte) (backendBucket, error)
+	CreateBucketIfNotExists(name []byte) (backendBucket, error)
+	DeleteBucket(name []byte) error
+}
+
+type backendCursor interface {
+	First() (key, value []byte)
+	Next() (key, value []byte)
+}
+
+// snapshotter is implemented by backends that can write a consistent
+// copy of the whole database, in the format of their database file.
+type snapshotter interface {
+	WriteTo(w io.Writer) (int64, error)
+}
+
+//
+
+// prefixedBackend keeps the buckets of a store in a database that it
+// shares with other code, by prefixing the names of the top level
+// buckets.
+type prefixedBackend struct {
+	backend backend
+	prefix  string
+}
+
+func (b prefixedBackend) View(fn func(tx backendTx) error) error {
+	return b.backend.View(func(tx backendTx) error {
+		return fn(prefixedTx{tx, b.prefix})
+	})
+}
+
+func (b prefixedBackend) Update(fn func(tx backendTx) error) error {
+	return b.backend.Update(func(tx backendTx) error {
+		return fn(prefixedTx{tx, b.prefix})
+	})
+}
+
+func (b prefixedBackend) Close() error {
+	return b.backend.Close()
+}
+
+type prefixedTx struct {
+	tx     backendTx
+	prefix string
+}
+
+func (t prefixedTx) Bucket(name []byte) backendBucket {
+	return t.tx.Bucket(t.name(name))
+}
+
+func (t prefixedTx) CreateBucketIfNotExists(name []byte) (backendBucket, error) {
+	return t.tx.CreateBucketIfNotExists(t.name(name))
+}
+
+func (t prefixedTx) DeleteBucket(name []byte) error {
+	return t.tx.DeleteBucket(t.name(name))
+}
+
+func (t prefixedTx) ForEach(fn func(name []byte, bucket backendBucket) error) error {
+	return t.tx.ForEach(func(name []byte, bucket backendBucket) error {
+		if !bytes.HasPrefix(name, []byte(t.prefix)) {
+			return nil
+		}
+		return fn(name[len(t.prefix):], bucket)
+	})
+}
+
+func (t prefixedTx) name(name []byte) []byte {
+	return append([]byte(t.prefix), name...)
+}
@@ -0,0 +1,220 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNotSupported is returned for operations that the storage backend
+// of the store cannot do, like backing up an in-memory store.
+var ErrNotSupported = errors.New("not supported by this backend")
+
+const backupTimeFormat = "20060102T150405Z"
+
+// WriteBackup writes a consistent snapshot of the database to w while
+// the store stays available. The snapshot is a complete bolt database
+// file, so sharded stores, which have several, are not supported.
+func (s *Store) WriteBackup(w io.Writer) (int64, error) {
+	snapshotter, ok := s.storage.(snapshotter)
+	if !ok || s.sharding != nil {
+		return 0, ErrNotSupported
+	}
+	return snapshotter.WriteTo(w)
+}
+
+// BackupToDirectory writes a snapshot of the database into dir and
+// then removes all but the newest retain backups in there. It returns
+// the path of the new backup.
+func (s *Store) BackupToDirectory(dir string, retain int) (string, error) {
+	snapshotter, ok := s.storage.(snapshotter)
+	if !ok || s.sharding != nil {
+		return "", ErrNotSupported
+	}
+
+	path := filepath.Join(dir, "tqs-"+s.clock.Now().UTC().Format(backupTimeFormat)+".db")
+
+	// Write to a temporary file first so that an interrupted backup
+	// never looks like a complete one
+	if err := writeSnapshot(snapshotter, path+".tmp"); err != nil {
+		os.Remove(path + ".tmp")
+		return "", err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return "", err
+	}
+
+	return path, pruneBackups(dir, retain)
+}
+
+func pruneBackups(dir string, retain int) error {
+	if retain <= 0 {
+		return nil
+	}
+
+	backups, err := filepath.Glob(filepath.Join(dir, "tqs-*.db"))
+	if err != nil {
+		return err
+	}
+
+	// The timestamp format sorts chronologically
+	sort.Strings(backups)
+
+	for len(backups) > retain {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+// BackupTask returns a task that backs up the database into dir every
+// interval, keeping the newest retain backups.
+func (s *Store) BackupTask(dir string, interval time.Duration, retain int) func(ctx context.Context) {
+	return func(ctx context.Context) {
+		ticker := s.clock.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+				var path string
+				err := s.runTask("backup", func() (err error) {
+					path, err = s.BackupToDirectory(dir, retain)
+					return err
+				})
+				if err != nil {
+					s.logger.Error("Failed to backup database", "error", err)
+				} else {
+					s.logger.Info("Backed up database", "path", path)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// VerifyBackup checks that the file at path is a snapshot that this
+// version of tqs can open and that its queues are intact.
+func VerifyBackup(path string) error {
+	backend, err := openBoltBackendReadOnly(path)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = backend.View(func(tx backendTx) error {
+		if tx.Bucket([]byte("Queues")) == nil {
+			return errors.New("Queues bucket not found")
+		}
+		v, err := schemaVersion(tx)
+		version = v
+		return err
+	})
+	backend.Close()
+	if err != nil {
+		return err
+	}
+
+	if version > SchemaVersion {
+		return fmt.Errorf("%w: backup is at version %d, expected at most %d", ErrSchemaTooNew, version, SchemaVersion)
+	}
+
+	problems, err := CheckDatabase(path, false)
+	if err != nil {
+		return err
+	}
+
+	if len(problems) != 0 {
+		var descriptions []string
+		for _, problem := range problems {
+			descriptions = append(descriptions, problem.String())
+		}
+		return fmt.Errorf("backup has %d problems: %s", len(problems), strings.Join(descriptions, "; "))
+	}
+
+	return nil
+}
+
+// RestoreBackup verifies the snapshot at backupPath and installs it as
+// the database at path. An existing database is kept as path.orig.
+// This must not be done while tqsd has the database open, which is
+// checked by briefly opening it.
+func RestoreBackup(backupPath string, path string) error {
+	if err := VerifyBackup(backupPath); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		backend, err := openBoltBackendWithTimeout(path, time.Second)
+		if err != nil {
+			return fmt.Errorf("database is in use: %w", err)
+		}
+		backend.Close()
+	}
+
+	// Copy next to the database so that the final rename is atomic
+	if err := copyFile(backupPath, path+".restore"); err != nil {
+		os.Remove(path + ".restore")
+		return err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if err := os.Rename(path, path+".orig"); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(path+".restore", path)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,101 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_BackupAndRestore(t *testing.T) {
+	store, err := NewStore(temporaryDatabase())
+	assert.Nil(t, err)
+	defer store.Close()
+
+	_, _, err = store.CreateQueue("hello")
+	assert.Nil(t, err)
+
+	_, err = store.PutMessages("hello", []Message{{Body: "Message1"}})
+	assert.Nil(t, err)
+
+	var backup bytes.Buffer
+	n, err := store.WriteBackup(&backup)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(backup.Len()), n)
+
+	backupPath := temporaryDatabase()
+	assert.Nil(t, ioutil.WriteFile(backupPath, backup.Bytes(), 0600))
+	assert.Nil(t, VerifyBackup(backupPath))
+
+	path := temporaryDatabase()
+	assert.Nil(t, RestoreBackup(backupPath, path))
+
+	restored, err := NewStore(path)
+	assert.Nil(t, err)
+	defer restored.Close()
+
+	messages, _, err := restored.GetMessages("hello", 1, DefaultLeaseDuration)
+	assert.Nil(t, err)
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "Message1", messages[0].Body)
+	}
+}
+
+func Test_VerifyBackupRejectsGarbage(t *testing.T) {
+	path := temporaryDatabase()
+	assert.Nil(t, ioutil.WriteFile(path, []byte("This is not a database"), 0600))
+	assert.NotNil(t, VerifyBackup(path))
+	assert.NotNil(t, RestoreBackup(path, temporaryDatabase()))
+}
+
+func Test_BackupToDirectoryRetention(t *testing.T) {
+	store, err := NewStore(temporaryDatabase())
+	assert.Nil(t, err)
+	defer store.Close()
+
+	dir, err := ioutil.TempDir("", "tqs-backups")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// Backups are named by the second, so fake some older ones
+	for _, name := range []string{"tqs-20180101T000000Z.db", "tqs-20180102T000000Z.db"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), nil, 0600))
+	}
+
+	path, err := store.BackupToDirectory(dir, 2)
+	assert.Nil(t, err)
+	assert.Nil(t, VerifyBackup(path))
+
+	backups, err := filepath.Glob(filepath.Join(dir, "tqs-*.db"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "tqs-20180102T000000Z.db"), path}, backups)
+}
+
+func Test_BackupMemoryStore(t *testing.T) {
+	store, err := NewStore(MemoryDatabase)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	_, err = store.WriteBackup(ioutil.Discard)
+	assert.Equal(t, ErrNotSupported, err)
+}
@@ -0,0 +1,376 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// boltBackend stores everything in a single bolt file. The db can be
+// replaced by a compacted copy while the store is in use: while the
+// copy is made, updates are recorded in the journal, which is applied
+// to the copy under the write lock before the swap, so that no update
+// gets lost. The RWMutex protects the db itself. Backups read lock the
+// compact lock, so that the swap never has to wait for one. A borrowed
+// db belongs to the application and is never closed or replaced.
+type boltBackend struct {
+	sync.RWMutex
+	writeLock   sync.Mutex
+	compactLock sync.RWMutex
+	journal     *boltJournal // Guarded by the write lock
+	path        string
+	options     *bolt.Options // Also for the compacted copy
+	db          *bolt.DB
+	borrowed    bool
+}
+
+func openBoltBackend(path string) (*boltBackend, error) {
+	return openBoltBackendWithOptions(path, nil)
+}
+
+// openBoltBackendWithTimeout gives up waiting for the file lock after
+// timeout, instead of blocking while another process has the database
+// open.
+func openBoltBackendWithTimeout(path string, timeout time.Duration) (*boltBackend, error) {
+	return openBoltBackendWithOptions(path, &bolt.Options{Timeout: timeout})
+}
+
+func openBoltBackendWithOptions(path string, options *bolt.Options) (*boltBackend, error) {
+	db, err := bolt.Open(path, 0600, options)
+	if err != nil {
+		return nil, err
+	}
+	return &boltBackend{path: path, options: options, db: db}, nil
+}
+
+// openBoltBackendReadOnly opens an existing database for inspection.
+// Bolt allows only one process to open a file for writing, so this
+// gives up after a second if tqsd has the database open.
+func openBoltBackendReadOnly(path string) (*boltBackend, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &boltBackend{path: path, db: db}, nil
+}
+
+func (b *boltBackend) View(fn func(tx backendTx) error) error {
+	b.RLock()
+	defer b.RUnlock()
+	return b.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx, nil})
+	})
+}
+
+func (b *boltBackend) Update(fn func(tx backendTx) error) error {
+	b.writeLock.Lock()
+	defer b.writeLock.Unlock()
+	b.RLock()
+	defer b.RUnlock()
+
+	var journal *boltJournal
+	if b.journal != nil {
+		journal = &boltJournal{}
+	}
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx, journal})
+	})
+	if err == nil && journal != nil {
+		b.journal.changes = append(b.journal.changes, journal.changes...)
+	}
+	return err
+}
+
+// WriteTo holds the read lock only to start the transaction, because
+// a backup that streams to a slow client would otherwise hold up the
+// swap of a compaction, and with it every other transaction.
+func (b *boltBackend) WriteTo(w io.Writer) (int64, error) {
+	b.compactLock.RLock()
+	defer b.compactLock.RUnlock()
+
+	b.RLock()
+	tx, err := b.db.Begin(false)
+	b.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	return tx.WriteTo(w)
+}
+
+func (b *boltBackend) Close() error {
+	if b.borrowed {
+		return nil
+	}
+	b.Lock()
+	defer b.Unlock()
+	return b.db.Close()
+}
+
+//
+
+// boltTx and boltBucket record their changes in a journal when one is
+// given, which is only while the database is compacted.
+type boltTx struct {
+	tx      *bolt.Tx
+	journal *boltJournal
+}
+
+func (t boltTx) Bucket(name []byte) backendBucket {
+	return wrapBoltBucket(t.tx.Bucket(name), [][]byte{name}, t.journal)
+}
+
+func (t boltTx) CreateBucketIfNotExists(name []byte) (backendBucket, error) {
+	bucket, err := t.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	t.journal.record(boltCreateBucket, [][]byte{name}, nil, nil)
+	return boltBucket{bucket, [][]byte{name}, t.journal}, nil
+}
+
+func (t boltTx) DeleteBucket(name []byte) error {
+	if err := t.tx.DeleteBucket(name); err != nil {
+		if err == bolt.ErrBucketNotFound {
+			return errBucketNotFound
+		}
+		return err
+	}
+	t.journal.record(boltDeleteBucket, [][]byte{name}, nil, nil)
+	return nil
+}
+
+func (t boltTx) ForEach(fn func(name []byte, bucket backendBucket) error) error {
+	return t.tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+		return fn(name, boltBucket{bucket, [][]byte{name}, t.journal})
+	})
+}
+
+//
+
+type boltBucket struct {
+	bucket  *bolt.Bucket
+	path    [][]byte
+	journal *boltJournal
+}
+
+func wrapBoltBucket(bucket *bolt.Bucket, path [][]byte, journal *boltJournal) backendBucket {
+	if bucket == nil {
+		return nil
+	}
+	return boltBucket{bucket, path, journal}
+}
+
+// child returns the path of the nested bucket name.
+func (b boltBucket) child(name []byte) [][]byte {
+	return append(append([][]byte{}, b.path...), name)
+}
+
+func (b boltBucket) Get(key []byte) []byte {
+	return b.bucket.Get(key)
+}
+
+func (b boltBucket) Put(key, value []byte) error {
+	if err := b.bucket.Put(key, value); err != nil {
+		return err
+	}
+	b.journal.record(boltPut, b.path, key, value)
+	return nil
+}
+
+func (b boltBucket) Delete(key []byte) error {
+	if err := b.bucket.Delete(key); err != nil {
+		return err
+	}
+	b.journal.record(boltDelete, b.path, key, nil)
+	return nil
+}
+
+func (b boltBucket) ForEach(fn func(key, value []byte) error) error {
+	return b.bucket.ForEach(fn)
+}
+
+func (b boltBucket) Cursor() backendCursor {
+	return b.bucket.Cursor()
+}
+
+// KeyN counts the keys from the page headers, which is a lot less work
+// than visiting them. The pages do not have the changes of a write
+// transaction yet, so then the keys are visited after all.
+func (b boltBucket) KeyN() int {
+	if b.bucket.Tx().Writable() {
+		count := 0
+		b.bucket.ForEach(func(key, value []byte) error {
+			count++
+			if value == nil {
+				count += b.Bucket(key).KeyN()
+			}
+			return nil
+		})
+		return count
+	}
+	return b.bucket.Stats().KeyN
+}
+
+func (b boltBucket) Bucket(name []byte) backendBucket {
+	return wrapBoltBucket(b.bucket.Bucket(name), b.child(name), b.journal)
+}
+
+func (b boltBucket) CreateBucket(name []byte) (backendBucket, error) {
+	bucket, err := b.bucket.CreateBucket(name)
+	if err != nil {
+		if err == bolt.ErrBucketExists {
+			return nil, errBucketExists
+		}
+		return nil, err
+	}
+	b.journal.record(boltCreateBucket, b.child(name), nil, nil)
+	return boltBucket{bucket, b.child(name), b.journal}, nil
+}
+
+func (b boltBucket) CreateBucketIfNotExists(name []byte) (backendBucket, error) {
+	bucket, err := b.bucket.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	b.journal.record(boltCreateBucket, b.child(name), nil, nil)
+	return boltBucket{bucket, b.child(name), b.journal}, nil
+}
+
+func (b boltBucket) DeleteBucket(name []byte) error {
+	if err := b.bucket.DeleteBucket(name); err != nil {
+		if err == bolt.ErrBucketNotFound {
+			return errBucketNotFound
+		}
+		return err
+	}
+	b.journal.record(boltDeleteBucket, b.child(name), nil, nil)
+	return nil
+}
+
+//
+
+type boltChangeKind int
+
+const (
+	boltPut boltChangeKind = iota
+	boltDelete
+	boltCreateBucket
+	boltDeleteBucket
+)
+
+// boltChange is a change to the bucket at path, or for the bucket
+// changes, to the bucket at path itself.
+type boltChange struct {
+	kind  boltChangeKind
+	path  [][]byte
+	key   []byte
+	value []byte
+}
+
+// boltJournal records the changes of committed updates, so that they
+// can be made again on a copy of the database.
+type boltJournal struct {
+	changes []boltChange
+}
+
+// record adds a change to the journal. Keys, values and names can
+// point into the memory map of the database, so they are copied.
+func (j *boltJournal) record(kind boltChangeKind, path [][]byte, key, value []byte) {
+	if j == nil {
+		return
+	}
+	change := boltChange{kind: kind, path: make([][]byte, len(path))}
+	for i, name := range path {
+		change.path[i] = append([]byte{}, name...)
+	}
+	if key != nil {
+		change.key = append([]byte{}, key...)
+	}
+	if value != nil {
+		change.value = append([]byte{}, value...)
+	}
+	j.changes = append(j.changes, change)
+}
+
+// apply makes the changes in the journal in tx, in the order in which
+// they were made.
+func (j *boltJournal) apply(tx *bolt.Tx) error {
+	for _, change := range j.changes {
+		var err error
+		switch change.kind {
+		case boltPut:
+			var bucket *bolt.Bucket
+			if bucket, err = boltCreateBuckets(tx, change.path); err == nil {
+				err = bucket.Put(change.key, change.value)
+			}
+		case boltDelete:
+			if bucket := boltLookupBucket(tx, change.path); bucket != nil {
+				err = bucket.Delete(change.key)
+			}
+		case boltCreateBucket:
+			_, err = boltCreateBuckets(tx, change.path)
+		case boltDeleteBucket:
+			last := len(change.path) - 1
+			if last == 0 {
+				err = tx.DeleteBucket(change.path[0])
+			} else if parent := boltLookupBucket(tx, change.path[:last]); parent != nil {
+				err = parent.DeleteBucket(change.path[last])
+			}
+			if err == bolt.ErrBucketNotFound {
+				err = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func boltLookupBucket(tx *bolt.Tx, path [][]byte) *bolt.Bucket {
+	bucket := tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		if bucket == nil {
+			return nil
+		}
+		bucket = bucket.Bucket(name)
+	}
+	return bucket
+}
+
+func boltCreateBuckets(tx *bolt.Tx, path [][]byte) (*bolt.Bucket, error) {
+	bucket, err := tx.CreateBucketIfNotExists(path[0])
+	for _, name := range path[1:] {
+		if err != nil {
+			return nil, err
+		}
+		bucket, err = bucket.CreateBucketIfNotExists(name)
+	}
+	return bucket, err
+}
@@ -0,0 +1,410 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// QueueSizes holds the number of entries in each of the buckets of a
+// queue.
+type QueueSizes struct {
+	Name        string
+	Visible     int
+	Leased      int
+	Delayed     int
+	Quarantined int
+}
+
+// Problem is an inconsistency found by CheckDatabase.
+type Problem struct {
+	Queue       string
+	Bucket      string
+	Key         []byte
+	Description string
+	Repair      string // What was, or would be, done about it
+}
+
+func (p Problem) String() string {
+	if p.Key != nil {
+		return fmt.Sprintf("%s/%s/%x: %s", p.Queue, p.Bucket, p.Key, p.Description)
+	}
+	if p.Bucket != "" {
+		return fmt.Sprintf("%s/%s: %s", p.Queue, p.Bucket, p.Description)
+	}
+	return fmt.Sprintf("%s: %s", p.Queue, p.Description)
+}
+
+// InspectDatabase opens the database file at path read-only and
+// returns the sizes of all queues in it.
+func InspectDatabase(path string) ([]QueueSizes, error) {
+	backend, err := openBoltBackendReadOnly(path)
+	if err != nil {
+		return nil, err
+	}
+	defer backend.Close()
+
+	var sizes []QueueSizes
+	err = backend.View(func(tx backendTx) error {
+		s := offlineStore()
+		queues := s.queues(tx)
+		if queues == nil {
+			return errors.New("Queues bucket not found")
+		}
+		return queues.ForEach(func(key, value []byte) error {
+			if value == nil {
+				sizes = append(sizes, s.queueSizes(tx, string(key)))
+			}
+			return nil
+		})
+	})
+	return sizes, err
+}
+
+// CheckDatabase opens the database file at path and verifies the
+// structure of every queue and the encoding of every message in it.
+// The database is only opened for writing when repair is true, in
+// which case missing buckets and settings are recreated, bad leases
+// are dropped and undecodable messages are quarantined.
+func CheckDatabase(path string, repair bool) ([]Problem, error) {
+	var backend backend
+	var err error
+	if repair {
+		backend, err = openBoltBackend(path)
+	} else {
+		backend, err = openBoltBackendReadOnly(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer backend.Close()
+
+	var problems []Problem
+	check := func(tx backendTx) error {
+		// Repairing the catalog as a database would delete it
+		if filepath.Base(path) == catalogName || offlineStore().isCatalog(tx) {
+			return errors.New("this is the catalog of a sharded store, check the shard files in its directory instead")
+		}
+		p, err := offlineStore().checkQueues(tx, repair)
+		problems = p
+		return err
+	}
+
+	if repair {
+		err = backend.Update(check)
+	} else {
+		err = backend.View(check)
+	}
+
+	return problems, err
+}
+
+// isCatalog tells if the database is the catalog of a sharded store,
+// which has the file of every queue in its Queues bucket instead of
+// the queues themselves.
+func (s *Store) isCatalog(tx backendTx) bool {
+	queues := s.queues(tx)
+	if queues == nil {
+		return false
+	}
+
+	entries, files := 0, 0
+	queues.ForEach(func(key, value []byte) error {
+		entries++
+		if value != nil && strings.HasSuffix(string(value), ".db") {
+			files++
+		}
+		return nil
+	})
+
+	return entries != 0 && files == entries
+}
+
+// offlineStore gives the checks access to the helpers of a Store
+// without opening one.
+func offlineStore() *Store {
+	o := defaultStoreOptions()
+	return &Store{options: o, logger: o.logger, clock: o.clock}
+}
+
+// countKeys returns the number of messages in a bucket, which is read
+// for every queue on every metrics scrape, so it does not visit them.
+func countKeys(bucket backendBucket) int {
+	if bucket == nil {
+		return 0
+	}
+	return bucket.KeyN()
+}
+
+func (s *Store) queueSizes(tx backendTx, name string) QueueSizes {
+	return QueueSizes{
+		Name:        name,
+		Visible:     countKeys(s.visible(tx, name)),
+		Leased:      countKeys(s.leased(tx, name)),
+		Delayed:     countKeys(s.delayed(tx, name)),
+		Quarantined: countKeys(s.bucket(tx, "Queues", name, "Quarantine")),
+	}
+}
+
+func (s *Store) checkQueues(tx backendTx, repair bool) ([]Problem, error) {
+	queues := s.queues(tx)
+	if queues == nil {
+		return nil, errors.New("Queues bucket not found")
+	}
+
+	var names []string
+	var badKeys [][]byte
+	queues.ForEach(func(key, value []byte) error {
+		if value != nil {
+			badKeys = append(badKeys, append([]byte{}, key...))
+		} else {
+			names = append(names, string(key))
+		}
+		return nil
+	})
+
+	var problems []Problem
+
+	for _, key := range badKeys {
+		problems = append(problems, Problem{
+			Queue:       string(key),
+			Description: "queue is a value instead of a bucket",
+			Repair:      "delete it",
+		})
+		if repair {
+			if err := queues.Delete(key); err != nil {
+				return problems, err
+			}
+		}
+	}
+
+	for _, name := range names {
+		p, err := s.checkQueue(tx, name, repair)
+		problems = append(problems, p...)
+		if err != nil {
+			return problems, err
+		}
+	}
+
+	return problems, nil
+}
+
+func (s *Store) checkQueue(tx backendTx, name string, repair bool) ([]Problem, error) {
+	var problems []Problem
+
+	queue := s.queue(tx, name)
+
+	// Meta
+
+	metaIsBroken := true
+	meta := queue.Bucket([]byte("Meta"))
+	if meta == nil {
+		problems = append(problems, Problem{Queue: name, Bucket: "Meta", Description: "bucket is missing", Repair: "recreate it"})
+	} else if _, err := decodeTime(meta.Get([]byte("Created"))); err != nil {
+		problems = append(problems, Problem{Queue: name, Bucket: "Meta", Key: []byte("Created"), Description: err.Error(), Repair: "set it to now"})
+	} else {
+		metaIsBroken = false
+	}
+
+	if repair && metaIsBroken {
+		meta, err := queue.CreateBucketIfNotExists([]byte("Meta"))
+		if err != nil {
+			return problems, err
+		}
+		if err := meta.Put([]byte("Name"), []byte(name)); err != nil {
+			return problems, err
+		}
+		if err := meta.Put([]byte("Created"), encodeTime(s.clock.Now())); err != nil {
+			return problems, err
+		}
+	}
+
+	// Settings
+
+	settings := queue.Bucket([]byte("Settings"))
+	if settings == nil {
+		problems = append(problems, Problem{Queue: name, Bucket: "Settings", Description: "bucket is missing", Repair: "recreate it with default settings"})
+		if repair {
+			var err error
+			if settings, err = queue.CreateBucketIfNotExists([]byte("Settings")); err != nil {
+				return problems, err
+			}
+		}
+	}
+
+	defaults := defaultQueueSettings()
+	for _, setting := range []struct {
+		name         string
+		defaultValue int
+		min, max     int
+	}{
+		{"LeaseDuration", defaults.LeaseDuration, MinLeaseDuration, MaxLeaseDuration},
+		{"MessageRetentionPeriod", defaults.MessageRetentionPeriod, MinMessageRetentionPeriod, MaxMessageRetentionPeriod},
+		{"DelaySeconds", defaults.DelaySeconds, MinDelaySeconds, MaxDelaySeconds},
+	} {
+		if settings == nil {
+			continue
+		}
+		v, err := decodeInt(settings.Get([]byte(setting.name)))
+		if err == nil && isInRange(v, setting.min, setting.max) {
+			continue
+		}
+		description := fmt.Sprintf("value %d is out of range", v)
+		if err != nil {
+			description = err.Error()
+		}
+		problems = append(problems, Problem{Queue: name, Bucket: "Settings", Key: []byte(setting.name), Description: description, Repair: "reset it to the default"})
+		if repair {
+			if err := settings.Put([]byte(setting.name), encodeInt(setting.defaultValue)); err != nil {
+				return problems, err
+			}
+		}
+	}
+
+	// Message buckets
+
+	messages := queue.Bucket([]byte("Messages"))
+	if messages == nil {
+		problems = append(problems, Problem{Queue: name, Bucket: "Messages", Description: "bucket is missing", Repair: "recreate it"})
+		if !repair {
+			return problems, nil
+		}
+		var err error
+		if messages, err = queue.CreateBucketIfNotExists([]byte("Messages")); err != nil {
+			return problems, err
+		}
+	}
+
+	for _, source := range []string{"Visible", "Leased", "Delayed"} {
+		bucket := messages.Bucket([]byte(source))
+		if bucket == nil {
+			problems = append(problems, Problem{Queue: name, Bucket: "Messages/" + source, Description: "bucket is missing", Repair: "recreate it"})
+			if repair {
+				if _, err := messages.CreateBucketIfNotExists([]byte(source)); err != nil {
+					return problems, err
+				}
+			}
+			continue
+		}
+
+		p, err := s.checkMessages(queue, name, source, repair)
+		problems = append(problems, p...)
+		if err != nil {
+			return problems, err
+		}
+	}
+
+	return problems, nil
+}
+
+// checkMessages verifies the keys and values in one of the message
+// buckets of a queue. Problems are collected first and repaired after
+// iterating, so that the bucket is not modified under the cursor.
+func (s *Store) checkMessages(queue backendBucket, name, source string, repair bool) ([]Problem, error) {
+	messages := queue.Bucket([]byte("Messages"))
+	bucket := messages.Bucket([]byte(source))
+	visible := messages.Bucket([]byte("Visible"))
+
+	type damage struct {
+		key, value []byte
+		reason     error
+		orphan     bool
+	}
+
+	var damaged []damage
+
+	bucket.ForEach(func(key, value []byte) error {
+		key, value = append([]byte{}, key...), append([]byte{}, value...)
+		if source == "Leased" {
+			if err := checkLeasedMessage(key, value); err != nil {
+				damaged = append(damaged, damage{key: key, value: value, reason: err})
+				return nil
+			}
+			var leaseID LeaseID
+			copy(leaseID[:], key)
+			messageID := messageIDFromLeaseID(leaseID)
+			if visible != nil && visible.Get(messageID[:]) != nil {
+				damaged = append(damaged, damage{key: key, value: value, reason: errors.New("orphaned lease, message is also visible"), orphan: true})
+			}
+		} else if err := checkMessage(key, value); err != nil {
+			damaged = append(damaged, damage{key: key, value: value, reason: err})
+		}
+		return nil
+	})
+
+	var problems []Problem
+
+	for _, d := range damaged {
+		problem := Problem{
+			Queue:       name,
+			Bucket:      "Messages/" + source,
+			Key:         d.key,
+			Description: d.reason.Error(),
+			Repair:      "quarantine it",
+		}
+		if d.orphan {
+			problem.Repair = "delete the lease"
+		}
+		problems = append(problems, problem)
+
+		if !repair {
+			continue
+		}
+
+		if d.orphan {
+			if err := bucket.Delete(d.key); err != nil {
+				return problems, err
+			}
+		} else if err := s.quarantineMessage(queue, source, d.key, d.value, d.reason); err != nil {
+			return problems, err
+		}
+	}
+
+	return problems, nil
+}
+
+func checkMessage(key, value []byte) error {
+	if len(key) != len(MessageID{}) {
+		return fmt.Errorf("bad message key length %d", len(key))
+	}
+	var message Message
+	if err := msgpack.Unmarshal(value, &message); err != nil {
+		return fmt.Errorf("undecodable message: %s", err)
+	}
+	return nil
+}
+
+func checkLeasedMessage(key, value []byte) error {
+	if len(key) != len(LeaseID{}) {
+		return fmt.Errorf("bad lease key length %d", len(key))
+	}
+	var leasedMessage LeasedMessage
+	if err := msgpack.Unmarshal(value, &leasedMessage); err != nil {
+		return fmt.Errorf("undecodable leased message: %s", err)
+	}
+	var message Message
+	if err := msgpack.Unmarshal(leasedMessage.Message, &message); err != nil {
+		return fmt.Errorf("undecodable message in lease: %s", err)
+	}
+	return nil
+}
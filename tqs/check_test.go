@@ -0,0 +1,139 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CheckDatabase(t *testing.T) {
+	path := temporaryDatabase()
+
+	store, err := NewStore(path)
+	assert.Nil(t, err)
+
+	_, _, err = store.CreateQueue("hello")
+	assert.Nil(t, err)
+
+	ids, err := store.PutMessages("hello", []Message{{Body: "Message1"}, {Body: "Message2"}})
+	assert.Len(t, ids, 2)
+	assert.Nil(t, err)
+
+	err = store.backend.Update(func(tx backendTx) error {
+		if err := store.visible(tx, "hello").Put(ids[0][:], []byte{0xc1}); err != nil {
+			return err
+		}
+		return store.settings(tx, "hello").Delete([]byte("DelaySeconds"))
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, store.Close())
+
+	problems, err := CheckDatabase(path, false)
+	assert.Nil(t, err)
+	assert.Len(t, problems, 2)
+
+	problems, err = CheckDatabase(path, true)
+	assert.Nil(t, err)
+	assert.Len(t, problems, 2)
+
+	problems, err = CheckDatabase(path, false)
+	assert.Nil(t, err)
+	assert.Len(t, problems, 0)
+
+	sizes, err := InspectDatabase(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []QueueSizes{{Name: "hello", Visible: 1, Quarantined: 1}}, sizes)
+}
+
+func Test_CheckDatabaseOrphanedLease(t *testing.T) {
+	path := temporaryDatabase()
+
+	store, err := NewStore(path)
+	assert.Nil(t, err)
+
+	_, _, err = store.CreateQueue("hello")
+	assert.Nil(t, err)
+
+	ids, err := store.PutMessages("hello", []Message{{Body: "Message1"}})
+	assert.Nil(t, err)
+
+	var value []byte
+	err = store.backend.View(func(tx backendTx) error {
+		value = append(value, store.visible(tx, "hello").Get(ids[0][:])...)
+		return nil
+	})
+	assert.Nil(t, err)
+
+	_, leases, err := store.GetMessages("hello", 1, DefaultLeaseDuration)
+	assert.Len(t, leases, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, ids[0], messageIDFromLeaseID(leases[0].ID))
+
+	err = store.backend.Update(func(tx backendTx) error {
+		return store.visible(tx, "hello").Put(ids[0][:], value)
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, store.Close())
+
+	problems, err := CheckDatabase(path, true)
+	assert.Nil(t, err)
+	assert.Len(t, problems, 1)
+
+	sizes, err := InspectDatabase(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []QueueSizes{{Name: "hello", Visible: 1}}, sizes)
+}
+
+func Test_CheckDatabaseRefusesCatalog(t *testing.T) {
+	directory := temporaryDatabase() + ".d"
+	defer os.RemoveAll(directory)
+
+	store, err := NewShardedStore(directory, 0)
+	assert.Nil(t, err)
+	for _, name := range []string{"one", "two"} {
+		_, _, err := store.CreateQueue(name)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, store.Close())
+
+	_, err = CheckDatabase(filepath.Join(directory, catalogName), true)
+	assert.NotNil(t, err)
+
+	// Also under another name
+	renamed := filepath.Join(directory, "renamed.db")
+	assert.Nil(t, os.Rename(filepath.Join(directory, catalogName), renamed))
+	_, err = CheckDatabase(renamed, true)
+	assert.NotNil(t, err)
+	assert.Nil(t, os.Rename(renamed, filepath.Join(directory, catalogName)))
+
+	problems, err := CheckDatabase(filepath.Join(directory, "queue-one.db"), true)
+	assert.Nil(t, err)
+	assert.Len(t, problems, 0)
+
+	store, err = NewShardedStore(directory, 0)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	names, err := store.GetQueueNames()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"one", "two"}, names)
+}
@@ -0,0 +1,483 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"github.com/vmihailenco/msgpack"
+)
+
+// In clustered mode every update goes through a Raft log instead of
+// being committed directly. The leader runs the update in a transaction
+// that is rolled back, records the mutations it made and appends them
+// to the log. Once a majority of the nodes has stored the entry, every
+// node applies the mutations to its own database. An update returns
+// only after that, so sends, receives, deletes and expiries that were
+// acknowledged survive the loss of the leader.
+//
+// The database itself is the state machine. The index of the last
+// applied entry is kept in the Cluster bucket, in the same transaction
+// as the mutations.
+
+var (
+	// ErrNotClustered is returned for cluster operations on a store
+	// that was not opened with NewClusteredStore.
+	ErrNotClustered = errors.New("store is not clustered")
+
+	errRollback = errors.New("rollback")
+)
+
+const (
+	clusterTimeout           = 10 * time.Second
+	clusterMaxPool           = 3
+	clusterSnapshotRetain    = 2
+	clusterSnapshotChunkSize = 1000 // Mutations per snapshot frame
+)
+
+// ClusterPeer is a node of a cluster.
+type ClusterPeer struct {
+	ID         string
+	Address    string // Address of the Raft transport, host:port
+	APIAddress string // Address of the HTTP API, host:port
+}
+
+// ClusterConfig configures a node of a cluster. Peers lists every node
+// of the cluster, including this one, and must be the same on all of
+// them. It is used to form the cluster the first time the nodes start.
+type ClusterConfig struct {
+	NodeID    string
+	Directory string // Where the Raft log and snapshots are kept
+	Peers     []ClusterPeer
+}
+
+// ClusterStatus describes a node of a cluster.
+type ClusterStatus struct {
+	NodeID       string
+	State        string
+	Leader       string
+	Term         uint64
+	AppliedIndex uint64
+	LastContact  time.Time
+	Peers        []ClusterPeer
+}
+
+type cluster struct {
+	sync.Mutex // Serializes updates on the leader
+	backend    backend
+	config     ClusterConfig
+	raft       *raft.Raft
+	logs       *raftboltdb.BoltStore
+	transport  *raft.NetworkTransport
+	readyTerm  uint64
+}
+
+// NewClusteredStore opens the database at path as a node of a cluster.
+// Updates fail with ErrNotLeader on every node but the leader.
+func NewClusteredStore(path string, config ClusterConfig, options ...StoreOption) (*Store, error) {
+	store, err := NewStore(path, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	cluster, err := newCluster(store.storage, config, store.logger)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	store.backend = cluster
+	store.cluster = cluster
+
+	return store, nil
+}
+
+func newCluster(storage backend, config ClusterConfig, logger *slog.Logger) (*cluster, error) {
+	self, ok := config.peer(config.NodeID)
+	if !ok {
+		return nil, fmt.Errorf("node <%s> is not one of the cluster peers", config.NodeID)
+	}
+
+	if err := os.MkdirAll(config.Directory, 0700); err != nil {
+		return nil, err
+	}
+
+	// Raft logs lines of text, which end up as messages of the logger
+	logOutput := slog.NewLogLogger(logger.Handler(), slog.LevelInfo).Writer()
+
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = raft.ServerID(config.NodeID)
+	raftConfig.LogOutput = logOutput
+	raftConfig.LogLevel = "WARN"
+
+	snapshots, err := raft.NewFileSnapshotStore(config.Directory, clusterSnapshotRetain, logOutput)
+	if err != nil {
+		return nil, err
+	}
+
+	logs, err := raftboltdb.NewBoltStore(filepath.Join(config.Directory, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := raft.NewTCPTransport(self.Address, nil, clusterMaxPool, clusterTimeout, logOutput)
+	if err != nil {
+		logs.Close()
+		return nil, err
+	}
+
+	c := &cluster{
+		backend:   storage,
+		config:    config,
+		logs:      logs,
+		transport: transport,
+	}
+
+	existing, err := raft.HasExistingState(logs, logs, snapshots)
+	if err != nil {
+		c.closeRaft()
+		return nil, err
+	}
+
+	if !existing {
+		var configuration raft.Configuration
+		for _, peer := range config.Peers {
+			configuration.Servers = append(configuration.Servers, raft.Server{
+				ID:      raft.ServerID(peer.ID),
+				Address: raft.ServerAddress(peer.Address),
+			})
+		}
+		if err := raft.BootstrapCluster(raftConfig, logs, logs, snapshots, transport, configuration); err != nil {
+			c.closeRaft()
+			return nil, err
+		}
+	}
+
+	c.raft, err = raft.NewRaft(raftConfig, clusterFSM{storage}, logs, logs, snapshots, transport)
+	if err != nil {
+		c.closeRaft()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (config ClusterConfig) peer(id string) (ClusterPeer, bool) {
+	for _, peer := range config.Peers {
+		if peer.ID == id {
+			return peer, true
+		}
+	}
+	return ClusterPeer{}, false
+}
+
+func (c *cluster) View(fn func(tx backendTx) error) error {
+	return c.backend.View(fn)
+}
+
+func (c *cluster) Update(fn func(tx backendTx) error) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	// A new leader can have committed entries that it did not apply
+	// yet, the update has to see those
+	if term := c.raft.CurrentTerm(); term != c.readyTerm {
+		if err := c.raft.Barrier(clusterTimeout).Error(); err != nil {
+			return clusterError(err)
+		}
+		c.readyTerm = term
+	}
+
+	var mutations []mutation
+	err := c.backend.Update(func(tx backendTx) error {
+		if err := fn(recordingTx{tx, &mutations}); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		return err
+	}
+
+	if len(mutations) == 0 {
+		return nil
+	}
+
+	encoded, err := msgpack.Marshal(mutations)
+	if err != nil {
+		return err
+	}
+
+	future := c.raft.Apply(encoded, clusterTimeout)
+	if err := future.Error(); err != nil {
+		return clusterError(err)
+	}
+	if err, ok := future.Response().(error); ok {
+		return err
+	}
+
+	return nil
+}
+
+func (c *cluster) Close() error {
+	err := c.raft.Shutdown().Error()
+	c.closeRaft()
+	if closeErr := c.backend.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (c *cluster) closeRaft() {
+	c.transport.Close()
+	c.logs.Close()
+}
+
+// appliedIndex is the index of the last entry applied to the database.
+// Raft's own applied index can run ahead of that.
+func (c *cluster) appliedIndex() uint64 {
+	var applied int
+	c.backend.View(func(tx backendTx) error {
+		if bucket := tx.Bucket([]byte("Cluster")); bucket != nil {
+			applied, _ = decodeInt(bucket.Get([]byte("AppliedIndex")))
+		}
+		return nil
+	})
+	return uint64(applied)
+}
+
+func (c *cluster) isLeader() bool {
+	return c.raft.State() == raft.Leader
+}
+
+// clusterError turns the errors of a node that lost or never had the
+// leadership into ErrNotLeader.
+func clusterError(err error) error {
+	switch err {
+	case raft.ErrNotLeader, raft.ErrLeadershipLost, raft.ErrLeadershipTransferInProgress:
+		return ErrNotLeader
+	}
+	return err
+}
+
+//
+
+// ClusterStatus returns the state of this node of the cluster.
+func (s *Store) ClusterStatus() (ClusterStatus, error) {
+	if s.cluster == nil {
+		return ClusterStatus{}, ErrNotClustered
+	}
+
+	c := s.cluster
+	_, leader := c.raft.LeaderWithID()
+
+	status := ClusterStatus{
+		NodeID:       c.config.NodeID,
+		State:        c.raft.State().String(),
+		Leader:       string(leader),
+		Term:         c.raft.CurrentTerm(),
+		AppliedIndex: c.appliedIndex(),
+		LastContact:  c.raft.LastContact(),
+	}
+
+	future := c.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return ClusterStatus{}, err
+	}
+	for _, server := range future.Configuration().Servers {
+		peer, ok := c.config.peer(string(server.ID))
+		if !ok {
+			peer = ClusterPeer{ID: string(server.ID)}
+		}
+		peer.Address = string(server.Address)
+		status.Peers = append(status.Peers, peer)
+	}
+
+	return status, nil
+}
+
+// ClusterLeader returns the API address of the leader of the cluster,
+// if there is one, and whether that is this node. A store that is not
+// clustered is always its own leader.
+func (s *Store) ClusterLeader() (string, bool) {
+	if s.cluster == nil {
+		return "", true
+	}
+
+	_, id := s.cluster.raft.LeaderWithID()
+	if id == "" {
+		return "", false
+	}
+
+	peer, _ := s.cluster.config.peer(string(id))
+	return peer.APIAddress, peer.ID == s.cluster.config.NodeID
+}
+
+//
+
+type clusterFSM struct {
+	backend backend
+}
+
+func (f clusterFSM) Apply(entry *raft.Log) interface{} {
+	var mutations []mutation
+	if err := msgpack.Unmarshal(entry.Data, &mutations); err != nil {
+		return err
+	}
+
+	return f.backend.Update(func(tx backendTx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("Cluster"))
+		if err != nil {
+			return err
+		}
+
+		// Entries can be applied again when a node restarts
+		if applied, err := decodeInt(bucket.Get([]byte("AppliedIndex"))); err == nil && uint64(applied) >= entry.Index {
+			return nil
+		}
+
+		if err := applyMutations(tx, mutations); err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte("AppliedIndex"), encodeInt(int(entry.Index)))
+	})
+}
+
+// Snapshot starts a read transaction that Persist writes out later,
+// while new entries are already being applied.
+func (f clusterFSM) Snapshot() (raft.FSMSnapshot, error) {
+	snapshot := &clusterSnapshot{
+		sinks:    make(chan raft.SnapshotSink),
+		done:     make(chan error, 1),
+		released: make(chan struct{}),
+	}
+
+	started := make(chan struct{})
+	go func() {
+		snapshot.done <- f.backend.View(func(tx backendTx) error {
+			close(started)
+			select {
+			case sink := <-snapshot.sinks:
+				return writeClusterSnapshot(tx, sink)
+			case <-snapshot.released:
+				return nil
+			}
+		})
+	}()
+
+	select {
+	case <-started:
+		return snapshot, nil
+	case err := <-snapshot.done:
+		return nil, err
+	}
+}
+
+// Restore replaces the whole database with a snapshot.
+func (f clusterFSM) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+	reader := bufio.NewReader(snapshot)
+
+	return f.backend.Update(func(tx backendTx) error {
+		if err := deleteBuckets(tx, ""); err != nil {
+			return err
+		}
+		for {
+			var mutations []mutation
+			if err := readFrame(reader, &mutations); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			if err := applyMutations(tx, mutations); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// A snapshot is a series of frames with the mutations that recreate
+// the database, including the Cluster bucket.
+func writeClusterSnapshot(tx backendTx, w io.Writer) error {
+	writer := bufio.NewWriter(w)
+
+	var chunk []mutation
+	err := walkDatabase(tx, "", func(m mutation) error {
+		chunk = append(chunk, m)
+		if len(chunk) < clusterSnapshotChunkSize {
+			return nil
+		}
+		err := writeFrameTo(writer, chunk)
+		chunk = chunk[:0]
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(chunk) != 0 {
+		if err := writeFrameTo(writer, chunk); err != nil {
+			return err
+		}
+	}
+
+	return writer.Flush()
+}
+
+type clusterSnapshot struct {
+	sinks    chan raft.SnapshotSink
+	done     chan error
+	released chan struct{}
+	once     sync.Once
+}
+
+func (s *clusterSnapshot) Persist(sink raft.SnapshotSink) error {
+	var err error
+	select {
+	case s.sinks <- sink:
+		err = <-s.done
+	case err = <-s.done:
+	}
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *clusterSnapshot) Release() {
+	s.once.Do(func() {
+		close(s.released)
+	})
+}
@@ -0,0 +1,214 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func newTestCluster(t *testing.T, size int) map[string]*Store {
+	var peers []ClusterPeer
+	for i := 1; i <= size; i++ {
+		id := fmt.Sprintf("n%d", i)
+		peers = append(peers, ClusterPeer{ID: id, Address: freeAddress(t), APIAddress: "api-" + id})
+	}
+
+	nodes := make(map[string]*Store)
+	for _, peer := range peers {
+		path := temporaryDatabase()
+		store, err := NewClusteredStore(path, ClusterConfig{NodeID: peer.ID, Directory: path + ".raft", Peers: peers})
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		nodes[peer.ID] = store
+		t.Cleanup(func() {
+			store.Close()
+			os.RemoveAll(path + ".raft")
+		})
+	}
+
+	return nodes
+}
+
+// waitForLeader waits until one of the nodes is the leader and all of
+// them agree on that.
+func waitForLeader(t *testing.T, nodes map[string]*Store) string {
+	deadline := time.Now().Add(15 * time.Second)
+	for time.Now().Before(deadline) {
+		var leader string
+		agreed := true
+		for id, node := range nodes {
+			address, isLeader := node.ClusterLeader()
+			if isLeader {
+				leader = id
+			}
+			if address == "" {
+				agreed = false
+			}
+		}
+		if leader != "" && agreed {
+			return leader
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("The cluster did not elect a leader")
+	return ""
+}
+
+// waitForApplied waits until every node applied what the leader applied.
+func waitForApplied(t *testing.T, nodes map[string]*Store, leader string) {
+	target, err := nodes[leader].ClusterStatus()
+	assert.Nil(t, err)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		caughtUp := true
+		for _, node := range nodes {
+			status, err := node.ClusterStatus()
+			assert.Nil(t, err)
+			if status.AppliedIndex < target.AppliedIndex {
+				caughtUp = false
+			}
+		}
+		if caughtUp {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("The nodes did not apply all entries")
+}
+
+func Test_Cluster(t *testing.T) {
+	nodes := newTestCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+
+	_, _, err := nodes[leader].CreateQueue("test")
+	assert.Nil(t, err)
+
+	_, err = nodes[leader].PutMessages("test", []Message{{Body: "Message1"}, {Body: "Message2"}, {Body: "Message3"}})
+	assert.Nil(t, err)
+
+	_, leases, err := nodes[leader].GetMessages("test", 1, DefaultLeaseDuration)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(leases))
+
+	waitForApplied(t, nodes, leader)
+
+	for id, node := range nodes {
+		assert.Equal(t, 2, countMessages(t, node, "test"), id)
+		if id != leader {
+			_, _, err := node.CreateQueue("other")
+			assert.Equal(t, ErrNotLeader, err)
+		}
+	}
+
+	// Acknowledged changes survive the loss of the leader
+
+	assert.Nil(t, nodes[leader].Close())
+	delete(nodes, leader)
+
+	leader = waitForLeader(t, nodes)
+
+	assert.Equal(t, 2, countMessages(t, nodes[leader], "test"))
+	assert.Nil(t, nodes[leader].DeleteLeasedMessage("test", leases[0].ID))
+
+	_, err = nodes[leader].PutMessages("test", []Message{{Body: "Message4"}})
+	assert.Nil(t, err)
+
+	waitForApplied(t, nodes, leader)
+
+	for id, node := range nodes {
+		assert.Equal(t, 3, countMessages(t, node, "test"), id)
+	}
+}
+
+func Test_NotClustered(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		_, err := store.ClusterStatus()
+		assert.Equal(t, ErrNotClustered, err)
+
+		_, leader := store.ClusterLeader()
+		assert.True(t, leader)
+	})
+}
+
+type testSnapshotSink struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (s *testSnapshotSink) ID() string    { return "test" }
+func (s *testSnapshotSink) Cancel() error { return nil }
+func (s *testSnapshotSink) Close() error  { s.closed = true; return nil }
+
+func Test_ClusterSnapshot(t *testing.T) {
+	withStores(t, func(t *testing.T, source *Store) {
+		_, _, err := source.CreateQueue("test")
+		assert.Nil(t, err)
+
+		_, err = source.PutMessages("test", []Message{{Body: "Message1"}, {Body: "Message2"}})
+		assert.Nil(t, err)
+
+		snapshot, err := clusterFSM{source.storage}.Snapshot()
+		assert.Nil(t, err)
+
+		var sink testSnapshotSink
+		persisted := make(chan error)
+		go func() {
+			persisted <- snapshot.Persist(&sink)
+		}()
+
+		// Changes after the snapshot was taken are not in it. The memory
+		// backend holds them back until the snapshot is written.
+		_, err = source.PutMessages("test", []Message{{Body: "Message3"}})
+		assert.Nil(t, err)
+
+		assert.Nil(t, <-persisted)
+		snapshot.Release()
+		assert.True(t, sink.closed)
+
+		destination, err := NewStore(MemoryDatabase)
+		assert.Nil(t, err)
+		defer destination.Close()
+
+		_, _, err = destination.CreateQueue("other")
+		assert.Nil(t, err)
+
+		assert.Nil(t, clusterFSM{destination.storage}.Restore(io.NopCloser(&sink)))
+
+		names, err := destination.GetQueueNames()
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"test"}, names)
+		assert.Equal(t, 2, countMessages(t, destination, "test"))
+	})
+}
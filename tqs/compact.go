@@ -0,0 +1,278 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// ErrCompactionBusy is returned by Compact while a backup or another
+// compaction of the database runs.
+var ErrCompactionBusy = errors.New("a backup or another compaction is running")
+
+// Bolt keeps a transaction in memory until it commits, so the copy is
+// committed in chunks of about this many bytes.
+const compactTxMaxSize = 16 * 1024 * 1024
+
+// CompactionProgress is passed to the progress callback of Compact
+// every time a chunk of the copy has been committed.
+type CompactionProgress struct {
+	Keys  int64
+	Bytes int64
+}
+
+// CompactionResult describes a finished compaction.
+type CompactionResult struct {
+	OriginalSize  int64
+	CompactedSize int64
+	Keys          int64
+	Duration      time.Duration
+}
+
+// Reclaimed returns the number of bytes the database file shrunk.
+func (r CompactionResult) Reclaimed() int64 {
+	return r.OriginalSize - r.CompactedSize
+}
+
+type compacter interface {
+	Compact(progress func(CompactionProgress)) (CompactionResult, error)
+}
+
+// Compact rewrites the database into a new file without the free
+// pages that bolt never gives back, and swaps it in. Reads and updates
+// continue while the data is copied, only the updates made during the
+// copy are made again on the copy while updates wait. An update that
+// has to grow the database file does wait for the copy, because bolt
+// cannot remap the file during a read transaction, which a large
+// InitialMmapSize in WithBoltOptions avoids. It does not wait for a
+// backup that is running, but returns ErrCompactionBusy. The files of
+// a sharded store have to be compacted with CompactDatabase.
+func (s *Store) Compact(progress func(CompactionProgress)) (CompactionResult, error) {
+	compacter, ok := s.storage.(compacter)
+	if !ok || s.sharding != nil {
+		return CompactionResult{}, ErrNotSupported
+	}
+	return compacter.Compact(progress)
+}
+
+// CompactDatabase compacts the database file at path, which must not
+// be in use.
+func CompactDatabase(path string, progress func(CompactionProgress)) (CompactionResult, error) {
+	backend, err := openBoltBackendWithTimeout(path, time.Second)
+	if err != nil {
+		return CompactionResult{}, err
+	}
+	defer backend.Close()
+	return backend.Compact(progress)
+}
+
+func (b *boltBackend) Compact(progress func(CompactionProgress)) (CompactionResult, error) {
+	if b.borrowed {
+		return CompactionResult{}, ErrNotSupported
+	}
+
+	if !b.compactLock.TryLock() {
+		return CompactionResult{}, ErrCompactionBusy
+	}
+	defer b.compactLock.Unlock()
+
+	start := time.Now()
+
+	result := CompactionResult{}
+	if info, err := os.Stat(b.path); err == nil {
+		result.OriginalSize = info.Size()
+	}
+
+	compactPath := b.path + ".compact"
+	os.Remove(compactPath)
+
+	compacted, err := bolt.Open(compactPath, 0600, b.options)
+	if err != nil {
+		return result, err
+	}
+
+	// The copy is made from a read transaction, while updates continue
+	// and are recorded in the journal from the moment it starts
+	b.writeLock.Lock()
+	b.RLock()
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		b.RUnlock()
+		b.writeLock.Unlock()
+		compacted.Close()
+		os.Remove(compactPath)
+		return result, err
+	}
+	b.journal = &boltJournal{}
+	b.writeLock.Unlock()
+
+	// Keys and values point into the original database, so the last
+	// chunk has to be committed before the read transaction ends
+	writer := &compactWriter{db: compacted, progress: progress}
+	err = tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+		return writer.copyBucket([][]byte{name}, bucket)
+	})
+	if err == nil {
+		err = writer.commit()
+	}
+	tx.Rollback()
+	b.RUnlock()
+
+	// Updates wait while the journal is applied to the copy and the
+	// files are swapped, which takes about as long as the updates took
+	b.writeLock.Lock()
+	defer b.writeLock.Unlock()
+
+	journal := b.journal
+	b.journal = nil
+
+	if err == nil {
+		err = compacted.Update(journal.apply)
+	}
+
+	if err != nil {
+		writer.rollback()
+		compacted.Close()
+		os.Remove(compactPath)
+		return result, err
+	}
+
+	// The compacted database stays open while it is renamed over the
+	// original, so there is no moment without a database
+	b.Lock()
+	if err := os.Rename(compactPath, b.path); err != nil {
+		b.Unlock()
+		compacted.Close()
+		os.Remove(compactPath)
+		return result, err
+	}
+	original := b.db
+	b.db = compacted
+	b.Unlock()
+
+	if err := original.Close(); err != nil {
+		return result, err
+	}
+
+	if info, err := os.Stat(b.path); err == nil {
+		result.CompactedSize = info.Size()
+	}
+	result.Keys = writer.keys
+	result.Duration = time.Since(start)
+
+	return result, nil
+}
+
+type compactWriter struct {
+	db       *bolt.DB
+	tx       *bolt.Tx
+	size     int
+	keys     int64
+	bytes    int64
+	progress func(CompactionProgress)
+}
+
+func (c *compactWriter) begin() error {
+	if c.tx != nil && c.size < compactTxMaxSize {
+		return nil
+	}
+	if err := c.commit(); err != nil {
+		return err
+	}
+	tx, err := c.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	c.tx = tx
+	c.size = 0
+	return nil
+}
+
+func (c *compactWriter) commit() error {
+	if c.tx == nil {
+		return nil
+	}
+	err := c.tx.Commit()
+	c.tx = nil
+	if err == nil && c.progress != nil {
+		c.progress(CompactionProgress{Keys: c.keys, Bytes: c.bytes})
+	}
+	return err
+}
+
+func (c *compactWriter) rollback() {
+	if c.tx != nil {
+		c.tx.Rollback()
+		c.tx = nil
+	}
+}
+
+// bucket returns the bucket at path in the current transaction,
+// creating it when needed, because a new transaction may have started
+// since the bucket was created.
+func (c *compactWriter) bucket(path [][]byte) (*bolt.Bucket, error) {
+	bucket, err := c.tx.CreateBucketIfNotExists(path[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range path[1:] {
+		if bucket, err = bucket.CreateBucketIfNotExists(name); err != nil {
+			return nil, err
+		}
+	}
+	return bucket, nil
+}
+
+func (c *compactWriter) copyBucket(path [][]byte, source *bolt.Bucket) error {
+	if err := c.begin(); err != nil {
+		return err
+	}
+	if _, err := c.bucket(path); err != nil {
+		return err
+	}
+
+	return source.ForEach(func(key, value []byte) error {
+		if value == nil {
+			child := append(append([][]byte{}, path...), key)
+			return c.copyBucket(child, source.Bucket(key))
+		}
+
+		if err := c.begin(); err != nil {
+			return err
+		}
+
+		bucket, err := c.bucket(path)
+		if err != nil {
+			return err
+		}
+
+		if err := bucket.Put(key, value); err != nil {
+			return err
+		}
+
+		c.size += len(key) + len(value)
+		c.keys++
+		c.bytes += int64(len(key) + len(value))
+
+		return nil
+	})
+}
@@ -0,0 +1,198 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Compact(t *testing.T) {
+	path := temporaryDatabase()
+
+	store, err := NewStore(path)
+	assert.Nil(t, err)
+
+	_, _, err = store.CreateQueue("hello")
+	assert.Nil(t, err)
+
+	body := strings.Repeat("x", 1024)
+	for i := 0; i < 10; i++ {
+		messages := make([]Message, 500)
+		for j := range messages {
+			messages[j].Body = body
+		}
+		_, err = store.PutMessages("hello", messages)
+		assert.Nil(t, err)
+	}
+
+	assert.Nil(t, store.PurgeQueue("hello"))
+
+	_, err = store.PutMessages("hello", []Message{{Body: "Message1"}})
+	assert.Nil(t, err)
+
+	// Updates that arrive during the compaction must not get lost
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := store.PutMessages("hello", []Message{{Body: "Message2"}})
+		assert.Nil(t, err)
+	}()
+
+	var progressed bool
+	result, err := store.Compact(func(progress CompactionProgress) {
+		progressed = true
+	})
+	assert.Nil(t, err)
+	assert.True(t, progressed)
+	assert.True(t, result.Reclaimed() > 0)
+
+	wg.Wait()
+
+	messages, _, err := store.GetMessages("hello", 5, DefaultLeaseDuration)
+	assert.Nil(t, err)
+	assert.Len(t, messages, 2)
+
+	assert.Nil(t, store.Close())
+
+	problems, err := CheckDatabase(path, false)
+	assert.Nil(t, err)
+	assert.Len(t, problems, 0)
+}
+
+func Test_CompactKeepsUpdatesDuringCopy(t *testing.T) {
+	path := temporaryDatabase()
+
+	// Room to grow, otherwise the updates below wait for the copy that
+	// waits for them
+	store, err := NewStore(path, WithBoltOptions(&bolt.Options{InitialMmapSize: 16 * 1024 * 1024}))
+	assert.Nil(t, err)
+
+	for _, name := range []string{"hello", "doomed"} {
+		_, _, err = store.CreateQueue(name)
+		assert.Nil(t, err)
+		_, err = store.PutMessages(name, []Message{{Body: "Message1"}, {Body: "Message2"}})
+		assert.Nil(t, err)
+	}
+
+	// The progress callback runs while the copy is made, with the read
+	// transaction of the copy open
+	updated := false
+	_, err = store.Compact(func(progress CompactionProgress) {
+		if updated {
+			return
+		}
+		updated = true
+
+		_, err := store.PutMessages("hello", []Message{{Body: "Message3"}})
+		assert.Nil(t, err)
+
+		_, leases, err := store.GetMessages("hello", 1, DefaultLeaseDuration)
+		assert.Nil(t, err)
+		assert.Nil(t, store.DeleteLeasedMessage("hello", leases[0].ID))
+
+		assert.Nil(t, store.DeleteQueue("doomed"))
+
+		_, _, err = store.CreateQueue("new")
+		assert.Nil(t, err)
+		_, err = store.PutMessages("new", []Message{{Body: "Message4"}})
+		assert.Nil(t, err)
+	})
+	assert.Nil(t, err)
+	assert.True(t, updated)
+
+	names, err := store.GetQueueNames()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"hello", "new"}, names)
+
+	messages, _, err := store.GetMessages("hello", 5, DefaultLeaseDuration)
+	assert.Nil(t, err)
+	assert.Len(t, messages, 2)
+
+	messages, _, err = store.GetMessages("new", 5, DefaultLeaseDuration)
+	assert.Nil(t, err)
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "Message4", messages[0].Body)
+	}
+
+	assert.Nil(t, store.Close())
+
+	problems, err := CheckDatabase(path, false)
+	assert.Nil(t, err)
+	assert.Len(t, problems, 0)
+}
+
+func Test_CompactMemoryStore(t *testing.T) {
+	store, err := NewStore(MemoryDatabase)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	_, err = store.Compact(nil)
+	assert.Equal(t, ErrNotSupported, err)
+}
+
+func Test_CompactDoesNotWaitForBackup(t *testing.T) {
+	store, err := NewStore(temporaryDatabase())
+	assert.Nil(t, err)
+	defer store.Close()
+
+	_, _, err = store.CreateQueue("hello")
+	assert.Nil(t, err)
+
+	// A backup to a client that does not read
+	reader, writer := io.Pipe()
+	backup := make(chan error, 1)
+	go func() {
+		_, err := store.WriteBackup(writer)
+		writer.Close()
+		backup <- err
+	}()
+
+	_, err = reader.Read(make([]byte, 1))
+	assert.Nil(t, err)
+
+	compacted := make(chan error, 1)
+	go func() {
+		_, err := store.Compact(nil)
+		compacted <- err
+	}()
+
+	select {
+	case err := <-compacted:
+		assert.Equal(t, ErrCompactionBusy, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Compact waits for the backup")
+	}
+
+	_, err = store.PutMessages("hello", []Message{{Body: "Hello"}})
+	assert.Nil(t, err)
+
+	_, err = io.Copy(io.Discard, reader)
+	assert.Nil(t, err)
+	assert.Nil(t, <-backup)
+
+	_, err = store.Compact(nil)
+	assert.Nil(t, err)
+}
@@ -17,12 +17,6 @@
 
 package tqs
 
-import (
-	"time"
-
-	"github.com/boltdb/bolt"
-)
-
 // QueueSetting needs a comment TODO
 type QueueSetting func(*QueueSettings) error
 
@@ -55,6 +49,31 @@ func defaultQueueSettings() QueueSettings {
 	}
 }
 
+// DefaultQueueSettings returns the settings that new queues get when
+// they are created without them.
+func (s *Store) DefaultQueueSettings() QueueSettings {
+	s.queueDefaultsLock.Lock()
+	defer s.queueDefaultsLock.Unlock()
+	return s.queueDefaults
+}
+
+// SetDefaultQueueSettings changes the settings that new queues get,
+// starting from the built in defaults. Existing queues keep theirs.
+func (s *Store) SetDefaultQueueSettings(settings ...QueueSetting) error {
+	defaults := defaultQueueSettings()
+	for _, setting := range settings {
+		if err := setting(&defaults); err != nil {
+			return err
+		}
+	}
+
+	s.queueDefaultsLock.Lock()
+	defer s.queueDefaultsLock.Unlock()
+	s.queueDefaults = defaults
+
+	return nil
+}
+
 //
 
 // CreateQueue needs a comment TODO
@@ -63,8 +82,8 @@ func (s *Store) CreateQueue(name string, overriddenSettings ...QueueSetting) (Qu
 		return QueueMeta{}, QueueSettings{}, ErrInvalidQueueName
 	}
 
-	meta := QueueMeta{Name: name, Created: time.Now()}
-	settings := defaultQueueSettings()
+	meta := QueueMeta{Name: name, Created: s.clock.Now()}
+	settings := s.DefaultQueueSettings()
 
 	for _, setting := range overriddenSettings {
 		if err := setting(&settings); err != nil {
@@ -72,68 +91,80 @@ func (s *Store) CreateQueue(name string, overriddenSettings ...QueueSetting) (Qu
 		}
 	}
 
-	return meta, settings, s.db.Update(func(tx *bolt.Tx) error {
-		queues := tx.Bucket([]byte("Queues"))
+	if s.sharding != nil {
+		return meta, settings, s.createShardedQueue(name, meta, settings)
+	}
 
-		bucket, err := queues.CreateBucket([]byte(name))
-		if err != nil {
-			if err == bolt.ErrBucketExists {
-				return ErrQueueExists
-			}
-			return err
-		}
+	return meta, settings, s.backend.Update(func(tx backendTx) error {
+		return s.createQueue(tx, name, meta, settings)
+	})
+}
 
-		// Meta
+func (s *Store) createQueue(tx backendTx, name string, meta QueueMeta, settings QueueSettings) error {
+	queues := tx.Bucket([]byte("Queues"))
 
-		metaBucket, err := bucket.CreateBucketIfNotExists([]byte("Meta"))
-		if err != nil {
-			return err
+	bucket, err := queues.CreateBucket([]byte(name))
+	if err != nil {
+		if err == errBucketExists {
+			return ErrQueueExists
 		}
+		return err
+	}
 
-		if err = metaBucket.Put([]byte("Name"), []byte(name)); err != nil {
-			return err
-		}
+	// Meta
 
-		if err = metaBucket.Put([]byte("Created"), encodeTime(meta.Created)); err != nil {
-			return err
-		}
+	metaBucket, err := bucket.CreateBucketIfNotExists([]byte("Meta"))
+	if err != nil {
+		return err
+	}
 
-		// Settings
+	if err = metaBucket.Put([]byte("Name"), []byte(name)); err != nil {
+		return err
+	}
 
-		settingsBucket, err := bucket.CreateBucketIfNotExists([]byte("Settings"))
-		if err != nil {
-			return err
-		}
+	if err = metaBucket.Put([]byte("Created"), encodeTime(meta.Created)); err != nil {
+		return err
+	}
 
-		if err = settingsBucket.Put([]byte("LeaseDuration"), encodeInt(settings.LeaseDuration)); err != nil {
-			return err
-		}
-		if err = settingsBucket.Put([]byte("MessageRetentionPeriod"), encodeInt(settings.MessageRetentionPeriod)); err != nil {
-			return err
-		}
-		if err = settingsBucket.Put([]byte("DelaySeconds"), encodeInt(settings.DelaySeconds)); err != nil {
-			return err
-		}
+	// Settings
 
-		// Message Buckets
+	settingsBucket, err := bucket.CreateBucketIfNotExists([]byte("Settings"))
+	if err != nil {
+		return err
+	}
 
-		messages, err := bucket.CreateBucketIfNotExists([]byte("Messages"))
-		if err != nil {
-			return err
-		}
+	if err := putQueueSettings(settingsBucket, settings); err != nil {
+		return err
+	}
 
-		if _, err := messages.CreateBucketIfNotExists([]byte("Visible")); err != nil {
-			return err
-		}
+	// Message Buckets
 
-		if _, err := messages.CreateBucketIfNotExists([]byte("Leased")); err != nil {
-			return err
-		}
+	messages, err := bucket.CreateBucketIfNotExists([]byte("Messages"))
+	if err != nil {
+		return err
+	}
 
-		if _, err := messages.CreateBucketIfNotExists([]byte("Delayed")); err != nil {
-			return err
-		}
+	if _, err := messages.CreateBucketIfNotExists([]byte("Visible")); err != nil {
+		return err
+	}
 
-		return nil
-	})
+	if _, err := messages.CreateBucketIfNotExists([]byte("Leased")); err != nil {
+		return err
+	}
+
+	if _, err := messages.CreateBucketIfNotExists([]byte("Delayed")); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func putQueueSettings(bucket backendBucket, settings QueueSettings) error {
+	if err := bucket.Put([]byte("LeaseDuration"), encodeInt(settings.LeaseDuration)); err != nil {
+		return err
+	}
+	if err := bucket.Put([]byte("MessageRetentionPeriod"), encodeInt(settings.MessageRetentionPeriod)); err != nil {
+		return err
+	}
+	return bucket.Put([]byte("DelaySeconds"), encodeInt(settings.DelaySeconds))
 }
@@ -0,0 +1,46 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Package tqs is the queue store behind tqsd. It can also be embedded
+// in a Go program that wants durable queues without running tqsd:
+//
+//	store, err := tqs.NewStore("/var/lib/myapp/queues.db")
+//	if err != nil {
+//		return err
+//	}
+//	defer store.Close()
+//
+//	store.Start() // Expire leases and messages in the background
+//
+//	store.CreateQueue("jobs")
+//	store.PutMessages("jobs", []tqs.Message{{Body: "hello"}})
+//	messages, leases, err := store.GetMessages("jobs", 10, 30)
+//	...
+//	store.DeleteLeasedMessage("jobs", leases[0].ID)
+//
+// NewStore takes options for the logger, the clock and bolt itself, and
+// WithBoltDB puts the queues in a bolt database that the program
+// already has open.
+//
+// All methods of a Store are safe for concurrent use. Each call runs in
+// its own transaction, so a receive never hands out a message that
+// another receive leased, and a failed call changes nothing.
+//
+// Errors that callers are expected to handle, like ErrQueueNotFound and
+// ErrLeaseNotFound, are returned as they are or wrapped, and should be
+// tested with errors.Is.
+package tqs
@@ -0,0 +1,294 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// ErrInvalidImport is returned by ImportQueue for input that is not a
+// valid export.
+var ErrInvalidImport = errors.New("invalid import")
+
+const importBatchSize = 1000
+
+// ExportedMessage is one line of a queue export. LeaseID and
+// LeaseExpiration are only set for messages in the Leased state.
+type ExportedMessage struct {
+	ID              MessageID
+	State           string // Visible, Leased or Delayed
+	Enqueued        time.Time
+	Body            string
+	Settings        MessageSettings
+	LeaseID         *LeaseID   `json:",omitempty"`
+	LeaseExpiration *time.Time `json:",omitempty"`
+}
+
+// ImportOptions control how ImportQueue recreates messages.
+type ImportOptions struct {
+	// PreserveIDs keeps the exported message and lease IDs. Otherwise
+	// messages get new IDs, which also resets their enqueue time and
+	// with that their retention period. An import that keeps IDs stops
+	// at a message whose ID is already in the queue, instead of
+	// replacing that message.
+	PreserveIDs bool
+	// ResetLeases makes leased messages visible again instead of
+	// restoring their leases.
+	ResetLeases bool
+}
+
+// ExportQueue writes all messages of a queue to w as JSON Lines, one
+// ExportedMessage per line, from a single consistent view of the
+// queue. Quarantined and undecodable messages are not exported. It
+// returns the number of exported messages.
+func (s *Store) ExportQueue(name string, w io.Writer) (int, error) {
+	count := 0
+	err := s.queueView(name, func(tx backendTx) error {
+		if s.queue(tx, name) == nil {
+			return ErrQueueNotFound
+		}
+
+		encoder := json.NewEncoder(w)
+
+		for _, state := range []string{"Visible", "Leased", "Delayed"} {
+			err := s.bucket(tx, "Queues", name, "Messages", state).ForEach(func(key, value []byte) error {
+				exported, err := exportMessage(state, key, value)
+				if err != nil {
+					s.logger.Warn("Not exporting undecodable message", "queue", name, "state", state, "key", fmt.Sprintf("%x", key), "error", err)
+					return nil
+				}
+				count++
+				return encoder.Encode(&exported)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	return count, err
+}
+
+func exportMessage(state string, key, value []byte) (ExportedMessage, error) {
+	exported := ExportedMessage{State: state}
+
+	if state == "Leased" {
+		if err := checkLeasedMessage(key, value); err != nil {
+			return exported, err
+		}
+
+		var leasedMessage LeasedMessage
+		if err := msgpack.Unmarshal(value, &leasedMessage); err != nil {
+			return exported, err
+		}
+
+		var leaseID LeaseID
+		copy(leaseID[:], key)
+		exported.LeaseID = &leaseID
+		exported.LeaseExpiration = &leasedMessage.Expiration
+
+		key, value = leaseID[:len(MessageID{})], leasedMessage.Message
+	}
+
+	if err := checkMessage(key, value); err != nil {
+		return exported, err
+	}
+
+	var message Message
+	if err := msgpack.Unmarshal(value, &message); err != nil {
+		return exported, err
+	}
+
+	copy(exported.ID[:], key)
+	exported.Enqueued = timeFromMessageKey(key)
+	exported.Body = message.Body
+	exported.Settings = message.Settings
+
+	return exported, nil
+}
+
+// ImportQueue reads messages in the format written by ExportQueue from
+// r and adds them to an existing queue. Messages are committed in
+// batches, so when an error is returned the messages before the bad
+// line may have been imported. It returns the number of imported
+// messages.
+func (s *Store) ImportQueue(name string, r io.Reader, options ImportOptions) (int, error) {
+	count := 0
+	line := 0
+	batch := make([]ExportedMessage, 0, importBatchSize)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 8*MaxBodyLength) // Room for escaped bodies
+
+	for {
+		more := scanner.Scan()
+
+		if more {
+			line++
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			var exported ExportedMessage
+			if err := json.Unmarshal(scanner.Bytes(), &exported); err != nil {
+				return count, fmt.Errorf("%w: line %d: %s", ErrInvalidImport, line, err)
+			}
+			if err := validateExportedMessage(exported); err != nil {
+				return count, fmt.Errorf("%w: line %d: %s", ErrInvalidImport, line, err)
+			}
+			// A preserved lease ID has to start with the message ID,
+			// or the lease would release or delete another message
+			if options.PreserveIDs && exported.LeaseID != nil && messageIDFromLeaseID(*exported.LeaseID) != exported.ID {
+				return count, fmt.Errorf("%w: line %d: lease ID is not of message %x", ErrInvalidImport, line, exported.ID[:])
+			}
+			batch = append(batch, exported)
+		}
+
+		if len(batch) == importBatchSize || (!more && len(batch) != 0) {
+			if err := s.importMessages(name, batch, options); err != nil {
+				return count, err
+			}
+			count += len(batch)
+			batch = batch[:0]
+		}
+
+		if !more {
+			break
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return count, fmt.Errorf("%w: line %d: %s", ErrInvalidImport, line+1, err)
+	}
+
+	return count, nil
+}
+
+func validateExportedMessage(exported ExportedMessage) error {
+	switch exported.State {
+	case "Visible", "Delayed":
+	case "Leased":
+		if exported.LeaseID == nil || exported.LeaseExpiration == nil {
+			return errors.New("leased message without LeaseID or LeaseExpiration")
+		}
+	default:
+		return fmt.Errorf("unknown state <%s>", exported.State)
+	}
+	if len(exported.Body) > MaxBodyLength {
+		return errors.New("message body too long")
+	}
+	return nil
+}
+
+func (s *Store) importMessages(name string, batch []ExportedMessage, options ImportOptions) error {
+	return s.queueUpdate(name, func(tx backendTx) error {
+		if s.queue(tx, name) == nil {
+			return ErrQueueNotFound
+		}
+
+		// Leased messages are keyed by their lease ID, which starts with
+		// the ID of the message
+		var leased map[MessageID]struct{}
+		if options.PreserveIDs {
+			leased = make(map[MessageID]struct{})
+			err := s.leased(tx, name).ForEach(func(key, value []byte) error {
+				var leaseID LeaseID
+				copy(leaseID[:], key)
+				leased[messageIDFromLeaseID(leaseID)] = struct{}{}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, exported := range batch {
+			message := Message{Body: exported.Body, Settings: exported.Settings}
+			if message.Settings.Priority == 0 {
+				message.Settings.Priority = DefaultPriority
+			}
+
+			value, err := msgpack.Marshal(&message)
+			if err != nil {
+				return err
+			}
+
+			messageID := exported.ID
+			if options.PreserveIDs {
+				if s.hasMessage(tx, name, leased, messageID) {
+					return fmt.Errorf("%w: message %x is already in the queue", ErrInvalidImport, messageID[:])
+				}
+				leased[messageID] = struct{}{} // Also catches duplicates in the import
+			} else {
+				messageID = generateMessageID(uint8(message.Settings.Priority), s.timestamp())
+			}
+
+			state := exported.State
+			if state == "Leased" && options.ResetLeases {
+				state = "Visible"
+			}
+
+			if state != "Leased" {
+				if err := s.bucket(tx, "Queues", name, "Messages", state).Put(messageID[:], value); err != nil {
+					return err
+				}
+				continue
+			}
+
+			leaseID := *exported.LeaseID
+			if !options.PreserveIDs {
+				leaseID = generateLeaseID(messageID, s.timestamp())
+			}
+
+			encodedLeasedMessage, err := msgpack.Marshal(LeasedMessage{
+				Expiration: *exported.LeaseExpiration,
+				Message:    value,
+			})
+			if err != nil {
+				return err
+			}
+
+			if err := s.leased(tx, name).Put(leaseID[:], encodedLeasedMessage); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// hasMessage tells if a message with id is visible, delayed or in the
+// leased set of the queue.
+func (s *Store) hasMessage(tx backendTx, name string, leased map[MessageID]struct{}, id MessageID) bool {
+	if _, ok := leased[id]; ok {
+		return true
+	}
+	for _, state := range []string{"Visible", "Delayed"} {
+		if s.bucket(tx, "Queues", name, "Messages", state).Get(id[:]) != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ExportImportQueue(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		_, _, err := store.CreateQueue("source")
+		assert.Nil(t, err)
+
+		_, err = store.PutMessages("source", []Message{{Body: "Message1"}, {Body: "Message2"}, {Body: "Message3"}})
+		assert.Nil(t, err)
+
+		_, leases, err := store.GetMessages("source", 1, DefaultLeaseDuration)
+		assert.Nil(t, err)
+
+		var export bytes.Buffer
+		n, err := store.ExportQueue("source", &export)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, n)
+		assert.Equal(t, 3, strings.Count(export.String(), "\n"))
+
+		// Preserving IDs and leases gives an identical queue
+
+		_, _, err = store.CreateQueue("copy")
+		assert.Nil(t, err)
+
+		n, err = store.ImportQueue("copy", bytes.NewReader(export.Bytes()), ImportOptions{PreserveIDs: true})
+		assert.Nil(t, err)
+		assert.Equal(t, 3, n)
+
+		var copied bytes.Buffer
+		_, err = store.ExportQueue("copy", &copied)
+		assert.Nil(t, err)
+		assert.Equal(t, export.String(), copied.String())
+
+		assert.Nil(t, store.DeleteLeasedMessage("copy", leases[0].ID))
+
+		// Resetting leases makes all messages visible under new IDs
+
+		_, _, err = store.CreateQueue("reset")
+		assert.Nil(t, err)
+
+		n, err = store.ImportQueue("reset", bytes.NewReader(export.Bytes()), ImportOptions{ResetLeases: true})
+		assert.Nil(t, err)
+		assert.Equal(t, 3, n)
+
+		messages, _, err := store.GetMessages("reset", 5, DefaultLeaseDuration)
+		assert.Nil(t, err)
+		assert.Len(t, messages, 3)
+	})
+}
+
+func Test_ImportQueueRejectsBadInput(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		_, _, err := store.CreateQueue("hello")
+		assert.Nil(t, err)
+
+		input := `{"ID":"7f0000000000000001","State":"Visible","Body":"Message1"}
+{"ID":"7f0000000000000002","State":"Sleeping","Body":"Message2"}
+`
+		n, err := store.ImportQueue("hello", strings.NewReader(input), ImportOptions{})
+		assert.Equal(t, 0, n)
+		assert.True(t, errors.Is(err, ErrInvalidImport))
+
+		_, err = store.ImportQueue("missing", strings.NewReader(input[:strings.Index(input, "\n")]), ImportOptions{})
+		assert.Equal(t, ErrQueueNotFound, err)
+	})
+}
+
+func Test_ImportQueueRejectsDuplicateIDs(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		_, _, err := store.CreateQueue("hello")
+		assert.Nil(t, err)
+
+		_, err = store.PutMessages("hello", []Message{{Body: "Message1"}, {Body: "Message2"}})
+		assert.Nil(t, err)
+
+		_, _, err = store.GetMessages("hello", 1, DefaultLeaseDuration)
+		assert.Nil(t, err)
+
+		var export bytes.Buffer
+		_, err = store.ExportQueue("hello", &export)
+		assert.Nil(t, err)
+
+		// Both the visible and the leased message are already there
+		for _, line := range strings.SplitAfter(strings.TrimSpace(export.String()), "\n") {
+			n, err := store.ImportQueue("hello", strings.NewReader(line), ImportOptions{PreserveIDs: true})
+			assert.Equal(t, 0, n)
+			assert.True(t, errors.Is(err, ErrInvalidImport))
+		}
+
+		// And so is a message that appears twice in the import
+		_, _, err = store.CreateQueue("copy")
+		assert.Nil(t, err)
+
+		line := export.String()[:strings.Index(export.String(), "\n")+1]
+		n, err := store.ImportQueue("copy", strings.NewReader(line+line), ImportOptions{PreserveIDs: true})
+		assert.Equal(t, 0, n)
+		assert.True(t, errors.Is(err, ErrInvalidImport))
+
+		// Without PreserveIDs the messages get new IDs
+		n, err = store.ImportQueue("hello", bytes.NewReader(export.Bytes()), ImportOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, 2, n)
+
+		n, err = store.ExportQueue("hello", io.Discard)
+		assert.Nil(t, err)
+		assert.Equal(t, 4, n)
+	})
+}
+
+func Test_ImportQueueRejectsLeaseOfOtherMessage(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		for _, name := range []string{"hello", "copy"} {
+			_, _, err := store.CreateQueue(name)
+			assert.Nil(t, err)
+		}
+
+		_, err := store.PutMessages("hello", []Message{{Body: "Message1"}, {Body: "Message2"}})
+		assert.Nil(t, err)
+
+		_, leases, err := store.GetMessages("hello", 1, DefaultLeaseDuration)
+		assert.Nil(t, err)
+
+		var export bytes.Buffer
+		_, err = store.ExportQueue("hello", &export)
+		assert.Nil(t, err)
+
+		// The lease of the first message on the second one
+		var messages []ExportedMessage
+		for _, line := range strings.Split(strings.TrimSpace(export.String()), "\n") {
+			var exported ExportedMessage
+			assert.Nil(t, json.Unmarshal([]byte(line), &exported))
+			messages = append(messages, exported)
+		}
+		if !assert.Len(t, messages, 2) {
+			return
+		}
+		for i := range messages {
+			messages[i].State = "Leased"
+			messages[i].LeaseID = &leases[0].ID
+			messages[i].LeaseExpiration = &leases[0].Expiration
+		}
+
+		for _, message := range messages {
+			line, err := json.Marshal(&message)
+			assert.Nil(t, err)
+
+			n, err := store.ImportQueue("copy", bytes.NewReader(line), ImportOptions{PreserveIDs: true})
+			if messageIDFromLeaseID(leases[0].ID) == message.ID {
+				assert.Nil(t, err)
+				assert.Equal(t, 1, n)
+			} else {
+				assert.Equal(t, 0, n)
+				assert.True(t, errors.Is(err, ErrInvalidImport))
+			}
+		}
+	})
+}
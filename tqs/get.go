@@ -20,7 +20,6 @@ package tqs
 import (
 	"time"
 
-	"github.com/boltdb/bolt"
 	"github.com/vmihailenco/msgpack"
 )
 
@@ -28,7 +27,8 @@ import (
 func (s *Store) GetMessages(name string, maxNumberOfMessages int, leaseDuration int) ([]Message, []Lease, error) {
 	messages := []Message{}
 	leases := []Lease{}
-	return messages, leases, s.db.Update(func(tx *bolt.Tx) error {
+	quarantined := 0
+	err := s.queueUpdate(name, func(tx backendTx) error {
 		visible := s.visible(tx, name)
 		if visible == nil {
 			return ErrQueueNotFound
@@ -52,6 +52,16 @@ func (s *Store) GetMessages(name string, maxNumberOfMessages int, leaseDuration
 
 		cursor := visible.Cursor()
 		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			// Move bad entries out of the way so that they do not
+			// block the rest of the queue
+			if err := checkMessage(k, v); err != nil {
+				if err := s.quarantineMessage(s.queue(tx, name), "Visible", k, v, err); err != nil {
+					return err
+				}
+				quarantined++
+				continue
+			}
+
 			var messageID MessageID
 			for i := 0; i < len(messageID); i++ {
 				messageID[i] = k[i]
@@ -73,7 +83,7 @@ func (s *Store) GetMessages(name string, maxNumberOfMessages int, leaseDuration
 			// easily sort on it.
 
 			leasedMessage := LeasedMessage{
-				Expiration: time.Now().Add(time.Duration(leaseDuration) * time.Second),
+				Expiration: s.clock.Now().Add(time.Duration(settings.LeaseDuration) * time.Second),
 				Message:    v,
 			}
 
@@ -82,7 +92,7 @@ func (s *Store) GetMessages(name string, maxNumberOfMessages int, leaseDuration
 				return err
 			}
 
-			leaseID := generateLeaseID(messageID)
+			leaseID := generateLeaseID(messageID, s.timestamp())
 			if err := leased.Put(leaseID[:], encodedLeasedMessage); err != nil {
 				return err
 			}
@@ -107,4 +117,14 @@ func (s *Store) GetMessages(name string, maxNumberOfMessages int, leaseDuration
 		}
 		return nil
 	})
+	if err != nil {
+		return messages, leases, err
+	}
+
+	s.counters.queue(name, func(c *queueCounters) {
+		c.received += uint64(len(messages))
+		c.quarantined += uint64(quarantined)
+	})
+
+	return messages, leases, nil
 }
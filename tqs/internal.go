@@ -19,15 +19,15 @@ package tqs
 
 import (
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"regexp"
 	"strconv"
 	"time"
-
-	"github.com/boltdb/bolt"
 )
 
-func (s *Store) bucket(tx *bolt.Tx, path ...string) *bolt.Bucket {
+func (s *Store) bucket(tx backendTx, path ...string) backendBucket {
 	bucket := tx.Bucket([]byte(path[0]))
 	if bucket == nil {
 		return nil
@@ -43,35 +43,35 @@ func (s *Store) bucket(tx *bolt.Tx, path ...string) *bolt.Bucket {
 	return bucket
 }
 
-func (s *Store) queues(tx *bolt.Tx) *bolt.Bucket {
+func (s *Store) queues(tx backendTx) backendBucket {
 	return s.bucket(tx, "Queues")
 }
 
-func (s *Store) queue(tx *bolt.Tx, name string) *bolt.Bucket {
+func (s *Store) queue(tx backendTx, name string) backendBucket {
 	return s.bucket(tx, "Queues", name)
 }
 
-func (s *Store) meta(tx *bolt.Tx, name string) *bolt.Bucket {
+func (s *Store) meta(tx backendTx, name string) backendBucket {
 	return s.bucket(tx, "Queues", name, "Meta")
 }
 
-func (s *Store) settings(tx *bolt.Tx, name string) *bolt.Bucket {
+func (s *Store) settings(tx backendTx, name string) backendBucket {
 	return s.bucket(tx, "Queues", name, "Settings")
 }
 
-func (s *Store) messages(tx *bolt.Tx, name string) *bolt.Bucket {
+func (s *Store) messages(tx backendTx, name string) backendBucket {
 	return s.bucket(tx, "Queues", name, "Messages")
 }
 
-func (s *Store) visible(tx *bolt.Tx, name string) *bolt.Bucket {
+func (s *Store) visible(tx backendTx, name string) backendBucket {
 	return s.bucket(tx, "Queues", name, "Messages", "Visible")
 }
 
-func (s *Store) leased(tx *bolt.Tx, name string) *bolt.Bucket {
+func (s *Store) leased(tx backendTx, name string) backendBucket {
 	return s.bucket(tx, "Queues", name, "Messages", "Leased")
 }
 
-func (s *Store) delayed(tx *bolt.Tx, name string) *bolt.Bucket {
+func (s *Store) delayed(tx backendTx, name string) backendBucket {
 	return s.bucket(tx, "Queues", name, "Messages", "Delayed")
 }
 
@@ -113,6 +113,18 @@ func decodeTime(b []byte) (time.Time, error) {
 	return time.Unix(sec, 0), nil
 }
 
+func unmarshalHexID(data []byte, id []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if hex.DecodedLen(len(s)) != len(id) {
+		return fmt.Errorf("Invalid ID length %d", len(s))
+	}
+	_, err := hex.Decode(id, []byte(s))
+	return err
+}
+
 func isInRange(v, min, max int) bool {
 	return v >= min && v <= max
 }
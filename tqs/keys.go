@@ -0,0 +1,302 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+var (
+	ErrAPIKeyNotFound    = errors.New("api key not found")
+	ErrAPIKeyExists      = errors.New("api key already exists")
+	ErrInvalidAPIKeyName = errors.New("invalid api key name")
+	ErrInvalidGrant      = errors.New("invalid grant")
+)
+
+// API keys live in the Keys bucket, under the SHA-256 hash of their
+// token, so that the database never holds a token that can be used.
+// The bucket is created when the first key is.
+
+// APIKeyPrefix starts every token that CreateAPIKey makes.
+const APIKeyPrefix = "tqs_"
+
+// Action is something that a key can be allowed to do with a queue.
+type Action string
+
+const (
+	// ActionSend allows sending messages
+	ActionSend Action = "send"
+	// ActionReceive allows receiving messages and deleting, extending
+	// and releasing their leases
+	ActionReceive Action = "receive"
+	// ActionAdmin allows everything, including creating, changing,
+	// purging and deleting the queue
+	ActionAdmin Action = "admin"
+)
+
+// Grant allows Actions on the queues whose names match Queues, a
+// pattern as understood by path.Match like "orders-*".
+type Grant struct {
+	Queues  string
+	Actions []Action
+}
+
+// AdminGrant allows everything on every queue. Keys that are created
+// without grants get it.
+var AdminGrant = Grant{Queues: "*", Actions: []Action{ActionAdmin}}
+
+// APIKey describes a key that clients authenticate with. Names follow
+// the same rules as queue names and are unique.
+type APIKey struct {
+	Name    string
+	Created time.Time
+	Grants  []Grant
+}
+
+// Allows tells if one of the grants of the key allows one of actions
+// on queue.
+func (k APIKey) Allows(queue string, actions ...Action) bool {
+	for _, grant := range k.Grants {
+		if matched, _ := path.Match(grant.Queues, queue); !matched {
+			continue
+		}
+		for _, granted := range grant.Actions {
+			if granted == ActionAdmin {
+				return true
+			}
+			for _, action := range actions {
+				if granted == action {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// ValidateGrants checks that grants have valid patterns and known
+// actions.
+func ValidateGrants(grants []Grant) error {
+	for _, grant := range grants {
+		if _, err := path.Match(grant.Queues, ""); err != nil || grant.Queues == "" {
+			return fmt.Errorf("%w: bad pattern <%s>", ErrInvalidGrant, grant.Queues)
+		}
+		if len(grant.Actions) == 0 {
+			return fmt.Errorf("%w: no actions for <%s>", ErrInvalidGrant, grant.Queues)
+		}
+		for _, action := range grant.Actions {
+			if action != ActionSend && action != ActionReceive && action != ActionAdmin {
+				return fmt.Errorf("%w: unknown action <%s>", ErrInvalidGrant, action)
+			}
+		}
+	}
+	return nil
+}
+
+// HashAPIKey returns the hash that a token is stored under.
+func HashAPIKey(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+func (s *Store) keys(tx backendTx) backendBucket {
+	return s.bucket(tx, "Keys")
+}
+
+// findAPIKey returns the hash and the key called name.
+func findAPIKey(keys backendBucket, name string) ([]byte, APIKey, error) {
+	var found []byte
+	var key APIKey
+
+	if keys == nil {
+		return nil, APIKey{}, ErrAPIKeyNotFound
+	}
+
+	err := keys.ForEach(func(hash, value []byte) error {
+		if found != nil {
+			return nil
+		}
+		var candidate APIKey
+		if err := msgpack.Unmarshal(value, &candidate); err != nil {
+			return err
+		}
+		if candidate.Name == name {
+			found = append([]byte(nil), hash...)
+			key = candidate
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, APIKey{}, err
+	}
+
+	if found == nil {
+		return nil, APIKey{}, ErrAPIKeyNotFound
+	}
+
+	return found, key, nil
+}
+
+// CreateAPIKey creates a key called name and returns it with its
+// token. The token cannot be retrieved later. Without grants the key
+// gets AdminGrant.
+func (s *Store) CreateAPIKey(name string, grants ...Grant) (APIKey, string, error) {
+	if !isValidQueueName(name) {
+		return APIKey{}, "", ErrInvalidAPIKeyName
+	}
+
+	if len(grants) == 0 {
+		grants = []Grant{AdminGrant}
+	}
+
+	if err := ValidateGrants(grants); err != nil {
+		return APIKey{}, "", err
+	}
+
+	var secret [32]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return APIKey{}, "", err
+	}
+	token := APIKeyPrefix + base64.RawURLEncoding.EncodeToString(secret[:])
+
+	key := APIKey{Name: name, Created: s.clock.Now(), Grants: grants}
+
+	encoded, err := msgpack.Marshal(key)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+
+	err = s.backend.Update(func(tx backendTx) error {
+		keys, err := tx.CreateBucketIfNotExists([]byte("Keys"))
+		if err != nil {
+			return err
+		}
+
+		if _, _, err := findAPIKey(keys, name); err != ErrAPIKeyNotFound {
+			if err == nil {
+				return ErrAPIKeyExists
+			}
+			return err
+		}
+
+		return keys.Put(HashAPIKey(token), encoded)
+	})
+	if err != nil {
+		return APIKey{}, "", err
+	}
+
+	return key, token, nil
+}
+
+// GetAPIKeys returns all keys, ordered by name.
+func (s *Store) GetAPIKeys() ([]APIKey, error) {
+	keys := []APIKey{}
+	err := s.backend.View(func(tx backendTx) error {
+		bucket := s.keys(tx)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(hash, value []byte) error {
+			var key APIKey
+			if err := msgpack.Unmarshal(value, &key); err != nil {
+				return err
+			}
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Name < keys[j].Name
+	})
+
+	return keys, nil
+}
+
+// RevokeAPIKey deletes the key called name, after which its token is
+// no longer accepted.
+func (s *Store) RevokeAPIKey(name string) error {
+	return s.backend.Update(func(tx backendTx) error {
+		keys := s.keys(tx)
+		hash, _, err := findAPIKey(keys, name)
+		if err != nil {
+			return err
+		}
+		return keys.Delete(hash)
+	})
+}
+
+// SetAPIKeyGrants replaces the grants of the key called name. A key
+// without grants is not allowed to do anything.
+func (s *Store) SetAPIKeyGrants(name string, grants []Grant) (APIKey, error) {
+	if err := ValidateGrants(grants); err != nil {
+		return APIKey{}, err
+	}
+
+	var key APIKey
+	err := s.backend.Update(func(tx backendTx) error {
+		keys := s.keys(tx)
+		hash, found, err := findAPIKey(keys, name)
+		if err != nil {
+			return err
+		}
+
+		key = found
+		key.Grants = grants
+
+		encoded, err := msgpack.Marshal(key)
+		if err != nil {
+			return err
+		}
+
+		return keys.Put(hash, encoded)
+	})
+	return key, err
+}
+
+// AuthenticateAPIKey returns the key that token belongs to, or
+// ErrAPIKeyNotFound.
+func (s *Store) AuthenticateAPIKey(token string) (APIKey, error) {
+	var key APIKey
+	err := s.backend.View(func(tx backendTx) error {
+		keys := s.keys(tx)
+		if keys == nil {
+			return ErrAPIKeyNotFound
+		}
+
+		value := keys.Get(HashAPIKey(token))
+		if value == nil {
+			return ErrAPIKeyNotFound
+		}
+
+		return msgpack.Unmarshal(value, &key)
+	})
+	return key, err
+}
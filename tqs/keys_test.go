@@ -0,0 +1,118 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_APIKeys(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		_, err := store.AuthenticateAPIKey("tqs_nothing")
+		assert.Equal(t, ErrAPIKeyNotFound, err)
+
+		keys, err := store.GetAPIKeys()
+		assert.Nil(t, err)
+		assert.Len(t, keys, 0)
+
+		key, token, err := store.CreateAPIKey("deploy")
+		assert.Nil(t, err)
+		assert.Equal(t, "deploy", key.Name)
+		assert.True(t, strings.HasPrefix(token, APIKeyPrefix))
+
+		_, _, err = store.CreateAPIKey("deploy")
+		assert.Equal(t, ErrAPIKeyExists, err)
+
+		_, _, err = store.CreateAPIKey("Not Valid")
+		assert.Equal(t, ErrInvalidAPIKeyName, err)
+
+		_, other, err := store.CreateAPIKey("backup")
+		assert.Nil(t, err)
+		assert.NotEqual(t, token, other)
+
+		authenticated, err := store.AuthenticateAPIKey(token)
+		assert.Nil(t, err)
+		assert.Equal(t, "deploy", authenticated.Name)
+
+		keys, err = store.GetAPIKeys()
+		assert.Nil(t, err)
+		if assert.Len(t, keys, 2) {
+			assert.Equal(t, "backup", keys[0].Name)
+			assert.Equal(t, "deploy", keys[1].Name)
+		}
+
+		// Only the hash of the token is stored
+		err = store.backend.View(func(tx backendTx) error {
+			assert.Nil(t, store.keys(tx).Get([]byte(token)))
+			assert.NotNil(t, store.keys(tx).Get(HashAPIKey(token)))
+			return nil
+		})
+		assert.Nil(t, err)
+
+		assert.Nil(t, store.RevokeAPIKey("deploy"))
+		assert.Equal(t, ErrAPIKeyNotFound, store.RevokeAPIKey("deploy"))
+
+		_, err = store.AuthenticateAPIKey(token)
+		assert.Equal(t, ErrAPIKeyNotFound, err)
+
+		_, err = store.AuthenticateAPIKey(other)
+		assert.Nil(t, err)
+	})
+}
+
+func Test_APIKeyGrants(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		key, _, err := store.CreateAPIKey("everything")
+		assert.Nil(t, err)
+		assert.Equal(t, []Grant{AdminGrant}, key.Grants)
+		assert.True(t, key.Allows("anything", ActionSend))
+
+		_, _, err = store.CreateAPIKey("bad", Grant{Queues: "[", Actions: []Action{ActionSend}})
+		assert.ErrorIs(t, err, ErrInvalidGrant)
+
+		_, _, err = store.CreateAPIKey("bad", Grant{Queues: "*", Actions: []Action{"delete"}})
+		assert.ErrorIs(t, err, ErrInvalidGrant)
+
+		_, token, err := store.CreateAPIKey("orders", Grant{Queues: "orders-*", Actions: []Action{ActionSend}})
+		assert.Nil(t, err)
+
+		key, err = store.AuthenticateAPIKey(token)
+		assert.Nil(t, err)
+		assert.True(t, key.Allows("orders-eu", ActionSend))
+		assert.False(t, key.Allows("orders-eu", ActionReceive))
+		assert.False(t, key.Allows("invoices", ActionSend))
+
+		_, err = store.SetAPIKeyGrants("orders", []Grant{
+			{Queues: "orders-*", Actions: []Action{ActionReceive}},
+			{Queues: "invoices", Actions: []Action{ActionAdmin}},
+		})
+		assert.Nil(t, err)
+
+		key, err = store.AuthenticateAPIKey(token)
+		assert.Nil(t, err)
+		assert.False(t, key.Allows("orders-eu", ActionSend))
+		assert.True(t, key.Allows("orders-eu", ActionReceive))
+		assert.True(t, key.Allows("invoices", ActionSend, ActionReceive))
+
+		_, err = store.SetAPIKeyGrants("missing", nil)
+		assert.Equal(t, ErrAPIKeyNotFound, err)
+	})
+}
@@ -20,7 +20,10 @@ package tqs
 import (
 	"encoding/binary"
 	"encoding/hex"
+	"fmt"
 	"time"
+
+	"github.com/vmihailenco/msgpack"
 )
 
 // TODO This file sould go, all types should move into store.go
@@ -37,13 +40,16 @@ func (id *LeaseID) MarshalJSON() ([]byte, error) {
 	return buffer, nil
 }
 
-func generateLeaseID(messageID MessageID) LeaseID {
-	now := uint64(time.Now().UnixNano())
+func (id *LeaseID) UnmarshalJSON(data []byte) error {
+	return unmarshalHexID(data, id[:])
+}
+
+func generateLeaseID(messageID MessageID, timestamp uint64) LeaseID {
 	var buf [17]byte
 	for i := 0; i < len(messageID); i++ {
 		buf[i] = messageID[i]
 	}
-	binary.BigEndian.PutUint64(buf[9:], now)
+	binary.BigEndian.PutUint64(buf[9:], timestamp)
 	return LeaseID(buf)
 }
 
@@ -51,3 +57,74 @@ type Lease struct {
 	ID         LeaseID
 	Expiration time.Time
 }
+
+// ExtendLease changes the expiration of a lease to leaseDuration
+// seconds from now, for consumers that need more time to process a
+// message. The lease keeps its ID.
+func (s *Store) ExtendLease(queueName string, leaseID LeaseID, leaseDuration int) (Lease, error) {
+	var lease Lease
+
+	if !isInRange(leaseDuration, MinLeaseDuration, MaxLeaseDuration) {
+		return lease, ErrInvalidLeaseDuration
+	}
+
+	return lease, s.queueUpdate(queueName, func(tx backendTx) error {
+		leased := s.leased(tx, queueName)
+		if leased == nil {
+			return ErrQueueNotFound
+		}
+
+		value := leased.Get(leaseID[:])
+		if value == nil {
+			return ErrLeaseNotFound
+		}
+
+		var leasedMessage LeasedMessage
+		if err := msgpack.Unmarshal(value, &leasedMessage); err != nil {
+			return fmt.Errorf("Could not decode lease: %w", err)
+		}
+
+		leasedMessage.Expiration = s.clock.Now().Add(time.Duration(leaseDuration) * time.Second)
+
+		encodedLeasedMessage, err := msgpack.Marshal(leasedMessage)
+		if err != nil {
+			return err
+		}
+
+		if err := leased.Put(leaseID[:], encodedLeasedMessage); err != nil {
+			return fmt.Errorf("Could not extend lease: %w", err)
+		}
+
+		lease = Lease{ID: leaseID, Expiration: leasedMessage.Expiration}
+		return nil
+	})
+}
+
+// ReleaseLease gives up a lease before it expires, which makes the
+// message visible again right away.
+func (s *Store) ReleaseLease(queueName string, leaseID LeaseID) error {
+	return s.queueUpdate(queueName, func(tx backendTx) error {
+		visible := s.visible(tx, queueName)
+		leased := s.leased(tx, queueName)
+		if visible == nil || leased == nil {
+			return ErrQueueNotFound
+		}
+
+		value := leased.Get(leaseID[:])
+		if value == nil {
+			return ErrLeaseNotFound
+		}
+
+		var leasedMessage LeasedMessage
+		if err := msgpack.Unmarshal(value, &leasedMessage); err != nil {
+			return fmt.Errorf("Could not decode lease: %w", err)
+		}
+
+		if err := leased.Delete(leaseID[:]); err != nil {
+			return fmt.Errorf("Could not release lease: %w", err)
+		}
+
+		messageID := messageIDFromLeaseID(leaseID)
+		return visible.Put(messageID[:], leasedMessage.Message)
+	})
+}
@@ -19,6 +19,7 @@ package tqs
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -37,3 +38,64 @@ func Benchmark_MarshalJSON(b *testing.B) {
 		_, _ = id.MarshalJSON()
 	}
 }
+
+func Test_ExtendLease(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		clock := &testClock{now: time.Now()}
+		store.clock = clock
+
+		_, _, err := store.CreateQueue("hello")
+		assert.Nil(t, err)
+
+		_, err = store.PutMessages("hello", []Message{{Body: "Message1"}})
+		assert.Nil(t, err)
+
+		_, leases, err := store.GetMessages("hello", 1, MinLeaseDuration)
+		assert.Nil(t, err)
+		assert.Len(t, leases, 1)
+
+		_, err = store.ExtendLease("hello", leases[0].ID, MaxLeaseDuration+1)
+		assert.Equal(t, ErrInvalidLeaseDuration, err)
+
+		lease, err := store.ExtendLease("hello", leases[0].ID, 60)
+		assert.Nil(t, err)
+		assert.Equal(t, leases[0].ID, lease.ID)
+		assert.Equal(t, clock.Now().Add(60*time.Second), lease.Expiration)
+
+		clock.Advance(30 * time.Second)
+		assert.Nil(t, store.expireLeasedMessages())
+
+		messages, _, err := store.GetMessages("hello", 1, MinLeaseDuration)
+		assert.Nil(t, err)
+		assert.Len(t, messages, 0)
+
+		_, err = store.ExtendLease("hello", LeaseID{}, 60)
+		assert.Equal(t, ErrLeaseNotFound, err)
+
+		_, err = store.ExtendLease("nope", leases[0].ID, 60)
+		assert.Equal(t, ErrQueueNotFound, err)
+	})
+}
+
+func Test_ReleaseLease(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		_, _, err := store.CreateQueue("hello")
+		assert.Nil(t, err)
+
+		_, err = store.PutMessages("hello", []Message{{Body: "Message1"}})
+		assert.Nil(t, err)
+
+		_, leases, err := store.GetMessages("hello", 1, MaxLeaseDuration)
+		assert.Nil(t, err)
+		assert.Len(t, leases, 1)
+
+		assert.Nil(t, store.ReleaseLease("hello", leases[0].ID))
+		assert.Equal(t, ErrLeaseNotFound, store.ReleaseLease("hello", leases[0].ID))
+
+		messages, _, err := store.GetMessages("hello", 1, MinLeaseDuration)
+		assert.Nil(t, err)
+		if assert.Len(t, messages, 1) {
+			assert.Equal(t, "Message1", messages[0].Body)
+		}
+	})
+}
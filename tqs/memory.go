@@ -0,0 +1,300 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var (
+	errDatabaseNotOpen = errors.New("database not open")
+	errTxNotWritable   = errors.New("tx not writable")
+)
+
+// memoryBackend keeps the bucket tree in maps. An update changes the
+// tree in place and keeps an undo log, which it plays back when the
+// transaction fails, which gives the same all or nothing behaviour as
+// a bolt transaction at the cost of only the changes it made. Nothing
+// is persisted.
+type memoryBackend struct {
+	sync.RWMutex
+	root *memoryBucket
+}
+
+type memoryBucket struct {
+	values  map[string][]byte
+	buckets map[string]*memoryBucket
+}
+
+func newMemoryBucket() *memoryBucket {
+	return &memoryBucket{
+		values:  make(map[string][]byte),
+		buckets: make(map[string]*memoryBucket),
+	}
+}
+
+func (b *memoryBucket) sortedKeys() []string {
+	keys := make([]string, 0, len(b.values)+len(b.buckets))
+	for k := range b.values {
+		keys = append(keys, k)
+	}
+	for k := range b.buckets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{root: newMemoryBucket()}
+}
+
+func (m *memoryBackend) View(fn func(tx backendTx) error) error {
+	m.RLock()
+	defer m.RUnlock()
+
+	if m.root == nil {
+		return errDatabaseNotOpen
+	}
+
+	return fn(&memoryTx{root: m.root})
+}
+
+func (m *memoryBackend) Update(fn func(tx backendTx) error) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.root == nil {
+		return errDatabaseNotOpen
+	}
+
+	tx := &memoryTx{root: m.root, writable: true}
+
+	committed := false
+	defer func() {
+		if !committed {
+			tx.rollback()
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	committed = true
+	return nil
+}
+
+func (m *memoryBackend) Close() error {
+	m.Lock()
+	defer m.Unlock()
+	m.root = nil
+	return nil
+}
+
+//
+
+type memoryTx struct {
+	root     *memoryBucket
+	writable bool
+	undo     []func()
+}
+
+// rollback undoes the changes of the transaction, the last one first.
+func (t *memoryTx) rollback() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		t.undo[i]()
+	}
+	t.undo = nil
+}
+
+func (t *memoryTx) Bucket(name []byte) backendBucket {
+	return memoryBucketRef{t.root, t}.Bucket(name)
+}
+
+func (t *memoryTx) CreateBucketIfNotExists(name []byte) (backendBucket, error) {
+	return memoryBucketRef{t.root, t}.CreateBucketIfNotExists(name)
+}
+
+func (t *memoryTx) DeleteBucket(name []byte) error {
+	return memoryBucketRef{t.root, t}.DeleteBucket(name)
+}
+
+func (t *memoryTx) ForEach(fn func(name []byte, bucket backendBucket) error) error {
+	root := memoryBucketRef{t.root, t}
+	return root.ForEach(func(key, value []byte) error {
+		if value != nil {
+			return nil
+		}
+		return fn(key, root.Bucket(key))
+	})
+}
+
+//
+
+type memoryBucketRef struct {
+	bucket *memoryBucket
+	tx     *memoryTx
+}
+
+func (b memoryBucketRef) Get(key []byte) []byte {
+	return b.bucket.values[string(key)]
+}
+
+func (b memoryBucketRef) Put(key, value []byte) error {
+	if !b.tx.writable {
+		return errTxNotWritable
+	}
+	b.restoreValue(string(key))
+	b.bucket.values[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (b memoryBucketRef) Delete(key []byte) error {
+	if !b.tx.writable {
+		return errTxNotWritable
+	}
+	b.restoreValue(string(key))
+	delete(b.bucket.values, string(key))
+	return nil
+}
+
+// restoreValue logs how to put back the current value of key. Values
+// are never modified in place, so keeping the slice is enough.
+func (b memoryBucketRef) restoreValue(key string) {
+	bucket := b.bucket
+	value, ok := bucket.values[key]
+	b.tx.undo = append(b.tx.undo, func() {
+		if ok {
+			bucket.values[key] = value
+		} else {
+			delete(bucket.values, key)
+		}
+	})
+}
+
+func (b memoryBucketRef) ForEach(fn func(key, value []byte) error) error {
+	cursor := b.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b memoryBucketRef) Cursor() backendCursor {
+	return &memoryCursor{bucket: b.bucket}
+}
+
+func (b memoryBucketRef) KeyN() int {
+	return b.bucket.keyN()
+}
+
+func (b *memoryBucket) keyN() int {
+	count := len(b.values) + len(b.buckets)
+	for _, bucket := range b.buckets {
+		count += bucket.keyN()
+	}
+	return count
+}
+
+func (b memoryBucketRef) Bucket(name []byte) backendBucket {
+	bucket, ok := b.bucket.buckets[string(name)]
+	if !ok {
+		return nil
+	}
+	return memoryBucketRef{bucket, b.tx}
+}
+
+func (b memoryBucketRef) CreateBucket(name []byte) (backendBucket, error) {
+	if !b.tx.writable {
+		return nil, errTxNotWritable
+	}
+	if _, ok := b.bucket.buckets[string(name)]; ok {
+		return nil, errBucketExists
+	}
+	bucket := newMemoryBucket()
+	b.bucket.buckets[string(name)] = bucket
+
+	parent := b.bucket
+	b.tx.undo = append(b.tx.undo, func() {
+		delete(parent.buckets, string(name))
+	})
+
+	return memoryBucketRef{bucket, b.tx}, nil
+}
+
+func (b memoryBucketRef) CreateBucketIfNotExists(name []byte) (backendBucket, error) {
+	if bucket := b.Bucket(name); bucket != nil {
+		return bucket, nil
+	}
+	return b.CreateBucket(name)
+}
+
+func (b memoryBucketRef) DeleteBucket(name []byte) error {
+	if !b.tx.writable {
+		return errTxNotWritable
+	}
+	bucket, ok := b.bucket.buckets[string(name)]
+	if !ok {
+		return errBucketNotFound
+	}
+	delete(b.bucket.buckets, string(name))
+
+	// Changes to the deleted bucket later in the transaction are
+	// undone before it is put back
+	parent := b.bucket
+	b.tx.undo = append(b.tx.undo, func() {
+		parent.buckets[string(name)] = bucket
+	})
+
+	return nil
+}
+
+//
+
+// memoryCursor walks a snapshot of the keys that were in the bucket
+// when First was called, so that keys can be deleted while iterating.
+// Like bolt, nested buckets show up as keys with a nil value.
+type memoryCursor struct {
+	bucket *memoryBucket
+	keys   []string
+	index  int
+}
+
+func (c *memoryCursor) First() ([]byte, []byte) {
+	c.keys = c.bucket.sortedKeys()
+	c.index = -1
+	return c.Next()
+}
+
+func (c *memoryCursor) Next() ([]byte, []byte) {
+	for c.index++; c.index < len(c.keys); c.index++ {
+		key := c.keys[c.index]
+		if value, ok := c.bucket.values[key]; ok {
+			return []byte(key), value
+		}
+		if _, ok := c.bucket.buckets[key]; ok {
+			return []byte(key), nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,147 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_MemoryBackendRollback(t *testing.T) {
+	backend := newMemoryBackend()
+	defer backend.Close()
+
+	err := backend.Update(func(tx backendTx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("Test"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("a"), []byte("1"))
+	})
+	assert.Nil(t, err)
+
+	failure := errors.New("failure")
+	err = backend.Update(func(tx backendTx) error {
+		bucket := tx.Bucket([]byte("Test"))
+		if err := bucket.Put([]byte("b"), []byte("2")); err != nil {
+			return err
+		}
+		return failure
+	})
+	assert.Equal(t, failure, err)
+
+	err = backend.View(func(tx backendTx) error {
+		bucket := tx.Bucket([]byte("Test"))
+		assert.Equal(t, []byte("1"), bucket.Get([]byte("a")))
+		assert.Nil(t, bucket.Get([]byte("b")))
+		assert.Equal(t, errTxNotWritable, bucket.Put([]byte("c"), []byte("3")))
+		return nil
+	})
+	assert.Nil(t, err)
+}
+
+func Test_MemoryBackendRollbackBuckets(t *testing.T) {
+	backend := newMemoryBackend()
+	defer backend.Close()
+
+	err := backend.Update(func(tx backendTx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("Test"))
+		if err != nil {
+			return err
+		}
+		nested, err := bucket.CreateBucket([]byte("Nested"))
+		if err != nil {
+			return err
+		}
+		if err := nested.Put([]byte("x"), []byte("1")); err != nil {
+			return err
+		}
+		return bucket.Put([]byte("a"), []byte("1"))
+	})
+	assert.Nil(t, err)
+
+	failure := errors.New("failure")
+	err = backend.Update(func(tx backendTx) error {
+		bucket := tx.Bucket([]byte("Test"))
+		bucket.Put([]byte("a"), []byte("2"))
+		bucket.Put([]byte("b"), []byte("2"))
+
+		nested := bucket.Bucket([]byte("Nested"))
+		assert.Nil(t, bucket.DeleteBucket([]byte("Nested")))
+		nested.Delete([]byte("x"))
+		nested.Put([]byte("y"), []byte("2"))
+
+		created, err := tx.CreateBucketIfNotExists([]byte("Created"))
+		if err != nil {
+			return err
+		}
+		created.Put([]byte("c"), []byte("3"))
+		return failure
+	})
+	assert.Equal(t, failure, err)
+
+	err = backend.View(func(tx backendTx) error {
+		bucket := tx.Bucket([]byte("Test"))
+		assert.Equal(t, []byte("1"), bucket.Get([]byte("a")))
+		assert.Nil(t, bucket.Get([]byte("b")))
+
+		nested := bucket.Bucket([]byte("Nested"))
+		if assert.NotNil(t, nested) {
+			assert.Equal(t, []byte("1"), nested.Get([]byte("x")))
+			assert.Nil(t, nested.Get([]byte("y")))
+		}
+
+		assert.Nil(t, tx.Bucket([]byte("Created")))
+		return nil
+	})
+	assert.Nil(t, err)
+}
+
+func Test_MemoryCursorDelete(t *testing.T) {
+	backend := newMemoryBackend()
+	defer backend.Close()
+
+	err := backend.Update(func(tx backendTx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("Test"))
+		if err != nil {
+			return err
+		}
+		for _, key := range []string{"c", "a", "b"} {
+			if err := bucket.Put([]byte(key), []byte(key)); err != nil {
+				return err
+			}
+		}
+
+		var keys []string
+		cursor := bucket.Cursor()
+		for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+			keys = append(keys, string(k))
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		assert.Equal(t, []string{"a", "b", "c"}, keys)
+
+		k, _ := bucket.Cursor().First()
+		assert.Nil(t, k)
+		return nil
+	})
+	assert.Nil(t, err)
+}
@@ -0,0 +1,252 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// counters count what happens in the store since it was opened, for
+// metrics. They are kept in memory only, so every node of a cluster or
+// replication setup counts what it did itself.
+type counters struct {
+	sync.Mutex
+	queues map[string]*queueCounters
+	tasks  map[string]*TaskMetrics
+}
+
+type queueCounters struct {
+	sent            uint64
+	received        uint64
+	deleted         uint64
+	leasesExpired   uint64
+	messagesExpired uint64
+	quarantined     uint64
+}
+
+func (c *counters) queue(name string, fn func(*queueCounters)) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.queues == nil {
+		c.queues = make(map[string]*queueCounters)
+	}
+
+	q, ok := c.queues[name]
+	if !ok {
+		q = &queueCounters{}
+		c.queues[name] = q
+	}
+
+	fn(q)
+}
+
+// add adds the counts that a transaction collected, after it committed.
+func (q *queueCounters) add(counts queueCounters) {
+	q.sent += counts.sent
+	q.received += counts.received
+	q.deleted += counts.deleted
+	q.leasesExpired += counts.leasesExpired
+	q.messagesExpired += counts.messagesExpired
+	q.quarantined += counts.quarantined
+}
+
+func (c *counters) forget(name string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.queues, name)
+}
+
+func (c *counters) task(name string, ran time.Time, duration time.Duration, err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.tasks == nil {
+		c.tasks = make(map[string]*TaskMetrics)
+	}
+
+	t, ok := c.tasks[name]
+	if !ok {
+		t = &TaskMetrics{Name: name}
+		c.tasks[name] = t
+	}
+
+	t.Runs++
+	t.Duration += duration
+	t.LastRun = ran
+
+	// The tasks of a follower or of a node of a cluster that is not
+	// the leader have nothing to do, the leader does the work
+	if err != nil && err != ErrNotLeader {
+		t.Errors++
+		t.LastError = err.Error()
+	} else {
+		t.LastSuccess = ran
+	}
+}
+
+// runTask runs a background task once and records how long it took and
+// whether it failed.
+func (s *Store) runTask(name string, fn func() error) error {
+	ran := s.clock.Now()
+	started := time.Now()
+	err := fn()
+	s.counters.task(name, ran, time.Since(started), err)
+	return err
+}
+
+//
+
+// QueueMetrics has the number of messages in every state of a queue,
+// and counts of what happened to its messages since the store was
+// opened.
+type QueueMetrics struct {
+	QueueSizes
+	Sent            uint64
+	Received        uint64
+	Deleted         uint64
+	LeasesExpired   uint64
+	MessagesExpired uint64
+	Quarantines     uint64
+}
+
+// TaskMetrics counts the runs of a background task and the time they
+// took in total, and has the times of its last run and of its last run
+// that succeeded.
+type TaskMetrics struct {
+	Name        string
+	Runs        uint64
+	Errors      uint64
+	Duration    time.Duration
+	LastRun     time.Time
+	LastSuccess time.Time
+	LastError   string
+}
+
+// DatabaseMetrics describes a bolt file of the store.
+type DatabaseMetrics struct {
+	Path  string
+	Size  int64
+	Stats bolt.Stats
+}
+
+// QueueMetrics returns the metrics of all queues, sorted by name.
+func (s *Store) QueueMetrics() ([]QueueMetrics, error) {
+	names, err := s.GetQueueNames()
+	if err != nil {
+		return nil, err
+	}
+
+	var metrics []QueueMetrics
+	for _, name := range names {
+		var sizes QueueSizes
+		err := s.queueView(name, func(tx backendTx) error {
+			if s.queue(tx, name) == nil {
+				return ErrQueueNotFound
+			}
+			sizes = s.queueSizes(tx, name)
+			return nil
+		})
+		if err != nil {
+			if err == ErrQueueNotFound {
+				continue // Deleted in the meantime
+			}
+			return nil, err
+		}
+
+		m := QueueMetrics{QueueSizes: sizes}
+		s.counters.queue(name, func(c *queueCounters) {
+			m.Sent = c.sent
+			m.Received = c.received
+			m.Deleted = c.deleted
+			m.LeasesExpired = c.leasesExpired
+			m.MessagesExpired = c.messagesExpired
+			m.Quarantines = c.quarantined
+		})
+		metrics = append(metrics, m)
+	}
+
+	return metrics, nil
+}
+
+// TaskMetrics returns the metrics of the background tasks that ran,
+// sorted by name.
+func (s *Store) TaskMetrics() []TaskMetrics {
+	s.counters.Lock()
+	defer s.counters.Unlock()
+
+	metrics := make([]TaskMetrics, 0, len(s.counters.tasks))
+	for _, t := range s.counters.tasks {
+		metrics = append(metrics, *t)
+	}
+
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Name < metrics[j].Name
+	})
+
+	return metrics
+}
+
+// DatabaseMetrics returns the metrics of the bolt files of the store,
+// which is one for a plain store and the open files of a sharded one.
+// An in-memory store has none.
+func (s *Store) DatabaseMetrics() []DatabaseMetrics {
+	backends := []backend{s.storage}
+	if s.sharding != nil {
+		s.sharding.Lock()
+		for _, sd := range s.sharding.open {
+			if !sd.removing {
+				backends = append(backends, sd.backend)
+			}
+		}
+		s.sharding.Unlock()
+	}
+
+	var metrics []DatabaseMetrics
+	for _, b := range backends {
+		if p, ok := b.(prefixedBackend); ok {
+			b = p.backend
+		}
+		if bb, ok := b.(*boltBackend); ok {
+			metrics = append(metrics, bb.metrics())
+		}
+	}
+
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Path < metrics[j].Path
+	})
+
+	return metrics
+}
+
+func (b *boltBackend) metrics() DatabaseMetrics {
+	b.RLock()
+	defer b.RUnlock()
+
+	m := DatabaseMetrics{Path: b.db.Path(), Stats: b.db.Stats()}
+	if info, err := os.Stat(m.Path); err == nil {
+		m.Size = info.Size()
+	}
+
+	return m
+}
@@ -0,0 +1,177 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_QueueMetrics(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		clock := &testClock{now: time.Now()}
+		store.clock = clock
+
+		_, _, err := store.CreateQueue("hello")
+		assert.Nil(t, err)
+
+		_, err = store.PutMessages("hello", []Message{{Body: "Message1"}, {Body: "Message2"}, {Body: "Message3"}})
+		assert.Nil(t, err)
+
+		_, leases, err := store.GetMessages("hello", 2, MinLeaseDuration)
+		assert.Nil(t, err)
+		assert.Len(t, leases, 2)
+
+		assert.Nil(t, store.DeleteLeasedMessage("hello", leases[0].ID))
+
+		clock.Advance(MinLeaseDuration*time.Second + time.Second)
+		assert.Nil(t, store.RunTasks())
+
+		metrics, err := store.QueueMetrics()
+		assert.Nil(t, err)
+		if assert.Len(t, metrics, 1) {
+			assert.Equal(t, "hello", metrics[0].Name)
+			assert.Equal(t, 2, metrics[0].Visible)
+			assert.Equal(t, 0, metrics[0].Leased)
+			assert.Equal(t, uint64(3), metrics[0].Sent)
+			assert.Equal(t, uint64(2), metrics[0].Received)
+			assert.Equal(t, uint64(1), metrics[0].Deleted)
+			assert.Equal(t, uint64(1), metrics[0].LeasesExpired)
+		}
+
+		statistics, err := store.GetQueueStatistics("hello")
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(3), statistics.Sends)
+		assert.Equal(t, uint64(1), statistics.LeaseExpires)
+
+		tasks := store.TaskMetrics()
+		if assert.Len(t, tasks, 3) {
+			assert.Equal(t, "expire_leases", tasks[0].Name)
+			assert.Equal(t, uint64(1), tasks[0].Runs)
+		}
+	})
+}
+
+func Test_QueueMetricsCountCommittedOnly(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		clock := &testClock{now: time.Now()}
+		store.clock = clock
+
+		_, _, err := store.CreateQueue("hello")
+		assert.Nil(t, err)
+
+		_, err = store.PutMessages("hello", []Message{{Body: "Message1"}})
+		assert.Nil(t, err)
+
+		_, _, err = store.GetMessages("hello", 1, MinLeaseDuration)
+		assert.Nil(t, err)
+
+		clock.Advance(MinLeaseDuration*time.Second + time.Second)
+
+		// The lease expires in a transaction that is rolled back
+		failed := errors.New("failed")
+		err = store.updateQueues(func(tx backendTx, name string, counts *queueCounters) error {
+			if err := store.expireLeasedMessagesForQueue(tx, name, counts); err != nil {
+				return err
+			}
+			return failed
+		})
+		assert.Equal(t, failed, err)
+
+		metrics, err := store.QueueMetrics()
+		assert.Nil(t, err)
+		if assert.Len(t, metrics, 1) {
+			assert.Equal(t, 1, metrics[0].Leased)
+			assert.Equal(t, uint64(0), metrics[0].LeasesExpired)
+		}
+
+		assert.Nil(t, store.RunTasks())
+
+		metrics, err = store.QueueMetrics()
+		assert.Nil(t, err)
+		if assert.Len(t, metrics, 1) {
+			assert.Equal(t, 0, metrics[0].Leased)
+			assert.Equal(t, uint64(1), metrics[0].LeasesExpired)
+		}
+	})
+}
+
+func Test_CountKeys(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		_, _, err := store.CreateQueue("hello")
+		assert.Nil(t, err)
+
+		// Enough messages for the bucket to take many pages
+		messages := make([]Message, 1000)
+		for i := range messages {
+			messages[i] = Message{Body: fmt.Sprintf("Message%d", i)}
+		}
+		_, err = store.PutMessages("hello", messages)
+		assert.Nil(t, err)
+
+		err = store.backend.View(func(tx backendTx) error {
+			assert.Equal(t, 1000, countKeys(store.visible(tx, "hello")))
+			assert.Equal(t, 0, countKeys(store.leased(tx, "hello")))
+			assert.Equal(t, 0, countKeys(store.bucket(tx, "Queues", "hello", "Quarantine")))
+			return nil
+		})
+		assert.Nil(t, err)
+
+		// Changes that are not committed yet count too
+		err = store.backend.Update(func(tx backendTx) error {
+			visible := store.visible(tx, "hello")
+			key, _ := visible.Cursor().First()
+			assert.Nil(t, visible.Delete(key))
+			assert.Equal(t, 999, countKeys(visible))
+			return nil
+		})
+		assert.Nil(t, err)
+	})
+}
+
+func Test_CheckReady(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		clock := &testClock{now: time.Now()}
+		store.clock = clock
+
+		assert.ErrorIs(t, store.CheckReady(), ErrNotReady) // Not started
+
+		store.Start()
+		assert.Nil(t, store.CheckReady())
+
+		clock.Advance(31 * time.Second)
+		assert.ErrorIs(t, store.CheckReady(), ErrNotReady)
+
+		assert.Nil(t, store.RunTasks())
+		assert.Nil(t, store.CheckReady())
+
+		tasks := store.TaskMetrics()
+		if assert.Len(t, tasks, 3) {
+			assert.Equal(t, clock.Now(), tasks[0].LastRun)
+			assert.Equal(t, clock.Now(), tasks[0].LastSuccess)
+			assert.Equal(t, uint64(0), tasks[0].Errors)
+		}
+
+		store.Stop()
+		assert.ErrorIs(t, store.CheckReady(), ErrNotReady)
+	})
+}
@@ -0,0 +1,84 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"sync"
+)
+
+// queueSignals lets receivers wait for a change to the messages of a
+// queue instead of polling it. A channel is handed out per queue and
+// closed, and forgotten, at the next change.
+type queueSignals struct {
+	sync.Mutex
+	changed map[string]chan struct{}
+}
+
+func (q *queueSignals) wait(name string) <-chan struct{} {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.changed == nil {
+		q.changed = make(map[string]chan struct{})
+	}
+
+	changed, ok := q.changed[name]
+	if !ok {
+		changed = make(chan struct{})
+		q.changed[name] = changed
+	}
+
+	return changed
+}
+
+func (q *queueSignals) notify(names ...string) {
+	q.Lock()
+	defer q.Unlock()
+
+	for _, name := range names {
+		if changed, ok := q.changed[name]; ok {
+			close(changed)
+			delete(q.changed, name)
+		}
+	}
+}
+
+// MessagesChanged returns a channel that is closed after the next
+// update of the queue name, like a send, a released or expired lease
+// or delayed messages that become visible. Call it before looking for
+// messages, so that no change gets missed between looking and waiting.
+func (s *Store) MessagesChanged(name string) <-chan struct{} {
+	return s.signals.wait(name)
+}
+
+// HasVisibleMessages tells if the queue name has messages to receive,
+// in a read transaction, which is much cheaper than trying to receive
+// them.
+func (s *Store) HasVisibleMessages(name string) (bool, error) {
+	visible := false
+	err := s.queueView(name, func(tx backendTx) error {
+		bucket := s.visible(tx, name)
+		if bucket == nil {
+			return ErrQueueNotFound
+		}
+		k, _ := bucket.Cursor().First()
+		visible = k != nil
+		return nil
+	})
+	return visible, err
+}
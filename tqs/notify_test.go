@@ -0,0 +1,88 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func changedWithin(changed <-chan struct{}, d time.Duration) bool {
+	select {
+	case <-changed:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+func Test_MessagesChanged(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		clock := &testClock{now: time.Now()}
+		store.clock = clock
+
+		_, _, err := store.CreateQueue("hello")
+		assert.Nil(t, err)
+		_, _, err = store.CreateQueue("other")
+		assert.Nil(t, err)
+
+		visible, err := store.HasVisibleMessages("hello")
+		assert.Nil(t, err)
+		assert.False(t, visible)
+
+		// A send to another queue does not wake receivers of this one
+		changed := store.MessagesChanged("hello")
+		_, err = store.PutMessages("other", []Message{{Body: "Message1"}})
+		assert.Nil(t, err)
+		assert.False(t, changedWithin(changed, 10*time.Millisecond))
+
+		_, err = store.PutMessages("hello", []Message{{Body: "Message1"}})
+		assert.Nil(t, err)
+		assert.True(t, changedWithin(changed, time.Second))
+
+		visible, err = store.HasVisibleMessages("hello")
+		assert.Nil(t, err)
+		assert.True(t, visible)
+
+		_, _, err = store.GetMessages("hello", 1, MinLeaseDuration)
+		assert.Nil(t, err)
+
+		visible, err = store.HasVisibleMessages("hello")
+		assert.Nil(t, err)
+		assert.False(t, visible)
+
+		// Expired leases make messages visible again
+		changed = store.MessagesChanged("hello")
+		clock.Advance(MinLeaseDuration*time.Second + time.Second)
+		assert.Nil(t, store.RunTasks())
+		assert.True(t, changedWithin(changed, time.Second))
+
+		visible, err = store.HasVisibleMessages("hello")
+		assert.Nil(t, err)
+		assert.True(t, visible)
+
+		changed = store.MessagesChanged("hello")
+		assert.Nil(t, store.DeleteQueue("hello"))
+		assert.True(t, changedWithin(changed, time.Second))
+
+		_, err = store.HasVisibleMessages("hello")
+		assert.Equal(t, ErrQueueNotFound, err)
+	})
+}
@@ -0,0 +1,183 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Clock tells the store what time it is. Lease expiry, message
+// retention, message and lease IDs, creation times and the schedule of
+// the background tasks all go through it. Network timeouts of
+// replication and clustering use the system clock.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks like a time.Ticker does.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// StoreOption configures a Store when it is opened.
+type StoreOption func(*storeOptions) error
+
+type storeOptions struct {
+	logger        *slog.Logger
+	clock         Clock
+	boltOptions   *bolt.Options
+	db            *bolt.DB
+	prefix        string
+	taskIntervals TaskIntervals
+	queueDefaults QueueSettings
+}
+
+func defaultStoreOptions() storeOptions {
+	return storeOptions{
+		logger:        slog.Default(),
+		clock:         systemClock{},
+		taskIntervals: DefaultTaskIntervals,
+		queueDefaults: defaultQueueSettings(),
+	}
+}
+
+// TaskIntervals are the times between the runs of the background
+// tasks that Start starts.
+type TaskIntervals struct {
+	ExpireLeases   time.Duration
+	ExpireMessages time.Duration
+	MoveDelayed    time.Duration
+}
+
+// DefaultTaskIntervals are the intervals that a store uses without
+// WithTaskIntervals.
+var DefaultTaskIntervals = TaskIntervals{
+	ExpireLeases:   2500 * time.Millisecond,
+	ExpireMessages: 2500 * time.Millisecond,
+	MoveDelayed:    2500 * time.Millisecond,
+}
+
+// WithTaskIntervals changes how often the background tasks run.
+func WithTaskIntervals(intervals TaskIntervals) StoreOption {
+	return func(o *storeOptions) error {
+		if intervals.ExpireLeases <= 0 || intervals.ExpireMessages <= 0 || intervals.MoveDelayed <= 0 {
+			return errors.New("task intervals must be positive")
+		}
+		o.taskIntervals = intervals
+		return nil
+	}
+}
+
+// WithDefaultQueueSettings changes the settings that new queues get
+// when they are created without them.
+func WithDefaultQueueSettings(settings ...QueueSetting) StoreOption {
+	return func(o *storeOptions) error {
+		for _, setting := range settings {
+			if err := setting(&o.queueDefaults); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// WithLogger sends the messages of the store to logger instead of the
+// default slog logger.
+func WithLogger(logger *slog.Logger) StoreOption {
+	return func(o *storeOptions) error {
+		if logger == nil {
+			return errors.New("logger is nil")
+		}
+		o.logger = logger
+		return nil
+	}
+}
+
+// WithClock makes the store use clock instead of the system clock.
+func WithClock(clock Clock) StoreOption {
+	return func(o *storeOptions) error {
+		if clock == nil {
+			return errors.New("clock is nil")
+		}
+		o.clock = clock
+		return nil
+	}
+}
+
+// WithBoltOptions passes options to bolt when the database file is
+// opened.
+func WithBoltOptions(options *bolt.Options) StoreOption {
+	return func(o *storeOptions) error {
+		o.boltOptions = options
+		return nil
+	}
+}
+
+// WithBoltDB makes the store keep its buckets in a database that the
+// application already has open, instead of opening the path given to
+// NewStore. The names of the top level buckets of the store start with
+// prefix, so that they do not collide with those of the application.
+// The database stays open when the store is closed, and backups and
+// compaction are left to the application.
+func WithBoltDB(db *bolt.DB, prefix string) StoreOption {
+	return func(o *storeOptions) error {
+		if db == nil {
+			return errors.New("bolt database is nil")
+		}
+		if prefix == "" {
+			return errors.New("bucket prefix is empty")
+		}
+		o.db = db
+		o.prefix = prefix
+		return nil
+	}
+}
+
+func (o storeOptions) openBackend(path string) (backend, error) {
+	if o.db != nil {
+		return prefixedBackend{&boltBackend{path: o.db.Path(), db: o.db, borrowed: true}, o.prefix}, nil
+	}
+	if path == MemoryDatabase {
+		return newMemoryBackend(), nil
+	}
+	return openBoltBackendWithOptions(path, o.boltOptions)
+}
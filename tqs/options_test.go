@@ -0,0 +1,146 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_WithBoltDB(t *testing.T) {
+	path := temporaryDatabase()
+	defer os.Remove(path)
+
+	db, err := bolt.Open(path, 0600, nil)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("Application"))
+		return err
+	})
+	assert.Nil(t, err)
+
+	store, err := NewStore("", WithBoltDB(db, "tqs."))
+	assert.Nil(t, err)
+
+	_, _, err = store.CreateQueue("test")
+	assert.Nil(t, err)
+
+	_, err = store.WriteBackup(&bytes.Buffer{})
+	assert.Equal(t, ErrNotSupported, err)
+
+	assert.Nil(t, store.Close())
+
+	// The database stays open and has the buckets of both
+
+	var names []string
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			names = append(names, string(name))
+			return nil
+		})
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Application", "tqs.Queues", "tqs.Schema"}, names)
+
+	store, err = NewStore("", WithBoltDB(db, "tqs."))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	queues, err := store.GetQueueNames()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"test"}, queues)
+
+	_, err = NewStore("", WithBoltDB(db, ""))
+	assert.NotNil(t, err)
+}
+
+func Test_WithLogger(t *testing.T) {
+	var output bytes.Buffer
+	store, err := NewStore(MemoryDatabase, WithLogger(slog.New(slog.NewJSONHandler(&output, nil))))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	_, _, err = store.CreateQueue("test")
+	assert.Nil(t, err)
+
+	err = store.queueUpdate("test", func(tx backendTx) error {
+		return store.visible(tx, "test").Put([]byte("bad"), []byte("bad"))
+	})
+	assert.Nil(t, err)
+
+	_, _, err = store.GetMessages("test", 10, DefaultLeaseDuration)
+	assert.Nil(t, err)
+	assert.Contains(t, output.String(), `"msg":"Quarantined message","queue":"test"`)
+}
+
+func Test_StartStop(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		store.Start()
+		store.Start()
+		store.Stop()
+		store.Stop()
+		store.Start()
+	})
+}
+
+func Test_ErrorsIs(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		_, err := store.PutMessages("missing", []Message{{Body: "Message1"}})
+		assert.True(t, errors.Is(err, ErrQueueNotFound))
+
+		_, _, err = store.CreateQueue("test")
+		assert.Nil(t, err)
+
+		assert.True(t, errors.Is(store.DeleteLeasedMessage("test", LeaseID{}), ErrLeaseNotFound))
+		assert.True(t, errors.Is(store.DeleteLeasedMessage("missing", LeaseID{}), ErrQueueNotFound))
+	})
+}
+
+func Test_WithDefaultQueueSettings(t *testing.T) {
+	_, err := NewStore(MemoryDatabase, WithDefaultQueueSettings(LeaseDuration(1)))
+	assert.Equal(t, ErrInvalidLeaseDuration, err)
+
+	_, err = NewStore(MemoryDatabase, WithTaskIntervals(TaskIntervals{}))
+	assert.NotNil(t, err)
+
+	store, err := NewStore(MemoryDatabase, WithDefaultQueueSettings(LeaseDuration(60)))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	_, settings, err := store.CreateQueue("first")
+	assert.Nil(t, err)
+	assert.Equal(t, 60, settings.LeaseDuration)
+	assert.Equal(t, DefaultMessageRetentionPeriod, settings.MessageRetentionPeriod)
+
+	assert.Nil(t, store.SetDefaultQueueSettings(DelaySeconds(10)))
+
+	_, settings, err = store.CreateQueue("second", MessageRetentionPeriod(600))
+	assert.Nil(t, err)
+	assert.Equal(t, QueueSettings{LeaseDuration: DefaultLeaseDuration, MessageRetentionPeriod: 600, DelaySeconds: 10}, settings)
+
+	assert.Equal(t, ErrInvalidDelaySeconds, store.SetDefaultQueueSettings(DelaySeconds(-1)))
+	assert.Equal(t, 10, store.DefaultQueueSettings().DelaySeconds)
+}
@@ -0,0 +1,224 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+// QueueChangeAction is what a QueueChange does to a queue.
+type QueueChangeAction string
+
+const (
+	CreateQueueAction QueueChangeAction = "create"
+	UpdateQueueAction QueueChangeAction = "update"
+	DeleteQueueAction QueueChangeAction = "delete"
+)
+
+// QueueChange is a step that PlanQueues found is needed to make the
+// queues of a store match the declared ones.
+type QueueChange struct {
+	Action   QueueChangeAction
+	Name     string
+	Current  QueueSettings // For updates and deletes
+	Declared QueueSettings // For creates and updates
+}
+
+// String describes the change like a diff.
+func (c QueueChange) String() string {
+	switch c.Action {
+	case CreateQueueAction:
+		return fmt.Sprintf("+ %s %s", c.Name, formatQueueSettings(c.Declared))
+	case DeleteQueueAction:
+		return fmt.Sprintf("- %s %s", c.Name, formatQueueSettings(c.Current))
+	default:
+		var changes []string
+		for _, setting := range []struct {
+			name              string
+			current, declared int
+		}{
+			{"LeaseDuration", c.Current.LeaseDuration, c.Declared.LeaseDuration},
+			{"MessageRetentionPeriod", c.Current.MessageRetentionPeriod, c.Declared.MessageRetentionPeriod},
+			{"DelaySeconds", c.Current.DelaySeconds, c.Declared.DelaySeconds},
+		} {
+			if setting.current != setting.declared {
+				changes = append(changes, fmt.Sprintf("%s=%d->%d", setting.name, setting.current, setting.declared))
+			}
+		}
+		return fmt.Sprintf("~ %s %s", c.Name, strings.Join(changes, " "))
+	}
+}
+
+func formatQueueSettings(settings QueueSettings) string {
+	return fmt.Sprintf("LeaseDuration=%d MessageRetentionPeriod=%d DelaySeconds=%d",
+		settings.LeaseDuration, settings.MessageRetentionPeriod, settings.DelaySeconds)
+}
+
+func (settings QueueSettings) options() []QueueSetting {
+	return []QueueSetting{
+		LeaseDuration(settings.LeaseDuration),
+		MessageRetentionPeriod(settings.MessageRetentionPeriod),
+		DelaySeconds(settings.DelaySeconds),
+	}
+}
+
+// PlanQueues returns the changes that make the queues of the store
+// match declared, ordered by queue name. Queues that are not declared
+// are only deleted when prune is true.
+func (s *Store) PlanQueues(declared map[string]QueueSettings, prune bool) ([]QueueChange, error) {
+	for name, settings := range declared {
+		if !isValidQueueName(name) {
+			return nil, fmt.Errorf("queue <%s>: %w", name, ErrInvalidQueueName)
+		}
+		var validated QueueSettings
+		for _, setting := range settings.options() {
+			if err := setting(&validated); err != nil {
+				return nil, fmt.Errorf("queue <%s>: %w", name, err)
+			}
+		}
+	}
+
+	names, err := s.GetQueueNames()
+	if err != nil {
+		return nil, err
+	}
+
+	existing := make(map[string]bool)
+	changes := []QueueChange{}
+
+	for _, name := range names {
+		existing[name] = true
+
+		settings, ok := declared[name]
+		if !ok && !prune {
+			continue
+		}
+
+		current, err := s.GetQueueSettings(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			changes = append(changes, QueueChange{Action: DeleteQueueAction, Name: name, Current: current})
+		} else if current != settings {
+			changes = append(changes, QueueChange{Action: UpdateQueueAction, Name: name, Current: current, Declared: settings})
+		}
+	}
+
+	for name, settings := range declared {
+		if !existing[name] {
+			changes = append(changes, QueueChange{Action: CreateQueueAction, Name: name, Declared: settings})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+
+	return changes, nil
+}
+
+// ApplyQueueChanges makes the changes that PlanQueues returned. It
+// stops at the first one that fails.
+func (s *Store) ApplyQueueChanges(changes []QueueChange) error {
+	for _, change := range changes {
+		var err error
+		switch change.Action {
+		case CreateQueueAction:
+			_, _, err = s.CreateQueue(change.Name, change.Declared.options()...)
+		case UpdateQueueAction:
+			_, err = s.UpdateQueueSettings(change.Name, change.Declared.options()...)
+		case DeleteQueueAction:
+			err = s.DeleteQueue(change.Name)
+		default:
+			err = fmt.Errorf("unknown action <%s>", change.Action)
+		}
+		if err != nil {
+			return fmt.Errorf("%s queue <%s>: %w", change.Action, change.Name, err)
+		}
+		s.logger.Info("Provisioned queue", "queue", change.Name, "action", string(change.Action))
+	}
+	return nil
+}
+
+// PlanDatabaseQueues is PlanQueues for the database file at path, or
+// for the sharded store in directory when that is not empty, without
+// opening a Store. The files are opened read-only, so it fails instead
+// of waiting when tqsd has them open, and never migrates them. A store
+// that does not exist yet is planned as an empty one.
+func PlanDatabaseQueues(path, directory string, declared map[string]QueueSettings, prune bool) ([]QueueChange, error) {
+	if directory != "" {
+		path = filepath.Join(directory, catalogName)
+	}
+
+	if _, err := os.Stat(path); path == MemoryDatabase || os.IsNotExist(err) {
+		store, err := NewStore(MemoryDatabase)
+		if err != nil {
+			return nil, err
+		}
+		defer store.Close()
+		return store.PlanQueues(declared, prune)
+	}
+
+	backend, err := openBoltBackendReadOnly(path)
+	if err != nil {
+		if err == bolt.ErrTimeout {
+			return nil, fmt.Errorf("%s is in use, stop tqsd first", path)
+		}
+		return nil, err
+	}
+
+	store := offlineStore()
+	store.path = path
+	store.storage = backend
+	store.backend = backend
+	defer store.Close()
+
+	var version int
+	err = backend.View(func(tx backendTx) error {
+		v, err := schemaVersion(tx)
+		version = v
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if version != SchemaVersion {
+		return nil, fmt.Errorf("database is at schema version %d, open it with tqsd once to migrate it to %d", version, SchemaVersion)
+	}
+
+	if directory != "" {
+		store.sharding = &sharding{
+			directory: directory,
+			options:   store.options,
+			readOnly:  true,
+			open:      make(map[string]*shard),
+		}
+		store.sharding.changed = sync.NewCond(store.sharding)
+	}
+
+	return store.PlanQueues(declared, prune)
+}
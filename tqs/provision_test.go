@@ -0,0 +1,128 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_PlanQueues(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		_, _, err := store.CreateQueue("unchanged")
+		assert.Nil(t, err)
+		_, _, err = store.CreateQueue("changed")
+		assert.Nil(t, err)
+		_, _, err = store.CreateQueue("undeclared")
+		assert.Nil(t, err)
+
+		defaults := defaultQueueSettings()
+		changed := defaults
+		changed.LeaseDuration = 60
+
+		declared := map[string]QueueSettings{
+			"unchanged": defaults,
+			"changed":   changed,
+			"new":       defaults,
+		}
+
+		changes, err := store.PlanQueues(declared, false)
+		assert.Nil(t, err)
+		if assert.Len(t, changes, 2) {
+			assert.Equal(t, "~ changed LeaseDuration=30->60", changes[0].String())
+			assert.Equal(t, CreateQueueAction, changes[1].Action)
+			assert.Equal(t, "new", changes[1].Name)
+		}
+
+		changes, err = store.PlanQueues(declared, true)
+		assert.Nil(t, err)
+		if assert.Len(t, changes, 3) {
+			assert.Equal(t, DeleteQueueAction, changes[2].Action)
+			assert.Equal(t, "undeclared", changes[2].Name)
+		}
+
+		assert.Nil(t, store.ApplyQueueChanges(changes))
+
+		names, err := store.GetQueueNames()
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"changed", "new", "unchanged"}, names)
+
+		settings, err := store.GetQueueSettings("changed")
+		assert.Nil(t, err)
+		assert.Equal(t, 60, settings.LeaseDuration)
+
+		changes, err = store.PlanQueues(declared, true)
+		assert.Nil(t, err)
+		assert.Len(t, changes, 0)
+
+		invalid := defaults
+		invalid.LeaseDuration = 1
+		_, err = store.PlanQueues(map[string]QueueSettings{"bad": invalid}, false)
+		assert.ErrorIs(t, err, ErrInvalidLeaseDuration)
+	})
+}
+
+func Test_PlanDatabaseQueues(t *testing.T) {
+	path := temporaryDatabase()
+	directory := t.TempDir()
+
+	for _, open := range []func() (*Store, error){
+		func() (*Store, error) { return NewStore(path) },
+		func() (*Store, error) { return NewShardedStore(directory, 0) },
+	} {
+		store, err := open()
+		assert.Nil(t, err)
+		_, _, err = store.CreateQueue("existing", LeaseDuration(60))
+		assert.Nil(t, err)
+
+		// The files of a store that is open are not waited for
+		_, err = PlanDatabaseQueues(path, "", nil, false)
+		if store.sharding != nil {
+			_, err = PlanDatabaseQueues("", directory, nil, false)
+		}
+		assert.NotNil(t, err)
+
+		assert.Nil(t, store.Close())
+	}
+
+	declared := map[string]QueueSettings{"new": defaultQueueSettings()}
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+
+	for _, test := range []struct{ path, directory string }{{path, ""}, {"", directory}} {
+		changes, err := PlanDatabaseQueues(test.path, test.directory, declared, true)
+		assert.Nil(t, err)
+		if assert.Len(t, changes, 2) {
+			assert.Equal(t, "- existing LeaseDuration=60 MessageRetentionPeriod=345600 DelaySeconds=0", changes[0].String())
+			assert.Equal(t, CreateQueueAction, changes[1].Action)
+		}
+	}
+
+	planned, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, info.ModTime(), planned.ModTime())
+
+	// A store that does not exist yet is empty
+	changes, err := PlanDatabaseQueues(filepath.Join(directory, "missing.db"), "", declared, true)
+	assert.Nil(t, err)
+	assert.Len(t, changes, 1)
+}
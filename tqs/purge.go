@@ -17,11 +17,9 @@
 
 package tqs
 
-import "github.com/boltdb/bolt"
-
 // PurgeQueue should have a comment TODO
 func (s *Store) PurgeQueue(name string) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
+	return s.queueUpdate(name, func(tx backendTx) error {
 		bucket := s.queue(tx, name)
 		if bucket == nil {
 			return ErrQueueNotFound
@@ -18,14 +18,13 @@
 package tqs
 
 import (
-	"github.com/boltdb/bolt"
 	"github.com/vmihailenco/msgpack"
 )
 
 // PutMessages should have a comment TODO
 func (s *Store) PutMessages(queueName string, messages []Message) ([]MessageID, error) {
 	var ids []MessageID
-	return ids, s.db.Update(func(tx *bolt.Tx) error {
+	err := s.queueUpdate(queueName, func(tx backendTx) error {
 		bucket := s.visible(tx, queueName)
 		if bucket == nil {
 			return ErrQueueNotFound
@@ -54,12 +53,19 @@ func (s *Store) PutMessages(queueName string, messages []Message) ([]MessageID,
 				return err
 			}
 
-			key := generateMessageID(uint8(messages[i].Settings.Priority))
+			key := generateMessageID(uint8(messages[i].Settings.Priority), s.timestamp())
 			ids = append(ids, key)
 			if err := bucket.Put(key[:], value); err != nil {
-				return nil
+				return err
 			}
 		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.counters.queue(queueName, func(c *queueCounters) { c.sent += uint64(len(ids)) })
+
+	return ids, nil
 }
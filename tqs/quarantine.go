@@ -0,0 +1,116 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// QuarantinedMessage is a message entry that could not be decoded or
+// was stored under a bad key. It is kept in the Quarantine bucket of
+// its queue, exactly as it was found, so that it can be inspected.
+type QuarantinedMessage struct {
+	Source      string // Visible, Leased or Delayed
+	Key         []byte
+	Value       []byte
+	Error       string
+	Quarantined time.Time
+}
+
+func quarantineKey(source string, key []byte) []byte {
+	return append(append([]byte(source), 0), key...)
+}
+
+// quarantineMessage moves the entry with the given key from the source
+// bucket of a queue to its Quarantine bucket. Callers count it once
+// their transaction committed.
+func (s *Store) quarantineMessage(queue backendBucket, source string, key, value []byte, reason error) error {
+	quarantine, err := queue.CreateBucketIfNotExists([]byte("Quarantine"))
+	if err != nil {
+		return err
+	}
+
+	encoded, err := msgpack.Marshal(QuarantinedMessage{
+		Source:      source,
+		Key:         key,
+		Value:       value,
+		Error:       reason.Error(),
+		Quarantined: s.clock.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := quarantine.Put(quarantineKey(source, key), encoded); err != nil {
+		return err
+	}
+
+	var name string
+	if meta := queue.Bucket([]byte("Meta")); meta != nil {
+		name = string(meta.Get([]byte("Name")))
+	}
+
+	s.logger.Warn("Quarantined message", "queue", name, "source", source, "key", fmt.Sprintf("%x", key), "reason", reason)
+
+	return queue.Bucket([]byte("Messages")).Bucket([]byte(source)).Delete(key)
+}
+
+// GetQuarantinedMessages returns the quarantined messages of a queue.
+func (s *Store) GetQuarantinedMessages(name string) ([]QuarantinedMessage, error) {
+	messages := []QuarantinedMessage{}
+	err := s.queueView(name, func(tx backendTx) error {
+		queue := s.queue(tx, name)
+		if queue == nil {
+			return ErrQueueNotFound
+		}
+
+		quarantine := queue.Bucket([]byte("Quarantine"))
+		if quarantine == nil {
+			return nil
+		}
+
+		return quarantine.ForEach(func(key, value []byte) error {
+			var message QuarantinedMessage
+			if err := msgpack.Unmarshal(value, &message); err != nil {
+				return err
+			}
+			messages = append(messages, message)
+			return nil
+		})
+	})
+	return messages, err
+}
+
+// PurgeQuarantine deletes all quarantined messages of a queue.
+func (s *Store) PurgeQuarantine(name string) error {
+	return s.queueUpdate(name, func(tx backendTx) error {
+		queue := s.queue(tx, name)
+		if queue == nil {
+			return ErrQueueNotFound
+		}
+
+		if err := queue.DeleteBucket([]byte("Quarantine")); err != nil && err != errBucketNotFound {
+			return err
+		}
+
+		return nil
+	})
+}
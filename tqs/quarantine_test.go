@@ -0,0 +1,88 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_GetMessagesQuarantinesBadMessages(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		_, _, err := store.CreateQueue("hello")
+		assert.Nil(t, err)
+
+		ids, err := store.PutMessages("hello", []Message{{Body: "Message1"}, {Body: "Message2"}})
+		assert.Nil(t, err)
+
+		err = store.backend.Update(func(tx backendTx) error {
+			return store.visible(tx, "hello").Put(ids[0][:], []byte{0xc1})
+		})
+		assert.Nil(t, err)
+
+		messages, leases, err := store.GetMessages("hello", 2, DefaultLeaseDuration)
+		assert.Nil(t, err)
+		assert.Len(t, leases, 1)
+		if assert.Len(t, messages, 1) {
+			assert.Equal(t, "Message2", messages[0].Body)
+		}
+
+		statistics, err := store.GetQueueStatistics("hello")
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(1), statistics.Quarantined)
+
+		quarantined, err := store.GetQuarantinedMessages("hello")
+		assert.Nil(t, err)
+		if assert.Len(t, quarantined, 1) {
+			assert.Equal(t, "Visible", quarantined[0].Source)
+			assert.Equal(t, ids[0][:], quarantined[0].Key)
+			assert.Equal(t, []byte{0xc1}, quarantined[0].Value)
+		}
+
+		assert.Nil(t, store.PurgeQuarantine("hello"))
+
+		quarantined, err = store.GetQuarantinedMessages("hello")
+		assert.Nil(t, err)
+		assert.Len(t, quarantined, 0)
+	})
+}
+
+func Test_ExpireLeasedMessagesQuarantinesBadLeases(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		_, _, err := store.CreateQueue("hello")
+		assert.Nil(t, err)
+
+		_, err = store.PutMessages("hello", []Message{{Body: "Message1"}})
+		assert.Nil(t, err)
+
+		_, leases, err := store.GetMessages("hello", 1, DefaultLeaseDuration)
+		assert.Nil(t, err)
+
+		err = store.backend.Update(func(tx backendTx) error {
+			return store.leased(tx, "hello").Put(leases[0].ID[:], []byte("garbage"))
+		})
+		assert.Nil(t, err)
+
+		assert.Nil(t, store.expireLeasedMessages())
+
+		statistics, err := store.GetQueueStatistics("hello")
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(1), statistics.Quarantined)
+	})
+}
@@ -0,0 +1,1040 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// Replication works below the queue logic: every committed update of a
+// leader is recorded as a changeset of bucket mutations with a sequence
+// number, and streamed to followers that apply it to their own
+// database. Because put, lease, delete and expiry are all updates, they
+// are all replicated. A follower that connects with a sequence the
+// leader still has in its buffer continues from there, any other
+// follower first receives a snapshot of the whole database.
+//
+// Sequences are only meaningful within a history, which starts every
+// time a store starts recording. The history ID and the last applied
+// sequence are stored in the Replication bucket of the follower, which
+// is itself never replicated.
+
+var (
+	// ErrNotLeader is returned for updates to a store that is
+	// following a leader, or that is not the leader of its cluster.
+	ErrNotLeader = errors.New("store is not the leader")
+	// ErrNotFollower is returned by Promote for a store that is not
+	// following a leader.
+	ErrNotFollower = errors.New("store is not a replication follower")
+)
+
+// Every store is a replication leader, unless it was told to follow
+// another one.
+const (
+	RoleLeader   = "leader"
+	RoleFollower = "follower"
+)
+
+const (
+	replicationBufferSize        = 10000 // Changesets kept for followers that reconnect
+	replicationFollowerQueueSize = 1024  // Changesets queued per follower before it is dropped
+	replicationSnapshotChunkSize = 1000  // Mutations per snapshot frame
+	replicationHeartbeatInterval = time.Second
+	replicationTimeout           = 10 * time.Second
+	replicationMaxFrameSize      = 256 * 1024 * 1024
+)
+
+const (
+	opPut uint8 = iota + 1
+	opDelete
+	opCreateBucket
+	opDeleteBucket
+)
+
+// mutation is a single change to the bucket tree. For bucket operations
+// Key is the name of the bucket that is created or deleted in the
+// bucket at Path; an empty Path is the root of the database.
+type mutation struct {
+	Op    uint8
+	Path  [][]byte
+	Key   []byte
+	Value []byte
+}
+
+const (
+	frameChangeset   = "changeset"
+	frameSnapshot    = "snapshot"
+	frameSnapshotEnd = "snapshot-end"
+	frameHeartbeat   = "heartbeat"
+)
+
+type replicationHello struct {
+	HistoryID []byte
+	Sequence  uint64
+}
+
+type replicationFrame struct {
+	Type      string
+	HistoryID []byte
+	Sequence  uint64
+	Mutations []mutation
+	Time      time.Time
+}
+
+// FollowerStatus describes a follower connected to a leader.
+type FollowerStatus struct {
+	Address  string
+	Sequence uint64 // Last sequence sent to the follower
+}
+
+// ReplicationStatus describes the replication state of a store. On a
+// leader Sequence is the last recorded changeset, on a follower it is
+// the last applied one and Lag is the number of changesets it is
+// behind on its leader.
+type ReplicationStatus struct {
+	Role           string
+	HistoryID      string
+	Sequence       uint64
+	Leader         string `json:",omitempty"`
+	Connected      bool
+	LeaderSequence uint64
+	Lag            uint64
+	LastContact    time.Time
+	Followers      []FollowerStatus `json:",omitempty"`
+}
+
+type replicationFollower struct {
+	address  string
+	frames   chan replicationFrame
+	dropped  chan struct{}
+	sequence uint64
+}
+
+// replication sits between the Store and its backend. The commit lock
+// serializes updates with recording their changeset, so that
+// changesets are numbered in commit order. The embedded mutex protects
+// the rest of the state.
+type replication struct {
+	sync.Mutex
+	commitLock sync.Mutex
+
+	backend backend
+
+	role      string
+	serving   bool
+	historyID []byte
+	sequence  uint64
+	buffer    []replicationFrame
+	followers map[*replicationFollower]struct{}
+
+	leader         string
+	connected      bool
+	leaderSequence uint64
+	lastContact    time.Time
+	cancelFollow   context.CancelFunc
+}
+
+func newReplication(backend backend) *replication {
+	return &replication{
+		backend:   backend,
+		role:      RoleLeader,
+		followers: make(map[*replicationFollower]struct{}),
+	}
+}
+
+func (r *replication) View(fn func(tx backendTx) error) error {
+	return r.backend.View(fn)
+}
+
+func (r *replication) Update(fn func(tx backendTx) error) error {
+	r.commitLock.Lock()
+	defer r.commitLock.Unlock()
+
+	r.Lock()
+	role, recording := r.role, r.serving && r.role == RoleLeader
+	r.Unlock()
+
+	if role == RoleFollower {
+		return ErrNotLeader
+	}
+
+	if !recording {
+		return r.backend.Update(fn)
+	}
+
+	var mutations []mutation
+	err := r.backend.Update(func(tx backendTx) error {
+		mutations = nil
+		return fn(recordingTx{tx: tx, mutations: &mutations})
+	})
+	if err != nil || len(mutations) == 0 {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.sequence++
+	frame := replicationFrame{
+		Type:      frameChangeset,
+		HistoryID: r.historyID,
+		Sequence:  r.sequence,
+		Mutations: mutations,
+	}
+
+	r.buffer = append(r.buffer, frame)
+	if len(r.buffer) > replicationBufferSize {
+		r.buffer = r.buffer[len(r.buffer)-replicationBufferSize:]
+	}
+
+	for follower := range r.followers {
+		select {
+		case follower.frames <- frame:
+		default:
+			// Too far behind, it will get a snapshot when it reconnects
+			r.dropFollower(follower)
+		}
+	}
+
+	return nil
+}
+
+func (r *replication) Close() error {
+	r.Lock()
+	if r.cancelFollow != nil {
+		r.cancelFollow()
+	}
+	for follower := range r.followers {
+		r.dropFollower(follower)
+	}
+	r.Unlock()
+	return r.backend.Close()
+}
+
+// startHistory must be called with the commit lock and the mutex held.
+func (r *replication) startHistory() {
+	r.historyID = make([]byte, 8)
+	rand.Read(r.historyID)
+	r.sequence = 0
+	r.buffer = nil
+}
+
+func (r *replication) followerSequence(follower *replicationFollower) uint64 {
+	r.Lock()
+	defer r.Unlock()
+	return follower.sequence
+}
+
+func (r *replication) setFollowerSequence(follower *replicationFollower, sequence uint64) {
+	r.Lock()
+	defer r.Unlock()
+	follower.sequence = sequence
+}
+
+func (r *replication) dropFollower(follower *replicationFollower) {
+	if _, ok := r.followers[follower]; ok {
+		delete(r.followers, follower)
+		close(follower.dropped)
+	}
+}
+
+// isFollower tells whether updates are made by another store, in which
+// case the background tasks have nothing to do.
+func (s *Store) isFollower() bool {
+	if s.cluster != nil {
+		return !s.cluster.isLeader()
+	}
+
+	s.replication.Lock()
+	defer s.replication.Unlock()
+	return s.replication.role == RoleFollower
+}
+
+//
+
+// ReplicationStatus returns the replication state of the store.
+func (s *Store) ReplicationStatus() ReplicationStatus {
+	r := s.replication
+	r.Lock()
+	defer r.Unlock()
+
+	status := ReplicationStatus{
+		Role:     r.role,
+		Sequence: r.sequence,
+	}
+
+	if r.role == RoleLeader {
+		status.HistoryID = hex.EncodeToString(r.historyID)
+		for follower := range r.followers {
+			status.Followers = append(status.Followers, FollowerStatus{
+				Address:  follower.address,
+				Sequence: follower.sequence,
+			})
+		}
+		return status
+	}
+
+	status.HistoryID = hex.EncodeToString(r.historyID)
+	status.Leader = r.leader
+	status.Connected = r.connected
+	status.LeaderSequence = r.leaderSequence
+	status.LastContact = r.lastContact
+	if r.leaderSequence > r.sequence {
+		status.Lag = r.leaderSequence - r.sequence
+	}
+
+	return status
+}
+
+// ServeReplication records all updates and streams them to followers
+// that connect to listener, until ctx is done. A follower that is
+// promoted can serve replication as well; until then it turns away
+// connections. Sharded stores cannot be replicated.
+func (s *Store) ServeReplication(ctx context.Context, listener net.Listener) error {
+	if s.sharding != nil {
+		listener.Close()
+		return ErrNotSupported
+	}
+
+	r := s.replication
+
+	r.commitLock.Lock()
+	r.Lock()
+	if !r.serving && r.role == RoleLeader {
+		r.startHistory()
+	}
+	r.serving = true
+	r.Unlock()
+	r.commitLock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			if err := s.serveFollower(ctx, conn); err != nil {
+				s.logger.Warn("Replication to follower stopped", "follower", conn.RemoteAddr().String(), "error", err)
+			}
+		}()
+	}
+}
+
+// ReplicationTask returns a task that serves replication on address.
+func (s *Store) ReplicationTask(address string) func(ctx context.Context) {
+	return func(ctx context.Context) {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			s.logger.Error("Failed to listen for followers", "error", err)
+			return
+		}
+		if err := s.ServeReplication(ctx, listener); err != nil {
+			s.logger.Error("Failed to serve replication", "error", err)
+		}
+	}
+}
+
+func (s *Store) serveFollower(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+
+	r := s.replication
+	reader := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+	var hello replicationHello
+	if err := readFrame(reader, &hello); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	follower := &replicationFollower{
+		address: conn.RemoteAddr().String(),
+		frames:  make(chan replicationFrame, replicationFollowerQueueSize),
+		dropped: make(chan struct{}),
+	}
+
+	// Stop writing when the follower goes away
+	go func() {
+		io.Copy(io.Discard, reader)
+		r.Lock()
+		r.dropFollower(follower)
+		r.Unlock()
+	}()
+
+	defer func() {
+		r.Lock()
+		r.dropFollower(follower)
+		r.Unlock()
+	}()
+
+	r.commitLock.Lock()
+	r.Lock()
+
+	if r.role != RoleLeader {
+		r.Unlock()
+		r.commitLock.Unlock()
+		return ErrNotLeader
+	}
+
+	historyID := r.historyID
+	sequence := r.sequence
+	r.followers[follower] = struct{}{}
+
+	// Continue from the buffer when it has everything the follower
+	// missed, otherwise send a snapshot
+	var pending []replicationFrame
+	incremental := bytes.Equal(hello.HistoryID, historyID) && hello.Sequence <= sequence
+	if incremental && hello.Sequence < sequence {
+		if len(r.buffer) == 0 || r.buffer[0].Sequence > hello.Sequence+1 {
+			incremental = false
+		} else {
+			pending = append(pending, r.buffer[hello.Sequence+1-r.buffer[0].Sequence:]...)
+		}
+	}
+
+	r.Unlock()
+
+	if incremental {
+		r.commitLock.Unlock()
+		r.setFollowerSequence(follower, hello.Sequence)
+		for _, frame := range pending {
+			if err := writeFrame(conn, frame); err != nil {
+				return err
+			}
+			r.setFollowerSequence(follower, frame.Sequence)
+		}
+	} else {
+		// Updates wait until the snapshot transaction has started, so
+		// that it contains exactly the changesets up to sequence
+		s.logger.Info("Sending snapshot", "sequence", sequence, "follower", follower.address)
+		if err := s.writeSnapshot(conn, historyID, sequence, r.commitLock.Unlock); err != nil {
+			return err
+		}
+		r.setFollowerSequence(follower, sequence)
+	}
+
+	heartbeat := time.NewTicker(replicationHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case frame := <-follower.frames:
+			if frame.Sequence <= r.followerSequence(follower) {
+				continue
+			}
+			if err := writeFrame(conn, frame); err != nil {
+				return err
+			}
+			r.setFollowerSequence(follower, frame.Sequence)
+		case <-heartbeat.C:
+			r.Lock()
+			frame := replicationFrame{Type: frameHeartbeat, HistoryID: r.historyID, Sequence: r.sequence, Time: time.Now()}
+			r.Unlock()
+			if err := writeFrame(conn, frame); err != nil {
+				return err
+			}
+		case <-follower.dropped:
+			return errors.New("follower disconnected or fell behind")
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// writeSnapshot sends the whole database except the Replication bucket
+// as a series of snapshot frames. It calls started once the read
+// transaction is open.
+func (s *Store) writeSnapshot(conn net.Conn, historyID []byte, sequence uint64, started func()) error {
+	var once sync.Once
+	defer once.Do(started)
+
+	return s.replication.backend.View(func(tx backendTx) error {
+		once.Do(started)
+
+		var chunk []mutation
+
+		flush := func() error {
+			err := writeFrame(conn, replicationFrame{Type: frameSnapshot, HistoryID: historyID, Sequence: sequence, Mutations: chunk})
+			chunk = chunk[:0]
+			return err
+		}
+
+		err := walkDatabase(tx, "Replication", func(m mutation) error {
+			chunk = append(chunk, m)
+			if len(chunk) >= replicationSnapshotChunkSize {
+				return flush()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := flush(); err != nil {
+			return err
+		}
+
+		return writeFrame(conn, replicationFrame{Type: frameSnapshotEnd, HistoryID: historyID, Sequence: sequence})
+	})
+}
+
+//
+
+// Follow makes the store a follower of the leader at address. From
+// then on it refuses updates of its own until it is promoted. The
+// returned task keeps the store connected to the leader, reconnecting
+// when the connection is lost.
+func (s *Store) Follow(address string) func(ctx context.Context) {
+	r := s.replication
+
+	r.commitLock.Lock()
+	r.Lock()
+	r.role = RoleFollower
+	r.leader = address
+	r.Unlock()
+	r.commitLock.Unlock()
+
+	return func(ctx context.Context) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		r.Lock()
+		if r.role != RoleFollower {
+			r.Unlock()
+			return
+		}
+		r.cancelFollow = cancel
+		r.Unlock()
+
+		backoff := time.Second
+		for {
+			started := time.Now()
+			err := s.followLeader(ctx, address)
+			if ctx.Err() != nil {
+				return
+			}
+			if time.Since(started) > time.Minute {
+				backoff = time.Second // It was working, retry quickly
+			}
+			s.logger.Warn("Replication from leader interrupted", "leader", address, "error", err)
+
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+		}
+	}
+}
+
+// Promote turns a follower into a leader that accepts updates. If the
+// store serves replication, other followers can then follow it.
+func (s *Store) Promote() error {
+	r := s.replication
+
+	r.commitLock.Lock()
+	defer r.commitLock.Unlock()
+	r.Lock()
+	defer r.Unlock()
+
+	if r.role != RoleFollower {
+		return ErrNotFollower
+	}
+
+	if r.cancelFollow != nil {
+		r.cancelFollow()
+		r.cancelFollow = nil
+	}
+
+	r.role = RoleLeader
+	r.leader = ""
+	r.connected = false
+	if r.serving {
+		r.startHistory()
+	}
+
+	s.logger.Info("Promoted to replication leader")
+
+	return nil
+}
+
+func (s *Store) followLeader(ctx context.Context, address string) error {
+	r := s.replication
+
+	dialer := net.Dialer{Timeout: replicationTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	var hello replicationHello
+	err = r.backend.View(func(tx backendTx) error {
+		hello.HistoryID, hello.Sequence = readReplicationState(tx)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := writeFrame(conn, hello); err != nil {
+		return err
+	}
+
+	r.Lock()
+	r.connected = true
+	r.historyID = hello.HistoryID
+	r.sequence = hello.Sequence
+	r.Unlock()
+
+	defer func() {
+		r.Lock()
+		r.connected = false
+		r.Unlock()
+	}()
+
+	reader := bufio.NewReader(conn)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+
+		var frame replicationFrame
+		if err := readFrame(reader, &frame); err != nil {
+			return err
+		}
+
+		switch frame.Type {
+		case frameHeartbeat:
+			r.Lock()
+			r.leaderSequence = frame.Sequence
+			r.lastContact = time.Now()
+			r.Unlock()
+			continue
+		case frameChangeset:
+			r.Lock()
+			expected := bytes.Equal(frame.HistoryID, r.historyID) && frame.Sequence == r.sequence+1
+			r.Unlock()
+			if !expected {
+				return fmt.Errorf("unexpected changeset %x/%d", frame.HistoryID, frame.Sequence)
+			}
+			err = s.applyReplicated(func(tx backendTx) error {
+				return applyMutations(tx, frame.Mutations)
+			}, frame)
+		case frameSnapshot:
+			s.logger.Info("Receiving snapshot", "sequence", frame.Sequence, "leader", address)
+			err = s.applyReplicated(func(tx backendTx) error {
+				return applySnapshot(tx, reader, conn, frame)
+			}, frame)
+		default:
+			err = fmt.Errorf("unexpected frame type <%s>", frame.Type)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// applyReplicated runs apply and records the new replication state in
+// one transaction, unless the store was promoted in the meantime.
+func (s *Store) applyReplicated(apply func(tx backendTx) error, frame replicationFrame) error {
+	r := s.replication
+
+	r.commitLock.Lock()
+	defer r.commitLock.Unlock()
+
+	r.Lock()
+	following := r.role == RoleFollower
+	r.Unlock()
+
+	if !following {
+		return ErrNotFollower
+	}
+
+	err := r.backend.Update(func(tx backendTx) error {
+		if err := apply(tx); err != nil {
+			return err
+		}
+		return writeReplicationState(tx, frame.HistoryID, frame.Sequence)
+	})
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	r.historyID = frame.HistoryID
+	r.sequence = frame.Sequence
+	if r.sequence > r.leaderSequence {
+		r.leaderSequence = r.sequence
+	}
+	r.lastContact = time.Now()
+	r.Unlock()
+
+	return nil
+}
+
+// applySnapshot replaces everything but the Replication bucket with the
+// snapshot that starts with first and continues until the end frame.
+func applySnapshot(tx backendTx, reader *bufio.Reader, conn net.Conn, first replicationFrame) error {
+	if err := deleteBuckets(tx, "Replication"); err != nil {
+		return err
+	}
+
+	frame := first
+	for frame.Type == frameSnapshot {
+		if !bytes.Equal(frame.HistoryID, first.HistoryID) || frame.Sequence != first.Sequence {
+			return errors.New("snapshot frames do not match")
+		}
+
+		if err := applyMutations(tx, frame.Mutations); err != nil {
+			return err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+		frame = replicationFrame{}
+		if err := readFrame(reader, &frame); err != nil {
+			return err
+		}
+	}
+
+	if frame.Type != frameSnapshotEnd {
+		return fmt.Errorf("unexpected frame type <%s> in snapshot", frame.Type)
+	}
+
+	return nil
+}
+
+// walkDatabase calls fn with the mutations that recreate every bucket
+// and key in the database, except for the top level bucket skip.
+func walkDatabase(tx backendTx, skip string, fn func(m mutation) error) error {
+	var walk func(path [][]byte, bucket backendBucket) error
+	walk = func(path [][]byte, bucket backendBucket) error {
+		return bucket.ForEach(func(key, value []byte) error {
+			if value == nil {
+				if err := fn(mutation{Op: opCreateBucket, Path: path, Key: key}); err != nil {
+					return err
+				}
+				return walk(appendPath(path, key), bucket.Bucket(key))
+			}
+			return fn(mutation{Op: opPut, Path: path, Key: key, Value: value})
+		})
+	}
+
+	return tx.ForEach(func(name []byte, bucket backendBucket) error {
+		if string(name) == skip {
+			return nil
+		}
+		if err := fn(mutation{Op: opCreateBucket, Key: name}); err != nil {
+			return err
+		}
+		return walk([][]byte{name}, bucket)
+	})
+}
+
+// deleteBuckets deletes every top level bucket except keep.
+func deleteBuckets(tx backendTx, keep string) error {
+	var names [][]byte
+	err := tx.ForEach(func(name []byte, bucket backendBucket) error {
+		if string(name) != keep {
+			names = append(names, append([]byte{}, name...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := tx.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readReplicationState(tx backendTx) ([]byte, uint64) {
+	bucket := tx.Bucket([]byte("Replication"))
+	if bucket == nil {
+		return nil, 0
+	}
+	historyID := append([]byte{}, bucket.Get([]byte("HistoryID"))...)
+	sequence, err := decodeInt(bucket.Get([]byte("Sequence")))
+	if err != nil {
+		return nil, 0
+	}
+	return historyID, uint64(sequence)
+}
+
+func writeReplicationState(tx backendTx, historyID []byte, sequence uint64) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte("Replication"))
+	if err != nil {
+		return err
+	}
+	if err := bucket.Put([]byte("HistoryID"), historyID); err != nil {
+		return err
+	}
+	return bucket.Put([]byte("Sequence"), encodeInt(int(sequence)))
+}
+
+//
+
+func applyMutations(tx backendTx, mutations []mutation) error {
+	for _, m := range mutations {
+		if len(m.Path) == 0 {
+			var err error
+			switch m.Op {
+			case opCreateBucket:
+				_, err = tx.CreateBucketIfNotExists(m.Key)
+			case opDeleteBucket:
+				err = tx.DeleteBucket(m.Key)
+			default:
+				err = fmt.Errorf("invalid operation %d on the root bucket", m.Op)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		bucket := tx.Bucket(m.Path[0])
+		for _, name := range m.Path[1:] {
+			if bucket == nil {
+				break
+			}
+			bucket = bucket.Bucket(name)
+		}
+		if bucket == nil {
+			return fmt.Errorf("bucket <%s> not found", bytes.Join(m.Path, []byte("/")))
+		}
+
+		var err error
+		switch m.Op {
+		case opPut:
+			err = bucket.Put(m.Key, m.Value)
+		case opDelete:
+			err = bucket.Delete(m.Key)
+		case opCreateBucket:
+			_, err = bucket.CreateBucketIfNotExists(m.Key)
+		case opDeleteBucket:
+			err = bucket.DeleteBucket(m.Key)
+		default:
+			err = fmt.Errorf("invalid operation %d", m.Op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendPath(path [][]byte, name []byte) [][]byte {
+	return append(append([][]byte{}, path...), name)
+}
+
+// Frames are msgpack encoded and prefixed with their length.
+
+func writeFrame(conn net.Conn, v interface{}) error {
+	conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+	return writeFrameTo(conn, v)
+}
+
+func writeFrameTo(w io.Writer, v interface{}) error {
+	encoded, err := msgpack.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(encoded)))
+
+	if _, err := w.Write(append(length[:], encoded...)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func readFrame(reader *bufio.Reader, v interface{}) error {
+	var length [4]byte
+	if _, err := io.ReadFull(reader, length[:]); err != nil {
+		return err
+	}
+
+	size := binary.BigEndian.Uint32(length[:])
+	if size > replicationMaxFrameSize {
+		return fmt.Errorf("frame of %d bytes is too large", size)
+	}
+
+	encoded := make([]byte, size)
+	if _, err := io.ReadFull(reader, encoded); err != nil {
+		return err
+	}
+
+	return msgpack.Unmarshal(encoded, v)
+}
+
+//
+
+// recordingTx and recordingBucket pass everything through to the
+// backend and record the mutations they make.
+
+type recordingTx struct {
+	tx        backendTx
+	mutations *[]mutation
+}
+
+func (t recordingTx) record(m mutation) {
+	*t.mutations = append(*t.mutations, m)
+}
+
+func (t recordingTx) Bucket(name []byte) backendBucket {
+	bucket := t.tx.Bucket(name)
+	if bucket == nil {
+		return nil
+	}
+	return recordingBucket{bucket: bucket, path: [][]byte{copyBytes(name)}, tx: t}
+}
+
+func (t recordingTx) CreateBucketIfNotExists(name []byte) (backendBucket, error) {
+	bucket, err := t.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	t.record(mutation{Op: opCreateBucket, Key: copyBytes(name)})
+	return recordingBucket{bucket: bucket, path: [][]byte{copyBytes(name)}, tx: t}, nil
+}
+
+func (t recordingTx) DeleteBucket(name []byte) error {
+	if err := t.tx.DeleteBucket(name); err != nil {
+		return err
+	}
+	t.record(mutation{Op: opDeleteBucket, Key: copyBytes(name)})
+	return nil
+}
+
+func (t recordingTx) ForEach(fn func(name []byte, bucket backendBucket) error) error {
+	return t.tx.ForEach(func(name []byte, bucket backendBucket) error {
+		return fn(name, recordingBucket{bucket: bucket, path: [][]byte{copyBytes(name)}, tx: t})
+	})
+}
+
+type recordingBucket struct {
+	bucket backendBucket
+	path   [][]byte
+	tx     recordingTx
+}
+
+func (b recordingBucket) Get(key []byte) []byte {
+	return b.bucket.Get(key)
+}
+
+func (b recordingBucket) Put(key, value []byte) error {
+	if err := b.bucket.Put(key, value); err != nil {
+		return err
+	}
+	b.tx.record(mutation{Op: opPut, Path: b.path, Key: copyBytes(key), Value: copyBytes(value)})
+	return nil
+}
+
+func (b recordingBucket) Delete(key []byte) error {
+	if err := b.bucket.Delete(key); err != nil {
+		return err
+	}
+	b.tx.record(mutation{Op: opDelete, Path: b.path, Key: copyBytes(key)})
+	return nil
+}
+
+func (b recordingBucket) ForEach(fn func(key, value []byte) error) error {
+	return b.bucket.ForEach(fn)
+}
+
+func (b recordingBucket) Cursor() backendCursor {
+	return b.bucket.Cursor()
+}
+
+func (b recordingBucket) KeyN() int {
+	return b.bucket.KeyN()
+}
+
+func (b recordingBucket) Bucket(name []byte) backendBucket {
+	bucket := b.bucket.Bucket(name)
+	if bucket == nil {
+		return nil
+	}
+	return recordingBucket{bucket: bucket, path: appendPath(b.path, copyBytes(name)), tx: b.tx}
+}
+
+func (b recordingBucket) CreateBucket(name []byte) (backendBucket, error) {
+	bucket, err := b.bucket.CreateBucket(name)
+	if err != nil {
+		return nil, err
+	}
+	b.tx.record(mutation{Op: opCreateBucket, Path: b.path, Key: copyBytes(name)})
+	return recordingBucket{bucket: bucket, path: appendPath(b.path, copyBytes(name)), tx: b.tx}, nil
+}
+
+func (b recordingBucket) CreateBucketIfNotExists(name []byte) (backendBucket, error) {
+	bucket, err := b.bucket.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	b.tx.record(mutation{Op: opCreateBucket, Path: b.path, Key: copyBytes(name)})
+	return recordingBucket{bucket: bucket, path: appendPath(b.path, copyBytes(name)), tx: b.tx}, nil
+}
+
+func (b recordingBucket) DeleteBucket(name []byte) error {
+	if err := b.bucket.DeleteBucket(name); err != nil {
+		return err
+	}
+	b.tx.record(mutation{Op: opDeleteBucket, Path: b.path, Key: copyBytes(name)})
+	return nil
+}
+
+func copyBytes(b []byte) []byte {
+	return append([]byte{}, b...)
+}
@@ -0,0 +1,138 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// waitForReplication waits until follower has applied everything that
+// leader has recorded.
+func waitForReplication(t *testing.T, leader, follower *Store) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		leaderStatus, followerStatus := leader.ReplicationStatus(), follower.ReplicationStatus()
+		if followerStatus.Connected && followerStatus.HistoryID == leaderStatus.HistoryID && followerStatus.Sequence == leaderStatus.Sequence {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Follower did not catch up with the leader")
+}
+
+func Test_Replication(t *testing.T) {
+	leader, err := NewStore(MemoryDatabase)
+	assert.Nil(t, err)
+	defer leader.Close()
+
+	follower, err := NewStore(temporaryDatabase())
+	assert.Nil(t, err)
+	defer follower.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go leader.ServeReplication(ctx, listener)
+
+	// Messages that exist before the follower connects arrive in a snapshot
+
+	_, _, err = leader.CreateQueue("test")
+	assert.Nil(t, err)
+
+	_, err = leader.PutMessages("test", []Message{{Body: "Message1"}, {Body: "Message2"}, {Body: "Message3"}})
+	assert.Nil(t, err)
+
+	followCtx, stopFollowing := context.WithCancel(ctx)
+	go follower.Follow(listener.Addr().String())(followCtx)
+
+	waitForReplication(t, leader, follower)
+
+	names, err := follower.GetQueueNames()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"test"}, names)
+
+	// Changes after that are streamed
+
+	_, leases, err := leader.GetMessages("test", 1, DefaultLeaseDuration)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(leases))
+	assert.Nil(t, leader.DeleteLeasedMessage("test", leases[0].ID))
+
+	waitForReplication(t, leader, follower)
+
+	assert.Equal(t, 2, countMessages(t, follower, "test"))
+
+	// The follower is read-only
+
+	_, _, err = follower.CreateQueue("other")
+	assert.Equal(t, ErrNotLeader, err)
+
+	status := follower.ReplicationStatus()
+	assert.Equal(t, RoleFollower, status.Role)
+	assert.Equal(t, uint64(0), status.Lag)
+	assert.Equal(t, 1, len(leader.ReplicationStatus().Followers))
+
+	// A follower that reconnects continues where it left off
+
+	stopFollowing()
+	for follower.ReplicationStatus().Connected {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, err = leader.PutMessages("test", []Message{{Body: "Message4"}})
+	assert.Nil(t, err)
+
+	go follower.Follow(listener.Addr().String())(ctx)
+
+	waitForReplication(t, leader, follower)
+
+	assert.Equal(t, 3, countMessages(t, follower, "test"))
+
+	// After a promotion the follower accepts updates
+
+	assert.Nil(t, follower.Promote())
+	assert.Equal(t, ErrNotFollower, follower.Promote())
+
+	_, _, err = follower.CreateQueue("other")
+	assert.Nil(t, err)
+}
+
+func Test_ReplicationNotFollower(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		assert.Equal(t, RoleLeader, store.ReplicationStatus().Role)
+		assert.Equal(t, ErrNotFollower, store.Promote())
+	})
+}
+
+func countMessages(t *testing.T, store *Store, name string) int {
+	var count int
+	err := store.backend.View(func(tx backendTx) error {
+		count = countKeys(store.bucket(tx, "Queues", name, "Messages", "Visible"))
+		return nil
+	})
+	assert.Nil(t, err)
+	return count
+}
@@ -0,0 +1,161 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// The on-disk layout is versioned. Version 0 is the layout from before
+// versioning existed:
+//
+//   Queues/<name>/Meta            Name, Created (unix seconds as decimal string)
+//   Queues/<name>/Settings        LeaseDuration, MessageRetentionPeriod,
+//                                 DelaySeconds (decimal strings)
+//   Queues/<name>/Messages/Visible  MessageID -> msgpack Message
+//   Queues/<name>/Messages/Leased   LeaseID -> msgpack LeasedMessage
+//   Queues/<name>/Messages/Delayed
+//
+// Every later version is described by the migration that produces it.
+// The version itself lives in Schema/Version.
+
+// SchemaVersion is the version of the layout that this code reads and
+// writes.
+const SchemaVersion = 1
+
+// ErrSchemaTooNew is returned by NewStore for a database that was
+// written by a newer version of tqs.
+var ErrSchemaTooNew = errors.New("database schema is newer than supported")
+
+type migration struct {
+	version     int
+	description string
+	migrate     func(tx backendTx) error
+}
+
+// migrations must be kept in order. Each one upgrades the database
+// from the previous version to its own.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "record the schema version",
+		migrate: func(tx backendTx) error {
+			return nil
+		},
+	},
+}
+
+func schemaVersion(tx backendTx) (int, error) {
+	schema := tx.Bucket([]byte("Schema"))
+	if schema == nil {
+		return 0, nil
+	}
+	return decodeInt(schema.Get([]byte("Version")))
+}
+
+func setSchemaVersion(tx backendTx, version int) error {
+	schema, err := tx.CreateBucketIfNotExists([]byte("Schema"))
+	if err != nil {
+		return err
+	}
+	return schema.Put([]byte("Version"), encodeInt(version))
+}
+
+// setupSchema initializes an empty database or brings an existing one
+// up to SchemaVersion. Before migrating, a snapshot of the database is
+// written next to it.
+func setupSchema(b backend, path string, logger *slog.Logger) error {
+	var version int
+	var empty bool
+
+	err := b.View(func(tx backendTx) error {
+		v, err := schemaVersion(tx)
+		if err != nil {
+			return fmt.Errorf("Unable to decode schema version: %w", err)
+		}
+		version = v
+		empty = tx.Bucket([]byte("Queues")) == nil
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if version > SchemaVersion {
+		return fmt.Errorf("%w: database is at version %d, expected at most %d", ErrSchemaTooNew, version, SchemaVersion)
+	}
+
+	if empty && version == 0 {
+		return b.Update(func(tx backendTx) error {
+			if _, err := tx.CreateBucketIfNotExists([]byte("Queues")); err != nil {
+				return err
+			}
+			return setSchemaVersion(tx, SchemaVersion)
+		})
+	}
+
+	if version == SchemaVersion {
+		return nil
+	}
+
+	if s, ok := b.(snapshotter); ok {
+		backupPath := fmt.Sprintf("%s.v%d.bak", path, version)
+		logger.Info("Backing up database before migrating", "path", backupPath)
+		if err := writeSnapshot(s, backupPath); err != nil {
+			return fmt.Errorf("Unable to backup database before migrating: %s", err)
+		}
+	}
+
+	return b.Update(func(tx backendTx) error {
+		for _, m := range migrations {
+			if m.version <= version {
+				continue
+			}
+			logger.Info("Migrating database", "version", m.version, "description", m.description)
+			if err := m.migrate(tx); err != nil {
+				return fmt.Errorf("Migration to schema version %d failed: %w", m.version, err)
+			}
+			if err := setSchemaVersion(tx, m.version); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func writeSnapshot(s snapshotter, path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.WriteTo(file); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
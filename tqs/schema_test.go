@@ -0,0 +1,90 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readSchemaVersion(t *testing.T, store *Store) int {
+	var version int
+	err := store.backend.View(func(tx backendTx) error {
+		v, err := schemaVersion(tx)
+		version = v
+		return err
+	})
+	assert.Nil(t, err)
+	return version
+}
+
+func Test_NewStoreRecordsSchemaVersion(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		assert.Equal(t, SchemaVersion, readSchemaVersion(t, store))
+	})
+}
+
+func Test_MigrateUnversionedDatabase(t *testing.T) {
+	path := temporaryDatabase()
+
+	// Create a database the way NewStore did before versioning
+	backend, err := openBoltBackend(path)
+	assert.Nil(t, err)
+	err = backend.Update(func(tx backendTx) error {
+		queues, err := tx.CreateBucketIfNotExists([]byte("Queues"))
+		if err != nil {
+			return err
+		}
+		_, err = queues.CreateBucket([]byte("hello"))
+		return err
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, backend.Close())
+
+	store, err := NewStore(path)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	assert.Equal(t, SchemaVersion, readSchemaVersion(t, store))
+
+	names, err := store.GetQueueNames()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"hello"}, names)
+
+	_, err = os.Stat(path + ".v0.bak")
+	assert.Nil(t, err)
+}
+
+func Test_RefuseNewerSchema(t *testing.T) {
+	path := temporaryDatabase()
+
+	store, err := NewStore(path)
+	assert.Nil(t, err)
+	err = store.backend.Update(func(tx backendTx) error {
+		return setSchemaVersion(tx, SchemaVersion+1)
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, store.Close())
+
+	store, err = NewStore(path)
+	assert.Nil(t, store)
+	assert.True(t, errors.Is(err, ErrSchemaTooNew))
+}
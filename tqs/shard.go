@@ -0,0 +1,478 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A sharded store keeps its queues in several bolt files under a data
+// directory, so that a busy queue does not hold up the writes to all
+// the others. The catalog, catalog.db in that directory, has the name
+// of every queue in its Queues bucket, with the file that holds it as
+// the value.
+//
+// Every shard file has the same layout as a single file database, with
+// only its own queues in its Queues bucket, so that inspect, fsck and
+// compact work on them as they are. With zero shards every queue gets
+// a file of its own, queue-<name>.db, otherwise the queues are spread
+// over shard-<n>.db by a hash of their name. Queues stay in the file
+// they were created in when the number of shards changes.
+//
+// Updates of different queues run in parallel, but cross queue work
+// like expiry becomes one transaction per queue.
+
+const catalogName = "catalog.db"
+
+type sharding struct {
+	sync.Mutex
+	changed   *sync.Cond // Broadcast when a shard is released or removed
+	directory string
+	shards    int
+	options   storeOptions
+	readOnly  bool // Shards are opened read-only and not migrated
+	open      map[string]*shard
+}
+
+// shard is an open file with the number of operations that use it. A
+// file that is being removed is not handed out anymore, and is closed
+// when the last of its users releases it.
+type shard struct {
+	backend  backend
+	users    int
+	removing bool
+}
+
+// NewShardedStore opens, or creates, a sharded store in directory that
+// puts new queues in one of shards files, or in a file of their own
+// when shards is zero. It cannot be combined with WithBoltDB.
+func NewShardedStore(directory string, shards int, options ...StoreOption) (*Store, error) {
+	if shards < 0 {
+		return nil, fmt.Errorf("invalid number of shards %d", shards)
+	}
+
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+
+	store, err := NewStore(filepath.Join(directory, catalogName), options...)
+	if err != nil {
+		return nil, err
+	}
+
+	if store.options.db != nil {
+		store.Close()
+		return nil, errors.New("a sharded store cannot use an existing bolt database")
+	}
+
+	store.sharding = &sharding{
+		directory: directory,
+		shards:    shards,
+		options:   store.options,
+		open:      make(map[string]*shard),
+	}
+	store.sharding.changed = sync.NewCond(store.sharding)
+
+	return store, nil
+}
+
+// file returns the name of the file that a new queue goes into.
+func (sh *sharding) file(name string) string {
+	if sh.shards == 0 {
+		return "queue-" + name + ".db"
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	return fmt.Sprintf("shard-%d.db", hash.Sum32()%uint32(sh.shards))
+}
+
+// acquire returns the backend of file, opening it when needed, and a
+// function that releases it again, which the caller must call when it
+// is done with the backend. It waits for a file that is being removed
+// to be gone, so that a queue that is created again gets a new file.
+func (sh *sharding) acquire(file string) (backend, func(), error) {
+	sh.Lock()
+	defer sh.Unlock()
+
+	sd, ok := sh.open[file]
+	for ok && sd.removing {
+		sh.changed.Wait()
+		sd, ok = sh.open[file]
+	}
+
+	if !ok {
+		path := filepath.Join(sh.directory, file)
+
+		var backend backend
+		var err error
+		if sh.readOnly {
+			backend, err = openBoltBackendReadOnly(path)
+		} else {
+			backend, err = sh.openShard(path)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		sd = &shard{backend: backend}
+		sh.open[file] = sd
+	}
+
+	sd.users++
+
+	release := func() {
+		sh.Lock()
+		defer sh.Unlock()
+		sd.users--
+		if sd.users == 0 {
+			sh.changed.Broadcast()
+		}
+	}
+
+	return sd.backend, release, nil
+}
+
+func (sh *sharding) openShard(path string) (backend, error) {
+	backend, err := openBoltBackendWithOptions(path, sh.options.boltOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setupSchema(backend, path, sh.options.logger); err != nil {
+		backend.Close()
+		return nil, err
+	}
+
+	return backend, nil
+}
+
+// remove closes and deletes the file of a queue that had a file of its
+// own, after the operations that use it are done.
+func (sh *sharding) remove(file string) error {
+	sh.Lock()
+	defer sh.Unlock()
+	defer sh.changed.Broadcast()
+
+	if sd, ok := sh.open[file]; ok {
+		sd.removing = true
+		for sd.users != 0 {
+			sh.changed.Wait()
+		}
+		delete(sh.open, file)
+		if err := sd.backend.Close(); err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(filepath.Join(sh.directory, file))
+}
+
+func (sh *sharding) close() {
+	sh.Lock()
+	defer sh.Unlock()
+
+	for file, sd := range sh.open {
+		if err := sd.backend.Close(); err != nil {
+			sh.options.logger.Error("Failed to close shard", "file", file, "error", err)
+		}
+	}
+	sh.open = nil
+}
+
+//
+
+// queueFile looks up the file of a queue in the catalog.
+func (s *Store) queueFile(name string) (string, error) {
+	var file string
+	err := s.backend.View(func(tx backendTx) error {
+		value := s.queues(tx).Get([]byte(name))
+		if value == nil {
+			return ErrQueueNotFound
+		}
+		file = string(value)
+		return nil
+	})
+	return file, err
+}
+
+// queueBackend returns the backend that holds the queue name, and a
+// function to call when done with it.
+func (s *Store) queueBackend(name string) (backend, func(), error) {
+	if s.sharding == nil {
+		return s.backend, func() {}, nil
+	}
+
+	file, err := s.queueFile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s.sharding.acquire(file)
+}
+
+// queueView and queueUpdate run fn in a transaction on the database
+// that holds the queue name.
+
+func (s *Store) queueView(name string, fn func(tx backendTx) error) error {
+	backend, release, err := s.queueBackend(name)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return backend.View(fn)
+}
+
+func (s *Store) queueUpdate(name string, fn func(tx backendTx) error) error {
+	backend, release, err := s.queueBackend(name)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := backend.Update(fn); err != nil {
+		return err
+	}
+
+	s.signals.notify(name)
+	return nil
+}
+
+// updateQueues calls fn for every queue, in one transaction or, for a
+// sharded store, in one transaction per queue. What fn counts for a
+// queue is added to its counters once its transaction committed.
+func (s *Store) updateQueues(fn func(tx backendTx, name string, counts *queueCounters) error) error {
+	if s.sharding == nil {
+		var names []string
+		var counts []queueCounters
+		err := s.backend.Update(func(tx backendTx) error {
+			names, counts = nil, nil
+			return s.queues(tx).ForEach(func(key, value []byte) error {
+				names = append(names, string(key))
+				counts = append(counts, queueCounters{})
+				return fn(tx, string(key), &counts[len(counts)-1])
+			})
+		})
+		if err != nil {
+			return err
+		}
+		for i, name := range names {
+			s.counters.queue(name, func(c *queueCounters) { c.add(counts[i]) })
+		}
+		s.signals.notify(names...)
+		return nil
+	}
+
+	names, err := s.GetQueueNames()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		var counts queueCounters
+		err := s.queueUpdate(name, func(tx backendTx) error {
+			counts = queueCounters{}
+			return fn(tx, name, &counts)
+		})
+		if err == ErrQueueNotFound { // Deleted in the meantime
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		s.counters.queue(name, func(c *queueCounters) { c.add(counts) })
+	}
+
+	return nil
+}
+
+// createShardedQueue claims the name in the catalog first, so that the
+// catalog decides which of two concurrent creates wins.
+func (s *Store) createShardedQueue(name string, meta QueueMeta, settings QueueSettings) error {
+	file := s.sharding.file(name)
+
+	err := s.backend.Update(func(tx backendTx) error {
+		queues := s.queues(tx)
+		if queues.Get([]byte(name)) != nil {
+			return ErrQueueExists
+		}
+		return queues.Put([]byte(name), []byte(file))
+	})
+	if err != nil {
+		return err
+	}
+
+	backend, release, err := s.sharding.acquire(file)
+	if err == nil {
+		err = backend.Update(func(tx backendTx) error {
+			return s.createQueue(tx, name, meta, settings)
+		})
+		release()
+	}
+
+	if err != nil {
+		s.backend.Update(func(tx backendTx) error {
+			return s.queues(tx).Delete([]byte(name))
+		})
+		return err
+	}
+
+	return nil
+}
+
+func (s *Store) deleteShardedQueue(name string) error {
+	var file string
+	err := s.backend.Update(func(tx backendTx) error {
+		queues := s.queues(tx)
+		value := queues.Get([]byte(name))
+		if value == nil {
+			return ErrQueueNotFound
+		}
+		file = string(value)
+		return queues.Delete([]byte(name))
+	})
+	if err != nil {
+		return err
+	}
+
+	backend, release, err := s.sharding.acquire(file)
+	if err != nil {
+		return err
+	}
+
+	err = backend.Update(func(tx backendTx) error {
+		err := s.queues(tx).DeleteBucket([]byte(name))
+		if err == errBucketNotFound {
+			return nil
+		}
+		return err
+	})
+	release()
+	if err != nil {
+		return err
+	}
+
+	if file == "queue-"+name+".db" {
+		return s.sharding.remove(file)
+	}
+
+	return nil
+}
+
+//
+
+// MigrateToShards copies every queue of the single file database at
+// path into the sharded store in directory. The database must not be
+// in use and is left as it is. It returns the number of queues copied.
+func MigrateToShards(path, directory string, shards int) (int, error) {
+	source, err := openBoltBackendReadOnly(path)
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+
+	var version int
+	err = source.View(func(tx backendTx) error {
+		v, err := schemaVersion(tx)
+		version = v
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if version != SchemaVersion {
+		return 0, fmt.Errorf("database is at schema version %d, open it with tqsd once to migrate it to %d", version, SchemaVersion)
+	}
+
+	store, err := NewShardedStore(directory, shards)
+	if err != nil {
+		return 0, err
+	}
+	defer store.Close()
+
+	var names []string
+	err = source.View(func(tx backendTx) error {
+		return store.queues(tx).ForEach(func(key, value []byte) error {
+			if value == nil {
+				names = append(names, string(key))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, name := range names {
+		file := store.sharding.file(name)
+
+		err := store.backend.Update(func(tx backendTx) error {
+			queues := store.queues(tx)
+			if queues.Get([]byte(name)) != nil {
+				return fmt.Errorf("queue <%s>: %w", name, ErrQueueExists)
+			}
+			return queues.Put([]byte(name), []byte(file))
+		})
+		if err != nil {
+			return i, err
+		}
+
+		shard, release, err := store.sharding.acquire(file)
+		if err != nil {
+			return i, err
+		}
+
+		err = source.View(func(src backendTx) error {
+			return shard.Update(func(dst backendTx) error {
+				queue, err := store.queues(dst).CreateBucket([]byte(name))
+				if err != nil {
+					return err
+				}
+				return copyBucket(queue, store.queue(src, name))
+			})
+		})
+		release()
+		if err != nil {
+			store.backend.Update(func(tx backendTx) error {
+				return store.queues(tx).Delete([]byte(name))
+			})
+			return i, fmt.Errorf("queue <%s>: %w", name, err)
+		}
+
+		store.logger.Info("Migrated queue", "queue", name, "file", file)
+	}
+
+	return len(names), nil
+}
+
+func copyBucket(dst, src backendBucket) error {
+	return src.ForEach(func(key, value []byte) error {
+		if value != nil {
+			return dst.Put(key, value)
+		}
+		bucket, err := dst.CreateBucket(key)
+		if err != nil {
+			return err
+		}
+		return copyBucket(bucket, src.Bucket(key))
+	})
+}
@@ -0,0 +1,191 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqs
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ShardedStore(t *testing.T) {
+	for _, shards := range []int{0, 2} {
+		directory := temporaryDatabase() + ".d"
+		defer os.RemoveAll(directory)
+
+		store, err := NewShardedStore(directory, shards)
+		assert.Nil(t, err)
+
+		for _, name := range []string{"one", "two", "three"} {
+			_, _, err := store.CreateQueue(name)
+			assert.Nil(t, err)
+		}
+
+		_, _, err = store.CreateQueue("one")
+		assert.Equal(t, ErrQueueExists, err)
+
+		names, err := store.GetQueueNames()
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"one", "three", "two"}, names)
+
+		_, err = store.PutMessages("two", []Message{{Body: "Message1"}, {Body: "Message2"}})
+		assert.Nil(t, err)
+
+		messages, leases, err := store.GetMessages("two", 10, DefaultLeaseDuration)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(messages))
+		assert.Nil(t, store.DeleteLeasedMessage("two", leases[0].ID))
+
+		assert.Nil(t, store.expireLeasedMessages())
+		assert.Nil(t, store.expireMessages())
+
+		_, err = store.PutMessages("missing", []Message{{Body: "Message1"}})
+		assert.Equal(t, ErrQueueNotFound, err)
+
+		assert.Nil(t, store.DeleteQueue("one"))
+		assert.Equal(t, ErrQueueNotFound, store.DeleteQueue("one"))
+
+		if shards == 0 {
+			_, err := os.Stat(filepath.Join(directory, "queue-one.db"))
+			assert.True(t, os.IsNotExist(err))
+			_, err = os.Stat(filepath.Join(directory, "queue-two.db"))
+			assert.Nil(t, err)
+		}
+
+		assert.Nil(t, store.Close())
+
+		// Queues are found again after reopening
+
+		store, err = NewShardedStore(directory, shards)
+		assert.Nil(t, err)
+
+		names, err = store.GetQueueNames()
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"three", "two"}, names)
+
+		_, err = store.GetQueueMeta("two")
+		assert.Nil(t, err)
+
+		assert.Nil(t, store.Close())
+	}
+}
+
+func Test_ShardedDeleteWhileInUse(t *testing.T) {
+	directory := temporaryDatabase() + ".d"
+	defer os.RemoveAll(directory)
+
+	store, err := NewShardedStore(directory, 0)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	_, _, err = store.CreateQueue("busy")
+	assert.Nil(t, err)
+
+	// Senders keep using the file of the queue while it is deleted and
+	// created again, which must only ever fail with a missing queue
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := store.PutMessages("busy", []Message{{Body: "Message"}}); err != nil {
+					assert.Equal(t, ErrQueueNotFound, err)
+				}
+				if _, _, err := store.GetMessages("busy", 1, DefaultLeaseDuration); err != nil {
+					assert.Equal(t, ErrQueueNotFound, err)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, store.DeleteQueue("busy"))
+		_, _, err := store.CreateQueue("busy")
+		assert.Nil(t, err)
+	}
+
+	close(done)
+	wg.Wait()
+
+	// The last queue is intact and the only file left
+	_, err = store.PutMessages("busy", []Message{{Body: "Last"}})
+	assert.Nil(t, err)
+
+	files, err := filepath.Glob(filepath.Join(directory, "queue-*.db"))
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+
+	assert.Nil(t, store.DeleteQueue("busy"))
+
+	files, err = filepath.Glob(filepath.Join(directory, "queue-*.db"))
+	assert.Nil(t, err)
+	assert.Len(t, files, 0)
+}
+
+func Test_MigrateToShards(t *testing.T) {
+	path := temporaryDatabase()
+
+	store, err := NewStore(path)
+	assert.Nil(t, err)
+
+	_, _, err = store.CreateQueue("one")
+	assert.Nil(t, err)
+	_, _, err = store.CreateQueue("two", LeaseDuration(60))
+	assert.Nil(t, err)
+
+	_, err = store.PutMessages("two", []Message{{Body: "Message1"}, {Body: "Message2"}})
+	assert.Nil(t, err)
+
+	assert.Nil(t, store.Close())
+
+	directory := path + ".d"
+	defer os.RemoveAll(directory)
+
+	n, err := MigrateToShards(path, directory, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+
+	_, err = MigrateToShards(path, directory, 0)
+	assert.ErrorIs(t, err, ErrQueueExists)
+
+	sharded, err := NewShardedStore(directory, 0)
+	assert.Nil(t, err)
+	defer sharded.Close()
+
+	names, err := sharded.GetQueueNames()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"one", "two"}, names)
+
+	settings, err := sharded.GetQueueSettings("two")
+	assert.Nil(t, err)
+	assert.Equal(t, 60, settings.LeaseDuration)
+
+	messages, _, err := sharded.GetMessages("two", 10, DefaultLeaseDuration)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(messages))
+}
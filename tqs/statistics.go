@@ -24,9 +24,31 @@ type QueueStatistics struct {
 	Deletes        uint64
 	LeaseExpires   uint64
 	MessageExpires uint64
+	Quarantined    uint64
 }
 
-// GetQueueStatistics needs a comment TODO
+// GetQueueStatistics returns what happened to the messages of a queue
+// since the store was opened, and how many are in quarantine.
 func (s *Store) GetQueueStatistics(name string) (QueueStatistics, error) {
-	return QueueStatistics{}, nil
+	var statistics QueueStatistics
+	err := s.queueView(name, func(tx backendTx) error {
+		if s.queue(tx, name) == nil {
+			return ErrQueueNotFound
+		}
+		statistics.Quarantined = uint64(countKeys(s.bucket(tx, "Queues", name, "Quarantine")))
+		return nil
+	})
+	if err != nil {
+		return statistics, err
+	}
+
+	s.counters.queue(name, func(c *queueCounters) {
+		statistics.Sends = c.sent
+		statistics.Receives = c.received
+		statistics.Deletes = c.deleted
+		statistics.LeaseExpires = c.leasesExpired
+		statistics.MessageExpires = c.messagesExpired
+	})
+
+	return statistics, nil
 }
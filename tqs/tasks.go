@@ -19,20 +19,14 @@ package tqs
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
 	"time"
 
-	"github.com/boltdb/bolt"
 	"github.com/vmihailenco/msgpack"
 )
 
-const (
-	expireLeasedMessagesInterval = 2500
-	expireMessagesInterval       = 2500
-	moveDelayedMessagesInterval  = 2500
-)
-
-func (s *Store) expireLeasedMessagesForQueue(tx *bolt.Tx, name string) error {
+func (s *Store) expireLeasedMessagesForQueue(tx backendTx, name string, counts *queueCounters) error {
 	queue := s.queue(tx, name)
 	if queue == nil {
 		return ErrQueueNotFound
@@ -44,12 +38,20 @@ func (s *Store) expireLeasedMessagesForQueue(tx *bolt.Tx, name string) error {
 	leased := queue.Bucket([]byte("Messages")).Bucket([]byte("Leased"))
 	cursor := leased.Cursor()
 	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		if err := checkLeasedMessage(k, v); err != nil {
+			if err := s.quarantineMessage(queue, "Leased", k, v, err); err != nil {
+				return err
+			}
+			counts.quarantined++
+			continue
+		}
+
 		var leasedMessage LeasedMessage
 		if err := msgpack.Unmarshal(v, &leasedMessage); err != nil {
 			return err
 		}
 
-		if time.Now().After(leasedMessage.Expiration) {
+		if s.clock.Now().After(leasedMessage.Expiration) {
 			if err := leased.Delete(k); err != nil {
 				return err
 			}
@@ -67,28 +69,30 @@ func (s *Store) expireLeasedMessagesForQueue(tx *bolt.Tx, name string) error {
 		}
 	}
 
-	if s.debug {
-		log.Printf("Expired <%d> messages from <%s/Messages/Leased>", count, name)
+	counts.leasesExpired += uint64(count)
+
+	if count != 0 {
+		s.logger.Debug("Expired leases", "queue", name, "count", count)
 	}
 
 	return nil
 }
 
 func (s *Store) expireLeasedMessages() error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		return s.queues(tx).ForEach(func(key, value []byte) error {
-			return s.expireLeasedMessagesForQueue(tx, string(key))
-		})
-	})
+	return s.updateQueues(s.expireLeasedMessagesForQueue)
 }
 
 func (s *Store) ExpireLeasedMessagesTask(ctx context.Context) {
-	ticker := time.NewTicker(expireLeasedMessagesInterval * time.Millisecond)
+	ticker := s.clock.NewTicker(s.options.taskIntervals.ExpireLeases)
+	defer ticker.Stop()
 	for {
 		select {
-		case <-ticker.C:
-			if err := s.expireLeasedMessages(); err != nil {
-				log.Println("Failed to expire leases: ", err)
+		case <-ticker.C():
+			if s.isFollower() {
+				continue // The leader does this for us
+			}
+			if err := s.runTask("expire_leases", s.expireLeasedMessages); err != nil {
+				s.logger.Error("Failed to expire leases", "error", err)
 			}
 		case <-ctx.Done():
 			return
@@ -96,7 +100,7 @@ func (s *Store) ExpireLeasedMessagesTask(ctx context.Context) {
 	}
 }
 
-func (s *Store) expireMessagesForQueue(tx *bolt.Tx, name string) error {
+func (s *Store) expireMessagesForQueue(tx backendTx, name string, counts *queueCounters) error {
 	queue := s.queue(tx, name)
 	if queue == nil {
 		return ErrQueueNotFound
@@ -111,7 +115,7 @@ func (s *Store) expireMessagesForQueue(tx *bolt.Tx, name string) error {
 
 	visible := queue.Bucket([]byte("Messages")).Bucket([]byte("Visible"))
 	err = visible.ForEach(func(key, value []byte) error {
-		if timeFromMessageKey(key).Add(time.Duration(settings.MessageRetentionPeriod) * time.Second).Before(time.Now()) {
+		if timeFromMessageKey(key).Add(time.Duration(settings.MessageRetentionPeriod) * time.Second).Before(s.clock.Now()) {
 			if err := visible.Delete(key); err != nil {
 				return err
 			}
@@ -120,28 +124,30 @@ func (s *Store) expireMessagesForQueue(tx *bolt.Tx, name string) error {
 		return nil
 	})
 
-	if s.debug {
-		log.Printf("Expired <%d> messages from <%s/Messages/Visible>", count, name)
+	counts.messagesExpired += uint64(count)
+
+	if count != 0 {
+		s.logger.Debug("Expired messages", "queue", name, "count", count)
 	}
 
 	return err
 }
 
 func (s *Store) expireMessages() error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		return s.queues(tx).ForEach(func(key, value []byte) error {
-			return s.expireMessagesForQueue(tx, string(key))
-		})
-	})
+	return s.updateQueues(s.expireMessagesForQueue)
 }
 
 func (s *Store) ExpireMessagesTask(ctx context.Context) {
-	ticker := time.NewTicker(expireMessagesInterval * time.Millisecond)
+	ticker := s.clock.NewTicker(s.options.taskIntervals.ExpireMessages)
+	defer ticker.Stop()
 	for {
 		select {
-		case <-ticker.C:
-			if err := s.expireMessages(); err != nil {
-				log.Println("Failed to visible messages: ", err)
+		case <-ticker.C():
+			if s.isFollower() {
+				continue // The leader does this for us
+			}
+			if err := s.runTask("expire_messages", s.expireMessages); err != nil {
+				s.logger.Error("Failed to expire messages", "error", err)
 			}
 		case <-ctx.Done():
 			return
@@ -149,47 +155,163 @@ func (s *Store) ExpireMessagesTask(ctx context.Context) {
 	}
 }
 
-func (s *Store) moveDelayedMessagesForQueue(tx *bolt.Tx, name string) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		// delayed := s.delayed(tx)
-		// visible := s.visible(tx)
-
-		// now := time.Now().Unix()
-
-		// cursor := delayed.Cursor()
-		// for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
-		//	if timeFromKey(k) >= now {
-		//		// TODO Move
-		//	}
-		// }
-
-		// return s.delayed(tx).ForEach(func(key, value []byte) error {
-		//	for keyIsExpired() {
-		//		// move
-		//	}
-		// })
-		return nil
-	})
+func (s *Store) moveDelayedMessagesForQueue(tx backendTx, name string, counts *queueCounters) error {
+	// This runs inside the transaction of moveDelayedMessages, opening
+	// another one here would deadlock.
+
+	// delayed := s.delayed(tx)
+	// visible := s.visible(tx)
+
+	// now := time.Now().Unix()
+
+	// cursor := delayed.Cursor()
+	// for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+	//	if timeFromKey(k) >= now {
+	//		// TODO Move
+	//	}
+	// }
+
+	// return s.delayed(tx).ForEach(func(key, value []byte) error {
+	//	for keyIsExpired() {
+	//		// move
+	//	}
+	// })
+	return nil
 }
 
 func (s *Store) moveDelayedMessages() error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		return s.queues(tx).ForEach(func(key, value []byte) error {
-			return s.moveDelayedMessagesForQueue(tx, string(key))
-		})
-	})
+	return s.updateQueues(s.moveDelayedMessagesForQueue)
 }
 
 func (s *Store) MoveDelayedMessagesTask(ctx context.Context) {
-	ticker := time.NewTicker(moveDelayedMessagesInterval * time.Millisecond)
+	ticker := s.clock.NewTicker(s.options.taskIntervals.MoveDelayed)
+	defer ticker.Stop()
 	for {
 		select {
-		case <-ticker.C:
-			if err := s.moveDelayedMessages(); err != nil {
-				log.Println("Failed to move delayed messages: ", err)
+		case <-ticker.C():
+			if s.isFollower() {
+				continue // The leader does this for us
+			}
+			if err := s.runTask("move_delayed", s.moveDelayedMessages); err != nil {
+				s.logger.Error("Failed to move delayed messages", "error", err)
 			}
 		case <-ctx.Done():
 			return
 		}
 	}
 }
+
+//
+
+// Start runs the background tasks that expire leases and messages and
+// that make delayed messages visible, until Stop or Close is called.
+// Starting a store that was already started does nothing.
+func (s *Store) Start() {
+	s.tasksLock.Lock()
+	defer s.tasksLock.Unlock()
+
+	if s.stopTasks != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopTasks = cancel
+	s.tasksStarted = s.clock.Now()
+
+	for _, task := range []func(context.Context){s.ExpireLeasedMessagesTask, s.ExpireMessagesTask, s.MoveDelayedMessagesTask} {
+		s.tasks.Add(1)
+		go func(task func(context.Context)) {
+			defer s.tasks.Done()
+			task(ctx)
+		}(task)
+	}
+}
+
+// RunTasks does the work of the background tasks once, right away. It
+// is meant for programs that schedule the work themselves, and for
+// tests that move a fake clock.
+func (s *Store) RunTasks() error {
+	if err := s.runTask("expire_leases", s.expireLeasedMessages); err != nil {
+		return err
+	}
+	if err := s.runTask("expire_messages", s.expireMessages); err != nil {
+		return err
+	}
+	return s.runTask("move_delayed", s.moveDelayedMessages)
+}
+
+// Stop stops the background tasks and waits for them to finish.
+func (s *Store) Stop() {
+	s.tasksLock.Lock()
+	defer s.tasksLock.Unlock()
+
+	if s.stopTasks == nil {
+		return
+	}
+
+	s.stopTasks()
+	s.stopTasks = nil
+	s.tasks.Wait()
+}
+
+//
+
+// ErrNotReady is returned by CheckReady, wrapped with the reason.
+var ErrNotReady = errors.New("store is not ready")
+
+// CheckReady tells if the store can do its work: it is open, its
+// background tasks were started and each of them succeeded within
+// three of its intervals, or 30 seconds for tasks that run more often.
+func (s *Store) CheckReady() error {
+	if s.closed.Load() {
+		return fmt.Errorf("%w: closed", ErrNotReady)
+	}
+
+	s.tasksLock.Lock()
+	started, running := s.tasksStarted, s.stopTasks != nil
+	s.tasksLock.Unlock()
+
+	if !running {
+		return fmt.Errorf("%w: background tasks are not running", ErrNotReady)
+	}
+
+	// A follower leaves the work of the tasks to the leader
+	if s.isFollower() {
+		return nil
+	}
+
+	metrics := make(map[string]TaskMetrics)
+	for _, m := range s.TaskMetrics() {
+		metrics[m.Name] = m
+	}
+
+	now := s.clock.Now()
+	for _, task := range []struct {
+		name     string
+		interval time.Duration
+	}{
+		{"expire_leases", s.options.taskIntervals.ExpireLeases},
+		{"expire_messages", s.options.taskIntervals.ExpireMessages},
+		{"move_delayed", s.options.taskIntervals.MoveDelayed},
+	} {
+		allowed := 3 * task.interval
+		if allowed < 30*time.Second {
+			allowed = 30 * time.Second
+		}
+
+		since := started
+		if m := metrics[task.name]; m.LastSuccess.After(since) {
+			since = m.LastSuccess
+		}
+
+		if now.Sub(since) > allowed {
+			reason := fmt.Sprintf("%s did not succeed since %s", task.name, since.Format(time.RFC3339))
+			if m := metrics[task.name]; m.LastError != "" {
+				reason += ": " + m.LastError
+			}
+			return fmt.Errorf("%w: %s", ErrNotReady, reason)
+		}
+	}
+
+	return nil
+}
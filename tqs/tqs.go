@@ -18,13 +18,15 @@
 package tqs
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/boltdb/bolt"
 )
 
 var (
@@ -79,19 +81,36 @@ func (id *MessageID) MarshalJSON() ([]byte, error) {
 	return []byte("\"" + hex.EncodeToString([]byte(id[:])) + "\""), nil
 }
 
-func generateMessageID(priority uint8) MessageID {
-	now := uint64(time.Now().UnixNano())
+func (id *MessageID) UnmarshalJSON(data []byte) error {
+	return unmarshalHexID(data, id[:])
+}
+
+func generateMessageID(priority uint8, timestamp uint64) MessageID {
 	var buf [9]byte
 	buf[0] = priority
-	binary.BigEndian.PutUint64(buf[1:], now)
+	binary.BigEndian.PutUint64(buf[1:], timestamp)
 	return MessageID(buf)
 }
 
+// timestamp returns the time of the clock in nanoseconds, for a new
+// message or lease ID. It never returns the same value twice, so that
+// IDs stay unique when the clock does not move between calls.
+func (s *Store) timestamp() uint64 {
+	s.timestampLock.Lock()
+	defer s.timestampLock.Unlock()
+
+	now := uint64(s.clock.Now().UnixNano())
+	if now <= s.lastTimestamp {
+		now = s.lastTimestamp + 1
+	}
+	s.lastTimestamp = now
+
+	return now
+}
+
 func messageIDFromLeaseID(leaseID LeaseID) MessageID {
 	var messageID MessageID
-	for i := 0; i < 8; i++ {
-		messageID[i] = leaseID[i]
-	}
+	copy(messageID[:], leaseID[:len(messageID)])
 	return messageID
 }
 
@@ -133,50 +152,94 @@ func (qs *QueueSettings) setDelaySeconds(delaySeconds int) error {
 	return nil
 }
 
-// Store needs a comment TODO
+// Store is a set of named queues in a bolt database, or in memory. All
+// of its methods are safe to call from multiple goroutines; every
+// operation runs in its own transaction.
 type Store struct {
-	path  string
-	db    *bolt.DB
-	debug bool
+	path        string
+	storage     backend // The storage engine itself
+	backend     backend // The storage engine behind replication or the cluster
+	replication *replication
+	cluster     *cluster
+	sharding    *sharding
+	options     storeOptions
+	logger      *slog.Logger
+	clock       Clock
+
+	tasksLock    sync.Mutex
+	stopTasks    context.CancelFunc
+	tasks        sync.WaitGroup
+	tasksStarted time.Time
+	closed       atomic.Bool
+
+	timestampLock sync.Mutex
+	lastTimestamp uint64
+
+	counters counters
+	signals  queueSignals
+
+	queueDefaultsLock sync.Mutex
+	queueDefaults     QueueSettings
 }
 
-// NewStore needs a comment TODO
-func NewStore(path string) (*Store, error) {
-	db, err := bolt.Open(path, 0600, nil)
+// NewStore opens the bolt database at path, or creates an in-memory
+// store when path is MemoryDatabase.
+func NewStore(path string, options ...StoreOption) (*Store, error) {
+	o := defaultStoreOptions()
+	for _, option := range options {
+		if err := option(&o); err != nil {
+			return nil, err
+		}
+	}
+
+	backend, err := o.openBackend(path)
 	if err != nil {
 		return nil, err
 	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		if _, err = tx.CreateBucketIfNotExists([]byte("Queues")); err != nil {
-			return err
-		}
-		return nil
-	})
-
-	if err != nil {
+	if err := setupSchema(backend, path, o.logger); err != nil {
+		backend.Close()
 		return nil, err
 	}
 
+	replication := newReplication(backend)
+
 	store := &Store{
-		path: path,
-		db:   db,
+		path:        path,
+		storage:     backend,
+		backend:     replication,
+		replication: replication,
+		options:     o,
+		logger:      o.logger,
+		clock:       o.clock,
+
+		queueDefaults: o.queueDefaults,
 	}
 
 	return store, nil
 }
 
-// Close should have a comment TODO
+// Close stops the background tasks and closes the database.
 func (s *Store) Close() error {
-	return s.db.Close()
+	s.closed.Store(true)
+	s.Stop()
+	if s.sharding != nil {
+		s.sharding.close()
+	}
+	return s.backend.Close()
 }
 
 // DeleteQueue should have a comment TODO
 func (s *Store) DeleteQueue(name string) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
+	defer s.counters.forget(name)
+	defer s.signals.notify(name) // Receivers that wait find out it is gone
+	if s.sharding != nil {
+		return s.deleteShardedQueue(name)
+	}
+	return s.backend.Update(func(tx backendTx) error {
 		bucket := s.queues(tx)
 		err := bucket.DeleteBucket([]byte(name))
-		if err == bolt.ErrBucketNotFound {
+		if err == errBucketNotFound {
 			return ErrQueueNotFound
 		}
 		return err
@@ -185,22 +248,32 @@ func (s *Store) DeleteQueue(name string) error {
 
 // DeleteLeasedMessage needs a comment TODO
 func (s *Store) DeleteLeasedMessage(queueName string, leaseID LeaseID) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
+	err := s.queueUpdate(queueName, func(tx backendTx) error {
 		leased := s.leased(tx, queueName)
 		if leased == nil {
-			return fmt.Errorf("Could not get %s/Messages/Leased bucket", queueName)
+			return ErrQueueNotFound
 		}
-		if err := leased.Delete([]byte(leaseID[:])); err != nil {
-			return fmt.Errorf("Could not delete lease: %s", err)
+		if leased.Get(leaseID[:]) == nil {
+			return ErrLeaseNotFound
+		}
+		if err := leased.Delete(leaseID[:]); err != nil {
+			return fmt.Errorf("Could not delete lease: %w", err)
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	s.counters.queue(queueName, func(c *queueCounters) { c.deleted++ })
+
+	return nil
 }
 
 // GetQueueNames needs a comment TODO
 func (s *Store) GetQueueNames() ([]string, error) {
 	var names []string
-	return names, s.db.View(func(tx *bolt.Tx) error {
+	return names, s.backend.View(func(tx backendTx) error {
 		return s.queues(tx).ForEach(func(key, value []byte) error {
 			names = append(names, string(key))
 			return nil
@@ -217,7 +290,7 @@ type QueueMeta struct {
 // GetQueueMeta needs a comment TODO
 func (s *Store) GetQueueMeta(name string) (QueueMeta, error) {
 	var meta QueueMeta
-	return meta, s.db.View(func(tx *bolt.Tx) error {
+	return meta, s.queueView(name, func(tx backendTx) error {
 		metaBucket := s.meta(tx, name)
 		if metaBucket == nil {
 			return ErrQueueNotFound
@@ -237,7 +310,7 @@ func (s *Store) GetQueueMeta(name string) (QueueMeta, error) {
 
 //
 
-func (s *Store) getQueueSettings(tx *bolt.Tx, name string) (QueueSettings, error) {
+func (s *Store) getQueueSettings(tx backendTx, name string) (QueueSettings, error) {
 	var settings QueueSettings
 
 	settingsBucket := s.settings(tx, name)
@@ -247,19 +320,19 @@ func (s *Store) getQueueSettings(tx *bolt.Tx, name string) (QueueSettings, error
 
 	leaseDuration, err := decodeInt(settingsBucket.Get([]byte("LeaseDuration")))
 	if err != nil {
-		return QueueSettings{}, fmt.Errorf("Unable to retrieve/decode setting (LeaseDuration): %s", err)
+		return QueueSettings{}, fmt.Errorf("Unable to retrieve/decode setting (LeaseDuration): %w", err)
 	}
 	settings.LeaseDuration = leaseDuration
 
 	messageRetentionPeriod, err := decodeInt(settingsBucket.Get([]byte("MessageRetentionPeriod")))
 	if err != nil {
-		return QueueSettings{}, fmt.Errorf("Unable to retrieve/decode setting (MessageRetentionPeriod): %s", err)
+		return QueueSettings{}, fmt.Errorf("Unable to retrieve/decode setting (MessageRetentionPeriod): %w", err)
 	}
 	settings.MessageRetentionPeriod = messageRetentionPeriod
 
 	delaySeconds, err := decodeInt(settingsBucket.Get([]byte("DelaySeconds")))
 	if err != nil {
-		return QueueSettings{}, fmt.Errorf("Unable to retrieve/decode setting (DelaySeconds): %s", err)
+		return QueueSettings{}, fmt.Errorf("Unable to retrieve/decode setting (DelaySeconds): %w", err)
 	}
 	settings.DelaySeconds = delaySeconds
 
@@ -269,7 +342,7 @@ func (s *Store) getQueueSettings(tx *bolt.Tx, name string) (QueueSettings, error
 // GetQueueSettings needs a comment TODO
 func (s *Store) GetQueueSettings(name string) (QueueSettings, error) {
 	var settings QueueSettings
-	return settings, s.db.View(func(tx *bolt.Tx) error {
+	return settings, s.queueView(name, func(tx backendTx) error {
 		s, err := s.getQueueSettings(tx, name)
 		if err != nil {
 			return err
@@ -278,3 +351,29 @@ func (s *Store) GetQueueSettings(name string) (QueueSettings, error) {
 		return nil
 	})
 }
+
+// UpdateQueueSettings changes the settings of an existing queue and
+// returns all its settings. The new settings also apply to the
+// messages that are already in the queue.
+func (s *Store) UpdateQueueSettings(name string, updatedSettings ...QueueSetting) (QueueSettings, error) {
+	var settings QueueSettings
+	return settings, s.queueUpdate(name, func(tx backendTx) error {
+		current, err := s.getQueueSettings(tx, name)
+		if err != nil {
+			return err
+		}
+
+		for _, setting := range updatedSettings {
+			if err := setting(&current); err != nil {
+				return err
+			}
+		}
+
+		if err := putQueueSettings(s.settings(tx, name), current); err != nil {
+			return err
+		}
+
+		settings = current
+		return nil
+	})
+}
@@ -26,134 +26,137 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// testClock only moves when a test advances it. The tqstest package
+// has a complete fake clock, but tests in this package cannot use it.
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) NewTicker(d time.Duration) Ticker {
+	return systemClock{}.NewTicker(d)
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
 func temporaryDatabase() string {
 	return fmt.Sprintf("%s/%d.db", os.TempDir(), time.Now().UnixNano())
 }
 
-func Test_NewStore(t *testing.T) {
-	store, err := NewStore(temporaryDatabase())
-	assert.NotNil(t, store)
-	assert.Nil(t, err)
-	defer store.Close()
+// withStores runs fn against a fresh store for each backend, so that
+// both backends are held to the same tests.
+func withStores(t *testing.T, fn func(t *testing.T, store *Store)) {
+	for _, backend := range []struct{ name, path string }{
+		{"bolt", temporaryDatabase()},
+		{"memory", MemoryDatabase},
+	} {
+		t.Run(backend.name, func(t *testing.T) {
+			store, err := NewStore(backend.path)
+			assert.NotNil(t, store)
+			assert.Nil(t, err)
+			defer store.Close()
+			fn(t, store)
+		})
+	}
 }
 
-func Test_CreateQueue(t *testing.T) {
+func Test_NewStore(t *testing.T) {
 	store, err := NewStore(temporaryDatabase())
 	assert.NotNil(t, store)
 	assert.Nil(t, err)
 	defer store.Close()
-
-	_, _, err = store.CreateQueue("hello")
-	assert.Nil(t, err)
 }
 
-func Test_QueueGetMessage(t *testing.T) {
-	store, err := NewStore(temporaryDatabase())
+func Test_NewMemoryStore(t *testing.T) {
+	store, err := NewStore(MemoryDatabase)
 	assert.NotNil(t, store)
 	assert.Nil(t, err)
 	defer store.Close()
-
-	_, _, err = store.CreateQueue("hello")
-	assert.Nil(t, err)
-
-	messages, leases, err := store.GetMessages("hello", 1, DefaultLeaseDuration)
-	assert.Zero(t, len(messages))
-	assert.Zero(t, len(leases))
-	assert.Nil(t, err)
 }
 
-func Test_QueuePutMessages1(t *testing.T) {
-	store, err := NewStore(temporaryDatabase())
-	assert.NotNil(t, store)
-	assert.Nil(t, err)
-	defer store.Close()
+func Test_DeleteQueue(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		_, _, err := store.CreateQueue("hello")
+		assert.Nil(t, err)
 
-	_, _, err = store.CreateQueue("hello")
-	assert.Nil(t, err)
+		_, _, err = store.CreateQueue("hello")
+		assert.Equal(t, ErrQueueExists, err)
 
-	messages := []Message{
-		Message{Body: "Hello, world!"},
-	}
+		names, err := store.GetQueueNames()
+		assert.Equal(t, []string{"hello"}, names)
+		assert.Nil(t, err)
 
-	ids, err := store.PutMessages("hello", messages)
-	assert.Len(t, ids, 1)
-	assert.Nil(t, err)
+		assert.Nil(t, store.DeleteQueue("hello"))
+		assert.Equal(t, ErrQueueNotFound, store.DeleteQueue("hello"))
+	})
 }
 
-func Test_QueuePutMessages3(t *testing.T) {
-	store, err := NewStore(temporaryDatabase())
-	assert.NotNil(t, store)
-	assert.Nil(t, err)
-	defer store.Close()
-
-	_, _, err = store.CreateQueue("hello")
-	assert.Nil(t, err)
+func Test_CreateQueue(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		_, _, err := store.CreateQueue("hello")
+		assert.Nil(t, err)
+	})
+}
 
-	messages := []Message{
-		Message{Body: "Message1"},
-		Message{Body: "Message2"},
-		Message{Body: "Message3"},
-	}
+func Test_UpdateQueueSettings(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		_, _, err := store.CreateQueue("hello", DelaySeconds(10))
+		assert.Nil(t, err)
 
-	ids, err := store.PutMessages("hello", messages)
-	assert.Len(t, ids, 3)
-	assert.Nil(t, err)
-}
+		settings, err := store.UpdateQueueSettings("hello", LeaseDuration(60))
+		assert.Nil(t, err)
+		assert.Equal(t, 60, settings.LeaseDuration)
+		assert.Equal(t, 10, settings.DelaySeconds)
 
-func Test_QueueGetMessages2(t *testing.T) {
-	store, err := NewStore(temporaryDatabase())
-	assert.NotNil(t, store)
-	assert.Nil(t, err)
-	defer store.Close()
+		settings, err = store.GetQueueSettings("hello")
+		assert.Nil(t, err)
+		assert.Equal(t, 60, settings.LeaseDuration)
 
-	_, _, err = store.CreateQueue("hello")
-	assert.Nil(t, err)
+		_, err = store.UpdateQueueSettings("hello", LeaseDuration(MaxLeaseDuration+1))
+		assert.Equal(t, ErrInvalidLeaseDuration, err)
 
-	messages := []Message{
-		Message{Body: "Message1"},
-		Message{Body: "Message2"},
-		Message{Body: "Message3"},
-	}
+		_, err = store.UpdateQueueSettings("nope", LeaseDuration(60))
+		assert.Equal(t, ErrQueueNotFound, err)
+	})
+}
 
-	ids, err := store.PutMessages("hello", messages)
-	assert.Len(t, ids, 3)
-	assert.NotZero(t, ids[0])
-	assert.NotZero(t, ids[1])
-	assert.NotZero(t, ids[2])
-	assert.Nil(t, err)
+func Test_QueueGetMessage(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		_, _, err := store.CreateQueue("hello")
+		assert.Nil(t, err)
 
-	if true {
 		messages, leases, err := store.GetMessages("hello", 1, DefaultLeaseDuration)
-		assert.Len(t, messages, 1)
-		assert.Len(t, leases, 1)
+		assert.Zero(t, len(messages))
+		assert.Zero(t, len(leases))
 		assert.Nil(t, err)
-	}
+	})
+}
 
-	if true {
-		messages, leases, err := store.GetMessages("hello", 5, DefaultLeaseDuration)
-		assert.Len(t, messages, 2)
-		assert.Len(t, leases, 2)
+func Test_QueuePutMessages1(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		_, _, err := store.CreateQueue("hello")
 		assert.Nil(t, err)
-	}
 
-	if true {
-		messages, leases, err := store.GetMessages("hello", 1, DefaultLeaseDuration)
-		assert.Len(t, messages, 0)
-		assert.Len(t, leases, 0)
+		messages := []Message{
+			Message{Body: "Hello, world!"},
+		}
+
+		ids, err := store.PutMessages("hello", messages)
+		assert.Len(t, ids, 1)
 		assert.Nil(t, err)
-	}
+	})
 }
 
-func Test_DeleteMessage(t *testing.T) {
-	store, err := NewStore(temporaryDatabase())
-	assert.NotNil(t, store)
-	assert.Nil(t, err)
-	defer store.Close()
-
-	_, _, err = store.CreateQueue("hello")
-	assert.Nil(t, err)
+func Test_QueuePutMessages3(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		_, _, err := store.CreateQueue("hello")
+		assert.Nil(t, err)
 
-	if true {
 		messages := []Message{
 			Message{Body: "Message1"},
 			Message{Body: "Message2"},
@@ -163,77 +166,140 @@ func Test_DeleteMessage(t *testing.T) {
 		ids, err := store.PutMessages("hello", messages)
 		assert.Len(t, ids, 3)
 		assert.Nil(t, err)
-	}
+	})
+}
 
-	if true {
-		messages, leases, err := store.GetMessages("hello", 3, MinLeaseDuration)
-		assert.Len(t, messages, 3)
-		assert.Len(t, leases, 3)
+func Test_QueueGetMessages2(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		_, _, err := store.CreateQueue("hello")
 		assert.Nil(t, err)
 
-		for _, lease := range leases {
-			err := store.DeleteLeasedMessage("hello", lease.ID)
-			assert.Nil(t, err)
+		messages := []Message{
+			Message{Body: "Message1"},
+			Message{Body: "Message2"},
+			Message{Body: "Message3"},
 		}
-	}
 
-	if true {
-		time.Sleep(MinLeaseDuration * time.Second)
-		err := store.expireLeasedMessages()
+		ids, err := store.PutMessages("hello", messages)
+		assert.Len(t, ids, 3)
+		assert.NotZero(t, ids[0])
+		assert.NotZero(t, ids[1])
+		assert.NotZero(t, ids[2])
 		assert.Nil(t, err)
-	}
 
-	if true {
-		messages, leases, err := store.GetMessages("hello", 3, DefaultLeaseDuration)
-		assert.Len(t, messages, 0)
-		assert.Len(t, leases, 0)
-		assert.Nil(t, err)
-	}
+		if true {
+			messages, leases, err := store.GetMessages("hello", 1, DefaultLeaseDuration)
+			assert.Len(t, messages, 1)
+			assert.Len(t, leases, 1)
+			assert.Nil(t, err)
+		}
+
+		if true {
+			messages, leases, err := store.GetMessages("hello", 5, DefaultLeaseDuration)
+			assert.Len(t, messages, 2)
+			assert.Len(t, leases, 2)
+			assert.Nil(t, err)
+		}
+
+		if true {
+			messages, leases, err := store.GetMessages("hello", 1, DefaultLeaseDuration)
+			assert.Len(t, messages, 0)
+			assert.Len(t, leases, 0)
+			assert.Nil(t, err)
+		}
+	})
 }
 
-func Test_LeaseExpiration(t *testing.T) {
-	store, err := NewStore(temporaryDatabase())
-	assert.NotNil(t, store)
-	assert.Nil(t, err)
-	defer store.Close()
+func Test_DeleteMessage(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		clock := &testClock{now: time.Now()}
+		store.clock = clock
 
-	_, _, err = store.CreateQueue("hello")
-	assert.Nil(t, err)
+		_, _, err := store.CreateQueue("hello")
+		assert.Nil(t, err)
 
-	messages := []Message{
-		Message{Body: "Message1"},
-		Message{Body: "Message2"},
-		Message{Body: "Message3"},
-	}
+		if true {
+			messages := []Message{
+				Message{Body: "Message1"},
+				Message{Body: "Message2"},
+				Message{Body: "Message3"},
+			}
 
-	ids, err := store.PutMessages("hello", messages)
-	assert.Len(t, ids, 3)
-	assert.Nil(t, err)
+			ids, err := store.PutMessages("hello", messages)
+			assert.Len(t, ids, 3)
+			assert.Nil(t, err)
+		}
 
-	if true {
-		messages, leases, err := store.GetMessages("hello", 3, MinLeaseDuration)
-		assert.Len(t, messages, 3)
-		assert.Len(t, leases, 3)
-		assert.Nil(t, err)
-	}
+		if true {
+			messages, leases, err := store.GetMessages("hello", 3, MinLeaseDuration)
+			assert.Len(t, messages, 3)
+			assert.Len(t, leases, 3)
+			assert.Nil(t, err)
 
-	if true {
-		messages, leases, err := store.GetMessages("hello", 3, MinLeaseDuration)
-		assert.Len(t, messages, 0)
-		assert.Len(t, leases, 0)
-		assert.Nil(t, err)
-	}
+			for _, lease := range leases {
+				err := store.DeleteLeasedMessage("hello", lease.ID)
+				assert.Nil(t, err)
+			}
+		}
+
+		if true {
+			clock.Advance(MinLeaseDuration*time.Second + time.Nanosecond)
+			err := store.expireLeasedMessages()
+			assert.Nil(t, err)
+		}
 
-	if true {
-		time.Sleep(MinLeaseDuration * time.Second)
-		err := store.expireLeasedMessages()
+		if true {
+			messages, leases, err := store.GetMessages("hello", 3, DefaultLeaseDuration)
+			assert.Len(t, messages, 0)
+			assert.Len(t, leases, 0)
+			assert.Nil(t, err)
+		}
+	})
+}
+
+func Test_LeaseExpiration(t *testing.T) {
+	withStores(t, func(t *testing.T, store *Store) {
+		clock := &testClock{now: time.Now()}
+		store.clock = clock
+
+		_, _, err := store.CreateQueue("hello")
 		assert.Nil(t, err)
-	}
 
-	if true {
-		messages, leases, err := store.GetMessages("hello", 3, DefaultLeaseDuration)
-		assert.Len(t, messages, 3)
-		assert.Len(t, leases, 3)
+		messages := []Message{
+			Message{Body: "Message1"},
+			Message{Body: "Message2"},
+			Message{Body: "Message3"},
+		}
+
+		ids, err := store.PutMessages("hello", messages)
+		assert.Len(t, ids, 3)
 		assert.Nil(t, err)
-	}
+
+		if true {
+			messages, leases, err := store.GetMessages("hello", 3, MinLeaseDuration)
+			assert.Len(t, messages, 3)
+			assert.Len(t, leases, 3)
+			assert.Nil(t, err)
+		}
+
+		if true {
+			messages, leases, err := store.GetMessages("hello", 3, MinLeaseDuration)
+			assert.Len(t, messages, 0)
+			assert.Len(t, leases, 0)
+			assert.Nil(t, err)
+		}
+
+		if true {
+			clock.Advance(MinLeaseDuration*time.Second + time.Nanosecond)
+			err := store.expireLeasedMessages()
+			assert.Nil(t, err)
+		}
+
+		if true {
+			messages, leases, err := store.GetMessages("hello", 3, DefaultLeaseDuration)
+			assert.Len(t, messages, 3)
+			assert.Len(t, leases, 3)
+			assert.Nil(t, err)
+		}
+	})
 }
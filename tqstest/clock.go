@@ -0,0 +1,102 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Package tqstest has helpers for testing code that uses tqs.
+package tqstest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/st3fan/tqsd/tqs"
+)
+
+// Clock is a tqs.Clock that only moves when Advance is called. Give it
+// to a store with tqs.WithClock, move it past a lease or retention
+// period and call RunTasks on the store to see the effect right away.
+type Clock struct {
+	sync.Mutex
+	now     time.Time
+	tickers []*ticker
+}
+
+// NewClock returns a clock that is stopped at now.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns the time of the clock.
+func (c *Clock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d and fires the tickers that are
+// due. Like a time.Ticker, a ticker drops ticks that nobody receives.
+func (c *Clock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.now = c.now.Add(d)
+
+	for _, t := range c.tickers {
+		if t.stopped || t.next.After(c.now) {
+			continue
+		}
+		for !t.next.After(c.now) {
+			t.next = t.next.Add(t.interval)
+		}
+		select {
+		case t.c <- c.now:
+		default:
+		}
+	}
+}
+
+// NewTicker returns a ticker that fires when Advance moves the clock
+// past its next tick.
+func (c *Clock) NewTicker(d time.Duration) tqs.Ticker {
+	if d <= 0 {
+		panic("tqstest: non-positive interval for NewTicker")
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	t := &ticker{clock: c, c: make(chan time.Time, 1), interval: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+type ticker struct {
+	clock    *Clock
+	c        chan time.Time
+	interval time.Duration
+	next     time.Time
+	stopped  bool
+}
+
+func (t *ticker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *ticker) Stop() {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	t.stopped = true
+}
@@ -0,0 +1,104 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqstest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/st3fan/tqsd/tqs"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestStore(t *testing.T, clock *Clock) *tqs.Store {
+	store, err := tqs.NewStore(tqs.MemoryDatabase, tqs.WithClock(clock))
+	if err != nil {
+		t.Fatal("Failed to create store: ", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func Test_LeaseExpiry(t *testing.T) {
+	clock := NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	store := newTestStore(t, clock)
+
+	_, _, err := store.CreateQueue("jobs")
+	assert.Nil(t, err)
+
+	_, err = store.PutMessages("jobs", []tqs.Message{{Body: "Hello"}})
+	assert.Nil(t, err)
+
+	messages, _, err := store.GetMessages("jobs", 1, 30)
+	assert.Nil(t, err)
+	assert.Len(t, messages, 1)
+
+	clock.Advance(29 * time.Second)
+	assert.Nil(t, store.RunTasks())
+
+	messages, _, err = store.GetMessages("jobs", 1, 30)
+	assert.Nil(t, err)
+	assert.Len(t, messages, 0)
+
+	clock.Advance(2 * time.Second)
+	assert.Nil(t, store.RunTasks())
+
+	messages, _, err = store.GetMessages("jobs", 1, 30)
+	assert.Nil(t, err)
+	assert.Len(t, messages, 1)
+}
+
+func Test_MessageRetention(t *testing.T) {
+	clock := NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	store := newTestStore(t, clock)
+
+	_, _, err := store.CreateQueue("jobs", tqs.MessageRetentionPeriod(tqs.MinMessageRetentionPeriod))
+	assert.Nil(t, err)
+
+	_, err = store.PutMessages("jobs", []tqs.Message{{Body: "Hello"}})
+	assert.Nil(t, err)
+
+	clock.Advance(tqs.MinMessageRetentionPeriod*time.Second + time.Second)
+	assert.Nil(t, store.RunTasks())
+
+	messages, _, err := store.GetMessages("jobs", 1, 30)
+	assert.Nil(t, err)
+	assert.Len(t, messages, 0)
+}
+
+func Test_Ticker(t *testing.T) {
+	clock := NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	ticker := clock.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	clock.Advance(500 * time.Millisecond)
+	select {
+	case <-ticker.C():
+		t.Fatal("Ticker fired early")
+	default:
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	select {
+	case now := <-ticker.C():
+		assert.Equal(t, clock.Now(), now)
+	default:
+		t.Fatal("Ticker did not fire")
+	}
+}
@@ -0,0 +1,175 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package tqstest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/st3fan/tqsd/api"
+	"github.com/st3fan/tqsd/tqs"
+)
+
+// Server is a tqsd running in the test process, on a local port. It is
+// closed when the test that created it finishes.
+type Server struct {
+	// URL is the base URL of the API, like http://127.0.0.1:41234
+	URL string
+	// Client is an HTTP client for talking to the server.
+	Client *http.Client
+	// Store is the store behind the server, for setting things up or
+	// checking them without going through the API.
+	Store *tqs.Store
+	// Clock is the clock of the store when WithClock was used.
+	Clock *Clock
+
+	server *httptest.Server
+}
+
+// ServerOption configures a Server created by NewServer.
+type ServerOption func(*serverOptions)
+
+type serverOptions struct {
+	temporaryFile bool
+	clock         *Clock
+	queues        []queueDefinition
+	adminToken    string
+	storeOptions  []tqs.StoreOption
+	serverOptions []api.ServerOption
+}
+
+type queueDefinition struct {
+	name     string
+	settings []tqs.QueueSetting
+}
+
+// WithQueue creates the queue name before the server starts.
+func WithQueue(name string, settings ...tqs.QueueSetting) ServerOption {
+	return func(o *serverOptions) {
+		o.queues = append(o.queues, queueDefinition{name, settings})
+	}
+}
+
+// WithTemporaryFile keeps the queues in a bolt file in a temporary
+// directory instead of in memory.
+func WithTemporaryFile() ServerOption {
+	return func(o *serverOptions) {
+		o.temporaryFile = true
+	}
+}
+
+// WithClock gives the store a fake clock, so that the test controls
+// lease expiry and message retention. See Clock.
+func WithClock(clock *Clock) ServerOption {
+	return func(o *serverOptions) {
+		o.clock = clock
+	}
+}
+
+// WithAdminToken enables the /admin endpoints for token.
+func WithAdminToken(token string) ServerOption {
+	return func(o *serverOptions) {
+		o.adminToken = token
+	}
+}
+
+// WithStoreOptions passes options to tqs.NewStore.
+func WithStoreOptions(options ...tqs.StoreOption) ServerOption {
+	return func(o *serverOptions) {
+		o.storeOptions = append(o.storeOptions, options...)
+	}
+}
+
+// WithServerOptions passes options to api.NewServer.
+func WithServerOptions(options ...api.ServerOption) ServerOption {
+	return func(o *serverOptions) {
+		o.serverOptions = append(o.serverOptions, options...)
+	}
+}
+
+// NewServer starts a server with an in-memory store, unless options say
+// otherwise. The background tasks of the store run on the clock of the
+// store. It fails the test if the server cannot be started.
+func NewServer(t testing.TB, options ...ServerOption) *Server {
+	t.Helper()
+
+	var o serverOptions
+	for _, option := range options {
+		option(&o)
+	}
+
+	path := tqs.MemoryDatabase
+	if o.temporaryFile {
+		path = filepath.Join(t.TempDir(), "tqsd.db")
+	}
+
+	storeOptions := o.storeOptions
+	if o.clock != nil {
+		storeOptions = append(storeOptions, tqs.WithClock(o.clock))
+	}
+
+	store, err := tqs.NewStore(path, storeOptions...)
+	if err != nil {
+		t.Fatal("tqstest: cannot create store: ", err)
+	}
+
+	for _, queue := range o.queues {
+		if _, _, err := store.CreateQueue(queue.name, queue.settings...); err != nil {
+			store.Close()
+			t.Fatalf("tqstest: cannot create queue <%s>: %s", queue.name, err)
+		}
+	}
+
+	store.Start()
+
+	serverOptions := o.serverOptions
+	if o.adminToken != "" {
+		serverOptions = append(serverOptions, api.AdminToken(o.adminToken))
+	}
+
+	server, err := api.NewServer("test", store, serverOptions...)
+	if err != nil {
+		store.Close()
+		t.Fatal("tqstest: cannot create server: ", err)
+	}
+
+	s := &Server{
+		Store:  store,
+		Clock:  o.clock,
+		server: httptest.NewServer(server.Handler()),
+	}
+	s.URL = s.server.URL
+	s.Client = s.server.Client()
+
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// Close stops the server and closes the store. It is called when the
+// test finishes, calling it earlier is fine.
+func (s *Server) Close() {
+	if s.server == nil {
+		return
+	}
+	s.server.Close()
+	s.server = nil
+	s.Store.Close()
+}
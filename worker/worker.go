@@ -0,0 +1,494 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Package worker runs a handler for every message in a queue, on top
+// of the client package:
+//
+//	w := worker.New(c, "jobs", func(ctx context.Context, message client.ReceivedMessage) error {
+//		return process(ctx, message.Body)
+//	}, worker.WithConcurrency(8))
+//
+//	err := w.Run(ctx) // Until ctx is done
+//
+// A message is deleted when the handler returns nil. When it returns an
+// error the message comes back after a backoff that grows with every
+// failure. While the handler runs its lease is extended, so handlers
+// can take longer than the lease duration of the queue.
+package worker
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/st3fan/tqsd/client"
+)
+
+const (
+	defaultConcurrency   = 1
+	defaultPrefetch      = 0
+	defaultWaitTime      = 10 * time.Second
+	defaultLeaseDuration = 30
+	defaultMinBackoff    = 5 * time.Second
+	defaultMaxBackoff    = 5 * time.Minute
+	defaultDrainTimeout  = 30 * time.Second
+
+	minLeaseDuration = 5    // Shorter leases are rejected by the server
+	maxFailures      = 4096 // Messages to remember failures for
+
+	receiveMinBackoff = time.Second
+	receiveMaxBackoff = 30 * time.Second
+	minExtendInterval = time.Second
+	requestTimeout    = 10 * time.Second
+)
+
+// Handler processes one message. The context is cancelled when the
+// worker loses the lease, or when a shutdown takes longer than the
+// drain timeout.
+type Handler func(ctx context.Context, message client.ReceivedMessage) error
+
+// Hooks are called with what the worker does, for example to count it
+// in metrics. Every hook is optional and must be safe for concurrent
+// use.
+type Hooks struct {
+	// Received is called with the number of messages of every receive
+	Received func(queue string, count int)
+	// Handled is called after the handler returns
+	Handled func(queue string, duration time.Duration, err error)
+	// Extended is called after a lease was extended, or failed to be
+	Extended func(queue string, err error)
+	// Error is called when receiving, deleting or releasing fails
+	Error func(queue string, err error)
+}
+
+// Option configures a Worker.
+type Option func(*Worker)
+
+// WithConcurrency sets how many handlers run at the same time.
+func WithConcurrency(concurrency int) Option {
+	return func(w *Worker) {
+		w.concurrency = concurrency
+	}
+}
+
+// WithPrefetch sets how many messages are received ahead of time,
+// while all handlers are busy. They are released again on shutdown.
+func WithPrefetch(prefetch int) Option {
+	return func(w *Worker) {
+		w.prefetch = prefetch
+	}
+}
+
+// WithMaxNumberOfMessages sets the most messages that one receive asks
+// for, which must not be more than the limit of the server. That is
+// client.MaxNumberOfMessages unless the server was configured with a
+// lower one.
+func WithMaxNumberOfMessages(max int) Option {
+	return func(w *Worker) {
+		w.maxNumberOfMessages = max
+	}
+}
+
+// WithLeaseDuration sets the duration, in seconds, of the leases that
+// the worker takes and extends.
+func WithLeaseDuration(leaseDuration int) Option {
+	return func(w *Worker) {
+		w.leaseDuration = leaseDuration
+	}
+}
+
+// WithWaitTime sets how long a receive waits for messages on an empty
+// queue.
+func WithWaitTime(waitTime time.Duration) Option {
+	return func(w *Worker) {
+		w.waitTime = waitTime
+	}
+}
+
+// WithBackoff sets how long a failed message stays away, the first
+// time it fails and at most. The server does not hand out a message
+// again sooner than five seconds, unless the backoff is zero.
+func WithBackoff(min, max time.Duration) Option {
+	return func(w *Worker) {
+		w.minBackoff = min
+		w.maxBackoff = max
+	}
+}
+
+// WithDrainTimeout sets how long Run waits for running handlers when
+// it is stopped, before it cancels their context.
+func WithDrainTimeout(timeout time.Duration) Option {
+	return func(w *Worker) {
+		w.drainTimeout = timeout
+	}
+}
+
+// WithHooks sets the hooks of the worker.
+func WithHooks(hooks Hooks) Option {
+	return func(w *Worker) {
+		w.hooks = hooks
+	}
+}
+
+// WithLogger sends the messages of the worker to logger instead of the
+// default slog logger.
+func WithLogger(logger *slog.Logger) Option {
+	return func(w *Worker) {
+		w.logger = logger
+	}
+}
+
+// Worker receives messages from a queue and runs a handler for them.
+type Worker struct {
+	client  *client.Client
+	queue   string
+	handler Handler
+
+	concurrency         int
+	prefetch            int
+	maxNumberOfMessages int
+	leaseDuration       int
+	waitTime            time.Duration
+	minBackoff          time.Duration
+	maxBackoff          time.Duration
+	drainTimeout        time.Duration
+	hooks               Hooks
+	logger              *slog.Logger
+
+	failuresLock sync.Mutex
+	failures     map[client.MessageID]int
+}
+
+// New returns a worker that runs handler for the messages in queue.
+func New(c *client.Client, queue string, handler Handler, options ...Option) *Worker {
+	w := &Worker{
+		client:              c,
+		queue:               queue,
+		handler:             handler,
+		concurrency:         defaultConcurrency,
+		prefetch:            defaultPrefetch,
+		maxNumberOfMessages: client.MaxNumberOfMessages,
+		leaseDuration:       defaultLeaseDuration,
+		waitTime:            defaultWaitTime,
+		minBackoff:          defaultMinBackoff,
+		maxBackoff:          defaultMaxBackoff,
+		drainTimeout:        defaultDrainTimeout,
+		logger:              slog.Default(),
+		failures:            make(map[client.MessageID]int),
+	}
+
+	for _, option := range options {
+		option(w)
+	}
+
+	if w.concurrency < 1 {
+		w.concurrency = 1
+	}
+	if w.prefetch < 0 {
+		w.prefetch = 0
+	}
+	if w.maxNumberOfMessages < 1 || w.maxNumberOfMessages > client.MaxNumberOfMessages {
+		w.maxNumberOfMessages = client.MaxNumberOfMessages
+	}
+	if w.leaseDuration < minLeaseDuration {
+		w.leaseDuration = minLeaseDuration
+	}
+
+	return w
+}
+
+// Run receives and handles messages until ctx is done. It then stops
+// receiving, releases the messages that were prefetched and waits for
+// the running handlers to finish, at most the drain timeout.
+func (w *Worker) Run(ctx context.Context) error {
+	// Handlers do not run on ctx, so that they can finish what they
+	// are doing after it is done
+	handlerCtx, cancelHandlers := context.WithCancel(context.Background())
+	defer cancelHandlers()
+
+	// A slot is a message that is being handled or waiting to be.
+	// The receiver only asks for as many messages as there are free
+	// slots.
+	slots := make(chan struct{}, w.concurrency+w.prefetch)
+	for i := 0; i < cap(slots); i++ {
+		slots <- struct{}{}
+	}
+
+	messages := make(chan client.ReceivedMessage, cap(slots))
+
+	var handlers sync.WaitGroup
+	for i := 0; i < w.concurrency; i++ {
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			for message := range messages {
+				if ctx.Err() != nil {
+					w.release(message)
+				} else {
+					w.handle(handlerCtx, message)
+				}
+				slots <- struct{}{}
+			}
+		}()
+	}
+
+	w.receive(ctx, slots, messages)
+	close(messages)
+
+	done := make(chan struct{})
+	go func() {
+		handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(w.drainTimeout):
+		w.logger.Warn("Cancelling handlers that did not finish", "queue", w.queue, "timeout", w.drainTimeout)
+		cancelHandlers()
+		<-done
+	}
+
+	return nil
+}
+
+func (w *Worker) receive(ctx context.Context, slots chan struct{}, messages chan<- client.ReceivedMessage) {
+	backoff := receiveMinBackoff
+
+	for {
+		// Wait for one free slot and take the others that are free
+		select {
+		case <-slots:
+		case <-ctx.Done():
+			return
+		}
+
+		free := 1
+	more:
+		for free < w.maxNumberOfMessages {
+			select {
+			case <-slots:
+				free++
+			default:
+				break more
+			}
+		}
+
+		received, err := w.client.ReceiveMessages(ctx, w.queue, client.ReceiveOptions{
+			MaxNumberOfMessages: free,
+			LeaseDuration:       w.leaseDuration,
+			WaitTime:            w.waitTime,
+		})
+
+		if err == nil && w.hooks.Received != nil {
+			w.hooks.Received(w.queue, len(received))
+		}
+
+		for _, message := range received {
+			messages <- message
+		}
+		for i := len(received); i < free; i++ {
+			slots <- struct{}{}
+		}
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			w.error(err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff = nextBackoff(backoff, receiveMaxBackoff)
+			continue
+		}
+
+		backoff = receiveMinBackoff
+	}
+}
+
+func (w *Worker) handle(ctx context.Context, message client.ReceivedMessage) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	extended := make(chan struct{})
+	go func() {
+		defer close(extended)
+		w.extend(ctx, cancel, message.Lease)
+	}()
+
+	started := time.Now()
+	err := w.run(ctx, message)
+
+	cancel()
+	<-extended
+
+	if w.hooks.Handled != nil {
+		w.hooks.Handled(w.queue, time.Since(started), err)
+	}
+
+	if err != nil {
+		w.nack(message, err)
+		return
+	}
+
+	w.forget(message.Lease.ID.MessageID())
+
+	requestCtx, cancelRequest := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancelRequest()
+
+	if err := w.client.DeleteLease(requestCtx, w.queue, message.Lease.ID); err != nil {
+		w.error(err)
+	}
+}
+
+// run calls the handler, turning a panic into an error so that one bad
+// message does not take down the worker.
+func (w *Worker) run(ctx context.Context, message client.ReceivedMessage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			w.logger.Error("Handler panicked", "queue", w.queue, "panic", r)
+			err = errHandlerPanicked
+		}
+	}()
+	return w.handler(ctx, message)
+}
+
+var errHandlerPanicked = errors.New("handler panicked")
+
+// extend keeps the lease from expiring until ctx is done, by extending
+// it when half of it is left. If the lease is lost the handler is
+// cancelled, because another worker will get the message.
+func (w *Worker) extend(ctx context.Context, cancel context.CancelFunc, lease client.Lease) {
+	expiration := lease.Expiration
+	for {
+		wait := time.Until(expiration) / 2
+		if wait < minExtendInterval {
+			wait = minExtendInterval
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		requestCtx, cancelRequest := context.WithTimeout(ctx, requestTimeout)
+		extended, err := w.client.ExtendLease(requestCtx, w.queue, lease.ID, w.leaseDuration)
+		cancelRequest()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if w.hooks.Extended != nil {
+			w.hooks.Extended(w.queue, err)
+		}
+
+		if err != nil {
+			if errors.Is(err, client.ErrLeaseNotFound) {
+				w.logger.Warn("Lost the lease on a message", "queue", w.queue, "message", lease.ID.MessageID())
+				cancel()
+				return
+			}
+			w.error(err) // Try again when half of what is left is over
+			continue
+		}
+
+		expiration = extended.Expiration
+	}
+}
+
+// nack makes a failed message come back after a backoff. The server has
+// no delays for leased messages, so this extends the lease by the
+// backoff instead.
+func (w *Worker) nack(message client.ReceivedMessage, err error) {
+	backoff := w.backoff(message.Lease.ID.MessageID())
+
+	requestCtx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	if backoff == 0 {
+		err = w.client.ReleaseLease(requestCtx, w.queue, message.Lease.ID)
+	} else {
+		seconds := int(backoff / time.Second)
+		if seconds < minLeaseDuration {
+			seconds = minLeaseDuration
+		}
+		_, err = w.client.ExtendLease(requestCtx, w.queue, message.Lease.ID, seconds)
+	}
+
+	if err != nil && !errors.Is(err, client.ErrLeaseNotFound) {
+		w.error(err)
+	}
+}
+
+func (w *Worker) release(message client.ReceivedMessage) {
+	requestCtx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	if err := w.client.ReleaseLease(requestCtx, w.queue, message.Lease.ID); err != nil && !errors.Is(err, client.ErrLeaseNotFound) {
+		w.error(err)
+	}
+}
+
+// backoff counts a failure of a message and returns how long to wait
+// before it is tried again.
+func (w *Worker) backoff(id client.MessageID) time.Duration {
+	w.failuresLock.Lock()
+	defer w.failuresLock.Unlock()
+
+	// Messages that failed here may succeed on another worker, so
+	// this forgets everything rather than growing without bounds
+	if len(w.failures) >= maxFailures {
+		w.failures = make(map[client.MessageID]int)
+	}
+
+	w.failures[id]++
+
+	backoff := w.minBackoff
+	for i := 1; i < w.failures[id]; i++ {
+		backoff = nextBackoff(backoff, w.maxBackoff)
+	}
+	return backoff
+}
+
+func (w *Worker) forget(id client.MessageID) {
+	w.failuresLock.Lock()
+	defer w.failuresLock.Unlock()
+	delete(w.failures, id)
+}
+
+func (w *Worker) error(err error) {
+	if w.hooks.Error != nil {
+		w.hooks.Error(w.queue, err)
+	}
+	w.logger.Error("Worker failed", "queue", w.queue, "error", err)
+}
+
+func nextBackoff(backoff, max time.Duration) time.Duration {
+	if backoff *= 2; backoff > max {
+		return max
+	}
+	return backoff
+}
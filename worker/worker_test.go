@@ -0,0 +1,260 @@
+//
+// This file is part of Tiny Queue Service.
+//
+// Tiny Queue Service is free software: you can redistribute it and/or
+// modify it under the terms of the GNU General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// Tiny Queue Service is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package worker_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/st3fan/tqsd/api"
+	"github.com/st3fan/tqsd/client"
+	"github.com/st3fan/tqsd/tqs"
+	"github.com/st3fan/tqsd/tqstest"
+	"github.com/st3fan/tqsd/worker"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestClient(t *testing.T) (*client.Client, *tqstest.Server) {
+	server := tqstest.NewServer(t, tqstest.WithQueue("jobs"))
+	c, err := client.New(server.URL, client.WithHTTPClient(server.Client))
+	if err != nil {
+		t.Fatal("Cannot create client: ", err)
+	}
+	return c, server
+}
+
+func sendMessages(t *testing.T, c *client.Client, count int) {
+	for i := 0; i < count; i++ {
+		_, err := c.SendMessages(context.Background(), "jobs", client.Message{Body: fmt.Sprintf("Message%d", i)})
+		assert.Nil(t, err)
+	}
+}
+
+func countMessages(t *testing.T, server *tqstest.Server) int {
+	messages, _, err := server.Store.GetMessages("jobs", 32, 0)
+	assert.Nil(t, err)
+	return len(messages)
+}
+
+func run(w *worker.Worker) (context.CancelFunc, <-chan error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- w.Run(ctx)
+	}()
+	return cancel, done
+}
+
+func waitFor(t *testing.T, c <-chan struct{}) {
+	select {
+	case <-c:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out")
+	}
+}
+
+func Test_Worker(t *testing.T) {
+	c, server := newTestClient(t)
+	sendMessages(t, c, 10)
+
+	var lock sync.Mutex
+	handled := make(map[string]bool)
+	finished := make(chan struct{})
+
+	var received int32
+	hooks := worker.Hooks{
+		Received: func(queue string, count int) {
+			atomic.AddInt32(&received, int32(count))
+		},
+	}
+
+	w := worker.New(c, "jobs", func(ctx context.Context, message client.ReceivedMessage) error {
+		lock.Lock()
+		defer lock.Unlock()
+		handled[message.Body] = true
+		if len(handled) == 10 {
+			close(finished)
+		}
+		return nil
+	}, worker.WithConcurrency(4), worker.WithPrefetch(4), worker.WithWaitTime(time.Second), worker.WithHooks(hooks))
+
+	cancel, done := run(w)
+	waitFor(t, finished)
+	cancel()
+	assert.Nil(t, <-done)
+
+	assert.Equal(t, int32(10), atomic.LoadInt32(&received))
+	assert.Equal(t, 0, countMessages(t, server))
+}
+
+func Test_WorkerWithMoreConcurrencyThanTheServerReturns(t *testing.T) {
+	assert.Equal(t, tqs.MaxMaxNumberOfMessages, client.MaxNumberOfMessages)
+
+	c, server := newTestClient(t)
+	sendMessages(t, c, 40)
+
+	var handled, errs int32
+	finished := make(chan struct{})
+
+	hooks := worker.Hooks{
+		Error: func(queue string, err error) {
+			atomic.AddInt32(&errs, 1)
+		},
+	}
+
+	w := worker.New(c, "jobs", func(ctx context.Context, message client.ReceivedMessage) error {
+		if atomic.AddInt32(&handled, 1) == 40 {
+			close(finished)
+		}
+		return nil
+	}, worker.WithConcurrency(30), worker.WithWaitTime(time.Second), worker.WithHooks(hooks))
+
+	cancel, done := run(w)
+	waitFor(t, finished)
+	cancel()
+	assert.Nil(t, <-done)
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&errs))
+	assert.Equal(t, 0, countMessages(t, server))
+}
+
+func Test_WorkerWithLowerServerLimit(t *testing.T) {
+	limits := api.DefaultRequestLimits
+	limits.MaxNumberOfMessages = 5
+
+	server := tqstest.NewServer(t, tqstest.WithQueue("jobs"), tqstest.WithServerOptions(api.Limits(limits)))
+	c, err := client.New(server.URL, client.WithHTTPClient(server.Client))
+	if err != nil {
+		t.Fatal("Cannot create client: ", err)
+	}
+	sendMessages(t, c, 20)
+
+	var handled, errs int32
+	finished := make(chan struct{})
+
+	hooks := worker.Hooks{
+		Error: func(queue string, err error) {
+			atomic.AddInt32(&errs, 1)
+		},
+	}
+
+	w := worker.New(c, "jobs", func(ctx context.Context, message client.ReceivedMessage) error {
+		if atomic.AddInt32(&handled, 1) == 20 {
+			close(finished)
+		}
+		return nil
+	}, worker.WithConcurrency(10), worker.WithMaxNumberOfMessages(5), worker.WithWaitTime(time.Second), worker.WithHooks(hooks))
+
+	cancel, done := run(w)
+	waitFor(t, finished)
+	cancel()
+	assert.Nil(t, <-done)
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&errs))
+	assert.Equal(t, 0, countMessages(t, server))
+}
+
+func Test_WorkerRetriesFailedMessages(t *testing.T) {
+	c, server := newTestClient(t)
+	sendMessages(t, c, 1)
+
+	var attempts int32
+	finished := make(chan struct{})
+
+	w := worker.New(c, "jobs", func(ctx context.Context, message client.ReceivedMessage) error {
+		switch atomic.AddInt32(&attempts, 1) {
+		case 1:
+			return errors.New("failed")
+		case 2:
+			panic("panicked")
+		default:
+			close(finished)
+			return nil
+		}
+	}, worker.WithBackoff(0, 0), worker.WithWaitTime(time.Second))
+
+	cancel, done := run(w)
+	waitFor(t, finished)
+	cancel()
+	assert.Nil(t, <-done)
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+	assert.Equal(t, 0, countMessages(t, server))
+}
+
+func Test_WorkerExtendsLeases(t *testing.T) {
+	c, server := newTestClient(t)
+	sendMessages(t, c, 1)
+
+	var extended int32
+	hooks := worker.Hooks{
+		Extended: func(queue string, err error) {
+			assert.Nil(t, err)
+			atomic.AddInt32(&extended, 1)
+		},
+	}
+
+	finished := make(chan struct{})
+	w := worker.New(c, "jobs", func(ctx context.Context, message client.ReceivedMessage) error {
+		// Longer than half of the lease, but not longer than the lease
+		time.Sleep(3 * time.Second)
+		close(finished)
+		return nil
+	}, worker.WithLeaseDuration(5), worker.WithWaitTime(time.Second), worker.WithHooks(hooks))
+
+	cancel, done := run(w)
+	waitFor(t, finished)
+	cancel()
+	assert.Nil(t, <-done)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&extended))
+	assert.Equal(t, 0, countMessages(t, server))
+}
+
+func Test_WorkerDrainsOnShutdown(t *testing.T) {
+	c, server := newTestClient(t)
+	sendMessages(t, c, 1)
+
+	started := make(chan struct{})
+	proceed := make(chan struct{})
+
+	w := worker.New(c, "jobs", func(ctx context.Context, message client.ReceivedMessage) error {
+		close(started)
+		<-proceed
+		return ctx.Err()
+	}, worker.WithWaitTime(time.Second))
+
+	cancel, done := run(w)
+	waitFor(t, started)
+	cancel()
+
+	select {
+	case <-done:
+		t.Fatal("Run returned before the handler finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(proceed)
+	assert.Nil(t, <-done)
+	assert.Equal(t, 0, countMessages(t, server))
+}